@@ -0,0 +1,364 @@
+package acl
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// ErrDenied is returned when the user has no access to the requested metrics
+var ErrDenied = errs.NewErrorWithCode("access denied by ACL", http.StatusForbidden)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// Rule grants access to the metrics to the users and groups
+type Rule struct {
+	Users    []string `toml:"users"`    // "*" - any user, "" - anonymous
+	Groups   []string `toml:"groups"`   // groups from [groups] section
+	Prefixes []string `toml:"prefixes"` // allowed metric name prefixes, empty - any name
+	Tags     []string `toml:"tags"`     // "key=glob" pairs, all of them must be matched by tagged series
+
+	anyUser bool
+	users   map[string]bool
+	groups  map[string]bool
+	tags    []tagMatcher
+}
+
+type tagMatcher struct {
+	key   string
+	value *regexp.Regexp
+}
+
+// ACL is a parsed ACL file
+type ACL struct {
+	Default string              `toml:"default"`
+	Groups  map[string][]string `toml:"groups"`
+	Rule    []Rule              `toml:"rule"`
+
+	userGroups map[string][]string
+}
+
+func ParseFile(filename string) (*ACL, error) {
+	c, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(string(c))
+}
+
+func Parse(content string) (*ACL, error) {
+	a := &ACL{}
+
+	if _, err := toml.Decode(content, a); err != nil {
+		return nil, err
+	}
+
+	switch a.Default {
+	case "":
+		a.Default = PolicyAllow
+	case PolicyAllow, PolicyDeny:
+	default:
+		return nil, fmt.Errorf("unknown acl default policy %q", a.Default)
+	}
+
+	a.userGroups = make(map[string][]string)
+
+	for group, users := range a.Groups {
+		for _, user := range users {
+			a.userGroups[user] = append(a.userGroups[user], group)
+		}
+	}
+
+	for i := range a.Rule {
+		r := &a.Rule[i]
+
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			return nil, fmt.Errorf("acl rule #%d has no users or groups", i+1)
+		}
+
+		r.users = make(map[string]bool, len(r.Users))
+
+		for _, user := range r.Users {
+			if user == "*" {
+				r.anyUser = true
+			} else {
+				r.users[user] = true
+			}
+		}
+
+		r.groups = make(map[string]bool, len(r.Groups))
+
+		for _, group := range r.Groups {
+			if _, ok := a.Groups[group]; !ok {
+				return nil, fmt.Errorf("acl rule #%d: unknown group %q", i+1, group)
+			}
+
+			r.groups[group] = true
+		}
+
+		r.tags = make([]tagMatcher, 0, len(r.Tags))
+
+		for _, tag := range r.Tags {
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("acl rule #%d: invalid tag %q, must be key=glob", i+1, tag)
+			}
+
+			if key == "name" {
+				key = "__name__"
+			}
+
+			r.tags = append(r.tags, tagMatcher{key: key, value: globToRegexp(value)})
+		}
+	}
+
+	return a, nil
+}
+
+// globToRegexp converts glob with '*' and '?' wildcards to the anchored regexp
+func globToRegexp(glob string) *regexp.Regexp {
+	s := regexp.QuoteMeta(glob)
+	s = strings.ReplaceAll(s, `\*`, ".*")
+	s = strings.ReplaceAll(s, `\?`, ".")
+
+	return regexp.MustCompile("^" + s + "$")
+}
+
+func (r *Rule) matchUser(user string, groups []string) bool {
+	if r.anyUser || r.users[user] {
+		return true
+	}
+
+	for _, g := range groups {
+		if r.groups[g] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// For returns the access for the user. Nil *Access means unrestricted access
+func (a *ACL) For(user string) *Access {
+	if a == nil {
+		return nil
+	}
+
+	groups := a.userGroups[user]
+	rules := make([]*Rule, 0)
+
+	for i := range a.Rule {
+		if a.Rule[i].matchUser(user, groups) {
+			rules = append(rules, &a.Rule[i])
+		}
+	}
+
+	if len(rules) == 0 && a.Default == PolicyAllow {
+		return nil
+	}
+
+	return &Access{user: user, rules: rules}
+}
+
+// Access is the union of the rules matched by user. Access without rules denies everything
+type Access struct {
+	user  string
+	rules []*Rule
+}
+
+// User returns the user name
+func (a *Access) User() string {
+	if a == nil {
+		return ""
+	}
+
+	return a.user
+}
+
+// Restricted returns true if the access is limited by ACL
+func (a *Access) Restricted() bool {
+	return a != nil
+}
+
+// allowPrefix checks the name against rule prefixes. If branch is set,
+// the name is allowed if it's a part of some prefix, so the user can walk through the tree
+func (r *Rule) allowPrefix(name string, branch bool) bool {
+	if len(r.Prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range r.Prefixes {
+		if strings.HasPrefix(name, p) || (branch && strings.HasPrefix(p, name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allowed checks the plain metric path or the tagged series (name?tag=value&...).
+// Plain branches ends with '.'
+func (a *Access) Allowed(path string) bool {
+	if a == nil {
+		return true
+	}
+
+	if name, tags, ok := strings.Cut(path, "?"); ok {
+		return a.allowedTagged(name, tags)
+	}
+
+	branch := strings.HasSuffix(path, ".")
+
+	for _, r := range a.rules {
+		// plain metrics have no tags
+		if len(r.tags) == 0 && r.allowPrefix(path, branch) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Access) allowedTagged(name, query string) bool {
+	var (
+		tags url.Values
+		err  error
+	)
+
+	for _, r := range a.rules {
+		if !r.allowPrefix(name, false) {
+			continue
+		}
+
+		if len(r.tags) > 0 && tags == nil {
+			if tags, err = url.ParseQuery(query); err != nil {
+				return false
+			}
+
+			tags.Set("__name__", name)
+		}
+
+		if r.matchTags(tags) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchTags(tags url.Values) bool {
+	for _, m := range r.tags {
+		if !m.value.MatchString(tags.Get(m.key)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowedQuery checks if the plain find query (glob) could match any allowed metric
+func (a *Access) AllowedQuery(query string) bool {
+	if a == nil {
+		return true
+	}
+
+	// prefix before the first wildcard
+	literal := query
+	if n := strings.IndexAny(query, "*?[{"); n >= 0 {
+		literal = query[:n]
+	}
+
+	for _, r := range a.rules {
+		if len(r.tags) == 0 && r.allowPrefix(literal, true) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedTagged checks if any tagged series could be allowed
+func (a *Access) AllowedTagged() bool {
+	return a == nil || len(a.rules) > 0
+}
+
+// AllowedTagValue checks the tag value for tags autocomplete. Only matchers for the same tag are checked,
+// the series itself is checked on render
+func (a *Access) AllowedTagValue(tag, value string) bool {
+	if a == nil {
+		return true
+	}
+
+	if tag == "name" {
+		tag = "__name__"
+	}
+
+LOOP:
+	for _, r := range a.rules {
+		if tag == "__name__" && !r.allowPrefix(value, false) {
+			continue
+		}
+
+		for _, m := range r.tags {
+			if m.key == tag && !m.value.MatchString(value) {
+				continue LOOP
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// TaggedWhere returns the condition for the rows of the tagged table, allowed by the access (like Allowed for the series).
+// Empty string is returned if any series is allowed
+func (a *Access) TaggedWhere() string {
+	if a == nil {
+		return ""
+	}
+
+	if len(a.rules) == 0 {
+		return "0"
+	}
+
+	w := where.New()
+
+	for _, r := range a.rules {
+		rw := where.New()
+
+		if len(r.Prefixes) > 0 {
+			prefixes := where.New()
+			for _, p := range r.Prefixes {
+				prefixes.Or(where.HasPrefix("Path", p))
+			}
+
+			rw.And(prefixes.String())
+		}
+
+		for _, m := range r.tags {
+			rw.And(where.ArrayMatch("Tags", "^"+regexp.QuoteMeta(m.key)+"="+strings.TrimPrefix(m.value.String(), "^")))
+		}
+
+		if rw.String() == "" {
+			// the rule allows all series
+			return ""
+		}
+
+		w.Or(rw.String())
+	}
+
+	return w.String()
+}
@@ -0,0 +1,243 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testACL = `
+default = "deny"
+
+[groups]
+ops = ["alice", "bob"]
+
+[[rule]]
+groups = ["ops"]
+prefixes = ["servers.", "cpu"]
+
+[[rule]]
+users = ["carol"]
+prefixes = ["apps.web."]
+
+[[rule]]
+users = ["carol"]
+tags = ["env=prod*", "dc=?1"]
+
+[[rule]]
+users = ["admin"]
+
+[[rule]]
+users = ["*"]
+prefixes = ["public."]
+`
+
+func TestParse(t *testing.T) {
+	for _, content := range []string{
+		`default = "maybe"`,
+		"[[rule]]\nprefixes = [\"a.\"]",
+		"[[rule]]\ngroups = [\"unknown\"]",
+		"[[rule]]\nusers = [\"a\"]\ntags = [\"env\"]",
+		"[[rule]\n",
+	} {
+		_, err := Parse(content)
+		assert.Error(t, err, content)
+	}
+
+	a, err := Parse("")
+	require.NoError(t, err)
+	assert.Equal(t, PolicyAllow, a.Default)
+	assert.Nil(t, a.For("alice"))
+}
+
+func TestAccess(t *testing.T) {
+	a, err := Parse(testACL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		user    string
+		path    string
+		allowed bool
+	}{
+		{"alice", "servers.a.cpu", true},
+		{"alice", "servers.", true},
+		{"alice", "servers", false},
+		{"alice", "cpu?host=a", true},
+		{"alice", "cpu_load?host=a", true},
+		{"alice", "mem?host=a", false},
+		{"alice", "apps.web.rps", false},
+		{"alice", "public.rps", true},
+		{"bob", "servers.b.cpu", true},
+		{"carol", "apps.", true},
+		{"carol", "apps.web.", true},
+		{"carol", "apps.db.", false},
+		{"carol", "apps.web.rps", true},
+		{"carol", "servers.a.cpu", false},
+		{"carol", "rps?dc=a1&env=production", true},
+		{"carol", "rps?dc=a12&env=production", false},
+		{"carol", "rps?dc=a1&env=dev", false},
+		{"carol", "rps?dc=a1", false},
+		{"carol", "apps.web.rps?env=dev", true},
+		{"admin", "anything.at.all", true},
+		{"admin", "rps?env=dev", true},
+		{"", "public.rps", true},
+		{"", "servers.a.cpu", false},
+		{"eve", "public.", true},
+		{"eve", "secret.", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+tt.path, func(t *testing.T) {
+			access := a.For(tt.user)
+			require.True(t, access.Restricted())
+			assert.Equal(t, tt.allowed, access.Allowed(tt.path))
+		})
+	}
+}
+
+func TestAccessDefault(t *testing.T) {
+	a, err := Parse("default = \"allow\"\n[[rule]]\nusers = [\"carol\"]\nprefixes = [\"apps.\"]")
+	require.NoError(t, err)
+
+	assert.False(t, a.For("alice").Restricted())
+	assert.True(t, a.For("alice").Allowed("servers.a.cpu"))
+	assert.True(t, a.For("carol").Restricted())
+	assert.False(t, a.For("carol").Allowed("servers.a.cpu"))
+
+	a, err = Parse("default = \"deny\"")
+	require.NoError(t, err)
+
+	access := a.For("alice")
+	assert.True(t, access.Restricted())
+	assert.False(t, access.AllowedTagged())
+	assert.False(t, access.AllowedQuery("*"))
+	assert.False(t, access.Allowed("servers.a.cpu"))
+}
+
+func TestAccessAllowedQuery(t *testing.T) {
+	a, err := Parse(testACL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		user    string
+		query   string
+		allowed bool
+	}{
+		{"alice", "*", true},
+		{"alice", "serv*", true},
+		{"alice", "servers.*.cpu", true},
+		{"alice", "apps.*", false},
+		{"alice", "public.{a,b}", true},
+		{"carol", "apps.w[e]b.*", true},
+		{"carol", "apps.db.*", false},
+		{"eve", "servers.*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, a.For(tt.user).AllowedQuery(tt.query))
+		})
+	}
+}
+
+func TestAccessAllowedTagValue(t *testing.T) {
+	a, err := Parse(testACL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		user    string
+		tag     string
+		value   string
+		allowed bool
+	}{
+		{"alice", "name", "cpu_load", true},
+		{"alice", "__name__", "mem", false},
+		{"alice", "host", "a", true},
+		{"carol", "env", "prod", true},
+		{"carol", "env", "dev", true}, // apps.web. prefix rule has no tags
+		{"carol", "name", "apps.web.rps", true},
+		{"eve", "name", "public.rps", true},
+		{"eve", "name", "rps", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+tt.tag+"="+tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, a.For(tt.user).AllowedTagValue(tt.tag, tt.value))
+		})
+	}
+
+	// only tag matchers rule
+	a, err = Parse("default = \"deny\"\n[[rule]]\nusers = [\"carol\"]\ntags = [\"env=prod\"]")
+	require.NoError(t, err)
+	assert.True(t, a.For("carol").AllowedTagValue("env", "prod"))
+	assert.False(t, a.For("carol").AllowedTagValue("env", "dev"))
+	assert.True(t, a.For("carol").AllowedTagValue("dc", "dc1"))
+}
+
+func TestAccessTaggedWhere(t *testing.T) {
+	a, err := Parse(testACL)
+	require.NoError(t, err)
+
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"admin", ""},
+		{"alice", "((Path LIKE 'servers.%') OR (Path LIKE 'cpu%')) OR (Path LIKE 'public.%')"},
+		{
+			"carol",
+			"((Path LIKE 'apps.web.%') OR ((arrayExists((x) -> match(x, '^env=prod.*$'), Tags)) AND (arrayExists((x) -> match(x, '^dc=.1$'), Tags)))) OR (Path LIKE 'public.%')",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			assert.Equal(t, tt.want, a.For(tt.user).TaggedWhere())
+		})
+	}
+
+	var unrestricted *Access
+	assert.Equal(t, "", unrestricted.TaggedWhere())
+
+	a, err = Parse("default = \"deny\"")
+	require.NoError(t, err)
+	assert.Equal(t, "0", a.For("eve").TaggedWhere())
+}
+
+func TestLoader(t *testing.T) {
+	defer Set(nil)
+
+	filename := filepath.Join(t.TempDir(), "acl.toml")
+	require.NoError(t, os.WriteFile(filename, []byte("default = \"deny\""), 0o644))
+
+	l := &loader{filename: filename}
+
+	reloaded, err := l.update()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.True(t, Restricted("alice"))
+
+	reloaded, err = l.update()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// broken file keeps the previous ACL
+	require.NoError(t, os.WriteFile(filename, []byte("default = \"maybe\""), 0o644))
+	require.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(time.Second)))
+
+	_, err = l.update()
+	assert.Error(t, err)
+	assert.True(t, Restricted("alice"))
+
+	require.NoError(t, os.WriteFile(filename, []byte("default = \"allow\""), 0o644))
+	require.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(2*time.Second)))
+
+	reloaded, err = l.update()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.False(t, Restricted("alice"))
+}
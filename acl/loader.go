@@ -0,0 +1,109 @@
+package acl
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/auth"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// current is the loaded ACL, nil if ACL is disabled
+var current atomic.Pointer[ACL]
+
+// Set replaces the current ACL, nil disables ACL
+func Set(a *ACL) {
+	current.Store(a)
+}
+
+// Get returns the current ACL
+func Get() *ACL {
+	return current.Load()
+}
+
+// For returns the user access from the current ACL
+func For(user string) *Access {
+	return Get().For(user)
+}
+
+// FromContext returns the access for the user from the request context (see scope.HttpRequest)
+func FromContext(ctx context.Context) *Access {
+	return For(scope.String(ctx, auth.UserHeader))
+}
+
+// Restricted returns true if the user access is limited by the current ACL
+func Restricted(user string) bool {
+	return For(user).Restricted()
+}
+
+type loader struct {
+	filename string
+	interval time.Duration
+	modTime  time.Time
+	size     int64
+}
+
+// Start loads the ACL file and starts the background reloader. Does nothing if acl file is not set
+func Start(cfg *config.Config) error {
+	if cfg.ACL.File == "" {
+		return nil
+	}
+
+	l := &loader{
+		filename: cfg.ACL.File,
+		interval: cfg.ACL.ReloadInterval,
+	}
+
+	if _, err := l.update(); err != nil {
+		return err
+	}
+
+	go l.worker()
+
+	return nil
+}
+
+// update reloads the file if it was changed since the last successful load
+func (l *loader) update() (bool, error) {
+	st, err := os.Stat(l.filename)
+	if err != nil {
+		return false, err
+	}
+
+	if st.ModTime().Equal(l.modTime) && st.Size() == l.size {
+		return false, nil
+	}
+
+	a, err := ParseFile(l.filename)
+	if err != nil {
+		return false, err
+	}
+
+	Set(a)
+
+	l.modTime = st.ModTime()
+	l.size = st.Size()
+
+	return true, nil
+}
+
+func (l *loader) worker() {
+	logger := zapwriter.Logger("acl")
+
+	for {
+		time.Sleep(l.interval)
+
+		reloaded, err := l.update()
+		if err != nil {
+			logger.Error("reload failed, previous ACL is used", zap.String("file", l.filename), zap.Error(err))
+		} else if reloaded {
+			logger.Info("reloaded", zap.String("file", l.filename), zap.Int("rules", len(Get().Rule)))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+// UserHeader is the request header with the user name, used by limiters, logs and ACL
+const UserHeader = "X-Forwarded-User"
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid user or password")
+	ErrMethodDisabled     = errors.New("authentication method is disabled")
+)
+
+// Authenticator checks the client certificate, basic auth or bearer token credentials of the request
+type Authenticator struct {
+	clientCert bool
+	htpasswd   *Htpasswd
+	jwt        *JWT
+	realm      string
+	exempt     map[string]bool
+	timeNow    func() time.Time
+}
+
+// New returns nil *Authenticator if authentication is disabled
+func New(cfg *config.Auth) (*Authenticator, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	a := &Authenticator{
+		clientCert: cfg.ClientCertUser,
+		realm:      cfg.Realm,
+		exempt:     make(map[string]bool, len(cfg.ExemptPaths)),
+		timeNow:    time.Now,
+	}
+
+	for _, path := range cfg.ExemptPaths {
+		a.exempt[path] = true
+	}
+
+	var err error
+
+	if cfg.HtpasswdFile != "" {
+		if a.htpasswd, err = ParseHtpasswdFile(cfg.HtpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWTKeyFile != "" {
+		if a.jwt, err = NewJWT(cfg.JWTAlgorithm, cfg.JWTKeyFile, cfg.JWTUserClaim, cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTLeeway); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// ClientCN returns CN of the verified TLS client certificate
+func ClientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// Authenticate returns the user from the verified client certificate, basic auth or bearer token
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	if a.clientCert {
+		if cn := ClientCN(r); cn != "" {
+			return cn, nil
+		}
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", ErrNoCredentials
+	}
+
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if a.htpasswd == nil {
+			return "", ErrMethodDisabled
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok || !a.htpasswd.Check(user, password) {
+			return "", ErrInvalidCredentials
+		}
+
+		return user, nil
+	case "bearer":
+		if a.jwt == nil {
+			return "", ErrMethodDisabled
+		}
+
+		return a.jwt.Validate(strings.TrimSpace(credentials), a.timeNow())
+	}
+
+	return "", ErrMethodDisabled
+}
+
+func (a *Authenticator) challenge(w http.ResponseWriter) {
+	if a.htpasswd != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+a.realm+`", charset="UTF-8"`)
+	}
+
+	if a.jwt != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+a.realm+`"`)
+	}
+}
+
+// Wrap returns the handler, which authenticates requests (except exempt paths) and replaces X-Forwarded-User header
+// with the authenticated user. Returns h as is, if a is nil
+func (a *Authenticator) Wrap(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+
+	logger := zapwriter.Logger("auth")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.exempt[r.URL.Path] {
+			// the header can't be trusted
+			r.Header.Del(UserHeader)
+			h.ServeHTTP(w, r)
+
+			return
+		}
+
+		user, err := a.Authenticate(r)
+		if err != nil {
+			logger.Warn("unauthorized",
+				zap.String("url", r.URL.String()),
+				zap.String("peer", r.RemoteAddr),
+				zap.Error(err),
+			)
+
+			a.challenge(w)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+
+			return
+		}
+
+		r.Header.Set(UserHeader, user)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+func signToken(t *testing.T, alg string, claims map[string]any, sign func(signed []byte) []byte) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+
+		return mac.Sum(nil)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	h, err := ParseHtpasswd(strings.NewReader("# users\n\nalice:" + string(hash) + "\n"))
+	require.NoError(t, err)
+
+	assert.True(t, h.Check("alice", "secret"))
+	assert.True(t, h.Check("alice", "secret")) // verified
+	assert.False(t, h.Check("alice", "wrong"))
+	assert.False(t, h.Check("bob", "secret"))
+
+	for _, content := range []string{"alice", "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", ":" + string(hash)} {
+		_, err = ParseHtpasswd(strings.NewReader(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dir := t.TempDir()
+
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("secret\n"), 0o600))
+
+	j, err := NewJWT("HS256", secretFile, "sub", "issuer", "gch", time.Minute)
+	require.NoError(t, err)
+
+	valid := map[string]any{"sub": "alice", "iss": "issuer", "aud": []string{"grafana", "gch"}, "exp": now.Unix() + 10}
+
+	tests := []struct {
+		name   string
+		token  string
+		user   string
+		wanted error
+	}{
+		{"valid", signToken(t, "HS256", valid, hs256("secret")), "alice", nil},
+		{"wrong secret", signToken(t, "HS256", valid, hs256("other")), "", ErrTokenSignature},
+		{"alg none", signToken(t, "none", valid, func([]byte) []byte { return nil }), "", ErrTokenAlgorithm},
+		{"malformed", "abc.def", "", ErrTokenMalformed},
+		{"expired", signToken(t, "HS256", map[string]any{"sub": "alice", "iss": "issuer", "aud": "gch", "exp": now.Unix() - 61}, hs256("secret")), "", ErrTokenExpired},
+		{"expired within leeway", signToken(t, "HS256", map[string]any{"sub": "alice", "iss": "issuer", "aud": "gch", "exp": now.Unix() - 30}, hs256("secret")), "alice", nil},
+		{"not before", signToken(t, "HS256", map[string]any{"sub": "alice", "iss": "issuer", "aud": "gch", "nbf": now.Unix() + 120, "exp": now.Unix() + 180}, hs256("secret")), "", ErrTokenNotValid},
+		{"issuer", signToken(t, "HS256", map[string]any{"sub": "alice", "iss": "other", "aud": "gch", "exp": now.Unix() + 10}, hs256("secret")), "", ErrTokenIssuer},
+		{"audience", signToken(t, "HS256", map[string]any{"sub": "alice", "iss": "issuer", "aud": "grafana", "exp": now.Unix() + 10}, hs256("secret")), "", ErrTokenAudience},
+		{"no user", signToken(t, "HS256", map[string]any{"iss": "issuer", "aud": "gch", "exp": now.Unix() + 10}, hs256("secret")), "", ErrTokenUser},
+		{"no expiry", signToken(t, "HS256", map[string]any{"sub": "alice", "iss": "issuer", "aud": "gch"}, hs256("secret")), "", ErrTokenNoExpiry},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := j.Validate(tt.token, now)
+			assert.Equal(t, tt.wanted, err)
+			assert.Equal(t, tt.user, user)
+		})
+	}
+
+	t.Run("RS256", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+
+		keyFile := filepath.Join(dir, "key.pem")
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+		j, err := NewJWT("RS256", keyFile, "email", "", "", 0)
+		require.NoError(t, err)
+
+		rs256 := func(signed []byte) []byte {
+			sum := sha256.Sum256(signed)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+			require.NoError(t, err)
+
+			return sig
+		}
+
+		user, err := j.Validate(signToken(t, "RS256", map[string]any{"email": "bob@example.com", "exp": now.Unix() + 10}, rs256), now)
+		require.NoError(t, err)
+		assert.Equal(t, "bob@example.com", user)
+
+		// HS256 token signed by the public key must be rejected
+		_, err = j.Validate(signToken(t, "HS256", map[string]any{"email": "bob@example.com"}, hs256(string(der))), now)
+		assert.Equal(t, ErrTokenAlgorithm, err)
+	})
+}
+
+func TestAuthenticatorWrap(t *testing.T) {
+	dir := t.TempDir()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	cfg := config.New().Auth
+	cfg.HtpasswdFile = filepath.Join(dir, "htpasswd")
+	cfg.JWTKeyFile = filepath.Join(dir, "secret")
+	cfg.ClientCertUser = true
+
+	require.NoError(t, os.WriteFile(cfg.HtpasswdFile, []byte("alice:"+string(hash)+"\n"), 0o600))
+	require.NoError(t, os.WriteFile(cfg.JWTKeyFile, []byte("secret"), 0o600))
+
+	a, err := New(&cfg)
+	require.NoError(t, err)
+
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(UserHeader)))
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header func(r *http.Request)
+		status int
+		user   string
+	}{
+		{"no credentials", "/render/", func(r *http.Request) { r.Header.Set(UserHeader, "admin") }, http.StatusUnauthorized, ""},
+		{"basic", "/render/", func(r *http.Request) { r.SetBasicAuth("alice", "secret"); r.Header.Set(UserHeader, "admin") }, http.StatusOK, "alice"},
+		{"basic wrong password", "/render/", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized, ""},
+		{"bearer", "/metrics/find/", func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+signToken(t, "HS256", map[string]any{"sub": "bob", "exp": time.Now().Unix() + 60}, hs256("secret")))
+		}, http.StatusOK, "bob"},
+		{"client cert", "/render/", func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "carol"}}}}}
+			r.SetBasicAuth("alice", "secret")
+		}, http.StatusOK, "carol"},
+		{"exempt", "/health", func(r *http.Request) { r.Header.Set(UserHeader, "admin") }, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.path, nil)
+			tt.header(r)
+
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+
+			if tt.status == http.StatusOK {
+				assert.Equal(t, tt.user, w.Body.String())
+			} else {
+				assert.Equal(t, []string{`Basic realm="graphite-clickhouse", charset="UTF-8"`, `Bearer realm="graphite-clickhouse"`}, w.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// disabled
+	a, err = New(&config.New().Auth)
+	require.NoError(t, err)
+	assert.Nil(t, a)
+}
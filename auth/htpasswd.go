@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd checks basic auth credentials against bcrypt hashes from htpasswd file
+type Htpasswd struct {
+	users map[string][]byte // user -> bcrypt hash
+
+	// bcrypt is slow by design, so successfully verified credentials are remembered
+	mu       sync.RWMutex
+	verified map[string][sha256.Size]byte
+}
+
+func ParseHtpasswdFile(filename string) (*Htpasswd, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads 'user:hash' lines, only bcrypt hashes ($2y$, $2a$, $2b$) are supported
+func ParseHtpasswd(reader io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{
+		users:    make(map[string][]byte),
+		verified: make(map[string][sha256.Size]byte),
+	}
+
+	scanner := bufio.NewScanner(reader)
+	n := 0
+
+	for scanner.Scan() {
+		n++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: invalid format, must be user:hash", n)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: only bcrypt hashes are supported: %w", n, err)
+		}
+
+		h.users[user] = []byte(hash)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Check returns true if the password is valid for the user
+func (h *Htpasswd) Check(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+
+	h.mu.RLock()
+	v, ok := h.verified[user]
+	h.mu.RUnlock()
+
+	if ok && v == sum {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	h.mu.Lock()
+	h.verified[user] = sum
+	h.mu.Unlock()
+
+	return true
+}
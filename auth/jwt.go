@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenMalformed = errors.New("malformed token")
+	ErrTokenAlgorithm = errors.New("unexpected token algorithm")
+	ErrTokenSignature = errors.New("invalid token signature")
+	ErrTokenExpired   = errors.New("token is expired")
+	ErrTokenNoExpiry  = errors.New("token has no exp claim")
+	ErrTokenNotValid  = errors.New("token is not valid yet")
+	ErrTokenIssuer    = errors.New("invalid token issuer")
+	ErrTokenAudience  = errors.New("invalid token audience")
+	ErrTokenUser      = errors.New("token has no user claim")
+)
+
+// JWT validates HS256 or RS256 signed tokens with the local key
+type JWT struct {
+	algorithm string
+	secret    []byte         // HS256
+	publicKey *rsa.PublicKey // RS256
+	userClaim string
+	issuer    string
+	audience  string
+	leeway    time.Duration
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// NewJWT reads the key file: secret for HS256, PEM public key or certificate for RS256
+func NewJWT(algorithm, keyFile, userClaim, issuer, audience string, leeway time.Duration) (*JWT, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &JWT{
+		algorithm: algorithm,
+		userClaim: userClaim,
+		issuer:    issuer,
+		audience:  audience,
+		leeway:    leeway,
+	}
+
+	switch algorithm {
+	case "HS256":
+		j.secret = bytes.TrimRight(key, "\r\n")
+		if len(j.secret) == 0 {
+			return nil, fmt.Errorf("jwt secret in %s is empty", keyFile)
+		}
+	case "RS256":
+		if j.publicKey, err = parseRSAPublicKey(key); err != nil {
+			return nil, fmt.Errorf("jwt key %s: %w", keyFile, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", algorithm)
+	}
+
+	return j, nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var pub any
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		pub = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		var err error
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not a RSA public key")
+	}
+
+	return key, nil
+}
+
+// Validate checks the token signature and claims and returns the user
+func (j *JWT) Validate(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrTokenMalformed
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrTokenMalformed
+	}
+
+	var header jwtHeader
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return "", ErrTokenMalformed
+	}
+
+	// algorithm is fixed by config, so tokens with 'none' or HS256 signed by the RSA public key are rejected
+	if header.Alg != j.algorithm {
+		return "", ErrTokenAlgorithm
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrTokenMalformed
+	}
+
+	if !j.verify(parts[0]+"."+parts[1], signature) {
+		return "", ErrTokenSignature
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrTokenMalformed
+	}
+
+	var claims map[string]any
+	if err = json.Unmarshal(claimsJSON, &claims); err != nil {
+		return "", ErrTokenMalformed
+	}
+
+	return j.checkClaims(claims, now)
+}
+
+func (j *JWT) verify(signed string, signature []byte) bool {
+	sum := sha256.Sum256([]byte(signed))
+
+	if j.algorithm == "RS256" {
+		return rsa.VerifyPKCS1v15(j.publicKey, crypto.SHA256, sum[:], signature) == nil
+	}
+
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(signed))
+
+	return hmac.Equal(mac.Sum(nil), signature)
+}
+
+func (j *JWT) checkClaims(claims map[string]any, now time.Time) (string, error) {
+	// tokens without exp would be valid forever
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", ErrTokenNoExpiry
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(j.leeway)) {
+		return "", ErrTokenExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", ErrTokenNotValid
+	}
+
+	if j.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.issuer {
+			return "", ErrTokenIssuer
+		}
+	}
+
+	if j.audience != "" && !hasAudience(claims["aud"], j.audience) {
+		return "", ErrTokenAudience
+	}
+
+	user, _ := claims[j.userClaim].(string)
+	if user == "" {
+		return "", ErrTokenUser
+	}
+
+	return user, nil
+}
+
+// hasAudience checks aud claim, which can be a string or an array of strings
+func hasAudience(aud any, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
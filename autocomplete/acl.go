@@ -0,0 +1,46 @@
+package autocomplete
+
+import (
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func aclFiltered(n int) {
+	if n > 0 && metrics.ACLMetrics != nil {
+		metrics.ACLMetrics.Filtered.Add(uint64(n))
+	}
+}
+
+// aclFilterValues removes tag values (rows can contain count after tab), not allowed by ACL
+func aclFilterValues(access *acl.Access, tag string, rows []string) []string {
+	result := make([]string, 0, len(rows))
+
+	for _, row := range rows {
+		value, _, _ := strings.Cut(row, "\t")
+		if access.AllowedTagValue(tag, value) {
+			result = append(result, row)
+		}
+	}
+
+	aclFiltered(len(rows) - len(result))
+
+	return result
+}
+
+// aclFilterNodes removes plain nodes, not allowed by ACL. Branch is kept if it leads to the allowed prefix
+func aclFilterNodes(access *acl.Access, nodes []finder.IndexNode) []finder.IndexNode {
+	result := make([]finder.IndexNode, 0, len(nodes))
+
+	for _, node := range nodes {
+		if (node.Leaf && access.Allowed(node.Name)) || (node.Branch && access.Allowed(node.Name+".")) {
+			result = append(result, node)
+		}
+	}
+
+	aclFiltered(len(nodes) - len(result))
+
+	return result
+}
@@ -0,0 +1,155 @@
+package autocomplete
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/auth"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestACLFilter(t *testing.T) {
+	a, err := acl.Parse("default = \"deny\"\n[[rule]]\nusers = [\"alice\"]\nprefixes = [\"servers.web\"]")
+	require.NoError(t, err)
+
+	access := a.For("alice")
+
+	nodes := []finder.IndexNode{
+		{Name: "servers", Branch: true},
+		{Name: "apps", Branch: true},
+		{Name: "servers.web1", Leaf: true},
+		{Name: "servers.db1", Leaf: true, Branch: true},
+	}
+	assert.Equal(t, []finder.IndexNode{nodes[0], nodes[2]}, aclFilterNodes(access, nodes))
+
+	// values of other tags can't be checked against prefixes
+	assert.Equal(t, []string{"prod\t10", "dev\t5"}, aclFilterValues(access, "env", []string{"prod\t10", "dev\t5"}))
+
+	b, err := acl.Parse("default = \"deny\"\n[[rule]]\nusers = [\"alice\"]\nprefixes = [\"servers.web\"]\ntags = [\"env=prod\"]")
+	require.NoError(t, err)
+
+	access = b.For("alice")
+
+	assert.Equal(t, []string{"prod\t10"}, aclFilterValues(access, "env", []string{"prod\t10", "dev\t5"}))
+	assert.Equal(t, []string{"servers.web.cpu"}, aclFilterValues(access, "__name__", []string{"servers.web.cpu", "apps.cpu"}))
+	// bob has no rules
+	assert.Empty(t, aclFilterValues(b.For("bob"), "__name__", []string{"servers.web.cpu"}))
+}
+
+func TestHandler_ServeTagsACL(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+
+	metrics.DisableMetrics()
+
+	a, err := acl.Parse("default = \"deny\"\n[[rule]]\nusers = [\"alice\"]\nprefixes = [\"servers.web\"]\ntags = [\"env=prod\"]")
+	require.NoError(t, err)
+
+	acl.Set(a)
+	defer acl.Set(nil)
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.TagsCountTable = "tag1_count_per_day"
+
+	h := NewTags(cfg)
+
+	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, timeNow())
+
+	// the count table can't be filtered by ACL, so the tagged table is used
+	srv.AddResponce(
+		"SELECT splitByChar('=', Tag1)[1] AS value, count() AS cnt FROM graphite_tagged  WHERE "+
+			"(Date >= '"+fromDate+"' AND Date <= '"+untilDate+"') AND ((Path LIKE 'servers.web%') AND (arrayExists((x) -> match(x, '^env=prod$'), Tags))) "+
+			"GROUP BY value ORDER BY cnt DESC, value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("env\t2\n__name__\t2\n"),
+		})
+
+	tests := []struct {
+		user string
+		want string
+	}{
+		{user: "alice", want: `["env","name"]`},
+		{user: "bob", want: `[]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := NewRequest("GET", srv.URL+"/tags/autoComplete/tags?sort=popularity", nil)
+			r.Header.Set(auth.UserHeader, tt.user)
+
+			h.ServeTags(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_ServeValuesACL(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+
+	metrics.DisableMetrics()
+
+	a, err := acl.Parse("default = \"deny\"\n[[rule]]\nusers = [\"alice\"]\ntags = [\"env=prod\"]")
+	require.NoError(t, err)
+
+	acl.Set(a)
+	defer acl.Set(nil)
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+
+	h := NewValues(cfg)
+
+	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, timeNow())
+
+	// the values of host tag are queried only from env=prod series
+	srv.AddResponce(
+		"SELECT substr(Tag1, 6) AS value FROM graphite_tagged  WHERE ((Tag1 LIKE 'host=%') AND "+
+			"(Date >= '"+fromDate+"' AND Date <= '"+untilDate+"')) AND (arrayExists((x) -> match(x, '^env=prod$'), Tags)) "+
+			"GROUP BY value ORDER BY value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("web1\nweb2\n"),
+		})
+
+	tests := []struct {
+		user string
+		want string
+	}{
+		{user: "alice", want: `["web1","web2"]`},
+		{user: "bob", want: `[]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := NewRequest("GET", srv.URL+"/tags/autoComplete/values?tag=host", nil)
+			r.Header.Set(auth.UserHeader, tt.user)
+
+			h.ServeValues(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/msaf1980/go-stringutils"
 	"go.uber.org/zap"
 
+	"github.com/lomik/graphite-clickhouse/acl"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
@@ -23,6 +24,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/pkg/where"
+	"github.com/lomik/graphite-clickhouse/querylog"
 )
 
 // override in unit tests for stable results
@@ -214,6 +216,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		queueFail     bool
 		queueDuration time.Duration
 		findCache     bool
+		exprs         []string
 	)
 
 	username := r.Header.Get("X-Forwarded-User")
@@ -236,6 +239,8 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		d := time.Since(start)
 		dMS := d.Milliseconds()
 		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, findCache, queueFail)
+		logs.SlowQueryLog(h.config, r, "tags", status, logs.Timings{Total: d, Queue: queueDuration})
+		querylog.Log(r, querylog.Entry{Endpoint: "tags", Targets: exprs, Metrics: metricsCount, Status: status, Duration: d})
 		limiter.SendDuration(queueDuration.Milliseconds())
 		metrics.SendFindMetrics(metrics.TagsRequestMetric, status, dMS, 0, h.config.Metrics.ExtendedStat, metricsCount)
 
@@ -267,16 +272,49 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, start)
+	popularity, withCounts, err := parseSort(r)
+	if err != nil {
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+
+	search, err := parseSearch(r, "tagContains", &h.config.ClickHouse.TagsSearch)
+	if err != nil {
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+
+	days, timeout, dsn := h.searchParams(&search)
+	fromDate, untilDate := dateString(days, start)
 
 	var key string
 
-	exprs := r.Form["expr"]
+	exprs = r.Form["expr"]
 	// params := taggedTagsQuery(exprs, tagPrefix, limit)
 
+	access := acl.For(username)
+	if !access.AllowedTagged() {
+		aclFiltered(1)
+		w.Write([]byte("[]"))
+
+		return
+	}
+
+	// tag names can't be checked by ACL rules, so the series are filtered in the query
+	aclWhere := access.TaggedWhere()
+
 	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
 	if useCache {
 		key, _ = taggedKey("tags;", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, "", exprs, tagPrefix, limit)
+		if popularity {
+			key += ";sort=" + sortPopularity
+		}
+
+		key += search.key()
+
+		if aclWhere != "" {
+			key += ";acl=" + aclWhere
+		}
 
 		body, err = h.config.Common.FindCache.Get(key)
 		if err == nil {
@@ -307,23 +345,39 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 			if tagPrefix != "" {
 				wr.And(where.HasPrefix("Tag1", tagPrefix))
 			}
+
+			wr.And(search.where("splitByChar('=', Tag1)[1]"))
 		} else {
 			valueSQL = "splitByChar('=', arrayJoin(Tags))[1] AS value"
 
 			if tagPrefix != "" {
 				wr.And(where.HasPrefix("arrayJoin(Tags)", tagPrefix))
 			}
+
+			wr.And(search.where("splitByChar('=', arrayJoin(Tags))[1]"))
 		}
 
-		queryLimit := limit + len(usedTags)
+		queryLimit := search.queryLimit(limit, h.config.ClickHouse.TagsSearch.FuzzyCandidates) + len(usedTags)
 
 		wr.Andf("Date >= '%s' AND Date <= '%s'", fromDate, untilDate)
+		wr.And(aclWhere)
+
+		// tags count table can't be filtered by expressions and ACL
+		table := h.config.ClickHouse.TaggedTable
+		if popularity && len(usedTags) == 0 && aclWhere == "" && h.config.ClickHouse.TagsCountTable != "" {
+			table = h.config.ClickHouse.TagsCountTable
+		}
+
+		countSQL, orderSQL := popularitySQL(popularity, table == h.config.ClickHouse.TagsCountTable)
+		orderSQL = search.order(orderSQL, popularity)
 
-		sql := fmt.Sprintf("SELECT %s FROM %s %s %s GROUP BY value ORDER BY value LIMIT %d",
+		sql := fmt.Sprintf("SELECT %s%s FROM %s %s %s GROUP BY value ORDER BY %s LIMIT %d",
 			valueSQL,
-			h.config.ClickHouse.TaggedTable,
+			countSQL,
+			table,
 			pw.PreWhereSQL(),
 			wr.SQL(),
+			orderSQL,
 			queryLimit,
 		)
 
@@ -334,7 +388,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		)
 
 		if limiter.Enabled() {
-			ctx, cancel = context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
+			ctx, cancel = context.WithTimeout(r.Context(), timeout)
 			defer cancel()
 
 			err = limiter.Enter(ctx, "tags")
@@ -363,12 +417,12 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		}
 
 		body, chReadRows, chReadBytes, err = clickhouse.Query(
-			scope.WithTable(r.Context(), h.config.ClickHouse.TaggedTable),
-			h.config.ClickHouse.URL,
+			scope.WithTable(r.Context(), table),
+			dsn,
 			sql,
 			clickhouse.Options{
 				TLSConfig:               h.config.ClickHouse.TLSConfig,
-				Timeout:                 h.config.ClickHouse.IndexTimeout,
+				Timeout:                 timeout,
 				ConnectTimeout:          h.config.ClickHouse.ConnectTimeout,
 				CheckRequestProgress:    h.config.FeatureFlags.LogQueryProgress,
 				ProgressSendingInterval: h.config.ClickHouse.ProgressSendingInterval,
@@ -400,7 +454,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rows := strings.Split(stringutils.UnsafeString(body), "\n")
-	tags := make([]string, 0, uint64(len(rows))+1) // +1 - reserve for "name" tag
+	items := make([]valueCount, 0, uint64(len(rows))+1) // +1 - reserve for "name" tag
 
 	hasName := false
 
@@ -409,29 +463,45 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		if rows[i] == "__name__" {
-			rows[i] = "name"
+		item := valueCount{Value: rows[i]}
+
+		if popularity {
+			item.Value, item.Count, err = splitCountRow(rows[i])
+			if err != nil {
+				status = http.StatusInternalServerError
+				http.Error(w, err.Error(), status)
+
+				return
+			}
 		}
 
-		if usedTags[rows[i]] {
+		if item.Value == "__name__" {
+			item.Value = "name"
+		}
+
+		if usedTags[item.Value] {
 			continue
 		}
 
-		tags = append(tags, rows[i])
+		items = append(items, item)
 
-		if rows[i] == "name" {
+		if item.Value == "name" {
 			hasName = true
 		}
 	}
 
-	if !hasName && !usedTags["name"] && (tagPrefix == "" || strings.HasPrefix("name", tagPrefix)) {
-		tags = append(tags, "name")
+	if !hasName && !usedTags["name"] && (tagPrefix == "" || strings.HasPrefix("name", tagPrefix)) && search.match("name") {
+		items = append(items, valueCount{Value: "name"})
 	}
 
-	sort.Strings(tags)
+	if search.fuzzy {
+		rankByEditDistance(items, search.contains, popularity)
+	} else if !popularity {
+		sort.Slice(items, func(i, j int) bool { return items[i].Value < items[j].Value })
+	}
 
-	if len(tags) > limit {
-		tags = tags[:limit]
+	if len(items) > limit {
+		items = items[:limit]
 	}
 
 	if useCache {
@@ -446,7 +516,24 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	b, err := json.Marshal(tags)
+	var b []byte
+
+	if withCounts {
+		answer := make([]tagCount, len(items))
+		for i := range items {
+			answer[i] = tagCount{Tag: items[i].Value, Count: items[i].Count}
+		}
+
+		b, err = json.Marshal(answer)
+	} else {
+		tags := make([]string, len(items))
+		for i := range items {
+			tags[i] = items[i].Value
+		}
+
+		b, err = json.Marshal(tags)
+	}
+
 	if err != nil {
 		status = http.StatusInternalServerError
 		http.Error(w, err.Error(), status)
@@ -454,7 +541,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	metricsCount = int64(len(tags))
+	metricsCount = int64(len(items))
 
 	w.Write(b)
 }
@@ -490,6 +577,7 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		queueFail     bool
 		queueDuration time.Duration
 		findCache     bool
+		exprs         []string
 	)
 
 	username := r.Header.Get("X-Forwarded-User")
@@ -512,6 +600,8 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		d := time.Since(start)
 		dMS := d.Milliseconds()
 		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, findCache, queueFail)
+		logs.SlowQueryLog(h.config, r, "values", status, logs.Timings{Total: d, Queue: queueDuration})
+		querylog.Log(r, querylog.Entry{Endpoint: "values", Targets: exprs, Metrics: metricsCount, Status: status, Duration: d})
 		limiter.SendDuration(queueDuration.Milliseconds())
 		metrics.SendFindMetrics(metrics.TagsRequestMetric, status, dMS, 0, h.config.Metrics.ExtendedStat, metricsCount)
 
@@ -542,18 +632,51 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, start)
+	popularity, withCounts, err := parseSort(r)
+	if err != nil {
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+
+	search, err := parseSearch(r, "valueContains", &h.config.ClickHouse.TagsSearch)
+	if err != nil {
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+
+	days, timeout, dsn := h.searchParams(&search)
+	fromDate, untilDate := dateString(days, start)
 
 	var key string
 
-	exprs := r.Form["expr"]
+	exprs = r.Form["expr"]
 	// params := taggedValuesQuery(tag, exprs, valuePrefix, limit)
 
+	access := acl.For(username)
+	if !access.AllowedTagged() {
+		aclFiltered(1)
+		w.Write([]byte("[]"))
+
+		return
+	}
+
+	// values of the other tags of the series can't be checked by ACL rules, so the series are filtered in the query
+	aclWhere := access.TaggedWhere()
+
 	// taggedKey(tag, , "valuePrefix="+valuePrefix, limit)
 	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
 	if useCache {
 		// logger = logger.With(zap.String("use_cache", "true"))
 		key, _ = taggedValuesKey("values;", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, tag, exprs, valuePrefix, limit)
+		if popularity {
+			key += ";sort=" + sortPopularity
+		}
+
+		key += search.key()
+
+		if aclWhere != "" {
+			key += ";acl=" + aclWhere
+		}
 
 		body, err = h.config.Common.FindCache.Get(key)
 		if err == nil {
@@ -585,20 +708,37 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		if len(usedTags) == 0 {
 			valueSQL = fmt.Sprintf("substr(Tag1, %d) AS value", len(tag)+2)
 			wr.And(where.HasPrefix("Tag1", tag+"="+valuePrefix))
+			wr.And(search.where(fmt.Sprintf("substr(Tag1, %d)", len(tag)+2)))
 		} else {
 			prefixSelector := where.HasPrefix("x", tag+"="+valuePrefix)
+			if search.enabled() {
+				prefixSelector += " AND " + search.where(fmt.Sprintf("substr(x, %d)", len(tag)+2))
+			}
+
 			valueSQL = fmt.Sprintf("substr(arrayFilter(x -> %s, Tags)[1], %d) AS value", prefixSelector, len(tag)+2)
 			wr.And("arrayExists(x -> " + prefixSelector + ", Tags)")
 		}
 
 		wr.Andf("Date >= '%s' AND Date <= '%s'", fromDate, untilDate)
+		wr.And(aclWhere)
+
+		// tags count table can't be filtered by expressions and ACL
+		table := h.config.ClickHouse.TaggedTable
+		if popularity && len(usedTags) == 0 && aclWhere == "" && h.config.ClickHouse.TagsCountTable != "" {
+			table = h.config.ClickHouse.TagsCountTable
+		}
 
-		sql := fmt.Sprintf("SELECT %s FROM %s %s %s GROUP BY value ORDER BY value LIMIT %d",
+		countSQL, orderSQL := popularitySQL(popularity, table == h.config.ClickHouse.TagsCountTable)
+		orderSQL = search.order(orderSQL, popularity)
+
+		sql := fmt.Sprintf("SELECT %s%s FROM %s %s %s GROUP BY value ORDER BY %s LIMIT %d",
 			valueSQL,
-			h.config.ClickHouse.TaggedTable,
+			countSQL,
+			table,
 			pw.PreWhereSQL(),
 			wr.SQL(),
-			limit,
+			orderSQL,
+			search.queryLimit(limit, h.config.ClickHouse.TagsSearch.FuzzyCandidates),
 		)
 
 		var (
@@ -608,7 +748,7 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		)
 
 		if limiter.Enabled() {
-			ctx, cancel = context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
+			ctx, cancel = context.WithTimeout(r.Context(), timeout)
 			defer cancel()
 
 			err = limiter.Enter(ctx, "tags")
@@ -637,12 +777,12 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		}
 
 		body, chReadRows, chReadBytes, err = clickhouse.Query(
-			scope.WithTable(r.Context(), h.config.ClickHouse.TaggedTable),
-			h.config.ClickHouse.URL,
+			scope.WithTable(r.Context(), table),
+			dsn,
 			sql,
 			clickhouse.Options{
 				TLSConfig:               h.config.ClickHouse.TLSConfig,
-				Timeout:                 h.config.ClickHouse.IndexTimeout,
+				Timeout:                 timeout,
 				ConnectTimeout:          h.config.ClickHouse.ConnectTimeout,
 				CheckRequestProgress:    h.config.FeatureFlags.LogQueryProgress,
 				ProgressSendingInterval: h.config.ClickHouse.ProgressSendingInterval,
@@ -678,6 +818,11 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 			rows = rows[:len(rows)-1]
 		}
 
+		if access.Restricted() {
+			// the query is already filtered by the rules, the values are checked for the safety
+			rows = aclFilterValues(access, tag, rows)
+		}
+
 		metricsCount = int64(len(rows))
 	}
 
@@ -693,7 +838,50 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	b, err := json.Marshal(rows)
+	var b []byte
+
+	if popularity || search.fuzzy {
+		items := make([]valueCount, len(rows))
+
+		for i := range rows {
+			if !popularity {
+				items[i].Value = rows[i]
+				continue
+			}
+
+			items[i].Value, items[i].Count, err = splitCountRow(rows[i])
+			if err != nil {
+				status = http.StatusInternalServerError
+				http.Error(w, err.Error(), status)
+
+				return
+			}
+		}
+
+		if search.fuzzy {
+			rankByEditDistance(items, search.contains, popularity)
+
+			if len(items) > limit {
+				items = items[:limit]
+			}
+
+			metricsCount = int64(len(items))
+		}
+
+		if withCounts {
+			b, err = json.Marshal(items)
+		} else {
+			values := make([]string, len(items))
+			for i := range items {
+				values[i] = items[i].Value
+			}
+
+			b, err = json.Marshal(values)
+		}
+	} else {
+		b, err = json.Marshal(rows)
+	}
+
 	if err != nil {
 		status = http.StatusInternalServerError
 		http.Error(w, err.Error(), status)
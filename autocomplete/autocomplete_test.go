@@ -4,6 +4,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -20,6 +21,13 @@ func NewRequest(method, url string, body io.Reader) *http.Request {
 	return r
 }
 
+func TestMain(m *testing.M) {
+	// test server responses are without X-Clickhouse-Summary, so the tags read stats are sent
+	metrics.AutocompleteQMetric = metrics.InitQueryMetrics("tags", &metrics.Config{})
+
+	os.Exit(m.Run())
+}
+
 type testStruct struct {
 	request     *http.Request
 	wantCode    int
@@ -173,3 +181,223 @@ func TestTagsAutocomplete_ServeValuesCached(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_ServePopularity(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.TagsCountTable = "tag1_count_per_day"
+
+	h := NewTags(cfg)
+
+	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, timeNow())
+	dateWhere := "(Date >= '" + fromDate + "' AND Date <= '" + untilDate + "')"
+
+	srv.AddResponce(
+		"SELECT substr(Tag1, 6) AS value, sum(Count) AS cnt FROM tag1_count_per_day  WHERE (Tag1 LIKE 'host=%') AND "+
+			dateWhere+" GROUP BY value ORDER BY cnt DESC, value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("dc-host2\t10\nhost1\t5\nhost2\t5\n"),
+		})
+	srv.AddResponce(
+		"SELECT substr(arrayFilter(x -> x LIKE 'host=%', Tags)[1], 6) AS value, count() AS cnt FROM graphite_tagged  WHERE ((Tag1='environment=production') AND (arrayExists(x -> x LIKE 'host=%', Tags))) AND "+
+			dateWhere+" GROUP BY value ORDER BY cnt DESC, value LIMIT 2",
+		&chtest.TestResponse{
+			Body: []byte("host2\t3\nhost1\t1\n"),
+		})
+	srv.AddResponce(
+		"SELECT splitByChar('=', Tag1)[1] AS value, sum(Count) AS cnt FROM tag1_count_per_day  WHERE "+
+			"Date >= '"+fromDate+"' AND Date <= '"+untilDate+"' GROUP BY value ORDER BY cnt DESC, value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("host\t20\n__name__\t20\nenvironment\t15\n"),
+		})
+	srv.AddResponce(
+		"SELECT splitByChar('=', arrayJoin(Tags))[1] AS value, count() AS cnt FROM graphite_tagged  WHERE "+
+			"(Tag1='environment=production') AND "+dateWhere+" GROUP BY value ORDER BY cnt DESC, value LIMIT 10001",
+		&chtest.TestResponse{
+			Body: []byte("environment\t4\nhost\t4\n"),
+		})
+
+	tests := []struct {
+		name     string
+		values   bool
+		query    string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "values from count table",
+			values:   true,
+			query:    "tag=host&sort=popularity",
+			wantCode: http.StatusOK,
+			want:     `["dc-host2","host1","host2"]`,
+		},
+		{
+			name:     "values from count table with counts",
+			values:   true,
+			query:    "tag=host&sort=popularity&counts=1",
+			wantCode: http.StatusOK,
+			want:     `[{"value":"dc-host2","count":10},{"value":"host1","count":5},{"value":"host2","count":5}]`,
+		},
+		{
+			name:     "values with expr",
+			values:   true,
+			query:    "tag=host&expr=environment%3Dproduction&limit=2&sort=popularity&counts=1",
+			wantCode: http.StatusOK,
+			want:     `[{"value":"host2","count":3},{"value":"host1","count":1}]`,
+		},
+		{
+			name:     "tags from count table",
+			query:    "sort=popularity&counts=1",
+			wantCode: http.StatusOK,
+			want:     `[{"tag":"host","count":20},{"tag":"name","count":20},{"tag":"environment","count":15}]`,
+		},
+		{
+			name:     "tags with expr",
+			query:    "expr=environment%3Dproduction&sort=popularity",
+			wantCode: http.StatusOK,
+			want:     `["host","name"]`,
+		},
+		{
+			name:     "unsupported sort",
+			values:   true,
+			query:    "tag=host&sort=size",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := NewRequest("GET", srv.URL+"/tags/autoComplete/?"+tt.query, nil)
+
+			if tt.values {
+				h.ServeValues(w, r)
+			} else {
+				h.ServeTags(w, r)
+			}
+
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_ServeSearch(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.TagsSearch.Days = 1
+	cfg.ClickHouse.TagsSearch.MaxRowsToRead = 1000000
+
+	h := NewTags(cfg)
+
+	fromDate, untilDate := dateString(1, timeNow())
+	dateWhere := "(Date >= '" + fromDate + "' AND Date <= '" + untilDate + "')"
+
+	srv.AddResponce(
+		"SELECT substr(Tag1, 6) AS value FROM graphite_tagged  WHERE ((Tag1 LIKE 'host=%') AND (positionCaseInsensitive(substr(Tag1, 6), 'prod') > 0)) AND "+
+			dateWhere+" GROUP BY value ORDER BY value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("eu-prod-1\nus-PROD-2\n"),
+		})
+	srv.AddResponce(
+		"SELECT substr(Tag1, 6) AS value FROM graphite_tagged  WHERE ((Tag1 LIKE 'host=%') AND (ngramSearchCaseInsensitive(substr(Tag1, 6), 'prod') >= 0.3)) AND "+
+			dateWhere+" GROUP BY value ORDER BY ngramSearchCaseInsensitive(value, 'prod') DESC, value LIMIT 1000",
+		&chtest.TestResponse{
+			Body: []byte("eu-prod-1\npr0d\nprod\n"),
+		})
+	srv.AddResponce(
+		"SELECT substr(arrayFilter(x -> x LIKE 'host=%' AND positionCaseInsensitive(substr(x, 6), 'prod') > 0, Tags)[1], 6) AS value FROM graphite_tagged  "+
+			"WHERE ((Tag1='environment=production') AND (arrayExists(x -> x LIKE 'host=%' AND positionCaseInsensitive(substr(x, 6), 'prod') > 0, Tags))) AND "+
+			dateWhere+" GROUP BY value ORDER BY value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("eu-prod-1\n"),
+		})
+	srv.AddResponce(
+		"SELECT splitByChar('=', Tag1)[1] AS value FROM graphite_tagged  WHERE (positionCaseInsensitive(splitByChar('=', Tag1)[1], 'env') > 0) AND "+
+			dateWhere+" GROUP BY value ORDER BY value LIMIT 10000",
+		&chtest.TestResponse{
+			Body: []byte("environment\n"),
+		})
+
+	tests := []struct {
+		name     string
+		values   bool
+		query    string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "values contains",
+			values:   true,
+			query:    "tag=host&valueContains=prod",
+			wantCode: http.StatusOK,
+			want:     `["eu-prod-1","us-PROD-2"]`,
+		},
+		{
+			name:     "values fuzzy",
+			values:   true,
+			query:    "tag=host&valueContains=prod&fuzzy=1&limit=2",
+			wantCode: http.StatusOK,
+			want:     `["prod","pr0d"]`,
+		},
+		{
+			name:     "values contains with expr",
+			values:   true,
+			query:    "tag=host&valueContains=prod&expr=environment%3Dproduction",
+			wantCode: http.StatusOK,
+			want:     `["eu-prod-1"]`,
+		},
+		{
+			name:     "tags contains",
+			query:    "tagContains=env",
+			wantCode: http.StatusOK,
+			want:     `["environment"]`,
+		},
+		{
+			name:     "too short",
+			values:   true,
+			query:    "tag=host&valueContains=pr",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := NewRequest("GET", srv.URL+"/tags/autoComplete/?"+tt.query, nil)
+
+			if tt.values {
+				h.ServeValues(w, r)
+			} else {
+				h.ServeTags(w, r)
+			}
+
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
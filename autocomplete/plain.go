@@ -0,0 +1,241 @@
+package autocomplete
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/utils"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// plainNode is a plain autocomplete answer item
+type plainNode struct {
+	Name   string  `json:"name"`
+	Leaf   bool    `json:"leaf"`
+	Branch bool    `json:"branch"`
+	Count  *uint64 `json:"count,omitempty"`
+}
+
+// PlainHandler serves autocomplete of the next node for plain (non-tagged) metrics from index table
+type PlainHandler struct {
+	config *config.Config
+}
+
+func NewPlain(config *config.Config) *PlainHandler {
+	return &PlainHandler{
+		config: config,
+	}
+}
+
+func (h *PlainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Don't process, if the index table is not set
+	if h.config.ClickHouse.IndexTable == "" {
+		w.Write([]byte{'[', ']'})
+		return
+	}
+
+	start := timeNow()
+	status := http.StatusOK
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("metrics-autocomplete")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	var (
+		err           error
+		body          []byte
+		stat          metrics.FinderStat
+		metricsCount  int64
+		queueFail     bool
+		queueDuration time.Duration
+		findCache     bool
+	)
+
+	username := r.Header.Get("X-Forwarded-User")
+	limiter := h.config.GetUserFindLimiter(username)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			status = http.StatusInternalServerError
+
+			logger.Error("panic during eval:",
+				zap.String("requestID", scope.String(r.Context(), "requestID")),
+				zap.Any("reason", rec),
+				zap.Stack("stack"),
+			)
+
+			answer := fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
+			http.Error(w, answer, status)
+		}
+
+		d := time.Since(start)
+		dMS := d.Milliseconds()
+		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, findCache, queueFail)
+		logs.SlowQueryLog(h.config, r, "autocomplete", status, logs.Timings{Total: d, Queue: queueDuration})
+		limiter.SendDuration(queueDuration.Milliseconds())
+		metrics.SendFindMetrics(metrics.AutocompleteRequestMetric, status, dMS, 0, h.config.Metrics.ExtendedStat, metricsCount)
+
+		if !findCache && stat.ChReadRows > 0 && stat.ChReadBytes > 0 {
+			errored := status != http.StatusOK && status != http.StatusNotFound
+			metrics.SendQueryRead(metrics.PlainAutocompleteQMetric, 0, 0, dMS, metricsCount, stat.ReadBytes, stat.ChReadRows, stat.ChReadBytes, errored)
+		}
+	}()
+
+	r.ParseMultipartForm(1024 * 1024)
+
+	query := r.FormValue("query")
+	counts := parser.TruthyBool(r.FormValue("counts"))
+	limitStr := r.FormValue("limit")
+	limit := 10000
+
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			status = http.StatusBadRequest
+			http.Error(w, "invalid limit: "+limitStr, status)
+
+			return
+		}
+	}
+
+	var key string
+
+	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+	if useCache {
+		ts := utils.TimestampTruncate(start.Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
+		key = "plain;" + finder.DefaultTreeDate + ";query=" + query + ";limit=" + strconv.Itoa(limit)
+
+		if counts {
+			key += ";counts=1"
+		}
+
+		key += ";ts=" + strconv.FormatInt(ts, 10)
+
+		body, err = h.config.Common.FindCache.Get(key)
+		if err == nil {
+			if metrics.FinderCacheMetrics != nil {
+				metrics.FinderCacheMetrics.CacheHits.Add(1)
+			}
+
+			findCache = true
+
+			w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
+		}
+	}
+
+	if !findCache {
+		var (
+			entered bool
+			ctx     context.Context
+			cancel  context.CancelFunc
+		)
+
+		if limiter.Enabled() {
+			ctx, cancel = context.WithTimeout(r.Context(), h.config.ClickHouse.IndexTimeout)
+			defer cancel()
+
+			err = limiter.Enter(ctx, "autocomplete")
+			queueDuration = time.Since(start)
+
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				queueFail = true
+
+				logger.Error(err.Error())
+				http.Error(w, err.Error(), status)
+
+				return
+			}
+
+			queueDuration = time.Since(start)
+			entered = true
+
+			defer func() {
+				if entered {
+					limiter.Leave(ctx, "autocomplete")
+
+					entered = false
+				}
+			}()
+		}
+
+		body, stat, err = finder.IndexAutocomplete(r.Context(), h.config, query, 0, 0, limit, counts)
+
+		if entered {
+			// release early as possible
+			limiter.Leave(ctx, "autocomplete")
+
+			entered = false
+		}
+
+		if err != nil {
+			status, _ = clickhouse.HandleError(w, err)
+			return
+		}
+
+		if useCache {
+			if metrics.FinderCacheMetrics != nil {
+				metrics.FinderCacheMetrics.CacheMisses.Add(1)
+			}
+
+			h.config.Common.FindCache.Set(key, body, h.config.Common.FindCacheConfig.FindTimeoutSec)
+		}
+	}
+
+	nodes, err := finder.ParseIndexNodes(body, counts)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	if access := acl.For(username); access.Restricted() {
+		nodes = aclFilterNodes(access, nodes)
+	}
+
+	metricsCount = int64(len(nodes))
+
+	if useCache {
+		if findCache {
+			logger.Info("finder", zap.String("get_cache", key),
+				zap.Int("metrics", len(nodes)), zap.Bool("find_cached", true),
+				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+		} else {
+			logger.Info("finder", zap.String("set_cache", key),
+				zap.Int("metrics", len(nodes)), zap.Bool("find_cached", false),
+				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+		}
+	}
+
+	answer := make([]plainNode, len(nodes))
+	for i := range nodes {
+		answer[i] = plainNode{Name: nodes[i].Name, Leaf: nodes[i].Leaf, Branch: nodes[i].Branch}
+		if counts {
+			answer[i].Count = &nodes[i].Count
+		}
+	}
+
+	b, err := json.Marshal(answer)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,76 @@
+package autocomplete
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestPlainHandler(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+
+	h := NewPlain(cfg)
+
+	srv.AddResponce(
+		"SELECT splitByChar('.', Path)[3] AS node, max(NOT endsWith(Path, '.')) AS leaf, max(endsWith(Path, '.')) AS branch FROM graphite_index "+
+			"WHERE ((Level=20003) AND (Path LIKE 'servers.web%' AND match(Path, '^servers[.]web([^.]*?)[.]c([^.]*?)[.]?$'))) AND (Date='1970-02-12') GROUP BY node ORDER BY node LIMIT 10000 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{
+			Body: []byte("count\t1\t0\ncpu\t0\t1\n"),
+		})
+	srv.AddResponce(
+		"SELECT splitByChar('.', Path)[2] AS node, max(Level = 20002 AND NOT endsWith(Path, '.')) AS leaf, max(Level > 20002 OR endsWith(Path, '.')) AS branch, uniqExactIf(Path, NOT endsWith(Path, '.')) AS cnt FROM graphite_index "+
+			"WHERE (((Level >= 20002 AND Level < 30000) AND (Path LIKE 'servers.%')) AND (arrayStringConcat(arraySlice(splitByChar('.', Path), 1, 2), '.') LIKE 'servers.%')) AND (Date='1970-02-12') GROUP BY node ORDER BY node LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{
+			Body: []byte("web1\t0\t1\t12\nweb2\t1\t1\t7\n"),
+		})
+
+	tests := []struct {
+		query    string
+		wantCode int
+		want     string
+	}{
+		{
+			query:    "query=servers.web*.c",
+			wantCode: http.StatusOK,
+			want:     `[{"name":"count","leaf":true,"branch":false},{"name":"cpu","leaf":false,"branch":true}]`,
+		},
+		{
+			query:    "query=servers.&counts=1&limit=2",
+			wantCode: http.StatusOK,
+			want:     `[{"name":"web1","leaf":false,"branch":true,"count":12},{"name":"web2","leaf":true,"branch":true,"count":7}]`,
+		},
+		{
+			query:    "query=servers.{web",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			query:    "query=servers.&limit=-1",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, NewRequest("GET", srv.URL+"/metrics/autocomplete/?"+tt.query, nil))
+
+			assert.Equal(t, tt.wantCode, w.Code, w.Body.String())
+
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package autocomplete
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+)
+
+const (
+	sortName       = "name"
+	sortPopularity = "popularity"
+)
+
+// tagCount is a tags autocomplete answer item with counts=1
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count uint64 `json:"count"`
+}
+
+// valueCount is a values autocomplete answer item with counts=1
+type valueCount struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// parseSort returns true if results must be ordered by series count (sort=popularity)
+// and true if counts must be included in the answer (counts=1, only with sort=popularity)
+func parseSort(r *http.Request) (popularity, withCounts bool, err error) {
+	switch s := r.FormValue("sort"); s {
+	case "", sortName:
+		return false, false, nil
+	case sortPopularity:
+		return true, parser.TruthyBool(r.FormValue("counts")), nil
+	default:
+		return false, false, errs.NewErrorWithCode("unsupported sort: "+s, http.StatusBadRequest)
+	}
+}
+
+// popularitySQL returns select expression for series count and order for the autocomplete query
+func popularitySQL(popularity, countTable bool) (string, string) {
+	if !popularity {
+		return "", "value"
+	}
+
+	if countTable {
+		return ", sum(Count) AS cnt", "cnt DESC, value"
+	}
+
+	return ", count() AS cnt", "cnt DESC, value"
+}
+
+// splitCountRow splits 'value\tcount' row from sort=popularity query
+func splitCountRow(row string) (string, uint64, error) {
+	n := strings.LastIndexByte(row, '\t')
+	if n == -1 {
+		return "", 0, fmt.Errorf("failed to parse autocomplete row: %q", row)
+	}
+
+	count, err := strconv.ParseUint(row[n+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse autocomplete row: %q: %w", row, err)
+	}
+
+	return row[:n], count, nil
+}
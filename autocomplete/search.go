@@ -0,0 +1,178 @@
+package autocomplete
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// search is a case-insensitive substring (or fuzzy) match from tagContains/valueContains parameters
+type search struct {
+	contains  string
+	fuzzy     bool
+	threshold float64
+}
+
+func parseSearch(r *http.Request, param string, cfg *config.TagsSearch) (search, error) {
+	s := search{contains: r.FormValue(param)}
+	if s.contains == "" {
+		return s, nil
+	}
+
+	if utf8.RuneCountInString(s.contains) < cfg.MinLength {
+		return s, errs.NewErrorWithCode(fmt.Sprintf("%s must be at least %d characters", param, cfg.MinLength), http.StatusBadRequest)
+	}
+
+	s.fuzzy = parser.TruthyBool(r.FormValue("fuzzy"))
+	s.threshold = cfg.FuzzyThreshold
+
+	return s, nil
+}
+
+func (s *search) enabled() bool {
+	return s.contains != ""
+}
+
+// match checks value in the same way as clickhouse substring search (fuzzy match is checked as substring)
+func (s *search) match(value string) bool {
+	if !s.enabled() {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(value), strings.ToLower(s.contains))
+}
+
+// where returns condition for field or empty string if search is not enabled
+func (s *search) where(field string) string {
+	if !s.enabled() {
+		return ""
+	}
+
+	if s.fuzzy {
+		return fmt.Sprintf("%s >= %s", where.NgramSearchCaseInsensitive(field, s.contains), strconv.FormatFloat(s.threshold, 'f', -1, 64))
+	}
+
+	return where.ContainsCaseInsensitive(field, s.contains)
+}
+
+// order returns ORDER BY expression for fuzzy search (the best ngram score first), otherwise returns order as is
+func (s *search) order(order string, popularity bool) string {
+	if !s.fuzzy || popularity {
+		return order
+	}
+
+	return where.NgramSearchCaseInsensitive("value", s.contains) + " DESC, value"
+}
+
+// queryLimit returns limit for clickhouse query, fuzzy search fetch more candidates for ranking
+func (s *search) queryLimit(limit, candidates int) int {
+	if s.fuzzy && candidates > limit {
+		return candidates
+	}
+
+	return limit
+}
+
+// key returns find cache key suffix
+func (s *search) key() string {
+	if !s.enabled() {
+		return ""
+	}
+
+	if s.fuzzy {
+		return ";contains=" + s.contains + ";fuzzy=1"
+	}
+
+	return ";contains=" + s.contains
+}
+
+// searchParams returns autocomplete days, query timeout and clickhouse url, overwritten by tags-search config if search is enabled
+func (h *Handler) searchParams(s *search) (int, time.Duration, string) {
+	days := h.config.ClickHouse.TaggedAutocompleDays
+	timeout := h.config.ClickHouse.IndexTimeout
+	dsn := h.config.ClickHouse.URL
+
+	if !s.enabled() {
+		return days, timeout, dsn
+	}
+
+	cfg := &h.config.ClickHouse.TagsSearch
+	if cfg.Days > 0 {
+		days = cfg.Days
+	}
+
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout
+	}
+
+	if cfg.MaxRowsToRead > 0 {
+		if u, err := url.Parse(dsn); err == nil {
+			q := u.Query()
+			q.Set("max_rows_to_read", strconv.FormatInt(cfg.MaxRowsToRead, 10))
+			u.RawQuery = q.Encode()
+			dsn = u.String()
+		}
+	}
+
+	return days, timeout, dsn
+}
+
+// rankByEditDistance sorts items by case-insensitive edit distance to s, the order of items with equal distance is kept.
+// With popularity the items are sorted by count and the edit distance only breaks the ties
+func rankByEditDistance(items []valueCount, s string, popularity bool) {
+	s = strings.ToLower(s)
+
+	distances := make(map[string]int, len(items))
+	for i := range items {
+		distances[items[i].Value] = editDistance(strings.ToLower(items[i].Value), s)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if popularity && items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+
+		return distances[items[i].Value] < distances[items[j].Value]
+	})
+}
+
+// editDistance returns Levenshtein distance between a and b (in runes)
+func editDistance(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
@@ -0,0 +1,64 @@
+package autocomplete
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"prod", "prod", 0},
+		{"prod", "pr0d", 1},
+		{"prod", "", 4},
+		{"prod", "eu-prod-1", 5},
+		{"kitten", "sitting", 3},
+		{"хост", "хосты", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			assert.Equal(t, tt.want, editDistance(tt.a, tt.b))
+			assert.Equal(t, tt.want, editDistance(tt.b, tt.a))
+		})
+	}
+}
+
+func TestRankByEditDistance(t *testing.T) {
+	items := []valueCount{
+		{Value: "eu-prod-1", Count: 10},
+		{Value: "PROD", Count: 5},
+		{Value: "pr0d", Count: 3},
+		{Value: "prd", Count: 1},
+	}
+
+	rankByEditDistance(items, "Prod", false)
+
+	assert.Equal(t, []valueCount{
+		{Value: "PROD", Count: 5},
+		{Value: "pr0d", Count: 3},
+		{Value: "prd", Count: 1},
+		{Value: "eu-prod-1", Count: 10},
+	}, items)
+
+	// popularity order is kept, the edit distance breaks the ties
+	items = []valueCount{
+		{Value: "eu-prod-1", Count: 10},
+		{Value: "prd", Count: 3},
+		{Value: "PROD", Count: 3},
+		{Value: "pr0d", Count: 1},
+	}
+
+	rankByEditDistance(items, "Prod", true)
+
+	assert.Equal(t, []valueCount{
+		{Value: "eu-prod-1", Count: 10},
+		{Value: "PROD", Count: 3},
+		{Value: "prd", Count: 3},
+		{Value: "pr0d", Count: 1},
+	}, items)
+}
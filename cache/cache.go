@@ -104,3 +104,21 @@ func (m *MemcachedCache) Set(k string, v []byte, expire int32) {
 func (m *MemcachedCache) Timeouts() uint64 {
 	return atomic.LoadUint64(&m.timeouts)
 }
+
+// NewPrefixed returns the cache, which adds the prefix to the keys. It's used to share the cache between tenants
+func NewPrefixed(prefix string, c BytesCache) BytesCache {
+	return &PrefixedCache{prefix: prefix, c: c}
+}
+
+type PrefixedCache struct {
+	prefix string
+	c      BytesCache
+}
+
+func (p *PrefixedCache) Get(k string) ([]byte, error) {
+	return p.c.Get(p.prefix + k)
+}
+
+func (p *PrefixedCache) Set(k string, v []byte, expire int32) {
+	p.c.Set(p.prefix+k, v, expire)
+}
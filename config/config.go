@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"reflect"
@@ -29,7 +30,9 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/date"
 	"github.com/lomik/graphite-clickhouse/helper/rollup"
 	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/load_avg"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 )
 
 type SDType uint8
@@ -105,17 +108,23 @@ type Common struct {
 	MemoryReturnInterval   time.Duration    `toml:"memory-return-interval"     json:"memory-return-interval"     comment:"daemon will return the freed memory to the OS when it>0"`
 	HeadersToLog           []string         `toml:"headers-to-log"             json:"headers-to-log"             comment:"additional request headers to log"`
 
-	BaseWeight       int           `toml:"base_weight"            json:"base_weight"            comment:"service discovery base weight (on idle)"`
-	DegragedMultiply float64       `toml:"degraged-multiply"            json:"degraged-multiply"            comment:"service discovery degraded load avg multiplier (if normalized load avg > degraged_load_avg) (default 4.0)"`
-	DegragedLoad     float64       `toml:"degraged-load-avg"            json:"degraged-load-avg"            comment:"service discovery normilized load avg degraded point (default 1.0)"`
-	SDType           SDType        `toml:"service-discovery-type" json:"service-discovery-type" comment:"service discovery type"`
-	SD               string        `toml:"service-discovery"      json:"service-discovery"      comment:"service discovery address (consul)"`
-	SDNamespace      string        `toml:"service-discovery-ns"   json:"service-discovery-ns"   comment:"service discovery namespace (graphite by default)"`
-	SDDc             []string      `toml:"service-discovery-ds"   json:"service-discovery-ds"   comment:"service discovery datacenters (first - is primary, in other register as backup)"`
-	SDExpire         time.Duration `toml:"service-discovery-expire"   json:"service-discovery-expire"   comment:"service discovery expire duration for cleanup (minimum is 24h, if enabled)"`
+	BaseWeight        int           `toml:"base_weight"            json:"base_weight"            comment:"service discovery base weight (on idle)"`
+	DegragedMultiply  float64       `toml:"degraged-multiply"            json:"degraged-multiply"            comment:"service discovery degraded load avg multiplier (if normalized load avg > degraged_load_avg) (default 4.0)"`
+	DegragedLoad      float64       `toml:"degraged-load-avg"            json:"degraged-load-avg"            comment:"service discovery normilized load avg degraded point (default 1.0)"`
+	LoadSignal        string        `toml:"load-signal"            json:"load-signal"            comment:"signal of the normalized load for the service discovery weight and the adaptive limiters: load-avg, cgroup-cpu, cpu-pressure, memory-pressure, pressure"`
+	LoadPressureScale float64       `toml:"load-pressure-scale"    json:"load-pressure-scale"    comment:"stall percent (PSI some avg10), treated as the normalized load 1.0"`
+	SDType            SDType        `toml:"service-discovery-type" json:"service-discovery-type" comment:"service discovery type"`
+	SD                string        `toml:"service-discovery"      json:"service-discovery"      comment:"service discovery address (consul)"`
+	SDNamespace       string        `toml:"service-discovery-ns"   json:"service-discovery-ns"   comment:"service discovery namespace (graphite by default)"`
+	SDDc              []string      `toml:"service-discovery-ds"   json:"service-discovery-ds"   comment:"service discovery datacenters (first - is primary, in other register as backup)"`
+	SDExpire          time.Duration `toml:"service-discovery-expire"   json:"service-discovery-expire"   comment:"service discovery expire duration for cleanup (minimum is 24h, if enabled)"`
 
 	FindCacheConfig CacheConfig `toml:"find-cache"      json:"find-cache"             comment:"find/tags cache config"`
 
+	TLS               config.TLS    `toml:"tls"                 json:"tls"                 comment:"TLS (and client certificates verification) for the general listener"                                     commented:"true"`
+	PprofTLS          config.TLS    `toml:"pprof-tls"           json:"pprof-tls"           comment:"TLS for the pprof listener"                                                                              commented:"true"`
+	TLSReloadInterval time.Duration `toml:"tls-reload-interval" json:"tls-reload-interval" comment:"interval to check certificates, keys and CA files of the listeners for changes (0 - reload is disabled)"`
+
 	FindCache cache.BytesCache `toml:"-" json:"-"`
 }
 
@@ -162,9 +171,17 @@ var IndexReverseNames = []string{"auto", "direct", "reversed"}
 type UserLimits struct {
 	MaxQueries        int `toml:"max-queries"      json:"max-queries"  comment:"Max queries to fetch data"`
 	ConcurrentQueries int `toml:"concurrent-queries" json:"concurrent-queries" comment:"Concurrent queries to fetch data"`
-	AdaptiveQueries   int `toml:"adaptive-queries" json:"adaptive-queries" comment:"Adaptive queries (based on load average) for increase/decrease concurrent queries"`
+	AdaptiveQueries   int `toml:"adaptive-queries" json:"adaptive-queries" comment:"Adaptive queries (based on load average or clickhouse latency, see adaptive-limiter) for increase/decrease concurrent queries"`
+
+	RequestsPerSecond float64       `toml:"requests-per-second" json:"requests-per-second" comment:"requests rate (token bucket), exceeding requests get 429 (0 - unlimited)"`
+	RequestsBurst     int           `toml:"requests-burst"      json:"requests-burst"      comment:"token bucket size (0 - requests-per-second, but at least 1)"`
+	ReadRowsQuota     int64         `toml:"read-rows-quota"     json:"read-rows-quota"     comment:"max clickhouse read rows in quota-window, exceeding requests get 429 (0 - unlimited)"`
+	ReadBytesQuota    int64         `toml:"read-bytes-quota"    json:"read-bytes-quota"    comment:"max clickhouse read bytes in quota-window, exceeding requests get 429 (0 - unlimited)"`
+	QuotaWindow       time.Duration `toml:"quota-window"        json:"quota-window"        comment:"rolling window for read-rows-quota and read-bytes-quota"`
+	MaxCost           int64         `toml:"max-cost"            json:"max-cost"            comment:"max cost of the render requests, see admission (0 - admission.max-cost)"`
 
 	Limiter limiter.ServerLimiter `toml:"-" json:"-"`
+	Quota   *limiter.UserQuota    `toml:"-" json:"-"`
 }
 
 type QueryParam struct {
@@ -174,7 +191,7 @@ type QueryParam struct {
 
 	MaxQueries        int `toml:"max-queries" json:"max-queries" comment:"Max queries to fetch data"`
 	ConcurrentQueries int `toml:"concurrent-queries" json:"concurrent-queries" comment:"Concurrent queries to fetch data"`
-	AdaptiveQueries   int `toml:"adaptive-queries" json:"adaptive-queries" comment:"Adaptive queries (based on load average) for increase/decrease concurrent queries"`
+	AdaptiveQueries   int `toml:"adaptive-queries" json:"adaptive-queries" comment:"Adaptive queries (based on load average or clickhouse latency, see adaptive-limiter) for increase/decrease concurrent queries"`
 
 	Limiter limiter.ServerLimiter `toml:"-" json:"-"`
 }
@@ -205,6 +222,171 @@ func binarySearchQueryParamLe(a []QueryParam, duration time.Duration, start, end
 	return result
 }
 
+// IndexReplica config
+type IndexReplica struct {
+	Enabled     bool          `toml:"enabled"       json:"enabled"       comment:"periodically load the index tree into memory and answer find queries from it"`
+	Interval    time.Duration `toml:"interval"      json:"interval"      comment:"reload interval"`
+	MaxAge      time.Duration `toml:"max-age"       json:"max-age"       comment:"if the last successful load is older than max-age, queries fall back to the clickhouse finder (3*interval by default)"`
+	LoadTimeout time.Duration `toml:"load-timeout"  json:"load-timeout"  comment:"total timeout to load the index tree"`
+	UseInRender bool          `toml:"use-in-render" json:"use-in-render" comment:"also use the replica for render queries (index-use-daily is ignored in this case)"`
+	Days        int           `toml:"days"          json:"days"          comment:"load only the paths of the last days from the daily index, queries for the older time range fall back to the clickhouse finder (0 - the whole tree)"`
+	MaxNodes    int           `toml:"max-nodes"     json:"max-nodes"     comment:"if the tree has more nodes, the replica is dropped and queries fall back to the clickhouse finder (0 - unlimited)"`
+}
+
+// IndexBloom config
+type IndexBloom struct {
+	Enabled           bool          `toml:"enabled"             json:"enabled"             comment:"build bloom filter of paths from index-table and skip index queries for non-existent metrics without wildcards"`
+	Interval          time.Duration `toml:"interval"            json:"interval"            comment:"rebuild interval, new metrics can't be found until the next rebuild"`
+	MaxAge            time.Duration `toml:"max-age"             json:"max-age"             comment:"if the last successful build is older than max-age, filter is not used (3*interval by default)"`
+	LoadTimeout       time.Duration `toml:"load-timeout"        json:"load-timeout"        comment:"total timeout to load paths from index-table"`
+	FalsePositiveRate float64       `toml:"false-positive-rate" json:"false-positive-rate" comment:"target false positive rate"`
+	MaxSize           int           `toml:"max-size"            json:"max-size"            comment:"max filter size in bytes, false positive rate grows if exceeded (0 - unlimited)"`
+}
+
+// TagsCountSnapshot config
+type TagsCountSnapshot struct {
+	Enabled     bool          `toml:"enabled"      json:"enabled"      comment:"periodically load tag-value counts from tags-count-table into memory and use them for tagged terms costs instead of the query on each seriesByTag"`
+	Interval    time.Duration `toml:"interval"     json:"interval"     comment:"reload interval"`
+	MaxAge      time.Duration `toml:"max-age"      json:"max-age"      comment:"if the last successful load is older than max-age, tags-count-table is queried on each request (3*interval by default)"`
+	LoadTimeout time.Duration `toml:"load-timeout" json:"load-timeout" comment:"total timeout to load counts"`
+	Days        int           `toml:"days"         json:"days"         comment:"load counts for the last days"`
+}
+
+// ACL config
+type ACL struct {
+	File           string        `toml:"file"            json:"file"            comment:"ACL file with per-user and per-group access rules, see doc/config.md (empty - disabled)"`
+	ReloadInterval time.Duration `toml:"reload-interval" json:"reload-interval" comment:"interval to check the ACL file for changes"`
+}
+
+// SlowQueryLog config
+type SlowQueryLog struct {
+	Threshold time.Duration            `toml:"threshold" json:"threshold" comment:"log the requests and clickhouse queries longer than threshold to the slow_query logger (0 - disabled)"`
+	Endpoints map[string]time.Duration `toml:"endpoints" json:"endpoints" comment:"request thresholds by the endpoint: render, find, expand, tags, values, autocomplete, index (override threshold)"`
+	Tables    map[string]time.Duration `toml:"tables"    json:"tables"    comment:"query thresholds by the table (override threshold)"`
+}
+
+// Enabled returns true if any threshold is set
+func (c *SlowQueryLog) Enabled() bool {
+	if c.Threshold > 0 {
+		return true
+	}
+
+	for _, d := range c.Endpoints {
+		if d > 0 {
+			return true
+		}
+	}
+
+	for _, d := range c.Tables {
+		if d > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks the thresholds
+func (c *SlowQueryLog) Validate() error {
+	if c.Threshold < 0 {
+		return fmt.Errorf("threshold can't be negative")
+	}
+
+	for endpoint, d := range c.Endpoints {
+		if d < 0 {
+			return fmt.Errorf("endpoints.%s threshold can't be negative", endpoint)
+		}
+	}
+
+	for table, d := range c.Tables {
+		if d < 0 {
+			return fmt.Errorf("tables.%s threshold can't be negative", table)
+		}
+	}
+
+	return nil
+}
+
+// EndpointThreshold returns the request threshold for the endpoint, 0 means the requests are not logged
+func (c *SlowQueryLog) EndpointThreshold(endpoint string) time.Duration {
+	if d, ok := c.Endpoints[endpoint]; ok {
+		return d
+	}
+
+	return c.Threshold
+}
+
+// TableThreshold returns the query threshold for the table, 0 means the queries are not logged
+func (c *SlowQueryLog) TableThreshold(table string) time.Duration {
+	if d, ok := c.Tables[table]; ok {
+		return d
+	}
+
+	return c.Threshold
+}
+
+// QueryLog config
+type QueryLog struct {
+	Table         string                     `toml:"table"          json:"table"          comment:"clickhouse table for the requests log, see doc/config.md for the schema (empty - disabled)"`
+	URL           string                     `toml:"url"            json:"url"            comment:"clickhouse url for inserts (empty - clickhouse.url)"`
+	QueueSize     int                        `toml:"queue-size"     json:"queue-size"     comment:"max rows in the queue, new rows are dropped when the queue is full"`
+	BatchSize     int                        `toml:"batch-size"     json:"batch-size"     comment:"max rows in one insert"`
+	FlushInterval time.Duration              `toml:"flush-interval" json:"flush-interval" comment:"max time between the inserts"`
+	Timeout       time.Duration              `toml:"timeout"        json:"timeout"        comment:"insert timeout"`
+	Compression   clickhouse.ContentEncoding `toml:"compression"    json:"compression"    comment:"content encoding of the inserts: gzip, none, zstd"`
+}
+
+// Enabled returns true if the query log table is set
+func (c *QueryLog) Enabled() bool {
+	return c.Table != ""
+}
+
+const (
+	AdmissionPoints   = "points"
+	AdmissionEstimate = "estimate"
+)
+
+// Admission config
+type Admission struct {
+	Mode     string `toml:"mode"      json:"mode"      comment:"cost of the render requests: points (by the metrics, rollup steps and time range) or estimate (rows by EXPLAIN ESTIMATE), empty - disabled"`
+	MaxCost  int64  `toml:"max-cost"  json:"max-cost"  comment:"requests with greater cost are rejected with 403 (0 - unlimited), can be overwritten in clickhouse.user-limits"`
+	SlotCost int64  `toml:"slot-cost" json:"slot-cost" comment:"each slot-cost of the request cost takes one more slot of the render limiter, up to half of concurrent-queries (0 - one slot)"`
+}
+
+// Enabled returns true if the request cost is calculated
+func (a *Admission) Enabled() bool {
+	return a.Mode != ""
+}
+
+// Auth config
+type Auth struct {
+	HtpasswdFile   string        `toml:"htpasswd-file"    json:"htpasswd-file"    comment:"htpasswd file with bcrypt hashed passwords for HTTP basic auth (empty - disabled)"`
+	ClientCertUser bool          `toml:"client-cert-user" json:"client-cert-user" comment:"authenticate by the verified TLS client certificate (see common.tls), CN is used as the user"`
+	JWTKeyFile     string        `toml:"jwt-key-file"     json:"jwt-key-file"     comment:"key to validate JWT bearer tokens: secret for HS256 or PEM public key (or certificate) for RS256 (empty - disabled)"`
+	JWTAlgorithm   string        `toml:"jwt-algorithm"    json:"jwt-algorithm"    comment:"JWT signing algorithm: HS256 or RS256"`
+	JWTUserClaim   string        `toml:"jwt-user-claim"   json:"jwt-user-claim"   comment:"JWT claim with the user name"`
+	JWTIssuer      string        `toml:"jwt-issuer"       json:"jwt-issuer"       comment:"required JWT iss claim (empty - not checked)"`
+	JWTAudience    string        `toml:"jwt-audience"     json:"jwt-audience"     comment:"required JWT aud claim (empty - not checked)"`
+	JWTLeeway      time.Duration `toml:"jwt-leeway"       json:"jwt-leeway"       comment:"allowed clock skew for JWT exp and nbf claims"`
+	Realm          string        `toml:"realm"            json:"realm"            comment:"realm for WWW-Authenticate header"`
+	ExemptPaths    []string      `toml:"exempt-paths"     json:"exempt-paths"     comment:"paths, served without authentication"`
+}
+
+// Enabled returns true if any authentication method is configured
+func (a *Auth) Enabled() bool {
+	return a.HtpasswdFile != "" || a.JWTKeyFile != "" || a.ClientCertUser
+}
+
+// TagsSearch config
+type TagsSearch struct {
+	MinLength       int           `toml:"min-length"       json:"min-length"       comment:"minimum length of tagContains/valueContains string"`
+	Days            int           `toml:"days"             json:"days"             comment:"how long the daemon will query tags during substring/fuzzy autocomplete (tagged-autocomplete-days by default)"`
+	Timeout         time.Duration `toml:"timeout"          json:"timeout"          comment:"total timeout for substring/fuzzy autocomplete queries (index-timeout by default)"`
+	MaxRowsToRead   int64         `toml:"max-rows-to-read" json:"max-rows-to-read" comment:"clickhouse max_rows_to_read setting for substring/fuzzy autocomplete queries (0 - unlimited)"`
+	FuzzyThreshold  float64       `toml:"fuzzy-threshold"  json:"fuzzy-threshold"  comment:"minimum ngramSearch score (from 0 to 1) for fuzzy autocomplete"`
+	FuzzyCandidates int           `toml:"fuzzy-candidates" json:"fuzzy-candidates" comment:"max candidates fetched for ranking by edit distance in fuzzy autocomplete"`
+}
+
 // ClickHouse config
 type ClickHouse struct {
 	URL         string        `toml:"url"                      json:"url"                      comment:"default url, see https://clickhouse.tech/docs/en/interfaces/http. Can be overwritten with query-params"`
@@ -215,16 +397,16 @@ type ClickHouse struct {
 
 	RenderMaxQueries        int `toml:"render-max-queries" json:"render-max-queries" comment:"Max queries to render queiries"`
 	RenderConcurrentQueries int `toml:"render-concurrent-queries" json:"render-concurrent-queries" comment:"Concurrent queries to render queiries"`
-	RenderAdaptiveQueries   int `toml:"render-adaptive-queries" json:"render-adaptive-queries" comment:"Render adaptive queries (based on load average) for increase/decrease concurrent queries"`
+	RenderAdaptiveQueries   int `toml:"render-adaptive-queries" json:"render-adaptive-queries" comment:"Render adaptive queries (based on load average or clickhouse latency, see adaptive-limiter) for increase/decrease concurrent queries"`
 
 	FindMaxQueries        int                   `toml:"find-max-queries" json:"find-max-queries" comment:"Max queries for find queries"`
 	FindConcurrentQueries int                   `toml:"find-concurrent-queries" json:"find-concurrent-queries" comment:"Find concurrent queries for find queries"`
-	FindAdaptiveQueries   int                   `toml:"find-adaptive-queries" json:"find-adaptive-queries" comment:"Find adaptive queries (based on load average) for increase/decrease concurrent queries"`
+	FindAdaptiveQueries   int                   `toml:"find-adaptive-queries" json:"find-adaptive-queries" comment:"Find adaptive queries (based on load average or clickhouse latency, see adaptive-limiter) for increase/decrease concurrent queries"`
 	FindLimiter           limiter.ServerLimiter `toml:"-"                        json:"-"`
 
 	TagsMaxQueries        int                   `toml:"tags-max-queries" json:"tags-max-queries" comment:"Max queries for tags queries"`
 	TagsConcurrentQueries int                   `toml:"tags-concurrent-queries" json:"tags-concurrent-queries" comment:"Concurrent queries for tags queries"`
-	TagsAdaptiveQueries   int                   `toml:"tags-adaptive-queries" json:"tags-adaptive-queries" comment:"Tags adaptive queries (based on load average) for increase/decrease concurrent queries"`
+	TagsAdaptiveQueries   int                   `toml:"tags-adaptive-queries" json:"tags-adaptive-queries" comment:"Tags adaptive queries (based on load average or clickhouse latency, see adaptive-limiter) for increase/decrease concurrent queries"`
 	TagsLimiter           limiter.ServerLimiter `toml:"-"                        json:"-"`
 
 	WildcardMinDistance   int  `toml:"wildcard-min-distance" json:"wildcard-min-distance" comment:"If a wildcard appears both at the start and the end of a plain query at a distance (in terms of nodes) less than wildcard-min-distance, then it will be discarded. This parameter can be used to discard expensive queries."`
@@ -233,6 +415,8 @@ type ClickHouse struct {
 	TagsMinInQuery        int  `toml:"tags-min-in-query" json:"tags-min-in-query" comment:"Minimum tags in seriesByTag query"`
 	TagsMinInAutocomplete int  `toml:"tags-min-in-autocomplete" json:"tags-min-in-autocomplete" comment:"Minimum tags in autocomplete query"`
 
+	AutocompleteCountsMaxRows int64 `toml:"autocomplete-counts-max-rows" json:"autocomplete-counts-max-rows" comment:"clickhouse max_rows_to_read setting for plain autocomplete with counts (0 - unlimited)"`
+
 	UserLimits           map[string]UserLimits `toml:"user-limits"              json:"user-limits"              comment:"customized query limiter for some users"                                                                                        commented:"true"`
 	DateFormat           string                `toml:"date-format"              json:"date-format"              comment:"Date format (default, utc, both)"`
 	IndexTable           string                `toml:"index-table"              json:"index-table"              comment:"see doc/index-table.md"`
@@ -261,6 +445,14 @@ type ClickHouse struct {
 	// InternalAggregation controls if ClickHouse itself or graphite-clickhouse aggregates points to proper retention
 	InternalAggregation bool `toml:"internal-aggregation"     json:"internal-aggregation"     comment:"ClickHouse-side aggregation, see doc/aggregation.md"`
 
+	IndexReplica IndexReplica `toml:"index-replica"            json:"index-replica"            comment:"in-memory index tree replica for find queries, see doc/config.md"`
+	IndexBloom   IndexBloom   `toml:"index-bloom"              json:"index-bloom"              comment:"bloom filter of known paths for queries without wildcards, see doc/config.md"`
+	TagsSearch   TagsSearch   `toml:"tags-search"              json:"tags-search"              comment:"cost controls for substring and fuzzy tags autocomplete, see doc/config.md"`
+
+	TagsCountSnapshot TagsCountSnapshot `toml:"tags-count-snapshot" json:"tags-count-snapshot" comment:"in-memory snapshot of tags-count-table, see doc/config.md"`
+
+	AdaptiveLimiter limiter.AdaptiveConfig `toml:"adaptive-limiter" json:"adaptive-limiter" comment:"adaptation of the concurrent queries for the limiters with adaptive-queries, see doc/config.md"`
+
 	TLSParams config.TLS  `toml:"tls"                      json:"tls"                      comment:"mTLS HTTPS configuration for connecting to clickhouse server"                                                                         commented:"true"`
 	TLSConfig *tls.Config `toml:"-"                        json:"-"`
 }
@@ -309,6 +501,8 @@ type Prometheus struct {
 	PageTitle                  string        `toml:"page-title"                    json:"page-title"`
 	LookbackDelta              time.Duration `toml:"lookback-delta"                json:"lookback-delta"`
 	RemoteReadConcurrencyLimit int           `toml:"remote-read-concurrency-limit" json:"remote-read-concurrency-limit" comment:"concurrently handled remote read requests"`
+	TLS                        config.TLS    `toml:"tls"                           json:"tls"                           comment:"TLS for prometheus listener, certificates are reloaded with common.tls-reload-interval" commented:"true"`
+	Tenant                     string        `toml:"tenant"                        json:"tenant"                        comment:"tenant served by the prometheus listener (empty - default tenant)"`
 }
 
 const (
@@ -358,16 +552,27 @@ type Debug struct {
 
 // Config is the daemon configuration
 type Config struct {
-	Common       Common             `toml:"common"        json:"common"`
-	FeatureFlags FeatureFlags       `toml:"feature-flags" json:"feature-flags"`
-	Metrics      metrics.Config     `toml:"metrics"       json:"metrics"`
-	ClickHouse   ClickHouse         `toml:"clickhouse"    json:"clickhouse"`
-	DataTable    []DataTable        `toml:"data-table"    json:"data-table" comment:"data tables, see doc/config.md for additional info"`
-	Tags         Tags               `toml:"tags"          json:"tags"       comment:"is not recommended to use, https://github.com/lomik/graphite-clickhouse/wiki/TagsRU" commented:"true"`
-	Carbonlink   Carbonlink         `toml:"carbonlink"    json:"carbonlink"`
-	Prometheus   Prometheus         `toml:"prometheus"    json:"prometheus"`
-	Debug        Debug              `toml:"debug"         json:"debug"      comment:"see doc/debugging.md"`
-	Logging      []zapwriter.Config `toml:"logging"       json:"logging"`
+	Common       Common                 `toml:"common"        json:"common"`
+	FeatureFlags FeatureFlags           `toml:"feature-flags" json:"feature-flags"`
+	Metrics      metrics.Config         `toml:"metrics"       json:"metrics"`
+	ClickHouse   ClickHouse             `toml:"clickhouse"    json:"clickhouse"`
+	DataTable    []DataTable            `toml:"data-table"    json:"data-table" comment:"data tables, see doc/config.md for additional info"`
+	Tags         Tags                   `toml:"tags"          json:"tags"       comment:"is not recommended to use, https://github.com/lomik/graphite-clickhouse/wiki/TagsRU" commented:"true"`
+	Carbonlink   Carbonlink             `toml:"carbonlink"    json:"carbonlink"`
+	Prometheus   Prometheus             `toml:"prometheus"    json:"prometheus"`
+	Auth         Auth                   `toml:"auth"          json:"auth"       comment:"authentication on the main listener, the authenticated user replaces X-Forwarded-User header"`
+	ACL          ACL                    `toml:"acl"           json:"acl"`
+	Tenants      Tenants                `toml:"tenants"       json:"tenants"    comment:"multi-tenant routing by request header or user, see doc/config.md"`
+	Tracing      tracing.Config         `toml:"tracing"       json:"tracing"    comment:"OpenTelemetry tracing, see doc/config.md"`
+	SlowQueryLog SlowQueryLog           `toml:"slow-query-log" json:"slow-query-log" comment:"slow requests and clickhouse queries log, see doc/config.md"`
+	QueryLog     QueryLog               `toml:"query-log"     json:"query-log"  comment:"requests log in clickhouse table for usage analytics, see doc/config.md"`
+	Priority     limiter.PriorityConfig `toml:"priority"      json:"priority"   comment:"priority classes of the requests, waiting for the limiters, see doc/config.md"`
+	Admission    Admission              `toml:"admission"     json:"admission"  comment:"cost-based admission of the render requests, see doc/config.md"`
+	Cluster      limiter.ClusterConfig  `toml:"cluster-limiter" json:"cluster-limiter" comment:"max-queries limits, shared by the instances, see doc/config.md"`
+	Debug        Debug                  `toml:"debug"         json:"debug"      comment:"see doc/debugging.md"`
+	Logging      []zapwriter.Config     `toml:"logging"       json:"logging"`
+
+	tenants *tenants // built from Tenants
 }
 
 // New returns *Config with default values
@@ -389,29 +594,58 @@ func New() *Config {
 				ShortTimeoutSec:   0,
 				FindTimeoutSec:    0,
 			},
-			DegragedMultiply: 4.0,
-			DegragedLoad:     1.0,
+			DegragedMultiply:  4.0,
+			DegragedLoad:      1.0,
+			LoadSignal:        load_avg.SignalLoadAvg,
+			LoadPressureScale: 20.0,
+			TLSReloadInterval: time.Minute,
 		},
 		ClickHouse: ClickHouse{
-			URL:                     "http://localhost:8123?cancel_http_readonly_queries_on_client_close=1",
-			DataTimeout:             time.Minute,
-			ProgressSendingInterval: 10 * time.Second,
-			IndexTable:              "graphite_index",
-			IndexUseDaily:           true,
-			TaggedUseDaily:          true,
-			IndexReverse:            "auto",
-			IndexReverses:           IndexReverses{},
-			IndexTimeout:            time.Minute,
-			TaggedTable:             "graphite_tagged",
-			TaggedAutocompleDays:    7,
-			ExtraPrefix:             "",
-			ConnectTimeout:          time.Second,
-			DataTableLegacy:         "",
-			RollupConfLegacy:        "auto",
-			MaxDataPoints:           1048576,
-			InternalAggregation:     true,
-			FindLimiter:             limiter.NoopLimiter{},
-			TagsLimiter:             limiter.NoopLimiter{},
+			URL:                       "http://localhost:8123?cancel_http_readonly_queries_on_client_close=1",
+			DataTimeout:               time.Minute,
+			ProgressSendingInterval:   10 * time.Second,
+			IndexTable:                "graphite_index",
+			IndexUseDaily:             true,
+			TaggedUseDaily:            true,
+			IndexReverse:              "auto",
+			IndexReverses:             IndexReverses{},
+			IndexTimeout:              time.Minute,
+			AutocompleteCountsMaxRows: 100000000,
+			TaggedTable:               "graphite_tagged",
+			TaggedAutocompleDays:      7,
+			ExtraPrefix:               "",
+			ConnectTimeout:            time.Second,
+			DataTableLegacy:           "",
+			RollupConfLegacy:          "auto",
+			MaxDataPoints:             1048576,
+			InternalAggregation:       true,
+			FindLimiter:               limiter.NoopLimiter{},
+			TagsLimiter:               limiter.NoopLimiter{},
+			IndexReplica: IndexReplica{
+				Interval:    10 * time.Minute,
+				LoadTimeout: 10 * time.Minute,
+			},
+			IndexBloom: IndexBloom{
+				Interval:          5 * time.Minute,
+				LoadTimeout:       10 * time.Minute,
+				FalsePositiveRate: 0.01,
+				MaxSize:           128 * 1024 * 1024,
+			},
+			TagsSearch: TagsSearch{
+				MinLength:       3,
+				FuzzyThreshold:  0.3,
+				FuzzyCandidates: 1000,
+			},
+			TagsCountSnapshot: TagsCountSnapshot{
+				Interval:    5 * time.Minute,
+				LoadTimeout: 5 * time.Minute,
+				Days:        1,
+			},
+			AdaptiveLimiter: limiter.AdaptiveConfig{
+				Mode:      limiter.AdaptiveLoadAvg,
+				Tolerance: 1.5,
+				Backoff:   0.9,
+			},
 		},
 		Tags: Tags{
 			Threads:     1,
@@ -431,6 +665,38 @@ func New() *Config {
 			LookbackDelta:              5 * time.Minute,
 			RemoteReadConcurrencyLimit: 10,
 		},
+		Auth: Auth{
+			JWTAlgorithm: "HS256",
+			JWTUserClaim: "sub",
+			JWTLeeway:    time.Minute,
+			Realm:        "graphite-clickhouse",
+			ExemptPaths:  []string{"/alive", "/health", "/metrics"},
+		},
+		ACL: ACL{
+			ReloadInterval: 10 * time.Second,
+		},
+		Tracing: tracing.Config{
+			Endpoint:    "http://localhost:4318/v1/traces",
+			SampleRatio: 1,
+			ServiceName: "graphite-clickhouse",
+			Timeout:     10 * time.Second,
+		},
+		Priority: limiter.PriorityConfig{
+			Mode: limiter.PriorityStrict,
+		},
+		Cluster: limiter.ClusterConfig{
+			Prefix:        "graphite-clickhouse:limiter:",
+			Lease:         time.Minute,
+			Timeout:       100 * time.Millisecond,
+			RetryInterval: 10 * time.Second,
+		},
+		QueryLog: QueryLog{
+			QueueSize:     10000,
+			BatchSize:     1000,
+			FlushInterval: 10 * time.Second,
+			Timeout:       30 * time.Second,
+			Compression:   clickhouse.ContentEncodingGzip,
+		},
 		Debug: Debug{
 			Directory:        "",
 			DirectoryPerm:    0755,
@@ -665,6 +931,130 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		return nil, nil, err
 	}
 
+	if cfg.ClickHouse.IndexReplica.Enabled {
+		if cfg.ClickHouse.IndexReplica.Interval <= 0 {
+			return nil, nil, fmt.Errorf("index-replica interval must be positive")
+		}
+
+		if cfg.ClickHouse.IndexReplica.MaxAge == 0 {
+			cfg.ClickHouse.IndexReplica.MaxAge = 3 * cfg.ClickHouse.IndexReplica.Interval
+		}
+
+		if cfg.ClickHouse.IndexReplica.Days < 0 || cfg.ClickHouse.IndexReplica.MaxNodes < 0 {
+			return nil, nil, fmt.Errorf("index-replica days and max-nodes can't be negative")
+		}
+
+		if cfg.ClickHouse.IndexReplica.Days > 0 && cfg.ClickHouse.IndexTable == "" {
+			return nil, nil, fmt.Errorf("index-replica days requires index-table")
+		}
+	}
+
+	if cfg.ClickHouse.IndexBloom.Enabled {
+		if cfg.ClickHouse.IndexTable == "" {
+			return nil, nil, fmt.Errorf("index-bloom requires index-table")
+		}
+
+		if cfg.ClickHouse.IndexBloom.Interval <= 0 {
+			return nil, nil, fmt.Errorf("index-bloom interval must be positive")
+		}
+
+		if cfg.ClickHouse.IndexBloom.FalsePositiveRate <= 0 || cfg.ClickHouse.IndexBloom.FalsePositiveRate >= 1 {
+			return nil, nil, fmt.Errorf("index-bloom false-positive-rate must be between 0 and 1")
+		}
+
+		if cfg.ClickHouse.IndexBloom.MaxAge == 0 {
+			cfg.ClickHouse.IndexBloom.MaxAge = 3 * cfg.ClickHouse.IndexBloom.Interval
+		}
+	}
+
+	if cfg.ClickHouse.TagsCountSnapshot.Enabled {
+		if cfg.ClickHouse.TagsCountTable == "" {
+			return nil, nil, fmt.Errorf("tags-count-snapshot requires tags-count-table")
+		}
+
+		if cfg.ClickHouse.TagsCountSnapshot.Interval <= 0 {
+			return nil, nil, fmt.Errorf("tags-count-snapshot interval must be positive")
+		}
+
+		if cfg.ClickHouse.TagsCountSnapshot.Days < 0 {
+			return nil, nil, fmt.Errorf("tags-count-snapshot days can't be negative")
+		}
+
+		if cfg.ClickHouse.TagsCountSnapshot.MaxAge == 0 {
+			cfg.ClickHouse.TagsCountSnapshot.MaxAge = 3 * cfg.ClickHouse.TagsCountSnapshot.Interval
+		}
+	}
+
+	if cfg.Auth.JWTKeyFile != "" {
+		switch cfg.Auth.JWTAlgorithm {
+		case "HS256", "RS256":
+		default:
+			return nil, nil, fmt.Errorf("unsupported auth jwt-algorithm %q, must be HS256 or RS256", cfg.Auth.JWTAlgorithm)
+		}
+
+		if cfg.Auth.JWTUserClaim == "" {
+			return nil, nil, fmt.Errorf("auth jwt-user-claim can't be empty")
+		}
+	}
+
+	if cfg.Auth.ClientCertUser && cfg.Common.TLS.ClientAuth != "VerifyClientCertIfGiven" && cfg.Common.TLS.ClientAuth != "RequireAndVerifyClientCert" {
+		return nil, nil, fmt.Errorf("auth client-cert-user requires common.tls client-auth VerifyClientCertIfGiven or RequireAndVerifyClientCert")
+	}
+
+	if cfg.ACL.File != "" && cfg.ACL.ReloadInterval <= 0 {
+		return nil, nil, fmt.Errorf("acl reload-interval must be positive")
+	}
+
+	if err = cfg.Tracing.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	if err = cfg.SlowQueryLog.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("slow-query-log: %w", err)
+	}
+
+	if cfg.QueryLog.Enabled() {
+		if cfg.QueryLog.URL == "" {
+			cfg.QueryLog.URL = cfg.ClickHouse.URL
+		}
+
+		if cfg.QueryLog.QueueSize <= 0 || cfg.QueryLog.BatchSize <= 0 || cfg.QueryLog.FlushInterval <= 0 {
+			return nil, nil, fmt.Errorf("query-log queue-size, batch-size and flush-interval must be positive")
+		}
+
+		switch cfg.QueryLog.Compression {
+		case clickhouse.ContentEncodingNone, clickhouse.ContentEncodingGzip, clickhouse.ContentEncodingZstd:
+		default:
+			return nil, nil, fmt.Errorf("query-log unknown compression: %s", cfg.QueryLog.Compression)
+		}
+	}
+
+	if !load_avg.ValidSignal(cfg.Common.LoadSignal) {
+		return nil, nil, fmt.Errorf("common unknown load-signal: %s", cfg.Common.LoadSignal)
+	}
+
+	if cfg.Common.LoadPressureScale <= 0 {
+		return nil, nil, fmt.Errorf("common load-pressure-scale must be positive")
+	}
+
+	switch cfg.Admission.Mode {
+	case "", AdmissionPoints, AdmissionEstimate:
+	default:
+		return nil, nil, fmt.Errorf("admission unknown mode: %s", cfg.Admission.Mode)
+	}
+
+	if cfg.Admission.MaxCost < 0 || cfg.Admission.SlotCost < 0 {
+		return nil, nil, fmt.Errorf("admission max-cost and slot-cost can't be negative")
+	}
+
+	if cfg.ClickHouse.TagsSearch.FuzzyThreshold < 0 || cfg.ClickHouse.TagsSearch.FuzzyThreshold > 1 {
+		return nil, nil, fmt.Errorf("tags-search fuzzy-threshold must be between 0 and 1")
+	}
+
+	if cfg.ClickHouse.TagsSearch.FuzzyCandidates <= 0 {
+		return nil, nil, fmt.Errorf("tags-search fuzzy-candidates must be positive")
+	}
+
 	if cfg.Common.FindCache, err = CreateCache("index", &cfg.Common.FindCacheConfig); err == nil {
 		if cfg.Common.FindCacheConfig.Type != "null" {
 			warns = append(warns, zap.Any("enable find cache", zap.String("type", cfg.Common.FindCacheConfig.Type)))
@@ -746,18 +1136,30 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 
 	metricsEnabled := cfg.setupGraphiteMetrics()
 
-	cfg.ClickHouse.FindLimiter = limiter.NewALimiter(
+	if err = cfg.Priority.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("priority: %w", err)
+	}
+
+	if err = cfg.ClickHouse.AdaptiveLimiter.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("adaptive-limiter: %w", err)
+	}
+
+	if err = cfg.Cluster.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("cluster-limiter: %w", err)
+	}
+
+	cfg.ClickHouse.FindLimiter = cfg.newLimiter(
 		cfg.ClickHouse.FindMaxQueries, cfg.ClickHouse.FindConcurrentQueries, cfg.ClickHouse.FindAdaptiveQueries,
 		metricsEnabled, "find", "all",
 	)
 
-	cfg.ClickHouse.TagsLimiter = limiter.NewALimiter(
+	cfg.ClickHouse.TagsLimiter = cfg.newLimiter(
 		cfg.ClickHouse.TagsMaxQueries, cfg.ClickHouse.TagsConcurrentQueries, cfg.ClickHouse.TagsAdaptiveQueries,
 		metricsEnabled, "tags", "all",
 	)
 
 	for i := range cfg.ClickHouse.QueryParams {
-		cfg.ClickHouse.QueryParams[i].Limiter = limiter.NewALimiter(
+		cfg.ClickHouse.QueryParams[i].Limiter = cfg.newLimiter(
 			cfg.ClickHouse.QueryParams[i].MaxQueries, cfg.ClickHouse.QueryParams[i].ConcurrentQueries,
 			cfg.ClickHouse.QueryParams[i].AdaptiveQueries,
 			metricsEnabled, "render", duration.String(cfg.ClickHouse.QueryParams[i].Duration),
@@ -765,15 +1167,65 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 	}
 
 	for u, q := range cfg.ClickHouse.UserLimits {
-		q.Limiter = limiter.NewALimiter(
-			q.MaxQueries, q.ConcurrentQueries, q.AdaptiveQueries, metricsEnabled, u, "all",
-		)
+		if q.RequestsPerSecond < 0 || q.RequestsBurst < 0 || q.ReadRowsQuota < 0 || q.ReadBytesQuota < 0 || q.MaxCost < 0 {
+			return nil, nil, fmt.Errorf("user-limits %q: rate limits, quotas and max-cost can't be negative", u)
+		}
+
+		if (q.ReadRowsQuota > 0 || q.ReadBytesQuota > 0) && q.QuotaWindow <= 0 {
+			return nil, nil, fmt.Errorf("user-limits %q: quota-window must be positive", u)
+		}
+
+		q.Limiter = cfg.newLimiter(q.MaxQueries, q.ConcurrentQueries, q.AdaptiveQueries, metricsEnabled, u, "all")
+		q.Quota = limiter.NewUserQuota(q.RequestsPerSecond, q.RequestsBurst, q.ReadRowsQuota, q.ReadBytesQuota, q.QuotaWindow)
 		cfg.ClickHouse.UserLimits[u] = q
 	}
 
+	if err = cfg.setupTenants(metricsEnabled); err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Tenant(cfg.Prometheus.Tenant) == nil {
+		return nil, nil, fmt.Errorf("unknown prometheus tenant %q", cfg.Prometheus.Tenant)
+	}
+
 	return cfg, warns, nil
 }
 
+// newLimiter creates the local limiter, max-queries are shared by the instances after SetupCluster
+func (c *Config) newLimiter(maxQueries, concurrentQueries, adaptiveQueries int, metricsEnabled bool, scope, sub string) limiter.ServerLimiter {
+	return limiter.NewAdaptiveLimiter(&c.ClickHouse.AdaptiveLimiter, &c.Priority, maxQueries, concurrentQueries, adaptiveQueries, metricsEnabled, scope, sub)
+}
+
+// SetupCluster shares max-queries of the limiters (tenants and users limiters too) by the instances with cluster-limiter
+func (c *Config) SetupCluster(cl *limiter.Cluster) {
+	if cl == nil {
+		return
+	}
+
+	c.ClickHouse.FindLimiter = cl.Wrap(c.ClickHouse.FindLimiter, c.ClickHouse.FindMaxQueries, "find", "all")
+	c.ClickHouse.TagsLimiter = cl.Wrap(c.ClickHouse.TagsLimiter, c.ClickHouse.TagsMaxQueries, "tags", "all")
+
+	for i := range c.ClickHouse.QueryParams {
+		q := &c.ClickHouse.QueryParams[i]
+		q.Limiter = cl.Wrap(q.Limiter, q.MaxQueries, "render", duration.String(q.Duration))
+	}
+
+	for _, name := range c.TenantNames() {
+		t := c.Tenant(name)
+		t.ClickHouse.FindLimiter = cl.Wrap(t.ClickHouse.FindLimiter, t.ClickHouse.FindMaxQueries, "find", "tenant_"+name)
+		t.ClickHouse.TagsLimiter = cl.Wrap(t.ClickHouse.TagsLimiter, t.ClickHouse.TagsMaxQueries, "tags", "tenant_"+name)
+		t.ClickHouse.QueryParams[0].Limiter = cl.Wrap(
+			t.ClickHouse.QueryParams[0].Limiter, t.ClickHouse.QueryParams[0].MaxQueries, "render", "tenant_"+name,
+		)
+	}
+
+	// user limits are shared with the tenants
+	for u, q := range c.ClickHouse.UserLimits {
+		q.Limiter = cl.Wrap(q.Limiter, q.MaxQueries, u, "all")
+		c.ClickHouse.UserLimits[u] = q
+	}
+}
+
 // NeedLoadAvgColect check if load avg collect is neeeded
 func (c *Config) NeedLoadAvgColect() bool {
 	if c.Common.SD != "" {
@@ -800,6 +1252,10 @@ func (c *Config) NeedLoadAvgColect() bool {
 		return true
 	}
 
+	if c.ClickHouse.AdaptiveLimiter.Mode != limiter.AdaptiveLoadAvg {
+		return false
+	}
+
 	if c.ClickHouse.RenderAdaptiveQueries > 0 {
 		return true
 	}
@@ -957,7 +1413,9 @@ func CreateCache(cacheName string, cacheConfig *CacheConfig) (cache.BytesCache,
 }
 
 func (c *Config) setupGraphiteMetrics() bool {
-	if c.Metrics.MetricEndpoint == "" {
+	metrics.Prometheus = c.Metrics.Prometheus
+
+	if c.Metrics.MetricEndpoint == "" && !c.Metrics.Prometheus {
 		metrics.DisableMetrics()
 	} else {
 		if c.Metrics.MetricInterval == 0 {
@@ -967,7 +1425,9 @@ func (c *Config) setupGraphiteMetrics() bool {
 		if c.Metrics.MetricTimeout == 0 {
 			c.Metrics.MetricTimeout = time.Second
 		}
+	}
 
+	if c.Metrics.MetricEndpoint != "" {
 		hostname, _ := os.Hostname()
 		fqdn := strings.ReplaceAll(hostname, ".", "_")
 		hostname = strings.Split(hostname, ".")[0]
@@ -997,12 +1457,15 @@ func (c *Config) setupGraphiteMetrics() bool {
 				fmt.Fprintf(os.Stderr, "statsd init: %v\n", err)
 			}
 		}
+	}
 
+	if metrics.Enabled() {
 		metrics.InitMetrics(&c.Metrics, c.ClickHouse.FindMaxQueries > 0, c.ClickHouse.TagsMaxQueries > 0)
 	}
 
 	metrics.AutocompleteQMetric = metrics.InitQueryMetrics("tags", &c.Metrics)
 	metrics.FindQMetric = metrics.InitQueryMetrics("find", &c.Metrics)
+	metrics.PlainAutocompleteQMetric = metrics.InitQueryMetrics("autocomplete", &c.Metrics)
 
 	for i := 0; i < len(c.DataTable); i++ {
 		c.DataTable[i].QueryMetrics = metrics.InitQueryMetrics(c.DataTable[i].Table, &c.Metrics)
@@ -1020,7 +1483,7 @@ func (c *Config) setupGraphiteMetrics() bool {
 		metrics.InitQueryMetrics(c.ClickHouse.TagsCountTable, &c.Metrics)
 	}
 
-	return metrics.Graphite != nil
+	return metrics.Enabled()
 }
 
 func (c *Config) GetUserFindLimiter(username string) limiter.ServerLimiter {
@@ -1033,6 +1496,27 @@ func (c *Config) GetUserFindLimiter(username string) limiter.ServerLimiter {
 	return c.ClickHouse.FindLimiter
 }
 
+// GetPriority returns the priority class of the request for the limiters
+func (c *Config) GetPriority(r *http.Request) int {
+	var header string
+	if c.Priority.Header != "" {
+		header = r.Header.Get(c.Priority.Header)
+	}
+
+	return c.Priority.Classify(header, r.Header.Get("X-Forwarded-User"), r.Header.Get("X-Grafana-Org-Id"), r.Header.Get("X-Dashboard-Id"))
+}
+
+// GetUserQuota returns the requests rate and read quotas of the user, nil if the user has no limits
+func (c *Config) GetUserQuota(username string) *limiter.UserQuota {
+	if username != "" && len(c.ClickHouse.UserLimits) > 0 {
+		if q, ok := c.ClickHouse.UserLimits[username]; ok {
+			return q.Quota
+		}
+	}
+
+	return nil
+}
+
 func (c *Config) GetUserTagsLimiter(username string) limiter.ServerLimiter {
 	if username != "" && len(c.ClickHouse.UserLimits) > 0 {
 		if q, ok := c.ClickHouse.UserLimits[username]; ok {
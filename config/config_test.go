@@ -17,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/load_avg"
 	"github.com/lomik/graphite-clickhouse/metrics"
 )
 
@@ -346,8 +347,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
-		DegragedMultiply: 4.0,
-		DegragedLoad:     1.0,
+		DegragedMultiply:  4.0,
+		DegragedLoad:      1.0,
+		LoadSignal:        load_avg.SignalLoadAvg,
+		LoadPressureScale: 20.0,
+		TLSReloadInterval: time.Minute,
 	}
 	expected.Metrics = metrics.Config{}
 
@@ -368,27 +372,53 @@ sample-thereafter = 12
 				Limiter:     limiter.NoopLimiter{},
 			},
 		},
-		ProgressSendingInterval: 10 * time.Second,
-		FindLimiter:             limiter.NoopLimiter{},
-		TagsLimiter:             limiter.NoopLimiter{},
-		IndexTable:              "graphite_index",
-		IndexReverse:            "direct",
-		IndexReverses:           make(IndexReverses, 2),
-		IndexTimeout:            4000000000,
-		TaggedTable:             "graphite_tags",
-		TaggedAutocompleDays:    5,
-		TreeTable:               "tree",
-		ReverseTreeTable:        "reversed_tree",
-		DateTreeTable:           "data_tree",
-		DateTreeTableVersion:    2,
-		TreeTimeout:             5000000000,
-		TagTable:                "tag_table",
-		ExtraPrefix:             "tum.pu-dum",
-		ConnectTimeout:          2000000000,
-		DataTableLegacy:         "data",
-		RollupConfLegacy:        "none",
-		MaxDataPoints:           8000,
-		InternalAggregation:     true,
+		ProgressSendingInterval:   10 * time.Second,
+		FindLimiter:               limiter.NoopLimiter{},
+		TagsLimiter:               limiter.NoopLimiter{},
+		IndexTable:                "graphite_index",
+		IndexReverse:              "direct",
+		IndexReverses:             make(IndexReverses, 2),
+		IndexTimeout:              4000000000,
+		AutocompleteCountsMaxRows: 100000000,
+		TaggedTable:               "graphite_tags",
+		TaggedAutocompleDays:      5,
+		TreeTable:                 "tree",
+		ReverseTreeTable:          "reversed_tree",
+		DateTreeTable:             "data_tree",
+		DateTreeTableVersion:      2,
+		TreeTimeout:               5000000000,
+		TagTable:                  "tag_table",
+		ExtraPrefix:               "tum.pu-dum",
+		ConnectTimeout:            2000000000,
+		DataTableLegacy:           "data",
+		RollupConfLegacy:          "none",
+		MaxDataPoints:             8000,
+		InternalAggregation:       true,
+		IndexReplica: IndexReplica{
+			Interval:    10 * time.Minute,
+			LoadTimeout: 10 * time.Minute,
+		},
+		IndexBloom: IndexBloom{
+			Interval:          5 * time.Minute,
+			LoadTimeout:       10 * time.Minute,
+			FalsePositiveRate: 0.01,
+			MaxSize:           128 * 1024 * 1024,
+		},
+		TagsSearch: TagsSearch{
+			MinLength:       3,
+			FuzzyThreshold:  0.3,
+			FuzzyCandidates: 1000,
+		},
+		TagsCountSnapshot: TagsCountSnapshot{
+			Interval:    5 * time.Minute,
+			LoadTimeout: 5 * time.Minute,
+			Days:        1,
+		},
+		AdaptiveLimiter: limiter.AdaptiveConfig{
+			Mode:      limiter.AdaptiveLoadAvg,
+			Tolerance: 1.5,
+			Backoff:   0.9,
+		},
 	}
 	expected.ClickHouse.IndexReverses[0] = &IndexReverseRule{"suf", "pref", "", nil, "direct"}
 	r, _ = regexp.Compile("^reg$")
@@ -586,8 +616,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
-		DegragedMultiply: 4.0,
-		DegragedLoad:     1.0,
+		DegragedMultiply:  4.0,
+		DegragedLoad:      1.0,
+		LoadSignal:        load_avg.SignalLoadAvg,
+		LoadPressureScale: 20.0,
+		TLSReloadInterval: time.Minute,
 	}
 	expected.Metrics = metrics.Config{
 		MetricEndpoint: "127.0.0.1:2003",
@@ -661,24 +694,50 @@ sample-thereafter = 12
 				ConcurrentQueries: 10,
 			},
 		},
-		IndexTable:           "graphite_index",
-		IndexReverse:         "direct",
-		IndexReverses:        make(IndexReverses, 2),
-		IndexTimeout:         4000000000,
-		TaggedTable:          "graphite_tags",
-		TaggedAutocompleDays: 5,
-		TreeTable:            "tree",
-		ReverseTreeTable:     "reversed_tree",
-		DateTreeTable:        "data_tree",
-		DateTreeTableVersion: 2,
-		TreeTimeout:          5000000000,
-		TagTable:             "tag_table",
-		ExtraPrefix:          "tum.pu-dum",
-		ConnectTimeout:       2000000000,
-		DataTableLegacy:      "data",
-		RollupConfLegacy:     "none",
-		MaxDataPoints:        8000,
-		InternalAggregation:  true,
+		IndexTable:                "graphite_index",
+		IndexReverse:              "direct",
+		IndexReverses:             make(IndexReverses, 2),
+		IndexTimeout:              4000000000,
+		AutocompleteCountsMaxRows: 100000000,
+		TaggedTable:               "graphite_tags",
+		TaggedAutocompleDays:      5,
+		TreeTable:                 "tree",
+		ReverseTreeTable:          "reversed_tree",
+		DateTreeTable:             "data_tree",
+		DateTreeTableVersion:      2,
+		TreeTimeout:               5000000000,
+		TagTable:                  "tag_table",
+		ExtraPrefix:               "tum.pu-dum",
+		ConnectTimeout:            2000000000,
+		DataTableLegacy:           "data",
+		RollupConfLegacy:          "none",
+		MaxDataPoints:             8000,
+		InternalAggregation:       true,
+		IndexReplica: IndexReplica{
+			Interval:    10 * time.Minute,
+			LoadTimeout: 10 * time.Minute,
+		},
+		IndexBloom: IndexBloom{
+			Interval:          5 * time.Minute,
+			LoadTimeout:       10 * time.Minute,
+			FalsePositiveRate: 0.01,
+			MaxSize:           128 * 1024 * 1024,
+		},
+		TagsSearch: TagsSearch{
+			MinLength:       3,
+			FuzzyThreshold:  0.3,
+			FuzzyCandidates: 1000,
+		},
+		TagsCountSnapshot: TagsCountSnapshot{
+			Interval:    5 * time.Minute,
+			LoadTimeout: 5 * time.Minute,
+			Days:        1,
+		},
+		AdaptiveLimiter: limiter.AdaptiveConfig{
+			Mode:      limiter.AdaptiveLoadAvg,
+			Tolerance: 1.5,
+			Backoff:   0.9,
+		},
 	}
 	expected.ClickHouse.IndexReverses[0] = &IndexReverseRule{"suf", "pref", "", nil, "direct"}
 	r, _ = regexp.Compile("^reg$")
@@ -908,8 +967,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
-		DegragedMultiply: 4.0,
-		DegragedLoad:     1.0,
+		DegragedMultiply:  4.0,
+		DegragedLoad:      1.0,
+		LoadSignal:        load_avg.SignalLoadAvg,
+		LoadPressureScale: 20.0,
+		TLSReloadInterval: time.Minute,
 	}
 	expected.Metrics = metrics.Config{
 		MetricEndpoint: "127.0.0.1:2003",
@@ -988,24 +1050,50 @@ sample-thereafter = 12
 				AdaptiveQueries:   5,
 			},
 		},
-		IndexTable:           "graphite_index",
-		IndexReverse:         "direct",
-		IndexReverses:        make(IndexReverses, 2),
-		IndexTimeout:         4000000000,
-		TaggedTable:          "graphite_tags",
-		TaggedAutocompleDays: 5,
-		TreeTable:            "tree",
-		ReverseTreeTable:     "reversed_tree",
-		DateTreeTable:        "data_tree",
-		DateTreeTableVersion: 2,
-		TreeTimeout:          5000000000,
-		TagTable:             "tag_table",
-		ExtraPrefix:          "tum.pu-dum",
-		ConnectTimeout:       2000000000,
-		DataTableLegacy:      "data",
-		RollupConfLegacy:     "none",
-		MaxDataPoints:        8000,
-		InternalAggregation:  true,
+		IndexTable:                "graphite_index",
+		IndexReverse:              "direct",
+		IndexReverses:             make(IndexReverses, 2),
+		IndexTimeout:              4000000000,
+		AutocompleteCountsMaxRows: 100000000,
+		TaggedTable:               "graphite_tags",
+		TaggedAutocompleDays:      5,
+		TreeTable:                 "tree",
+		ReverseTreeTable:          "reversed_tree",
+		DateTreeTable:             "data_tree",
+		DateTreeTableVersion:      2,
+		TreeTimeout:               5000000000,
+		TagTable:                  "tag_table",
+		ExtraPrefix:               "tum.pu-dum",
+		ConnectTimeout:            2000000000,
+		DataTableLegacy:           "data",
+		RollupConfLegacy:          "none",
+		MaxDataPoints:             8000,
+		InternalAggregation:       true,
+		IndexReplica: IndexReplica{
+			Interval:    10 * time.Minute,
+			LoadTimeout: 10 * time.Minute,
+		},
+		IndexBloom: IndexBloom{
+			Interval:          5 * time.Minute,
+			LoadTimeout:       10 * time.Minute,
+			FalsePositiveRate: 0.01,
+			MaxSize:           128 * 1024 * 1024,
+		},
+		TagsSearch: TagsSearch{
+			MinLength:       3,
+			FuzzyThreshold:  0.3,
+			FuzzyCandidates: 1000,
+		},
+		TagsCountSnapshot: TagsCountSnapshot{
+			Interval:    5 * time.Minute,
+			LoadTimeout: 5 * time.Minute,
+			Days:        1,
+		},
+		AdaptiveLimiter: limiter.AdaptiveConfig{
+			Mode:      limiter.AdaptiveLoadAvg,
+			Tolerance: 1.5,
+			Backoff:   0.9,
+		},
 	}
 	expected.ClickHouse.IndexReverses[0] = &IndexReverseRule{"suf", "pref", "", nil, "direct"}
 	r, _ = regexp.Compile("^reg$")
@@ -1327,3 +1415,238 @@ func TestClickHouse_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestSlowQueryLogThresholds(t *testing.T) {
+	body := []byte(`
+[slow-query-log]
+threshold = "5s"
+
+[slow-query-log.endpoints]
+render = "10s"
+find = "0s"
+
+[slow-query-log.tables]
+"graphite.data" = "2s"
+`)
+
+	config, _, err := Unmarshal(body, false)
+	require.NoError(t, err)
+
+	c := config.SlowQueryLog
+	assert.True(t, c.Enabled())
+	assert.Equal(t, 10*time.Second, c.EndpointThreshold("render"))
+	assert.Equal(t, time.Duration(0), c.EndpointThreshold("find"))
+	assert.Equal(t, 5*time.Second, c.EndpointThreshold("tags"))
+	assert.Equal(t, 2*time.Second, c.TableThreshold("graphite.data"))
+	assert.Equal(t, 5*time.Second, c.TableThreshold("graphite.index"))
+
+	assert.False(t, (&SlowQueryLog{}).Enabled())
+	assert.True(t, (&SlowQueryLog{Tables: map[string]time.Duration{"graphite.data": time.Second}}).Enabled())
+
+	for _, body := range []string{
+		"[slow-query-log]\nthreshold = \"-1s\"\n",
+		"[slow-query-log.endpoints]\nrender = \"-1s\"\n",
+		"[slow-query-log.tables]\n\"graphite.data\" = \"-1s\"\n",
+	} {
+		_, _, err := Unmarshal([]byte(body), false)
+		assert.Error(t, err, body)
+	}
+}
+
+func TestQueryLogConfig(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[clickhouse]
+url = "http://localhost:8123/?max_threads=2"
+
+[query-log]
+table = "graphite_query_log"
+`), false)
+	require.NoError(t, err)
+	assert.True(t, config.QueryLog.Enabled())
+	assert.Equal(t, "http://localhost:8123/?max_threads=2", config.QueryLog.URL)
+	assert.Equal(t, 1000, config.QueryLog.BatchSize)
+
+	_, _, err = Unmarshal([]byte(`
+[query-log]
+table = "graphite_query_log"
+compression = "lz4"
+`), false)
+	assert.EqualError(t, err, "query-log unknown compression: lz4")
+}
+
+func TestUserQuotaConfig(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[clickhouse.user-limits.robot]
+requests-per-second = 5.0
+read-rows-quota = 1000000
+quota-window = "1h"
+
+[clickhouse.user-limits.alerting]
+max-queries = 10
+`), false)
+	require.NoError(t, err)
+	assert.NotNil(t, config.GetUserQuota("robot"))
+	assert.Nil(t, config.GetUserQuota("alerting"))
+	assert.Nil(t, config.GetUserQuota("unknown"))
+
+	_, _, err = Unmarshal([]byte(`
+[clickhouse.user-limits.robot]
+read-rows-quota = 1000000
+`), false)
+	assert.EqualError(t, err, `user-limits "robot": quota-window must be positive`)
+}
+
+func TestAdaptiveLimiterConfig(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[clickhouse]
+render-concurrent-queries = 10
+render-adaptive-queries = 5
+
+[clickhouse.adaptive-limiter]
+mode = "latency"
+`), false)
+	require.NoError(t, err)
+	assert.IsType(t, &limiter.LLimiter{}, config.ClickHouse.QueryParams[0].Limiter)
+	assert.False(t, config.NeedLoadAvgColect())
+
+	_, _, err = Unmarshal([]byte(`
+[clickhouse.adaptive-limiter]
+mode = "latency"
+backoff = 1.5
+`), false)
+	assert.EqualError(t, err, "adaptive-limiter: backoff must be in (0, 1)")
+}
+
+func TestAdmissionConfig(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[admission]
+mode = "points"
+max-cost = 100000000
+slot-cost = 1000000
+
+[clickhouse.user-limits.robot]
+max-cost = 1000000
+`), false)
+	require.NoError(t, err)
+	assert.True(t, config.Admission.Enabled())
+	assert.Equal(t, int64(1000000), config.ClickHouse.UserLimits["robot"].MaxCost)
+
+	_, _, err = Unmarshal([]byte(`
+[admission]
+mode = "rows"
+`), false)
+	assert.EqualError(t, err, "admission unknown mode: rows")
+
+	_, _, err = Unmarshal([]byte(`
+[clickhouse.user-limits.robot]
+max-cost = -1
+`), false)
+	assert.EqualError(t, err, `user-limits "robot": rate limits, quotas and max-cost can't be negative`)
+}
+
+func TestClusterLimiterConfig(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[cluster-limiter]
+redis = "127.0.0.1:6379"
+lease = "30s"
+
+[clickhouse]
+find-max-queries = 10
+find-concurrent-queries = 5
+
+[clickhouse.user-limits.robot]
+max-queries = 4
+
+[tenants.tenant.a]
+index-table = "graphite_index_a"
+`), false)
+	require.NoError(t, err)
+	assert.Equal(t, limiter.ClusterConfig{
+		Redis:         "127.0.0.1:6379",
+		Prefix:        "graphite-clickhouse:limiter:",
+		Lease:         30 * time.Second,
+		Timeout:       100 * time.Millisecond,
+		RetryInterval: 10 * time.Second,
+	}, config.Cluster)
+
+	// the limiters are local till the cluster is set up
+	assert.IsType(t, &limiter.WLimiter{}, config.ClickHouse.FindLimiter)
+	assert.IsType(t, &limiter.Limiter{}, config.ClickHouse.UserLimits["robot"].Limiter)
+
+	cluster := limiter.NewCluster(&config.Cluster)
+	defer cluster.Close()
+
+	config.SetupCluster(cluster)
+	assert.IsType(t, &limiter.CLimiter{}, config.ClickHouse.FindLimiter)
+	assert.IsType(t, &limiter.CLimiter{}, config.ClickHouse.UserLimits["robot"].Limiter)
+	assert.IsType(t, limiter.NoopLimiter{}, config.ClickHouse.TagsLimiter)
+	assert.IsType(t, &limiter.CLimiter{}, config.Tenant("a").ClickHouse.FindLimiter)
+	assert.IsType(t, &limiter.CLimiter{}, config.Tenant("a").ClickHouse.UserLimits["robot"].Limiter)
+
+	// max-queries are local without redis
+	config, _, err = Unmarshal([]byte(`
+[clickhouse]
+find-max-queries = 10
+`), false)
+	require.NoError(t, err)
+	config.SetupCluster(limiter.NewCluster(&config.Cluster))
+	assert.IsType(t, &limiter.Limiter{}, config.ClickHouse.FindLimiter)
+
+	_, _, err = Unmarshal([]byte(`
+[cluster-limiter]
+redis = "127.0.0.1:6379"
+timeout = "0s"
+`), false)
+	assert.EqualError(t, err, "cluster-limiter: lease and timeout must be positive")
+}
+
+func TestLoadSignalConfig(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[common]
+load-signal = "pressure"
+load-pressure-scale = 10.0
+`), false)
+	require.NoError(t, err)
+	assert.Equal(t, load_avg.SignalPressure, config.Common.LoadSignal)
+	assert.Equal(t, 10.0, config.Common.LoadPressureScale)
+
+	_, _, err = Unmarshal([]byte(`
+[common]
+load-signal = "io-pressure"
+`), false)
+	assert.EqualError(t, err, "common unknown load-signal: io-pressure")
+
+	_, _, err = Unmarshal([]byte(`
+[common]
+load-pressure-scale = 0.0
+`), false)
+	assert.EqualError(t, err, "common load-pressure-scale must be positive")
+}
+
+func TestIndexReplicaValidate(t *testing.T) {
+	_, _, err := Unmarshal([]byte(`
+[clickhouse.index-replica]
+enabled = true
+days = 2
+max-nodes = 1000
+`), false)
+	require.NoError(t, err)
+
+	_, _, err = Unmarshal([]byte(`
+[clickhouse.index-replica]
+enabled = true
+max-nodes = -1
+`), false)
+	assert.EqualError(t, err, "index-replica days and max-nodes can't be negative")
+
+	_, _, err = Unmarshal([]byte(`
+[clickhouse]
+index-table = ""
+tree-table = "graphite_tree"
+
+[clickhouse.index-replica]
+enabled = true
+days = 2
+`), false)
+	assert.EqualError(t, err, "index-replica days requires index-table")
+}
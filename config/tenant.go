@@ -0,0 +1,253 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/lomik/graphite-clickhouse/cache"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// Tenants config
+type Tenants struct {
+	Header string            `toml:"header" json:"header" comment:"request header with the tenant name (empty - tenant is selected only by the user)"`
+	Tenant map[string]Tenant `toml:"tenant" json:"tenant" comment:"tenants with own clickhouse tables and limiters, see doc/config.md"                    commented:"true"`
+}
+
+// Tenant config, overrides [clickhouse] and [[data-table]] for the requests routed to the tenant
+type Tenant struct {
+	Users                   []string    `toml:"users"                     json:"users"                     comment:"authenticated users (X-Forwarded-User), routed to the tenant"`
+	HeaderUsers             []string    `toml:"header-users"              json:"header-users"              comment:"authenticated users allowed to select the tenant by the tenants.header (empty - the header is rejected)"`
+	URL                     string      `toml:"url"                       json:"url"                       comment:"clickhouse url (empty - clickhouse.url)"`
+	IndexTable              string      `toml:"index-table"               json:"index-table"`
+	TaggedTable             string      `toml:"tagged-table"              json:"tagged-table"`
+	TagsCountTable          string      `toml:"tags-count-table"          json:"tags-count-table"`
+	ExtraPrefix             string      `toml:"extra-prefix"              json:"extra-prefix"`
+	FindMaxQueries          int         `toml:"find-max-queries"          json:"find-max-queries"`
+	FindConcurrentQueries   int         `toml:"find-concurrent-queries"   json:"find-concurrent-queries"`
+	TagsMaxQueries          int         `toml:"tags-max-queries"          json:"tags-max-queries"`
+	TagsConcurrentQueries   int         `toml:"tags-concurrent-queries"   json:"tags-concurrent-queries"`
+	RenderMaxQueries        int         `toml:"render-max-queries"        json:"render-max-queries"`
+	RenderConcurrentQueries int         `toml:"render-concurrent-queries" json:"render-concurrent-queries"`
+	DataTable               []DataTable `toml:"data-table"                json:"data-table"`
+}
+
+// tenants holds the configs of the tenants, shared by the root and tenant configs
+type tenants struct {
+	configs map[string]*Config
+	users   map[string]string          // user -> tenant
+	header  map[string]map[string]bool // tenant -> users allowed to select it by the header
+}
+
+// Tenant returns the config of the tenant. Empty name is the default tenant, nil is returned for unknown tenant
+func (c *Config) Tenant(name string) *Config {
+	if c.tenants == nil {
+		if name == "" {
+			return c
+		}
+
+		return nil
+	}
+
+	return c.tenants.configs[name]
+}
+
+// ResolveTenant returns the tenant name for the authenticated user or the header value.
+// The user has precedence, the header is honoured only for the authenticated users from the tenant header-users
+func (c *Config) ResolveTenant(user, header string) (string, error) {
+	if c.tenants == nil {
+		return "", nil
+	}
+
+	if name, ok := c.tenants.users[user]; ok {
+		return name, nil
+	}
+
+	if header == "" {
+		return "", nil
+	}
+
+	if _, ok := c.tenants.configs[header]; !ok {
+		return "", errs.NewErrorfWithCode(http.StatusBadRequest, "unknown tenant %q", header)
+	}
+
+	if user == "" || !c.tenants.header[header][user] {
+		return "", errs.NewErrorfWithCode(http.StatusForbidden, "user %q isn't allowed to select tenant %q", user, header)
+	}
+
+	return header, nil
+}
+
+// TenantNames returns the sorted tenant names
+func (c *Config) TenantNames() []string {
+	if c.tenants == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(c.tenants.configs))
+
+	for name := range c.tenants.configs {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// ForContext returns the config of the tenant from the request context (see scope.WithTenant), c is returned if
+// the tenant isn't set
+func (c *Config) ForContext(ctx context.Context) *Config {
+	name := scope.Tenant(ctx)
+	if name == "" {
+		return c
+	}
+
+	if t := c.Tenant(name); t != nil {
+		return t
+	}
+
+	return c
+}
+
+// setupTenants builds the tenant configs from the root config: tables, data tables and limiters are replaced
+func (c *Config) setupTenants(metricsEnabled bool) error {
+	if len(c.Tenants.Tenant) == 0 {
+		return nil
+	}
+
+	t := &tenants{
+		configs: make(map[string]*Config, len(c.Tenants.Tenant)+1),
+		users:   make(map[string]string),
+		header:  make(map[string]map[string]bool),
+	}
+	c.tenants = t
+	t.configs[""] = c
+
+	for name, tenant := range c.Tenants.Tenant {
+		if name == "" {
+			return fmt.Errorf("tenant name can't be empty")
+		}
+
+		if tenant.IndexTable == "" {
+			return fmt.Errorf("tenant %s: index-table is required", name)
+		}
+
+		for i := range tenant.DataTable {
+			if tenant.DataTable[i].Table == "" {
+				return fmt.Errorf("tenant %s: data-table table can't be empty", name)
+			}
+		}
+
+		for _, user := range tenant.Users {
+			if other, ok := t.users[user]; ok {
+				return fmt.Errorf("tenant %s: user %s is already routed to tenant %s", name, user, other)
+			}
+
+			t.users[user] = name
+		}
+
+		t.header[name] = make(map[string]bool, len(tenant.HeaderUsers))
+		for _, user := range tenant.HeaderUsers {
+			t.header[name][user] = true
+		}
+
+		cfg, err := c.newTenantConfig(name, &tenant, metricsEnabled)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+
+		t.configs[name] = cfg
+	}
+
+	return nil
+}
+
+func (c *Config) newTenantConfig(name string, tenant *Tenant, metricsEnabled bool) (*Config, error) {
+	cfg := *c
+
+	if tenant.URL != "" {
+		if _, err := clickhouseURLValidate(tenant.URL); err != nil {
+			return nil, err
+		}
+
+		cfg.ClickHouse.URL = tenant.URL
+	}
+
+	cfg.ClickHouse.IndexTable = tenant.IndexTable
+	cfg.ClickHouse.TaggedTable = tenant.TaggedTable
+	cfg.ClickHouse.TagsCountTable = tenant.TagsCountTable
+	cfg.ClickHouse.ExtraPrefix = tenant.ExtraPrefix
+	cfg.ClickHouse.TreeTable = ""
+	cfg.ClickHouse.ReverseTreeTable = ""
+	cfg.ClickHouse.DateTreeTable = ""
+	cfg.ClickHouse.TagTable = ""
+	cfg.ClickHouse.DataTableLegacy = ""
+
+	// in-memory index replica, bloom filter and tags count snapshot are built for the default tenant tables
+	cfg.ClickHouse.IndexReplica.Enabled = false
+	cfg.ClickHouse.IndexBloom.Enabled = false
+	cfg.ClickHouse.TagsCountSnapshot.Enabled = false
+
+	// user limits are per user, so the limiters and quotas are shared with the default tenant
+
+	// the tenant without own limits has the limits of [clickhouse], but still own limiters
+	findMax, findConcurrent := tenantLimits(
+		tenant.FindMaxQueries, tenant.FindConcurrentQueries, c.ClickHouse.FindMaxQueries, c.ClickHouse.FindConcurrentQueries,
+	)
+	cfg.ClickHouse.FindMaxQueries, cfg.ClickHouse.FindConcurrentQueries = findMax, findConcurrent
+	cfg.ClickHouse.FindLimiter = cfg.newLimiter(findMax, findConcurrent, 0, metricsEnabled, "find", "tenant_"+name)
+
+	tagsMax, tagsConcurrent := tenantLimits(
+		tenant.TagsMaxQueries, tenant.TagsConcurrentQueries, c.ClickHouse.TagsMaxQueries, c.ClickHouse.TagsConcurrentQueries,
+	)
+	cfg.ClickHouse.TagsMaxQueries, cfg.ClickHouse.TagsConcurrentQueries = tagsMax, tagsConcurrent
+	cfg.ClickHouse.TagsLimiter = cfg.newLimiter(tagsMax, tagsConcurrent, 0, metricsEnabled, "tags", "tenant_"+name)
+
+	renderMax, renderConcurrent := tenantLimits(
+		tenant.RenderMaxQueries, tenant.RenderConcurrentQueries, c.ClickHouse.RenderMaxQueries, c.ClickHouse.RenderConcurrentQueries,
+	)
+	cfg.ClickHouse.QueryParams = []QueryParam{{
+		URL:               cfg.ClickHouse.URL,
+		DataTimeout:       cfg.ClickHouse.DataTimeout,
+		MaxQueries:        renderMax,
+		ConcurrentQueries: renderConcurrent,
+		Limiter:           cfg.newLimiter(renderMax, renderConcurrent, 0, metricsEnabled, "render", "tenant_"+name),
+	}}
+
+	cfg.DataTable = append([]DataTable(nil), tenant.DataTable...)
+	if err := cfg.ProcessDataTables(); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.DataTable {
+		cfg.DataTable[i].QueryMetrics = metrics.InitQueryMetrics(cfg.DataTable[i].Table, &cfg.Metrics)
+	}
+
+	for _, table := range []string{cfg.ClickHouse.IndexTable, cfg.ClickHouse.TaggedTable, cfg.ClickHouse.TagsCountTable} {
+		if table != "" {
+			metrics.InitQueryMetrics(table, &cfg.Metrics)
+		}
+	}
+
+	if c.Common.FindCache != nil {
+		cfg.Common.FindCache = cache.NewPrefixed("tenant;"+name+";", c.Common.FindCache)
+	}
+
+	return &cfg, nil
+}
+
+// tenantLimits returns the tenant limits or the global ones if the tenant has no limits
+func tenantLimits(maxQueries, concurrentQueries, globalMax, globalConcurrent int) (int, int) {
+	if maxQueries == 0 && concurrentQueries == 0 {
+		return globalMax, globalConcurrent
+	}
+
+	return maxQueries, concurrentQueries
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func TestTenants(t *testing.T) {
+	body := []byte(`
+[clickhouse]
+url = "http://localhost:8123/"
+index-table = "graphite_index"
+tagged-table = "graphite_tagged"
+render-max-queries = 100
+render-concurrent-queries = 10
+[clickhouse.user-limits.alice]
+max-queries = 1
+
+[[data-table]]
+table = "graphite_data"
+rollup-conf = "none"
+
+[tenants]
+header = "X-Gch-Tenant"
+
+[tenants.tenant.team-a]
+users = ["alice", "bob"]
+url = "http://team-a:8123/"
+index-table = "team_a_index"
+extra-prefix = "team-a"
+find-max-queries = 5
+find-concurrent-queries = 2
+render-max-queries = 20
+render-concurrent-queries = 4
+
+[[tenants.tenant.team-a.data-table]]
+table = "team_a_data"
+rollup-conf = "none"
+
+[tenants.tenant.team-b]
+header-users = ["grafana"]
+index-table = "team_b_index"
+tagged-table = "team_b_tagged"
+
+[prometheus]
+tenant = "team-b"
+`)
+
+	cfg, _, err := Unmarshal(body, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"team-a", "team-b"}, cfg.TenantNames())
+	assert.Same(t, cfg, cfg.Tenant(""))
+	assert.Nil(t, cfg.Tenant("team-c"))
+
+	a := cfg.Tenant("team-a")
+	require.NotNil(t, a)
+	assert.Equal(t, "http://team-a:8123/", a.ClickHouse.URL)
+	assert.Equal(t, "team_a_index", a.ClickHouse.IndexTable)
+	assert.Equal(t, "", a.ClickHouse.TaggedTable)
+	assert.Equal(t, "team-a", a.ClickHouse.ExtraPrefix)
+	assert.Equal(t, cfg.ClickHouse.UserLimits, a.ClickHouse.UserLimits)
+	assert.IsType(t, &limiter.WLimiter{}, a.ClickHouse.FindLimiter)
+	assert.IsType(t, limiter.NoopLimiter{}, a.ClickHouse.TagsLimiter)
+	require.Len(t, a.ClickHouse.QueryParams, 1)
+	assert.Equal(t, "http://team-a:8123/", a.ClickHouse.QueryParams[0].URL)
+	assert.Equal(t, 20, a.ClickHouse.QueryParams[0].Limiter.Capacity())
+	require.Len(t, a.DataTable, 1)
+	assert.Equal(t, "team_a_data", a.DataTable[0].Table)
+	assert.NotNil(t, a.DataTable[0].Rollup)
+
+	// root config is not changed
+	assert.Equal(t, "graphite_index", cfg.ClickHouse.IndexTable)
+	assert.Equal(t, "graphite_data", cfg.DataTable[0].Table)
+	assert.Equal(t, 100, cfg.ClickHouse.QueryParams[0].Limiter.Capacity())
+
+	b := cfg.Tenant("team-b")
+	require.NotNil(t, b)
+	assert.Equal(t, "http://localhost:8123/", b.ClickHouse.URL)
+	assert.Equal(t, "team_b_tagged", b.ClickHouse.TaggedTable)
+	assert.Empty(t, b.DataTable)
+	// no tenant limits, the global ones are used by the own tenant limiter
+	require.Len(t, b.ClickHouse.QueryParams, 1)
+	assert.Equal(t, 100, b.ClickHouse.QueryParams[0].Limiter.Capacity())
+	assert.NotSame(t, cfg.ClickHouse.QueryParams[0].Limiter, b.ClickHouse.QueryParams[0].Limiter)
+
+	tests := []struct {
+		user    string
+		header  string
+		want    string
+		wantErr int
+	}{
+		{"", "", "", 0},
+		{"carol", "", "", 0},
+		{"alice", "", "team-a", 0},
+		{"grafana", "team-b", "team-b", 0},
+		{"bob", "team-b", "team-a", 0},
+		{"", "team-b", "", http.StatusForbidden},
+		{"carol", "team-b", "", http.StatusForbidden},
+		{"grafana", "team-a", "", http.StatusForbidden},
+		{"carol", "team-c", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+tt.header, func(t *testing.T) {
+			tenant, err := cfg.ResolveTenant(tt.user, tt.header)
+			if tt.wantErr != 0 {
+				var cerr errs.ErrorWithCode
+				require.ErrorAs(t, err, &cerr)
+				assert.Equal(t, tt.wantErr, cerr.Code)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tenant)
+		})
+	}
+
+	ctx := context.Background()
+	assert.Same(t, cfg, cfg.ForContext(ctx))
+	assert.Same(t, a, cfg.ForContext(scope.WithTenant(ctx, "team-a")))
+	assert.Same(t, a, b.ForContext(scope.WithTenant(ctx, "team-a")))
+	assert.Same(t, b, b.ForContext(ctx))
+}
+
+func TestTenantsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "no tables",
+			body: "[tenants.tenant.a]\nurl = \"http://a:8123/\"\n",
+		},
+		{
+			name: "no index table",
+			body: "[tenants.tenant.a]\ntagged-table = \"a\"\n",
+		},
+		{
+			name: "empty data table",
+			body: "[tenants.tenant.a]\nindex-table = \"a\"\n[[tenants.tenant.a.data-table]]\nrollup-conf = \"none\"\n",
+		},
+		{
+			name: "duplicated user",
+			body: "[tenants.tenant.a]\nindex-table = \"a\"\nusers = [\"alice\"]\n[tenants.tenant.b]\nindex-table = \"b\"\nusers = [\"alice\"]\n",
+		},
+		{
+			name: "invalid url",
+			body: "[tenants.tenant.a]\nindex-table = \"a\"\nurl = \"tcp://a:9000\"\n",
+		},
+		{
+			name: "unknown prometheus tenant",
+			body: "[prometheus]\ntenant = \"a\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Unmarshal([]byte(tt.body), false)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package expand
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/lomik/graphite-clickhouse/finder"
+)
+
+// Expand is the result of glob expanding, like /metrics/expand in graphite-web
+type Expand struct {
+	queries    []string
+	leavesOnly bool
+	maxMetrics int                        // max-metrics-in-find-answer, 0 - unlimited
+	results    map[string]map[string]bool // query -> path -> isLeaf
+}
+
+func New(leavesOnly bool, maxMetrics int) *Expand {
+	return &Expand{
+		leavesOnly: leavesOnly,
+		maxMetrics: maxMetrics,
+		results:    make(map[string]map[string]bool),
+	}
+}
+
+// Add adds finder result for the query
+func (e *Expand) Add(query string, rows [][]byte) {
+	paths, ok := e.results[query]
+	if !ok {
+		e.queries = append(e.queries, query)
+		paths = make(map[string]bool)
+		e.results[query] = paths
+	}
+
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+
+		path, isLeaf := finder.Leaf(row)
+		if e.leavesOnly && !isLeaf {
+			continue
+		}
+
+		paths[string(path)] = paths[string(path)] || isLeaf
+	}
+}
+
+// sorted returns sorted paths, limited by max-metrics-in-find-answer
+func (e *Expand) sorted(paths map[string]bool) []string {
+	list := make([]string, 0, len(paths))
+	for path := range paths {
+		list = append(list, path)
+	}
+
+	sort.Strings(list)
+
+	if e.maxMetrics > 0 && len(list) > e.maxMetrics {
+		list = list[:e.maxMetrics]
+	}
+
+	return list
+}
+
+// Len returns count of the expanded paths
+func (e *Expand) Len() int {
+	n := 0
+	for _, paths := range e.results {
+		n += len(paths)
+	}
+
+	return n
+}
+
+// WriteJSON writes {"results": [paths]} or {"results": {query: [paths]}} if groupByExpr is set
+func (e *Expand) WriteJSON(w io.Writer, groupByExpr bool) error {
+	var response struct {
+		Results interface{} `json:"results"`
+	}
+
+	if groupByExpr {
+		results := make(map[string][]string, len(e.queries))
+		for _, query := range e.queries {
+			results[query] = e.sorted(e.results[query])
+		}
+
+		response.Results = results
+	} else {
+		all := make(map[string]bool)
+
+		for _, paths := range e.results {
+			for path, isLeaf := range paths {
+				all[path] = all[path] || isLeaf
+			}
+		}
+
+		response.Results = e.sorted(all)
+	}
+
+	return json.NewEncoder(w).Encode(response)
+}
+
+// WriteProtobufV3 writes carbonapi_v3_pb.MultiGlobResponse with GlobResponse for each query
+func (e *Expand) WriteProtobufV3(w io.Writer) error {
+	var multiGlobResponse v3pb.MultiGlobResponse
+
+	for _, query := range e.queries {
+		paths := e.results[query]
+		response := v3pb.GlobResponse{Name: query}
+
+		for _, path := range e.sorted(paths) {
+			response.Matches = append(response.Matches, v3pb.GlobMatch{
+				Path:   path,
+				IsLeaf: paths[path],
+			})
+		}
+
+		multiGlobResponse.Metrics = append(multiGlobResponse.Metrics, response)
+	}
+
+	body, err := proto.Marshal(&multiGlobResponse)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+
+	return err
+}
@@ -0,0 +1,227 @@
+package expand
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/utils"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+type Handler struct {
+	config *config.Config
+}
+
+func NewHandler(config *config.Config) *Handler {
+	return &Handler{
+		config: config,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := http.StatusOK
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("metrics-expand")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	var (
+		metricsCount  int64
+		queueFail     bool
+		queueDuration time.Duration
+		findCache     bool
+		queries       []string
+	)
+
+	username := r.Header.Get("X-Forwarded-User")
+	limiter := h.config.GetUserFindLimiter(username)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			status = http.StatusInternalServerError
+
+			logger.Error("panic during eval:",
+				zap.String("requestID", scope.String(r.Context(), "requestID")),
+				zap.Any("reason", rec),
+				zap.Stack("stack"),
+			)
+
+			answer := fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
+			http.Error(w, answer, status)
+		}
+
+		d := time.Since(start)
+		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, findCache, queueFail)
+		logs.SlowQueryLog(h.config, r, "expand", status, logs.Timings{Total: d, Queue: queueDuration})
+		limiter.SendDuration(queueDuration.Milliseconds())
+		metrics.SendFindMetrics(metrics.FindRequestMetric, status, d.Milliseconds(), 0, h.config.Metrics.ExtendedStat, metricsCount)
+	}()
+
+	r.ParseMultipartForm(1024 * 1024)
+
+	format := r.FormValue("format")
+	switch format {
+	case "carbonapi_v3_pb":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			status = http.StatusBadRequest
+			http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), status)
+
+			return
+		}
+
+		var pv3Request v3pb.MultiGlobRequest
+		if err := pv3Request.Unmarshal(body); err != nil {
+			status = http.StatusBadRequest
+			http.Error(w, fmt.Sprintf("Failed to unmarshal request: %v", err), status)
+
+			return
+		}
+
+		queries = pv3Request.Metrics
+	case "", "json":
+		queries = r.Form["query"]
+	default:
+		logger.Error("unsupported formatter")
+
+		status = http.StatusBadRequest
+		http.Error(w, "Failed to parse request: unsupported formatter", status)
+
+		return
+	}
+
+	if len(queries) == 0 {
+		status = http.StatusBadRequest
+		http.Error(w, "Query not set", status)
+
+		return
+	}
+
+	// find cache is shared between users, so results filtered by ACL are not cached
+	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache")) && !acl.Restricted(username)
+
+	var (
+		entered bool
+		ctx     context.Context
+		cancel  context.CancelFunc
+	)
+
+	if limiter.Enabled() {
+		ctx, cancel = context.WithTimeout(r.Context(), h.config.ClickHouse.IndexTimeout)
+		defer cancel()
+
+		err := limiter.Enter(ctx, "expand")
+		queueDuration = time.Since(start)
+
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			queueFail = true
+
+			logger.Error(err.Error())
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+
+		queueDuration = time.Since(start)
+		entered = true
+
+		defer func() {
+			if entered {
+				limiter.Leave(ctx, "expand")
+
+				entered = false
+			}
+		}()
+	}
+
+	e := New(parser.TruthyBool(r.FormValue("leavesOnly")), h.config.Common.MaxMetricsInFindAnswer)
+
+	for _, query := range queries {
+		rows, cached, err := h.find(r.Context(), logger, query, useCache)
+		if err != nil {
+			status, _ = clickhouse.HandleError(w, err)
+			return
+		}
+
+		findCache = findCache || cached
+
+		e.Add(query, rows)
+	}
+
+	if entered {
+		limiter.Leave(ctx, "expand")
+
+		entered = false
+	}
+
+	metricsCount = int64(e.Len())
+
+	if format == "carbonapi_v3_pb" {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		e.WriteProtobufV3(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		e.WriteJSON(w, parser.TruthyBool(r.FormValue("groupByExpr")))
+	}
+}
+
+// find returns the finder result for query, shares the cache with /metrics/find
+func (h *Handler) find(ctx context.Context, logger *zap.Logger, query string, useCache bool) ([][]byte, bool, error) {
+	var key string
+
+	if useCache {
+		ts := utils.TimestampTruncate(time.Now().Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
+		key = "1970-02-12;query=" + query + ";ts=" + strconv.FormatInt(ts, 10)
+
+		body, err := h.config.Common.FindCache.Get(key)
+		if err == nil {
+			if metrics.FinderCacheMetrics != nil {
+				metrics.FinderCacheMetrics.CacheHits.Add(1)
+			}
+
+			rows := finder.NewCachedIndex(body).List()
+			logger.Info("finder", zap.String("get_cache", key),
+				zap.Int("metrics", len(rows)), zap.Bool("find_cached", true),
+				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+
+			return rows, true, nil
+		}
+	}
+
+	res, err := finder.Find(h.config, ctx, query, 0, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rows := res.List()
+
+	if useCache {
+		if body, err := res.Bytes(); err == nil {
+			if metrics.FinderCacheMetrics != nil {
+				metrics.FinderCacheMetrics.CacheMisses.Add(1)
+			}
+
+			h.config.Common.FindCache.Set(key, body, h.config.Common.FindCacheConfig.FindTimeoutSec)
+			logger.Info("finder", zap.String("set_cache", key),
+				zap.Int("metrics", len(rows)), zap.Bool("find_cached", false),
+				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+		}
+	}
+
+	return rows, false, nil
+}
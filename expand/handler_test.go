@@ -0,0 +1,78 @@
+package expand
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestHandler(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'host.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.b.\nhost.a\nhost.a.\n")},
+	)
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path LIKE 'host.a.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.a.cpu\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+
+	handler := NewHandler(cfg)
+
+	tests := []struct {
+		params string
+		want   string
+	}{
+		{"query=host.*", `{"results":["host.a","host.b"]}` + "\n"},
+		{"query=host.*&leavesOnly=1", `{"results":["host.a"]}` + "\n"},
+		{"query=host.*&query=host.a.*", `{"results":["host.a","host.a.cpu","host.b"]}` + "\n"},
+		{"query=host.*&query=host.a.*&groupByExpr=1", `{"results":{"host.*":["host.a","host.b"],"host.a.*":["host.a.cpu"]}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.params, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/metrics/expand/?"+tt.params, nil)
+
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+
+	t.Run("carbonapi_v3_pb", func(t *testing.T) {
+		req := v3pb.MultiGlobRequest{Metrics: []string{"host.*"}}
+		body, err := req.Marshal()
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/metrics/expand/?format=carbonapi_v3_pb&leavesOnly=1", bytes.NewReader(body))
+
+		handler.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp v3pb.MultiGlobResponse
+		require.NoError(t, resp.Unmarshal(w.Body.Bytes()))
+		assert.Equal(t, []v3pb.GlobResponse{
+			{Name: "host.*", Matches: []v3pb.GlobMatch{{Path: "host.a", IsLeaf: true}}},
+		}, resp.Metrics)
+	})
+}
@@ -0,0 +1,242 @@
+package explain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+// Query is an index query sent to clickhouse by the finder
+type Query struct {
+	clickhouse.RecordedQuery
+	Estimate      []clickhouse.EstimateRow `json:"estimate,omitempty"`
+	EstimateError string                   `json:"estimate-error,omitempty"`
+}
+
+// Target shows how the target metrics are found
+type Target struct {
+	Target  string   `json:"target"`
+	Finders []string `json:"finders"`
+	Queries []Query  `json:"queries"`
+	Metrics int      `json:"metrics"`
+}
+
+// Limiter shows the limiter, which would be used for the render request
+type Limiter struct {
+	User            string `json:"user,omitempty"`
+	QueryParamIndex int    `json:"query-param-index"`
+	Enabled         bool   `json:"enabled"`
+}
+
+// Response is a /debug/explain answer
+type Response struct {
+	From    int64                   `json:"from"`
+	Until   int64                   `json:"until"`
+	Targets []Target                `json:"targets"`
+	Data    []data.ExplainTimeFrame `json:"data"`
+	Limiter Limiter                 `json:"limiter"`
+}
+
+// Handler shows the finders chain, SQL queries and rollup rules for the render request
+type Handler struct {
+	config *config.Config
+}
+
+func NewHandler(config *config.Config) *Handler {
+	return &Handler{
+		config: config,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := http.StatusOK
+
+	var (
+		queueDuration time.Duration
+		queueFail     bool
+	)
+
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("explain")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			status = http.StatusInternalServerError
+
+			logger.Error("panic during eval:",
+				zap.String("requestID", scope.String(r.Context(), "requestID")),
+				zap.Any("reason", rec),
+				zap.Stack("stack"),
+			)
+
+			answer := fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
+			http.Error(w, answer, status)
+		}
+
+		logs.AccessLog(accessLogger, h.config, r, status, time.Since(start), queueDuration, false, queueFail)
+	}()
+
+	r.ParseMultipartForm(1024 * 1024)
+
+	targets := dry.RemoveEmptyStrings(r.Form["target"])
+	if len(targets) == 0 {
+		status = http.StatusBadRequest
+		http.Error(w, "Target not set", status)
+
+		return
+	}
+
+	from, err := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, "cannot parse from", status)
+
+		return
+	}
+
+	until, err := strconv.ParseInt(r.FormValue("until"), 10, 64)
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, "cannot parse until", status)
+
+		return
+	}
+
+	if from >= until {
+		status, _ = clickhouse.HandleError(w, clickhouse.ErrInvalidTimeRange)
+		return
+	}
+
+	maxDataPoints, err := strconv.ParseInt(r.FormValue("maxDataPoints"), 10, 64)
+	if err != nil {
+		maxDataPoints = 0
+	}
+
+	estimate := parser.TruthyBool(r.FormValue("estimate"))
+
+	tf := data.TimeFrame{From: from, Until: until, MaxDataPoints: maxDataPoints}
+	fetchRequests := data.MultiTarget{tf: data.NewTargets(targets, alias.New())}
+
+	resp := Response{
+		From:    from,
+		Until:   until,
+		Targets: make([]Target, 0, len(targets)),
+	}
+
+	username := r.Header.Get("X-Forwarded-User")
+	luser, qlimiter := data.GetQueryLimiter(username, h.config, &fetchRequests)
+	resp.Limiter = Limiter{User: luser, Enabled: qlimiter.Enabled()}
+
+	if luser == "" {
+		_, resp.Limiter.QueryParamIndex = data.GetQueryParam(username, h.config, &fetchRequests)
+	}
+
+	if qlimiter.Enabled() {
+		// index and estimate queries are executed, so explain waits in the render limiter
+		limitCtx, cancel := context.WithTimeout(r.Context(), h.config.ClickHouse.IndexTimeout)
+		defer cancel()
+
+		err = qlimiter.Enter(limitCtx, "explain")
+		queueDuration = time.Since(start)
+
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			queueFail = true
+
+			logger.Error(err.Error())
+			http.Error(w, err.Error(), status)
+
+			return
+		}
+
+		defer qlimiter.Leave(limitCtx, "explain")
+	}
+
+	for _, target := range targets {
+		t, err := h.explainTarget(r.Context(), target, fetchRequests[tf], from, until, estimate)
+		if err != nil {
+			status, _ = clickhouse.HandleError(w, err)
+			return
+		}
+
+		resp.Targets = append(resp.Targets, t)
+	}
+
+	resp.Data, err = fetchRequests.Explain(r.Context(), h.config, config.ContextGraphite, estimate)
+	if err != nil {
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// explainTarget executes the finder for target with the recorded index queries and merges found metrics into targets
+func (h *Handler) explainTarget(ctx context.Context, target string, targets *data.Targets, from, until int64, estimate bool) (Target, error) {
+	var recorder clickhouse.QueryRecorder
+
+	res, chain, err := finder.Explain(clickhouse.WithQueryRecorder(ctx, &recorder), h.config, target, from, until)
+	if err != nil {
+		return Target{}, err
+	}
+
+	targets.AM.MergeTarget(res, target, false)
+
+	t := Target{
+		Target:  target,
+		Finders: chain,
+		Queries: make([]Query, 0),
+		Metrics: len(res.Series()),
+	}
+
+	for _, rq := range recorder.Queries() {
+		q := Query{RecordedQuery: rq}
+
+		if estimate {
+			q.Estimate, err = clickhouse.Estimate(
+				scope.WithTable(ctx, rq.Table),
+				h.config.ClickHouse.URL,
+				rq.SQL,
+				clickhouse.Options{
+					TLSConfig:      h.config.ClickHouse.TLSConfig,
+					Timeout:        h.config.ClickHouse.IndexTimeout,
+					ConnectTimeout: h.config.ClickHouse.ConnectTimeout,
+				},
+				nil,
+			)
+			if err != nil {
+				q.EstimateError = err.Error()
+			}
+		}
+
+		t.Queries = append(t.Queries, q)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,140 @@
+package explain
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestHandler(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	indexSQL := "SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path LIKE 'host.a.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw"
+
+	srv.AddResponce(indexSQL, &chtest.TestResponse{Body: []byte("host.a.cpu\nhost.a.mem\n")})
+	srv.AddResponce(
+		"EXPLAIN ESTIMATE SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path LIKE 'host.a.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("default\tgraphite_index\t2\t16384\t2\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.IndexUseDaily = false
+	cfg.ClickHouse.InternalAggregation = false
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: srv.URL, DataTimeout: time.Minute, Limiter: limiter.NoopLimiter{}}}
+	cfg.DataTable = []config.DataTable{{Table: "graphite_data", RollupConf: "none", RollupDefaultPrecision: 60, RollupDefaultFunction: "avg"}}
+	require.NoError(t, cfg.ProcessDataTables())
+
+	handler := NewHandler(cfg)
+
+	from := time.Now().Add(-time.Hour).Unix()
+	until := time.Now().Unix()
+
+	t.Run("bad request", func(t *testing.T) {
+		for _, params := range []string{"", "target=host.a.*&until=1", "target=host.a.*&from=2&until=1"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/debug/explain?"+params, nil)
+
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, params)
+		}
+	})
+
+	for _, estimate := range []bool{false, true} {
+		params := "target=host.a.*&from=" + strconv.FormatInt(from, 10) + "&until=" + strconv.FormatInt(until, 10)
+		if estimate {
+			params += "&estimate=1"
+		}
+
+		t.Run(params, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/debug/explain?"+params, nil)
+
+			handler.ServeHTTP(w, r)
+
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var resp Response
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+			require.Len(t, resp.Targets, 1)
+			assert.Equal(t, "host.a.*", resp.Targets[0].Target)
+			assert.Equal(t, []string{"IndexFinder"}, resp.Targets[0].Finders)
+			assert.Equal(t, 2, resp.Targets[0].Metrics)
+			require.Len(t, resp.Targets[0].Queries, 1)
+			assert.Equal(t, "graphite_index", resp.Targets[0].Queries[0].Table)
+			assert.Equal(t, indexSQL, resp.Targets[0].Queries[0].SQL)
+
+			if estimate {
+				assert.Equal(t, []clickhouse.EstimateRow{{Database: "default", Table: "graphite_index", Parts: 2, Rows: 16384, Marks: 2}}, resp.Targets[0].Queries[0].Estimate)
+			} else {
+				assert.Nil(t, resp.Targets[0].Queries[0].Estimate)
+			}
+
+			require.Len(t, resp.Data, 1)
+			d := resp.Data[0]
+			assert.Equal(t, "graphite_data", d.DataTable)
+			assert.Equal(t, int64(60), d.Step)
+			assert.Equal(t, 0, d.QueryParamIndex)
+			assert.Equal(t, time.Duration(0), d.QueryParamDuration)
+			assert.Len(t, d.Metrics, 2)
+
+			for _, m := range d.Metrics {
+				assert.Equal(t, uint32(60), m.Step)
+				assert.Equal(t, "avg", m.Aggregation)
+			}
+
+			require.Len(t, d.Queries, 1)
+			assert.Equal(t, 2, d.Queries[0].Metrics)
+			assert.Contains(t, d.Queries[0].SQL, "FROM graphite_data")
+			assert.Contains(t, d.Queries[0].SQL, "WHERE (Path in metrics_list)")
+
+			assert.Equal(t, Limiter{Enabled: false, QueryParamIndex: 0}, resp.Limiter)
+		})
+	}
+
+	t.Run("limiter", func(t *testing.T) {
+		l := limiter.NewWLimiter(nil, 1, 1, false, "render", "all")
+		cfg.ClickHouse.QueryParams[0].Limiter = l
+		cfg.ClickHouse.IndexTimeout = 50 * time.Millisecond
+
+		defer func() { cfg.ClickHouse.QueryParams[0].Limiter = limiter.NoopLimiter{} }()
+
+		// the slot is taken by the render request
+		ctx := context.Background()
+		require.NoError(t, l.Enter(ctx, "render"))
+
+		params := "target=host.a.*&from=" + strconv.FormatInt(from, 10) + "&until=" + strconv.FormatInt(until, 10)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/debug/explain?"+params, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, w.Body.String())
+
+		l.Leave(ctx, "render")
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/debug/explain?"+params, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, resp.Limiter.Enabled)
+	})
+}
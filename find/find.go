@@ -2,6 +2,7 @@ package find
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 
 	"github.com/gogo/protobuf/proto"
@@ -19,27 +20,76 @@ type Find struct {
 	context context.Context
 	query   string // original query
 	result  finder.Result
+	page    *finder.Page
+	rows    [][]byte // result list, limited by page
+	last    []byte   // last row of the full page before the ACL filter, nil if the page isn't full
 }
 
-func NewCached(config *config.Config, body []byte) *Find {
-	return &Find{
+// unfiltered is the result with the rows, removed after the page limit (by ACL)
+type unfiltered interface {
+	Unfiltered() [][]byte
+}
+
+func NewCached(config *config.Config, body []byte, page *finder.Page) *Find {
+	f := &Find{
 		config: config,
 		result: finder.NewCachedIndex(body),
+		page:   page,
 	}
+	f.rows = page.Apply(f.result.List())
+
+	return f
 }
 
-func New(config *config.Config, ctx context.Context, query string) (*Find, error) {
+func New(config *config.Config, ctx context.Context, query string, page *finder.Page) (*Find, error) {
+	if page != nil {
+		ctx = finder.WithPage(ctx, page)
+	}
+
 	res, err := finder.Find(config, ctx, query, 0, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Find{
+	f := &Find{
 		query:   query,
 		config:  config,
 		context: ctx,
 		result:  res,
-	}, nil
+		page:    page,
+		rows:    page.Apply(res.List()),
+	}
+
+	if u, ok := res.(unfiltered); ok && page != nil && page.Limit > 0 {
+		// the page can lose the rows to the filter, but the next page starts after the last unfiltered row
+		if rows := page.Apply(u.Unfiltered()); len(rows) >= page.Limit {
+			f.last = rows[len(rows)-1]
+		}
+	}
+
+	return f, nil
+}
+
+// Len returns count of the found paths
+func (f *Find) Len() int {
+	return len(f.rows)
+}
+
+// NextCursor returns cursor for the next page or empty string if the page is the last
+func (f *Find) NextCursor() string {
+	if f.page == nil || f.page.Limit <= 0 {
+		return ""
+	}
+
+	if len(f.rows) >= f.page.Limit {
+		return EncodeCursor(f.rows[len(f.rows)-1], f.page.Reverse)
+	}
+
+	if f.last != nil {
+		return EncodeCursor(f.last, f.page.Reverse)
+	}
+
+	return ""
 }
 
 func (f *Find) isResultsLimitExceeded(numResults int) bool {
@@ -48,7 +98,7 @@ func (f *Find) isResultsLimitExceeded(numResults int) bool {
 }
 
 func (f *Find) WritePickle(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		w.Write(pickle.EmptyList)
@@ -92,7 +142,7 @@ func (f *Find) WritePickle(w io.Writer) error {
 }
 
 func (f *Find) WriteProtobuf(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		return nil
@@ -142,7 +192,7 @@ func (f *Find) WriteProtobuf(w io.Writer) error {
 }
 
 func (f *Find) WriteProtobufV3(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
 
 	if len(rows) == 0 { // empty
 		return nil
@@ -197,8 +247,23 @@ func (f *Find) WriteProtobufV3(w io.Writer) error {
 	return nil
 }
 
+// jsonPage is the json response with the page of the paths and the cursor for the next page
+type jsonPage struct {
+	Metrics    []jsonMetric `json:"metrics"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type jsonMetric struct {
+	Path string `json:"path"`
+	Leaf int    `json:"leaf,omitempty"`
+}
+
 func (f *Find) WriteJSON(w io.Writer) error {
-	rows := f.result.List()
+	rows := f.rows
+
+	if f.page != nil {
+		return f.writeJSONPage(w)
+	}
 
 	if len(rows) == 0 { // empty
 		return nil
@@ -243,3 +308,31 @@ func (f *Find) WriteJSON(w io.Writer) error {
 
 	return nil
 }
+
+// writeJSONPage writes the page as the valid json object with the cursor for the next page
+func (f *Find) writeJSONPage(w io.Writer) error {
+	page := jsonPage{
+		Metrics:    make([]jsonMetric, 0, len(f.rows)),
+		NextCursor: f.NextCursor(),
+	}
+
+	for i := 0; i < len(f.rows); i++ {
+		if len(f.rows[i]) == 0 {
+			continue
+		}
+
+		path, isLeaf := finder.Leaf(f.rows[i])
+
+		m := jsonMetric{Path: string(path)}
+		if isLeaf {
+			m.Leaf = 1
+		}
+
+		page.Metrics = append(page.Metrics, m)
+		if f.isResultsLimitExceeded(len(page.Metrics)) {
+			break
+		}
+	}
+
+	return json.NewEncoder(w).Encode(page)
+}
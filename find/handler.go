@@ -10,12 +10,14 @@ import (
 
 	"github.com/go-graphite/carbonapi/pkg/parser"
 	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/lomik/graphite-clickhouse/acl"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/utils"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/querylog"
 	"go.uber.org/zap"
 )
 
@@ -67,6 +69,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		d := time.Since(start)
 		dMS := d.Milliseconds()
 		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, findCache, queueFail)
+		logs.SlowQueryLog(h.config, r, "find", status, logs.Timings{Total: d, Queue: queueDuration})
+		querylog.Log(r, querylog.Entry{Endpoint: "find", Targets: []string{query}, Metrics: metricsCount, Status: status, Duration: d})
 		limiter.SendDuration(queueDuration.Milliseconds())
 		metrics.SendFindMetrics(metrics.FindRequestMetric, status, dMS, 0, h.config.Metrics.ExtendedStat, metricsCount)
 
@@ -131,9 +135,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, err := parsePage(r, h.config.Common.MaxMetricsInFindAnswer)
+	if err != nil {
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+
 	var key string
 	// params := []string{query}
-	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+	// find cache is shared between users, so results filtered by ACL are not cached.
+	// The order of the pages is selected by the finder, so the pages are not cached too
+	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache")) &&
+		!acl.Restricted(username) && page == nil
 	if useCache {
 		ts := utils.TimestampTruncate(time.Now().Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
 		key = "1970-02-12;query=" + query + ";ts=" + strconv.FormatInt(ts, 10)
@@ -147,8 +160,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			findCache = true
 
 			w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
-			f := NewCached(h.config, body)
-			metricsCount = int64(len(f.result.List()))
+			f := NewCached(h.config, body, page)
+			metricsCount = int64(f.Len())
 			logger.Info("finder", zap.String("get_cache", key),
 				zap.Int64("metrics", metricsCount), zap.Bool("find_cached", true),
 				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
@@ -166,7 +179,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 
 	if limiter.Enabled() {
-		ctx, cancel = context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
+		ctx, cancel = context.WithTimeout(r.Context(), h.config.ClickHouse.IndexTimeout)
 		defer cancel()
 
 		err := limiter.Enter(ctx, "find")
@@ -194,7 +207,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	f, err := New(h.config, r.Context(), query)
+	f, err := New(h.config, r.Context(), query, page)
 
 	if entered {
 		// release early as possible
@@ -221,13 +234,17 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	metricsCount = int64(len(f.result.List()))
+	metricsCount = int64(f.Len())
 	status = h.Reply(w, r, f)
 }
 
 func (h *Handler) Reply(w http.ResponseWriter, r *http.Request, f *Find) (status int) {
 	status = http.StatusOK
 
+	if cursor := f.NextCursor(); cursor != "" {
+		w.Header().Set("X-Find-Next-Cursor", cursor)
+	}
+
 	switch r.FormValue("format") {
 	case "json":
 		f.WriteJSON(w)
@@ -1,12 +1,24 @@
 package find
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/auth"
 	"github.com/lomik/graphite-clickhouse/config"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
 )
 
 type clickhouseMock struct {
@@ -61,3 +73,189 @@ func TestFind(t *testing.T) {
 		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'host.%' AND match(Path, '^host[.][^.]cpu[.]?$'))) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
 	)
 }
+
+func TestFindPage(t *testing.T) {
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'host.%')) AND (Date='1970-02-12') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.a.\nhost.b\n")},
+	)
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE (((Level=20002) AND (Path LIKE 'host.%')) AND (Date='1970-02-12')) AND (Path>'host.b') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.c\n")},
+	)
+	// reversed index is used for the pages too
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=30002) AND (Path LIKE 'cpu.%')) AND (Date='1970-02-12') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("cpu.a\ncpu.b\n")},
+	)
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE (((Level=30002) AND (Path LIKE 'cpu.%')) AND (Date='1970-02-12')) AND (Path>'cpu.b') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("cpu.c\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.IndexReverse = "auto"
+
+	handler := NewHandler(cfg)
+
+	tests := []struct {
+		query      string
+		cursor     string
+		wantStatus int
+		wantBody   string
+		wantCursor string
+	}{
+		{
+			"host.*", "", http.StatusOK,
+			`{"metrics":[{"path":"host.a"},{"path":"host.b","leaf":1}],"next_cursor":"` + EncodeCursor([]byte("host.b"), false) + "\"}\n",
+			EncodeCursor([]byte("host.b"), false),
+		},
+		{"host.*", EncodeCursor([]byte("host.b"), false), http.StatusOK, `{"metrics":[{"path":"host.c","leaf":1}]}` + "\n", ""},
+		{
+			"*.cpu", "", http.StatusOK,
+			`{"metrics":[{"path":"a.cpu","leaf":1},{"path":"b.cpu","leaf":1}],"next_cursor":"` + EncodeCursor([]byte("b.cpu"), true) + "\"}\n",
+			EncodeCursor([]byte("b.cpu"), true),
+		},
+		{"*.cpu", EncodeCursor([]byte("b.cpu"), true), http.StatusOK, `{"metrics":[{"path":"c.cpu","leaf":1}]}` + "\n", ""},
+		{"host.*", "!invalid", http.StatusBadRequest, "invalid cursor\n", ""},
+		{"host.*", EncodeCursor(nil, false), http.StatusBadRequest, "invalid cursor\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query+"/"+tt.cursor, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(
+				http.MethodGet,
+				"http://localhost/metrics/find/?format=json&limit=2&query="+tt.query+"&cursor="+tt.cursor,
+				nil,
+			)
+
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+			assert.Equal(t, tt.wantCursor, w.Header().Get("X-Find-Next-Cursor"))
+		})
+	}
+}
+
+func TestFindPageACL(t *testing.T) {
+	metrics.DisableMetrics()
+
+	a, err := acl.Parse("default = \"deny\"\n[[rule]]\nusers = [\"alice\"]\nprefixes = [\"host.a\"]")
+	require.NoError(t, err)
+
+	acl.Set(a)
+	defer acl.Set(nil)
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'host.%')) AND (Date='1970-02-12') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.a.\nhost.b\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+
+	handler := NewHandler(cfg)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/metrics/find/?format=json&limit=2&query=host.*", nil)
+	r.Header.Set(auth.UserHeader, "alice")
+	r = scope.HttpRequest(r)
+
+	handler.ServeHTTP(w, r)
+
+	// the row, removed by ACL, doesn't end the pages
+	cursor := EncodeCursor([]byte("host.b"), false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"metrics":[{"path":"host.a"}],"next_cursor":"`+cursor+"\"}\n", w.Body.String())
+	assert.Equal(t, cursor, w.Header().Get("X-Find-Next-Cursor"))
+}
+
+func TestFindPriority(t *testing.T) {
+	metrics.DisableMetrics()
+
+	priority := &limiter.PriorityConfig{
+		Mode: limiter.PriorityStrict,
+		Classes: []limiter.PriorityClass{
+			{Name: "high", Reserved: 0.5},
+			{Name: "low"},
+		},
+	}
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'host.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.a\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.IndexTimeout = 100 * time.Millisecond
+	// find requests are limited by the tags limiter
+	cfg.ClickHouse.TagsLimiter = limiter.NewWLimiter(priority, 0, 2, false, "find", "test")
+
+	// the unreserved slot is used by the low class request
+	low := limiter.WithPriority(context.Background(), 1)
+	require.NoError(t, cfg.ClickHouse.TagsLimiter.Enter(low, "test"))
+	defer cfg.ClickHouse.TagsLimiter.Leave(low, "test")
+
+	handler := NewHandler(cfg)
+
+	tests := []struct {
+		class      int
+		wantStatus int
+	}{
+		{0, http.StatusOK},
+		{1, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.class), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/metrics/find/?format=json&query=host.*", nil)
+			r = r.WithContext(limiter.WithPriority(r.Context(), tt.class))
+
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestFindQueryErrors(t *testing.T) {
+	metrics.DisableMetrics()
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+
+	l := limiter.NewLLimiter(nil, 0, 2, 1, 1.5, 0.5, false, "find", "test")
+	cfg.ClickHouse.TagsLimiter = l
+
+	handler := NewHandler(cfg)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/metrics/find/?format=json&query=host.*", nil)
+	r = r.WithContext(limiter.WithQueries(r.Context()))
+
+	handler.ServeHTTP(w, r)
+
+	require.NotEqual(t, http.StatusOK, w.Code)
+
+	// the failed query decreases the window, only one slot is left
+	ctx := context.Background()
+	require.NoError(t, l.TryEnter(ctx, "test"))
+	assert.ErrorIs(t, l.TryEnter(ctx, "test"), limiter.ErrTimeout)
+}
@@ -0,0 +1,69 @@
+package find
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+)
+
+// cursor prefixes with the order of the pages
+const (
+	cursorDirect  = 'd'
+	cursorReverse = 'r'
+)
+
+// EncodeCursor returns opaque cursor for the last path of the page and the order of the pages
+func EncodeCursor(path []byte, reverse bool) string {
+	order := byte(cursorDirect)
+	if reverse {
+		order = cursorReverse
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append([]byte{order}, path...))
+}
+
+// DecodeCursor returns the last path of the page and the order of the pages from the opaque cursor
+func DecodeCursor(cursor string) (string, bool, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) < 2 || (b[0] != cursorDirect && b[0] != cursorReverse) {
+		return "", false, errs.NewErrorWithCode("invalid cursor", http.StatusBadRequest)
+	}
+
+	return string(b[1:]), b[0] == cursorReverse, nil
+}
+
+// parsePage returns page from limit and cursor request params, or nil if it's not set.
+// limit is capped by max-metrics-in-find-answer
+func parsePage(r *http.Request, maxMetrics int) (*finder.Page, error) {
+	limitStr := r.FormValue("limit")
+	cursor := r.FormValue("cursor")
+
+	if limitStr == "" && cursor == "" {
+		return nil, nil
+	}
+
+	page := &finder.Page{Limit: maxMetrics}
+
+	if limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, errs.NewErrorWithCode("invalid limit", http.StatusBadRequest)
+		}
+
+		if maxMetrics == 0 || limit < maxMetrics {
+			page.Limit = limit
+		}
+	}
+
+	if cursor != "" {
+		var err error
+		if page.After, page.Reverse, err = DecodeCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
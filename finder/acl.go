@@ -0,0 +1,105 @@
+package finder
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// ACLFinder removes metrics, not allowed for the user, from the wrapped finder result
+type ACLFinder struct {
+	wrapped Finder
+	access  *acl.Access
+	tagged  bool
+	list    [][]byte // filtered wrapped.List()
+	series  [][]byte // filtered wrapped.Series()
+}
+
+func WrapACL(f Finder, access *acl.Access, tagged bool) *ACLFinder {
+	return &ACLFinder{
+		wrapped: f,
+		access:  access,
+		tagged:  tagged,
+	}
+}
+
+// aclDenied logs and counts the request denied by ACL
+func aclDenied(ctx context.Context, access *acl.Access, query string) error {
+	if metrics.ACLMetrics != nil {
+		metrics.ACLMetrics.Denied.Add(1)
+	}
+
+	scope.Logger(ctx).Warn("acl", zap.String("user", access.User()), zap.String("query", query), zap.Bool("denied", true))
+
+	return acl.ErrDenied
+}
+
+func (p *ACLFinder) Execute(ctx context.Context, config *config.Config, query string, from int64, until int64) (err error) {
+	if p.tagged && !p.access.AllowedTagged() || !p.tagged && !p.access.AllowedQuery(query) {
+		return aclDenied(ctx, p.access, query)
+	}
+
+	return p.wrapped.Execute(ctx, config, query, from, until)
+}
+
+func (p *ACLFinder) filter(rows [][]byte) [][]byte {
+	result := make([][]byte, 0, len(rows))
+
+	for _, row := range rows {
+		// tagged rows are checked in the url encoded form (name?tag=value&...), plain paths with extra prefix
+		path := row
+		if !p.tagged {
+			path = p.wrapped.Abs(row)
+		}
+
+		if p.access.Allowed(string(path)) {
+			result = append(result, row)
+		}
+	}
+
+	if n := len(rows) - len(result); n > 0 && metrics.ACLMetrics != nil {
+		metrics.ACLMetrics.Filtered.Add(uint64(n))
+	}
+
+	return result
+}
+
+func (p *ACLFinder) List() [][]byte {
+	if p.list == nil {
+		p.list = p.filter(p.wrapped.List())
+	}
+
+	return p.list
+}
+
+// Unfiltered returns the wrapped finder result before the ACL filter. The find pages are limited in the query before
+// the filter, so the cursor for the next page is built by it
+func (p *ACLFinder) Unfiltered() [][]byte {
+	return p.wrapped.List()
+}
+
+// For Render
+func (p *ACLFinder) Series() [][]byte {
+	if p.series == nil {
+		p.series = p.filter(p.wrapped.Series())
+	}
+
+	return p.series
+}
+
+func (p *ACLFinder) Abs(v []byte) []byte {
+	return p.wrapped.Abs(v)
+}
+
+func (p *ACLFinder) Bytes() ([]byte, error) {
+	return nil, ErrNotImplemented
+}
+
+func (p *ACLFinder) Stats() []metrics.FinderStat {
+	return p.wrapped.Stats()
+}
@@ -0,0 +1,49 @@
+package finder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+func TestACLFinder(t *testing.T) {
+	a, err := acl.Parse("default = \"deny\"\n[[rule]]\nusers = [\"alice\"]\nprefixes = [\"servers.\", \"cpu\"]")
+	require.NoError(t, err)
+
+	access := a.For("alice")
+
+	t.Run("plain", func(t *testing.T) {
+		m := NewMockFinder([][]byte{[]byte("servers."), []byte("apps."), []byte("servers.a.cpu")})
+		f := WrapACL(m, access, false)
+
+		require.NoError(t, f.Execute(context.Background(), config.New(), "*", 0, 0))
+		assert.Equal(t, "*", m.query)
+		assert.Equal(t, [][]byte{[]byte("servers."), []byte("servers.a.cpu")}, f.List())
+		assert.Equal(t, []string{"WrapACL", "MockFinder"}, Chain(f))
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		m := NewMockFinder([][]byte{[]byte("apps.a.cpu")})
+		f := WrapACL(m, access, false)
+
+		err := f.Execute(context.Background(), config.New(), "apps.*", 0, 0)
+		assert.Equal(t, acl.ErrDenied, err)
+		assert.Equal(t, "", m.query)
+	})
+
+	t.Run("tagged", func(t *testing.T) {
+		m := NewMockTagged([][]byte{[]byte("cpu?host=a"), []byte("mem?host=a")})
+		f := WrapACL(m, access, true)
+
+		require.NoError(t, f.Execute(context.Background(), config.New(), "seriesByTag('host=a')", 0, 0))
+		assert.Equal(t, [][]byte{[]byte("cpu?host=a")}, f.Series())
+
+		err := WrapACL(m, a.For("bob"), true).Execute(context.Background(), config.New(), "seriesByTag('host=a')", 0, 0)
+		assert.Equal(t, acl.ErrDenied, err)
+	})
+}
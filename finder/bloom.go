@@ -0,0 +1,150 @@
+package finder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/bloom"
+)
+
+// IndexBloom is a bloom filter of the paths (metrics and directories) from index table, periodically rebuilt
+type IndexBloom struct {
+	mu      sync.RWMutex
+	filter  *bloom.Filter
+	updated time.Time
+	maxAge  time.Duration
+
+	fpRate  float64
+	maxSize int
+
+	loader indexLoader
+}
+
+// indexBlooms are the filters by the index table, set up once by StartIndexBloom.
+// The filter is built from the paths of the own table, so the other tables (of the tenants) are not checked
+var indexBlooms = make(map[string]*IndexBloom)
+
+// NewIndexBloom returns not loaded *IndexBloom for index table from config
+func NewIndexBloom(cfg *config.Config) *IndexBloom {
+	b := &IndexBloom{
+		maxAge:  cfg.ClickHouse.IndexBloom.MaxAge,
+		fpRate:  cfg.ClickHouse.IndexBloom.FalsePositiveRate,
+		maxSize: cfg.ClickHouse.IndexBloom.MaxSize,
+		loader: indexLoader{
+			name:  "index-bloom",
+			url:   cfg.ClickHouse.URL,
+			table: cfg.ClickHouse.IndexTable,
+			query: indexTreeQuery(cfg.ClickHouse.IndexTable),
+			opts: clickhouse.Options{
+				TLSConfig:               cfg.ClickHouse.TLSConfig,
+				Timeout:                 cfg.ClickHouse.IndexBloom.LoadTimeout,
+				ConnectTimeout:          cfg.ClickHouse.ConnectTimeout,
+				CheckRequestProgress:    cfg.FeatureFlags.LogQueryProgress,
+				ProgressSendingInterval: cfg.ClickHouse.ProgressSendingInterval,
+			},
+			interval: cfg.ClickHouse.IndexBloom.Interval,
+		},
+	}
+
+	b.loader.load = func(reader io.Reader) ([]zap.Field, error) {
+		if err := b.Load(reader); err != nil {
+			return nil, err
+		}
+
+		b.mu.RLock()
+		f := b.filter
+		b.mu.RUnlock()
+
+		return []zap.Field{zap.Int("paths", f.Items()), zap.Int("size", f.Size()), zap.Float64("fp_rate", f.FPRate())}, nil
+	}
+
+	return b
+}
+
+// StartIndexBloom starts the bloom filter builder until ctx is done. Does nothing if index-bloom is disabled
+func StartIndexBloom(ctx context.Context, cfg *config.Config) {
+	if !cfg.ClickHouse.IndexBloom.Enabled {
+		return
+	}
+
+	if _, ok := indexBlooms[cfg.ClickHouse.IndexTable]; ok {
+		return
+	}
+
+	b := NewIndexBloom(cfg)
+	indexBlooms[cfg.ClickHouse.IndexTable] = b
+
+	go b.loader.worker(ctx)
+}
+
+// Load reads paths from reader (one per line) and replaces the filter
+func (b *IndexBloom) Load(reader io.Reader) error {
+	// filter size depends on the items count, so collect hashes before
+	hashes := make([]uint64, 0, 1024)
+
+	s := bufio.NewScanner(reader)
+	for s.Scan() {
+		// directories are stored too, find for exact path without wildcards can return it
+		hashes = append(hashes, bloom.Hash(string(bytes.TrimSuffix(s.Bytes(), []byte{'.'}))))
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	f := bloom.New(len(hashes), b.fpRate, b.maxSize)
+	for _, h := range hashes {
+		f.AddHash(h)
+	}
+
+	b.mu.Lock()
+	b.filter = f
+	b.updated = time.Now()
+	b.mu.Unlock()
+
+	if metrics.IndexBloomMetrics != nil {
+		metrics.IndexBloomMetrics.Items.Update(int64(f.Items()))
+		metrics.IndexBloomMetrics.Size.Update(int64(f.Size()))
+		metrics.IndexBloomMetrics.FPRate.Update(f.FPRate())
+	}
+
+	return nil
+}
+
+// MayContain checks the path (without wildcards) in the filter.
+// Returns true if the filter is nil (not built for the table), not loaded yet or stale
+func (b *IndexBloom) MayContain(path string) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.RLock()
+	f := b.filter
+	stale := time.Since(b.updated) > b.maxAge
+	b.mu.RUnlock()
+
+	if f == nil || stale {
+		return true
+	}
+
+	found := f.Test(path)
+
+	if metrics.IndexBloomMetrics != nil {
+		metrics.IndexBloomMetrics.Checks.Add(1)
+
+		if !found {
+			metrics.IndexBloomMetrics.Skipped.Add(1)
+		}
+	}
+
+	return found
+}
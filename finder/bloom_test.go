@@ -0,0 +1,74 @@
+package finder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+)
+
+func TestIndexFinderBloom(t *testing.T) {
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path IN ('host.web1.cpu','host.web1.cpu.'))) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.web1.cpu\n")},
+	)
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20003) AND (Path LIKE 'host.web2.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.web2.cpu\n")},
+	)
+
+	srv.AddResponce(
+		"SELECT Path FROM tenant_index WHERE ((Level=20003) AND (Path IN ('host.web3.cpu','host.web3.cpu.'))) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host.web3.cpu\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.IndexBloom.Enabled = true
+	cfg.ClickHouse.IndexBloom.MaxAge = time.Minute
+
+	b := NewIndexBloom(cfg)
+	require.NoError(t, b.Load(strings.NewReader("host.\nhost.web1.\nhost.web1.cpu\nhost.web2.\nhost.web2.cpu\n")))
+
+	assert.True(t, b.MayContain("host.web1"))
+	assert.True(t, b.MayContain("host.web1.cpu"))
+	assert.False(t, b.MayContain("host.web3.cpu"))
+
+	indexBlooms["graphite_index"] = b
+	defer delete(indexBlooms, "graphite_index")
+
+	tests := []struct {
+		table       string
+		query       string
+		want        []string
+		wantQueries uint64
+	}{
+		{"graphite_index", "host.web1.cpu", []string{"host.web1.cpu"}, 1},
+		{"graphite_index", "host.web3.cpu", []string{}, 0},
+		{"graphite_index", "host.web2.*", []string{"host.web2.cpu"}, 1},
+		// the filter of the other table is not used
+		{"tenant_index", "host.web3.cpu", []string{"host.web3.cpu"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.table+"/"+tt.query, func(t *testing.T) {
+			queries := srv.Queries()
+
+			f := NewIndex(srv.URL, tt.table, false, "", nil, clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second}, false)
+			require.NoError(t, f.Execute(context.Background(), cfg, tt.query, 0, 0))
+
+			assert.Equal(t, tt.want, bytesToStrings(f.List()))
+			assert.Equal(t, tt.wantQueries, srv.Queries()-queries)
+		})
+	}
+}
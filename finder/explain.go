@@ -0,0 +1,53 @@
+package finder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+// Chain returns the finders chain from the outer wrapper to the base finder, like [WrapBlacklist WrapTag IndexFinder]
+func Chain(f Finder) []string {
+	var chain []string
+
+	for f != nil {
+		switch w := f.(type) {
+		case *ACLFinder:
+			chain = append(chain, "WrapACL")
+			f = w.wrapped
+		case *BlacklistFinder:
+			chain = append(chain, "WrapBlacklist")
+			f = w.wrapped
+		case *PrefixFinder:
+			chain = append(chain, "WrapPrefix")
+			f = w.wrapped
+		case *TagFinder:
+			chain = append(chain, "WrapTag")
+			f = w.wrapped
+		case *ReverseFinder:
+			chain = append(chain, "WrapReverse")
+			f = w.wrapped
+		case *SplitIndexFinder:
+			chain = append(chain, "WrapSplitIndex")
+			f = w.wrapped
+		default:
+			chain = append(chain, strings.TrimPrefix(fmt.Sprintf("%T", f), "*finder."))
+			f = nil
+		}
+	}
+
+	return chain
+}
+
+// Explain executes the query in the same way as Find (but without the find cache) and returns the finders chain
+func Explain(ctx context.Context, config *config.Config, query string, from int64, until int64) (Result, []string, error) {
+	config = config.ForContext(ctx)
+
+	fnd := newPlainFinder(ctx, config, query, from, until, false)
+
+	err := fnd.Execute(ctx, config, query, from, until)
+
+	return fnd.(Result), Chain(fnd), err
+}
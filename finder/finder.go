@@ -4,8 +4,12 @@ import (
 	"context"
 	"strings"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/lomik/graphite-clickhouse/acl"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 
 	"github.com/lomik/graphite-clickhouse/config"
 )
@@ -50,10 +54,16 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 			f = WrapBlacklist(f, config.Common.Blacklist)
 		}
 
+		if access := acl.FromContext(ctx); access.Restricted() {
+			f = WrapACL(f, access, true)
+		}
+
 		return f
 	}
 
-	if config.ClickHouse.IndexTable != "" {
+	if t := replicaTree(config, from, until); t != nil {
+		f = NewReplica(t)
+	} else if config.ClickHouse.IndexTable != "" {
 		f = NewIndex(
 			config.ClickHouse.URL,
 			config.ClickHouse.IndexTable,
@@ -101,13 +111,22 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 		f = WrapBlacklist(f, config.Common.Blacklist)
 	}
 
+	if access := acl.FromContext(ctx); access.Restricted() {
+		f = WrapACL(f, access, false)
+	}
+
 	return f
 }
 
 func Find(config *config.Config, ctx context.Context, query string, from int64, until int64) (Result, error) {
+	config = config.ForContext(ctx)
+
+	ctx, span := tracing.Start(ctx, "finder.Find", attribute.String("query", query))
+
 	fnd := newPlainFinder(ctx, config, query, from, until, config.Common.FindCache != nil)
 
 	err := fnd.Execute(ctx, config, query, from, until)
+	tracing.End(span, err)
 
 	return fnd.(Result), err
 }
@@ -121,7 +140,12 @@ func Leaf(value []byte) ([]byte, bool) {
 	return value, true
 }
 
-func FindTagged(ctx context.Context, config *config.Config, terms []TaggedTerm, from int64, until int64) (Result, error) {
+func FindTagged(ctx context.Context, config *config.Config, terms []TaggedTerm, from int64, until int64) (_ Result, err error) {
+	config = config.ForContext(ctx)
+
+	ctx, span := tracing.Start(ctx, "finder.FindTagged", attribute.Int("terms", len(terms)))
+	defer func() { tracing.End(span, err) }()
+
 	opts := clickhouse.Options{
 		Timeout:                 config.ClickHouse.IndexTimeout,
 		ConnectTimeout:          config.ClickHouse.ConnectTimeout,
@@ -136,7 +160,7 @@ func FindTagged(ctx context.Context, config *config.Config, terms []TaggedTerm,
 	if plain != nil {
 		plain.wrappedPlain = newPlainFinder(ctx, config, plain.Target(), from, until, useCache)
 
-		err := plain.Execute(ctx, config, plain.Target(), from, until)
+		err = plain.Execute(ctx, config, plain.Target(), from, until)
 		if err != nil {
 			return nil, err
 		}
@@ -156,10 +180,19 @@ func FindTagged(ctx context.Context, config *config.Config, terms []TaggedTerm,
 		config.ClickHouse.TaggedCosts,
 	)
 
-	err := fnd.ExecutePrepared(ctx, terms, from, until)
+	access := acl.FromContext(ctx)
+	if !access.AllowedTagged() {
+		return nil, aclDenied(ctx, access, "seriesByTag")
+	}
+
+	err = fnd.ExecutePrepared(ctx, terms, from, until)
 	if err != nil {
 		return nil, err
 	}
 
+	if access.Restricted() {
+		return Result(WrapACL(fnd, access, true)), nil
+	}
+
 	return Result(fnd), nil
 }
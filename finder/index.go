@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/lomik/graphite-clickhouse/config"
@@ -41,6 +42,7 @@ type IndexFinder struct {
 	stats        []metrics.FinderStat
 	useCache     bool // rotate body if needed (for store in cache)
 	useDaily     bool
+	page         *Page // request
 }
 
 func NewCachedIndex(body []byte) Finder {
@@ -162,11 +164,24 @@ func addDatesToWhere(w *where.Where, useDaily bool, from, until int64) {
 }
 
 func (idx *IndexFinder) whereFilter(query string, from int64, until int64) *where.Where {
+	if idx.page != nil && idx.page.After != "" {
+		// the next pages are ordered as the first one
+		if idx.page.Reverse {
+			idx.reverse = queryReversed
+		} else {
+			idx.reverse = queryDirect
+		}
+	}
+
 	reverse := idx.useReverse(query)
 	if reverse {
 		query = ReverseString(query)
 	}
 
+	if idx.page != nil {
+		idx.page.setReverse(reverse)
+	}
+
 	idx.useDaily = useDaily(idx.dailyEnabled, from, until)
 
 	levelOffset := calculateIndexLevelOffset(idx.useDaily, reverse)
@@ -182,6 +197,10 @@ func validatePlainQuery(query string, wildcardMinDistance int) error {
 		return errs.NewErrorWithCode("query has unmatched brackets", http.StatusBadRequest)
 	}
 
+	if err := where.ValidateRegexpNodes(query); err != nil {
+		return err
+	}
+
 	var maxDist = where.MaxWildcardDistance(query)
 
 	// If the amount of nodes in a plain query is equal to 1,
@@ -202,8 +221,29 @@ func (idx *IndexFinder) Execute(ctx context.Context, config *config.Config, quer
 		return err
 	}
 
+	if config.ClickHouse.IndexBloom.Enabled && where.IndexWildcard(query) == -1 && !indexBlooms[idx.table].MayContain(query) {
+		// definitely not exists
+		return nil
+	}
+
+	idx.page = pageFromContext(ctx)
+
 	w := idx.whereFilter(query, from, until)
 
+	var order string
+
+	if idx.page != nil {
+		if idx.page.After != "" {
+			// Path is reversed in the reversed index
+			w.And(where.Gt("Path", string(idx.page.key([]byte(idx.page.After)))))
+		}
+
+		order = " ORDER BY Path"
+		if idx.page.Limit > 0 {
+			order += " LIMIT " + strconv.Itoa(idx.page.Limit)
+		}
+	}
+
 	idx.stats = append(idx.stats, metrics.FinderStat{})
 	stat := &idx.stats[len(idx.stats)-1]
 
@@ -211,7 +251,7 @@ func (idx *IndexFinder) Execute(ctx context.Context, config *config.Config, quer
 		scope.WithTable(ctx, idx.table),
 		idx.url,
 		// TODO: consider consistent query generator
-		fmt.Sprintf("SELECT Path FROM %s WHERE %s GROUP BY Path FORMAT TabSeparatedRaw", idx.table, w),
+		fmt.Sprintf("SELECT Path FROM %s WHERE %s GROUP BY Path%s FORMAT TabSeparatedRaw", idx.table, w, order),
 		idx.opts,
 		nil,
 	)
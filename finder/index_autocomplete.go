@@ -0,0 +1,153 @@
+package finder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// IndexNode is a candidate for the next node of plain path
+type IndexNode struct {
+	Name   string
+	Leaf   bool   // metric with this path exists
+	Branch bool   // node has childs
+	Count  uint64 // series under the node (including the node itself), only if requested
+}
+
+// indexAutocompleteSQL returns query for the next node candidates of the partially typed plain path.
+// Query is ended by partial node, like 'servers.web*.cp' or 'servers.web*.' (for any node).
+func indexAutocompleteSQL(table, query string, useDaily bool, from, until int64, limit int, counts bool) string {
+	glob := query + "*"
+	level := strings.Count(glob, ".") + 1
+	levelOffset := calculateIndexLevelOffset(useDaily, false)
+
+	w := where.New()
+
+	var fields string
+
+	if counts {
+		// scan all levels under the node, levels of the other index kinds starts from the next offset
+		w.Andf("Level >= %d AND Level < %d", level+levelOffset, levelOffset+ReverseLevelOffset)
+
+		if p := where.IndexWildcard(glob); p > 0 {
+			w.And(where.HasPrefix("Path", glob[:p]))
+		}
+
+		w.And(where.TreeGlob(fmt.Sprintf("arrayStringConcat(arraySlice(splitByChar('.', Path), 1, %d), '.')", level), glob))
+
+		fields = fmt.Sprintf(
+			"max(Level = %d AND NOT endsWith(Path, '.')) AS leaf, max(Level > %d OR endsWith(Path, '.')) AS branch, uniqExactIf(Path, NOT endsWith(Path, '.')) AS cnt",
+			level+levelOffset, level+levelOffset,
+		)
+	} else {
+		w.And(where.Eq("Level", level+levelOffset))
+		w.And(where.TreeGlob("Path", glob))
+
+		fields = "max(NOT endsWith(Path, '.')) AS leaf, max(endsWith(Path, '.')) AS branch"
+	}
+
+	addDatesToWhere(w, useDaily, from, until)
+
+	return fmt.Sprintf(
+		"SELECT splitByChar('.', Path)[%d] AS node, %s FROM %s %s GROUP BY node ORDER BY node LIMIT %d FORMAT TabSeparatedRaw",
+		level, fields, table, w.SQL(), limit,
+	)
+}
+
+// IndexAutocomplete returns clickhouse response with candidates for the last (partially typed) node of the plain query,
+// parse it with ParseIndexNodes
+func IndexAutocomplete(ctx context.Context, cfg *config.Config, query string, from, until int64, limit int, counts bool) ([]byte, metrics.FinderStat, error) {
+	cfg = cfg.ForContext(ctx)
+
+	stat := metrics.FinderStat{Table: cfg.ClickHouse.IndexTable}
+
+	if err := validatePlainQuery(query, cfg.ClickHouse.WildcardMinDistance); err != nil {
+		return nil, stat, err
+	}
+
+	sql := indexAutocompleteSQL(
+		cfg.ClickHouse.IndexTable, query,
+		useDaily(cfg.ClickHouse.IndexUseDaily, from, until), from, until,
+		limit, counts,
+	)
+
+	dsn := cfg.ClickHouse.URL
+	if counts && cfg.ClickHouse.AutocompleteCountsMaxRows > 0 {
+		// counts scan the whole subtree of the matched nodes
+		if u, err := url.Parse(dsn); err == nil {
+			q := u.Query()
+			q.Set("max_rows_to_read", strconv.FormatInt(cfg.ClickHouse.AutocompleteCountsMaxRows, 10))
+			u.RawQuery = q.Encode()
+			dsn = u.String()
+		}
+	}
+
+	body, chReadRows, chReadBytes, err := clickhouse.Query(
+		scope.WithTable(ctx, cfg.ClickHouse.IndexTable),
+		dsn,
+		sql,
+		clickhouse.Options{
+			TLSConfig:               cfg.ClickHouse.TLSConfig,
+			Timeout:                 cfg.ClickHouse.IndexTimeout,
+			ConnectTimeout:          cfg.ClickHouse.ConnectTimeout,
+			CheckRequestProgress:    cfg.FeatureFlags.LogQueryProgress,
+			ProgressSendingInterval: cfg.ClickHouse.ProgressSendingInterval,
+		},
+		nil,
+	)
+	stat.ChReadRows = chReadRows
+	stat.ChReadBytes = chReadBytes
+	stat.ReadBytes = int64(len(body))
+
+	return body, stat, err
+}
+
+// ParseIndexNodes parses IndexAutocomplete response
+func ParseIndexNodes(body []byte, counts bool) ([]IndexNode, error) {
+	if len(body) == 0 {
+		return []IndexNode{}, nil
+	}
+
+	fieldsCount := 3
+	if counts {
+		fieldsCount = 4
+	}
+
+	rows := bytes.Split(bytes.TrimSuffix(body, []byte{'\n'}), []byte{'\n'})
+	nodes := make([]IndexNode, 0, len(rows))
+
+	for _, row := range rows {
+		fields := strings.Split(string(row), "\t")
+		if len(fields) != fieldsCount {
+			return nil, fmt.Errorf("failed to parse index autocomplete row: %q", row)
+		}
+
+		node := IndexNode{
+			Name:   fields[0],
+			Leaf:   fields[1] == "1",
+			Branch: fields[2] == "1",
+		}
+
+		if counts {
+			var err error
+
+			node.Count, err = strconv.ParseUint(fields[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse index autocomplete row: %q: %w", row, err)
+			}
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,95 @@
+package finder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+func TestIndexAutocompleteSQL(t *testing.T) {
+	tests := []struct {
+		query    string
+		useDaily bool
+		counts   bool
+		want     string
+	}{
+		{
+			query: "",
+			want: "SELECT splitByChar('.', Path)[1] AS node, max(NOT endsWith(Path, '.')) AS leaf, max(endsWith(Path, '.')) AS branch FROM graphite_index " +
+				"WHERE (Level=20001) AND (Date='1970-02-12') GROUP BY node ORDER BY node LIMIT 100 FORMAT TabSeparatedRaw",
+		},
+		{
+			query: "servers.web*.cp",
+			want: "SELECT splitByChar('.', Path)[3] AS node, max(NOT endsWith(Path, '.')) AS leaf, max(endsWith(Path, '.')) AS branch FROM graphite_index " +
+				"WHERE ((Level=20003) AND (Path LIKE 'servers.web%' AND match(Path, '^servers[.]web([^.]*?)[.]cp([^.]*?)[.]?$'))) AND (Date='1970-02-12') GROUP BY node ORDER BY node LIMIT 100 FORMAT TabSeparatedRaw",
+		},
+		{
+			query:    "servers.",
+			useDaily: true,
+			want: "SELECT splitByChar('.', Path)[2] AS node, max(NOT endsWith(Path, '.')) AS leaf, max(endsWith(Path, '.')) AS branch FROM graphite_index " +
+				"WHERE ((Level=2) AND (Path LIKE 'servers.%')) AND (Date >='2022-11-29' AND Date <= '2022-11-29') GROUP BY node ORDER BY node LIMIT 100 FORMAT TabSeparatedRaw",
+		},
+		{
+			query:  "servers.web",
+			counts: true,
+			want: "SELECT splitByChar('.', Path)[2] AS node, max(Level = 20002 AND NOT endsWith(Path, '.')) AS leaf, max(Level > 20002 OR endsWith(Path, '.')) AS branch, uniqExactIf(Path, NOT endsWith(Path, '.')) AS cnt FROM graphite_index " +
+				"WHERE (((Level >= 20002 AND Level < 30000) AND (Path LIKE 'servers.web%')) AND (arrayStringConcat(arraySlice(splitByChar('.', Path), 1, 2), '.') LIKE 'servers.web%')) AND (Date='1970-02-12') GROUP BY node ORDER BY node LIMIT 100 FORMAT TabSeparatedRaw",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			from := int64(1669714247)
+			assert.Equal(t, tt.want, indexAutocompleteSQL("graphite_index", tt.query, tt.useDaily, from, from, 100, tt.counts))
+		})
+	}
+}
+
+func TestParseIndexNodes(t *testing.T) {
+	nodes, err := ParseIndexNodes([]byte("cpu\t1\t1\t5\nmem\t0\t1\t3\n"), true)
+	require.NoError(t, err)
+	assert.Equal(t, []IndexNode{
+		{Name: "cpu", Leaf: true, Branch: true, Count: 5},
+		{Name: "mem", Branch: true, Count: 3},
+	}, nodes)
+
+	nodes, err = ParseIndexNodes([]byte("cpu\t1\t0\n"), false)
+	require.NoError(t, err)
+	assert.Equal(t, []IndexNode{{Name: "cpu", Leaf: true}}, nodes)
+
+	_, err = ParseIndexNodes([]byte("cpu\t1\t0\n"), true)
+	assert.Error(t, err)
+}
+
+func TestIndexAutocompleteMaxRows(t *testing.T) {
+	var maxRows []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxRows = append(maxRows, r.URL.Query().Get("max_rows_to_read"))
+	}))
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL + "/?max_rows_to_read=10"
+	cfg.ClickHouse.AutocompleteCountsMaxRows = 1000
+
+	// only the counts query scans the subtree and is limited
+	_, _, err := IndexAutocomplete(context.Background(), cfg, "servers.", 0, 0, 10, false)
+	require.NoError(t, err)
+
+	_, _, err = IndexAutocomplete(context.Background(), cfg, "servers.", 0, 0, 10, true)
+	require.NoError(t, err)
+
+	cfg.ClickHouse.AutocompleteCountsMaxRows = 0
+
+	_, _, err = IndexAutocomplete(context.Background(), cfg, "servers.", 0, 0, 10, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"10", "1000", "10"}, maxRows)
+}
@@ -0,0 +1,93 @@
+package finder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// indexLoader periodically reads the query result (usually paths from the index table) in background
+type indexLoader struct {
+	name     string // logger name
+	url      string
+	table    string
+	query    string
+	opts     clickhouse.Options
+	interval time.Duration
+	// load consumes the query result and returns fields for the log
+	load func(r io.Reader) ([]zap.Field, error)
+	// buildQuery overrides query, if set (for queries depended on the current time)
+	buildQuery func() string
+}
+
+func (l *indexLoader) update(ctx context.Context) error {
+	logger := zapwriter.Logger(l.name)
+	start := time.Now()
+
+	ctx = scope.WithTable(ctx, l.table)
+
+	var fields []zap.Field
+
+	query := l.query
+	if l.buildQuery != nil {
+		query = l.buildQuery()
+	}
+
+	reader, err := clickhouse.Reader(ctx, l.url, query, l.opts, nil)
+	if err == nil {
+		fields, err = l.load(reader)
+		reader.Close()
+	}
+
+	if err != nil {
+		logger.Error("load failed", zap.String("table", l.table), zap.Error(err))
+		return err
+	}
+
+	fields = append(fields, zap.String("table", l.table), zap.Duration("runtime", time.Since(start)))
+	logger.Info("loaded", fields...)
+
+	return nil
+}
+
+// worker reloads the data until ctx is done
+func (l *indexLoader) worker(ctx context.Context) {
+	for {
+		delay := l.interval
+
+		if err := l.update(ctx); err != nil && delay > time.Minute {
+			// retry failed load earlier
+			delay = time.Minute
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// indexTreeQuery returns query for all paths from the tree part of the index table
+func indexTreeQuery(table string) string {
+	return fmt.Sprintf(
+		"SELECT Path FROM %s WHERE Date = '%s' AND Level >= %d AND Level < %d GROUP BY Path",
+		table, DefaultTreeDate, TreeLevelOffset, ReverseTreeLevelOffset,
+	)
+}
+
+// indexDailyQuery returns query for the paths from the direct daily part of the index table since the date
+func indexDailyQuery(table string, from time.Time) string {
+	return fmt.Sprintf(
+		"SELECT Path FROM %s WHERE Date >= '%s' AND Level < %d GROUP BY Path",
+		table, date.FromTimeToDaysFormat(from), ReverseLevelOffset,
+	)
+}
@@ -183,6 +183,22 @@ func TestIndexFinder_whereFilter(t *testing.T) {
 			want: "((Level=10002) AND (Path LIKE 'metric.%' AND match(Path, '^metric[.]([^.]*?)test[.]?$'))) AND (Date >='" +
 				date.FromTimestampToDaysFormat(1668124800) + "' AND Date <= '" + date.UntilTimestampToDaysFormat(1668124810) + "')",
 		},
+		{
+			name:         "nodaily regexp node (direct)",
+			query:        "test.~^web-(eu|us)-[0-9]+$.cpu",
+			from:         1668106860,
+			until:        1668106870,
+			dailyEnabled: false,
+			want:         "((Level=20003) AND (Path LIKE 'test.%' AND match(Path, '^test[.](?:web-(eu|us)-[0-9]+)[.]cpu[.]?$'))) AND (Date='1970-02-12')",
+		},
+		{
+			name:         "nodaily regexp node (reverse)",
+			query:        "~^web-(eu|us)$.cpu.load",
+			from:         1668106860,
+			until:        1668106870,
+			dailyEnabled: false,
+			want:         "((Level=30003) AND (Path LIKE 'load.cpu.%' AND match(Path, '^load[.]cpu[.](?:web-(eu|us))[.]?$'))) AND (Date='1970-02-12')",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name+" "+time.Unix(tt.from, 0).Format(time.RFC3339), func(t *testing.T) {
@@ -0,0 +1,74 @@
+package finder
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+)
+
+// Page limits the plain find result to the paths after the cursor (in the sort order by Path)
+type Page struct {
+	After   string // last path from the previous page, directories are with a trailing dot
+	Limit   int
+	Reverse bool // paths are ordered by the reversed path (as in the reversed index), set by the finder for the first page
+
+	parent *Page // page with the prefix, see trimPrefix
+}
+
+type pageKey struct{}
+
+// WithPage returns the context with the find page. Finders, which can, read the page from the context and limit the query
+func WithPage(ctx context.Context, page *Page) context.Context {
+	return context.WithValue(ctx, pageKey{}, page)
+}
+
+func pageFromContext(ctx context.Context) *Page {
+	page, _ := ctx.Value(pageKey{}).(*Page)
+	return page
+}
+
+// setReverse sets the order of the page (and of the page with the prefix)
+func (p *Page) setReverse(reverse bool) {
+	for ; p != nil; p = p.parent {
+		p.Reverse = reverse
+	}
+}
+
+func (p *Page) key(path []byte) []byte {
+	if p.Reverse {
+		return ReverseBytes(path)
+	}
+
+	return path
+}
+
+// Apply sorts rows and returns the page from it
+func (p *Page) Apply(rows [][]byte) [][]byte {
+	if p == nil {
+		return rows
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(p.key(rows[i]), p.key(rows[j])) < 0 })
+
+	if p.After != "" {
+		after := p.key([]byte(p.After))
+		i := sort.Search(len(rows), func(i int) bool { return bytes.Compare(p.key(rows[i]), after) > 0 })
+		rows = rows[i:]
+	}
+
+	if p.Limit > 0 && len(rows) > p.Limit {
+		rows = rows[:p.Limit]
+	}
+
+	return rows
+}
+
+// trimPrefix returns the page for the paths without prefix (with a trailing dot)
+func (p *Page) trimPrefix(prefix string) *Page {
+	if p == nil || !strings.HasPrefix(p.After, prefix) {
+		return p
+	}
+
+	return &Page{After: p.After[len(prefix):], Limit: p.Limit, Reverse: p.Reverse, parent: p}
+}
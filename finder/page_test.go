@@ -0,0 +1,33 @@
+package finder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageApply(t *testing.T) {
+	rows := func() [][]byte {
+		return [][]byte{[]byte("a.c"), []byte("a.b."), []byte("a.a"), []byte("a.b"), []byte("a.d.")}
+	}
+
+	tests := []struct {
+		name string
+		page *Page
+		want []string
+	}{
+		{"nil", nil, []string{"a.c", "a.b.", "a.a", "a.b", "a.d."}},
+		{"limit", &Page{Limit: 2}, []string{"a.a", "a.b"}},
+		{"after", &Page{After: "a.b"}, []string{"a.b.", "a.c", "a.d."}},
+		{"after and limit", &Page{After: "a.b.", Limit: 1}, []string{"a.c"}},
+		{"after last", &Page{After: "a.d.", Limit: 1}, []string{}},
+		{"reverse", &Page{Limit: 3, Reverse: true}, []string{"a.b.", "a.d.", "a.a"}},
+		{"reverse after", &Page{After: "a.b.", Limit: 3, Reverse: true}, []string{"a.d.", "a.a", "a.b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, bytesToStrings(tt.page.Apply(rows())))
+		})
+	}
+}
@@ -77,6 +77,10 @@ func (p *PrefixFinder) Execute(ctx context.Context, config *config.Config, query
 
 	p.matched = PrefixMatched
 
+	if page := pageFromContext(ctx); page != nil {
+		ctx = WithPage(ctx, page.trimPrefix(string(p.prefixBytes)))
+	}
+
 	return p.wrapped.Execute(ctx, config, strings.Join(qs[len(ps):], "."), from, until)
 }
 
@@ -0,0 +1,224 @@
+package finder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/msaf1980/go-stringutils"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tree"
+)
+
+// IndexReplica is an in-memory copy of the index tree, periodically reloaded from ClickHouse
+type IndexReplica struct {
+	mu       sync.RWMutex
+	tree     *tree.Tree
+	updated  time.Time
+	maxAge   time.Duration
+	maxNodes int
+
+	loader indexLoader
+}
+
+// indexReplica is set up once by StartIndexReplica
+var indexReplica *IndexReplica
+
+// NewIndexReplica returns not loaded *IndexReplica for index (or tree) table from config
+func NewIndexReplica(cfg *config.Config) *IndexReplica {
+	r := &IndexReplica{
+		maxAge:   cfg.ClickHouse.IndexReplica.MaxAge,
+		maxNodes: cfg.ClickHouse.IndexReplica.MaxNodes,
+		loader: indexLoader{
+			name: "index-replica",
+			url:  cfg.ClickHouse.URL,
+			opts: clickhouse.Options{
+				TLSConfig:               cfg.ClickHouse.TLSConfig,
+				Timeout:                 cfg.ClickHouse.IndexReplica.LoadTimeout,
+				ConnectTimeout:          cfg.ClickHouse.ConnectTimeout,
+				CheckRequestProgress:    cfg.FeatureFlags.LogQueryProgress,
+				ProgressSendingInterval: cfg.ClickHouse.ProgressSendingInterval,
+			},
+			interval: cfg.ClickHouse.IndexReplica.Interval,
+		},
+	}
+
+	// ORDER BY is not required, but sorted input is much faster to insert into the tree
+	var suffix string
+	if r.maxNodes > 0 {
+		// the extra row is enough to detect the overflow
+		suffix = fmt.Sprintf(" LIMIT %d", r.maxNodes+1)
+	}
+
+	if days := cfg.ClickHouse.IndexReplica.Days; days > 0 {
+		r.loader.table = cfg.ClickHouse.IndexTable
+		r.loader.buildQuery = func() string {
+			return indexDailyQuery(cfg.ClickHouse.IndexTable, time.Now().AddDate(0, 0, -days)) + " ORDER BY Path" + suffix
+		}
+	} else if cfg.ClickHouse.IndexTable != "" {
+		r.loader.table = cfg.ClickHouse.IndexTable
+		r.loader.query = indexTreeQuery(cfg.ClickHouse.IndexTable) + " ORDER BY Path" + suffix
+	} else {
+		r.loader.table = cfg.ClickHouse.TreeTable
+		r.loader.query = fmt.Sprintf("SELECT Path FROM %s GROUP BY Path ORDER BY Path", cfg.ClickHouse.TreeTable) + suffix
+	}
+
+	r.loader.load = func(reader io.Reader) ([]zap.Field, error) {
+		if err := r.Load(reader); err != nil {
+			return nil, err
+		}
+
+		t := r.Tree()
+
+		return []zap.Field{zap.Int("nodes", t.Nodes()), zap.Int("metrics", t.Leafs())}, nil
+	}
+
+	return r
+}
+
+// StartIndexReplica starts the index tree loader until ctx is done. Does nothing if index-replica is disabled
+func StartIndexReplica(ctx context.Context, cfg *config.Config) {
+	if indexReplica != nil || !cfg.ClickHouse.IndexReplica.Enabled {
+		return
+	}
+
+	indexReplica = NewIndexReplica(cfg)
+
+	go indexReplica.loader.worker(ctx)
+}
+
+// Tree returns the loaded tree or nil if it's not loaded yet or stale
+func (r *IndexReplica) Tree() *tree.Tree {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.tree == nil || time.Since(r.updated) > r.maxAge {
+		return nil
+	}
+
+	return r.tree
+}
+
+// Load reads paths from reader (one per line) and replaces the tree.
+// If there are more than max-nodes rows (the result is truncated by the query limit) or the tree has more than
+// max-nodes nodes, the replica is dropped
+func (r *IndexReplica) Load(reader io.Reader) error {
+	t := tree.New()
+
+	var rows int
+
+	s := bufio.NewScanner(reader)
+	for s.Scan() {
+		t.Add(stringutils.UnsafeString(s.Bytes()))
+		rows++
+
+		if r.maxNodes > 0 && (rows > r.maxNodes || t.Nodes() > r.maxNodes) {
+			r.mu.Lock()
+			r.tree = nil
+			r.mu.Unlock()
+
+			if rows > r.maxNodes {
+				return fmt.Errorf("index has more than %d paths", r.maxNodes)
+			}
+
+			return fmt.Errorf("index tree has more than %d nodes", r.maxNodes)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.tree = t
+	r.updated = time.Now()
+	r.mu.Unlock()
+
+	return nil
+}
+
+func replicaTree(cfg *config.Config, from, until int64) *tree.Tree {
+	if !cfg.ClickHouse.IndexReplica.Enabled {
+		return nil
+	}
+
+	if (from > 0 || until > 0) && !cfg.ClickHouse.IndexReplica.UseInRender {
+		return nil
+	}
+
+	if days := cfg.ClickHouse.IndexReplica.Days; days > 0 && from > 0 && from < time.Now().AddDate(0, 0, -days).Unix() {
+		// the replica has no paths older than days
+		return nil
+	}
+
+	return indexReplica.Tree()
+}
+
+// ReplicaFinder answers plain queries from the in-memory index tree
+type ReplicaFinder struct {
+	tree *tree.Tree
+	rows [][]byte
+}
+
+func NewReplica(t *tree.Tree) *ReplicaFinder {
+	return &ReplicaFinder{tree: t}
+}
+
+func (f *ReplicaFinder) Execute(ctx context.Context, config *config.Config, query string, from int64, until int64) (err error) {
+	err = validatePlainQuery(query, config.ClickHouse.WildcardMinDistance)
+	if err != nil {
+		return err
+	}
+
+	if f.rows, err = f.tree.Match(query); err != nil {
+		return
+	}
+
+	f.rows = pageFromContext(ctx).Apply(f.rows)
+
+	return
+}
+
+func (f *ReplicaFinder) List() [][]byte {
+	if f.rows == nil {
+		return [][]byte{}
+	}
+
+	return f.rows
+}
+
+func (f *ReplicaFinder) Series() [][]byte {
+	rows := make([][]byte, 0, len(f.rows))
+
+	for _, row := range f.rows {
+		if row[len(row)-1] != '.' {
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+func (f *ReplicaFinder) Abs(v []byte) []byte {
+	return v
+}
+
+func (f *ReplicaFinder) Bytes() ([]byte, error) {
+	return bytes.Join(f.rows, []byte{'\n'}), nil
+}
+
+func (f *ReplicaFinder) Stats() []metrics.FinderStat {
+	return []metrics.FinderStat{}
+}
@@ -0,0 +1,108 @@
+package finder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/date"
+)
+
+func TestReplicaFinder(t *testing.T) {
+	cfg := config.New()
+	cfg.ClickHouse.IndexReplica.Enabled = true
+	cfg.ClickHouse.IndexReplica.MaxAge = time.Minute
+
+	r := NewIndexReplica(cfg)
+	assert.Nil(t, r.Tree())
+
+	body := "host.\nhost.web1.\nhost.web1.cpu\nhost.web2.\nhost.web2.cpu\nhost.web2.cpu.\nhost.web2.cpu.user\n"
+	require.NoError(t, r.Load(strings.NewReader(body)))
+	require.NotNil(t, r.Tree())
+
+	tests := []struct {
+		query      string
+		wantList   []string
+		wantSeries []string
+	}{
+		{"host.*", []string{"host.web1.", "host.web2."}, []string{}},
+		{"host.web?.cpu", []string{"host.web1.cpu", "host.web2.cpu.", "host.web2.cpu"}, []string{"host.web1.cpu", "host.web2.cpu"}},
+		{"host.web2.cpu.*", []string{"host.web2.cpu.user"}, []string{"host.web2.cpu.user"}},
+		{"host.web3.*", []string{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f := NewReplica(r.Tree())
+			require.NoError(t, f.Execute(context.Background(), cfg, tt.query, 0, 0))
+
+			assert.Equal(t, tt.wantList, bytesToStrings(f.List()), "list")
+			assert.Equal(t, tt.wantSeries, bytesToStrings(f.Series()), "series")
+		})
+	}
+
+	// stale replica is not used
+	r.updated = time.Now().Add(-2 * time.Minute)
+	assert.Nil(t, r.Tree())
+}
+
+func bytesToStrings(rows [][]byte) []string {
+	s := make([]string, 0, len(rows))
+	for _, row := range rows {
+		s = append(s, string(row))
+	}
+
+	return s
+}
+
+func TestReplicaMaxNodes(t *testing.T) {
+	cfg := config.New()
+	cfg.ClickHouse.IndexReplica.Enabled = true
+	cfg.ClickHouse.IndexReplica.MaxAge = time.Minute
+	cfg.ClickHouse.IndexReplica.MaxNodes = 3
+
+	r := NewIndexReplica(cfg)
+	assert.True(t, strings.HasSuffix(r.loader.query, " ORDER BY Path LIMIT 4"), r.loader.query)
+
+	require.NoError(t, r.Load(strings.NewReader("host.\nhost.web1.\nhost.web1.cpu\n")))
+	require.NotNil(t, r.Tree())
+
+	// too big tree is dropped, queries fall back to clickhouse
+	assert.EqualError(t, r.Load(strings.NewReader("host.web1.cpu\nhost.web2.cpu\n")), "index tree has more than 3 nodes")
+	assert.Nil(t, r.Tree())
+
+	// the rows of the same node are truncated by the query limit too
+	require.NoError(t, r.Load(strings.NewReader("host.\nhost.web1.\nhost.web1.cpu\n")))
+	assert.EqualError(t, r.Load(strings.NewReader("host.\nhost.\nhost.web1.\nhost.web1.cpu\n")), "index has more than 3 paths")
+	assert.Nil(t, r.Tree())
+}
+
+func TestReplicaDays(t *testing.T) {
+	cfg := config.New()
+	cfg.ClickHouse.IndexReplica.Enabled = true
+	cfg.ClickHouse.IndexReplica.MaxAge = time.Minute
+	cfg.ClickHouse.IndexReplica.UseInRender = true
+	cfg.ClickHouse.IndexReplica.Days = 2
+	cfg.ClickHouse.IndexReplica.MaxNodes = 0
+
+	r := NewIndexReplica(cfg)
+	from := date.FromTimeToDaysFormat(time.Now().AddDate(0, 0, -2))
+	assert.Equal(t, "SELECT Path FROM graphite_index WHERE Date >= '"+from+"' AND Level < 10000 GROUP BY Path ORDER BY Path", r.loader.buildQuery())
+
+	require.NoError(t, r.Load(strings.NewReader("host.\nhost.web1.\nhost.web1.cpu\n")))
+
+	defer func() { indexReplica = nil }()
+
+	indexReplica = r
+
+	now := time.Now().Unix()
+	assert.NotNil(t, replicaTree(cfg, 0, 0))
+	assert.NotNil(t, replicaTree(cfg, now-86400, now))
+	// the older time range is not in the replica
+	assert.Nil(t, replicaTree(cfg, now-3*86400, now))
+}
@@ -57,7 +57,7 @@ func (r *ReverseFinder) Execute(ctx context.Context, config *config.Config, quer
 		return r.wrapped.Execute(ctx, config, query, from, until)
 	}
 
-	if where.HasWildcard(query[p+1:]) {
+	if where.IndexWildcard(query[p+1:]) != -1 {
 		return r.wrapped.Execute(ctx, config, query, from, until)
 	}
 
@@ -81,12 +81,14 @@ func (splitFinder *SplitIndexFinder) Execute(
 		return errs.NewErrorWithCode("query has unmatched brackets", http.StatusBadRequest)
 	}
 
+	// regexp nodes can contain braces, hide it from lists expanding
+	query, regexpNodes := where.MaskRegexpNodes(query)
 	query = where.ClearGlob(query)
 
 	idx := strings.IndexAny(query, "{}")
-	if idx == -1 {
+	if idx == -1 || pageFromContext(ctx) != nil {
 		splitFinder.useWrapped = true
-		return splitFinder.wrapped.Execute(ctx, config, query, from, until)
+		return splitFinder.wrapped.Execute(ctx, config, where.UnmaskRegexpNodes(query, regexpNodes), from, until)
 	}
 
 	splitQueries, err := splitQuery(query, config.ClickHouse.MaxNodeToSplitIndex)
@@ -94,9 +96,13 @@ func (splitFinder *SplitIndexFinder) Execute(
 		return err
 	}
 
+	for i := range splitQueries {
+		splitQueries[i] = where.UnmaskRegexpNodes(splitQueries[i], regexpNodes)
+	}
+
 	if len(splitQueries) <= 1 {
 		splitFinder.useWrapped = true
-		return splitFinder.wrapped.Execute(ctx, config, query, from, until)
+		return splitFinder.wrapped.Execute(ctx, config, where.UnmaskRegexpNodes(query, regexpNodes), from, until)
 	}
 
 	w, err := splitFinder.whereFilter(splitQueries, from, until)
@@ -247,7 +253,7 @@ func (splitFinder *SplitIndexFinder) whereFilter(queries []string, from, until i
 			return nil, err
 		}
 
-		if queryWithWildcardIdx < 0 && where.HasWildcard(q) {
+		if queryWithWildcardIdx < 0 && where.IndexWildcard(q) != -1 {
 			queryWithWildcardIdx = i
 		}
 	}
@@ -269,7 +275,7 @@ func (splitFinder *SplitIndexFinder) whereFilter(queries []string, from, until i
 			q = ReverseString(q)
 		}
 
-		if !where.HasWildcard(q) {
+		if where.IndexWildcard(q) == -1 {
 			nonWildcardQueries = append(nonWildcardQueries, q, q+".")
 		} else {
 			aggregatedWhere.Or(where.TreeGlob("Path", q))
@@ -1,6 +1,7 @@
 package finder
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"testing"
@@ -10,7 +11,9 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/date"
 	"github.com/lomik/graphite-clickhouse/helper/errs"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_splitQuery(t *testing.T) {
@@ -321,6 +324,15 @@ func TestSplitIndexFinder_whereFilter(t *testing.T) {
 			expectedWhereStr: "((((Path LIKE 'count.metric.%' AND match(Path, '^count[.]metric[.]([^.]*?)first[.]help[.]?$')) OR (Path LIKE 'count.metric.th%' AND match(Path, '^count[.]metric[.]th([^.]*?)rd[.]help[.]?$'))) OR (Path IN ('count.metric.second.help','count.metric.second.help.','count.metric.forth.help','count.metric.forth.help.'))) AND (Level=10004)) AND (Date >='" +
 				date.FromTimestampToDaysFormat(someFrom) + "' AND Date <= '" + date.UntilTimestampToDaysFormat(someUntil) + "')",
 		},
+		{
+			name: "regexp node in queries, reverse preferred, no daily",
+			givenQueries: []string{
+				"~^web-[0-9]{1,2}$.first.metric",
+				"~^web-[0-9]{1,2}$.second.metric",
+			},
+			dailyEnabled:     false,
+			expectedWhereStr: "(((Path LIKE 'metric.first.%' AND match(Path, '^metric[.]first[.](?:web-[0-9]{1,2})[.]?$')) OR (Path LIKE 'metric.second.%' AND match(Path, '^metric[.]second[.](?:web-[0-9]{1,2})[.]?$'))) AND (Level=30003)) AND (Date='1970-02-12')",
+		},
 		{
 			name: "queries do not satisfy wildcard min distance",
 			givenQueries: []string{
@@ -355,3 +367,25 @@ func TestSplitIndexFinder_whereFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitIndexFinder_ExecuteRegexpNode(t *testing.T) {
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE (((Path LIKE 'a.%' AND match(Path, '^a[.](?:web-[0-9]{1,2})[.]cpu[.]?$')) OR (Path LIKE 'b.%' AND match(Path, '^b[.](?:web-[0-9]{1,2})[.]cpu[.]?$'))) AND (Level=20003)) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("a.web-1.cpu\nb.web-22.cpu\n")},
+	)
+
+	cfg := config.New()
+	cfg.ClickHouse.MaxNodeToSplitIndex = 1
+
+	opts := clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second}
+	f := WrapSplitIndex(NewIndex(srv.URL, "graphite_index", false, "", nil, opts, false), 0, srv.URL, "graphite_index", false, "", nil, opts, false)
+
+	err := f.Execute(context.Background(), cfg, "{a,b}.~^web-[0-9]{1,2}$.cpu", 0, 0)
+	require.NoError(t, err)
+
+	assert.False(t, f.useWrapped)
+	assert.Equal(t, []string{"a.web-1.cpu", "b.web-22.cpu"}, bytesToStrings(f.List()))
+}
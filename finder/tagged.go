@@ -40,6 +40,9 @@ type TaggedTerm struct {
 	Op          TaggedTermOp
 	Value       string
 	HasWildcard bool // only for TaggedTermEq
+	// only for TaggedTermMatch and TaggedTermNotMatch
+	CaseInsensitive bool // =~* or =~(?i), match value case-insensitive
+	Anchored        bool // ==~, regex must match the whole value
 
 	NonDefaultCost bool
 	Cost           int // tag cost for use ad primary filter (use tag with maximal selectivity). 0 by default, minimal is better.
@@ -116,6 +119,20 @@ func (term *TaggedTerm) concatMask() string {
 	return fmt.Sprintf("%s=%s", term.Key, v)
 }
 
+// match returns regex condition for TaggedTermMatch and TaggedTermNotMatch terms
+func (term *TaggedTerm) match(field string) string {
+	value := term.Value
+	if term.Anchored {
+		value = where.AnchorRegex(value)
+	}
+
+	if term.CaseInsensitive {
+		return where.MatchCaseInsensitive(field, term.Key, value)
+	}
+
+	return where.Match(field, term.Key, value)
+}
+
 func TaggedTermWhere1(term *TaggedTerm, useCarbonBehaviour, dontMatchMissingTags bool) (string, error) {
 	// positive expression check only in Tag1
 	// negative check in all Tags
@@ -176,14 +193,14 @@ func TaggedTermWhere1(term *TaggedTerm, useCarbonBehaviour, dontMatchMissingTags
 			return fmt.Sprintf("%sNOT arrayExists((x) -> %s, Tags)", whereLikeAnyVal, whereEq), nil
 		}
 	case TaggedTermMatch:
-		return where.Match("Tag1", term.Key, term.Value), nil
+		return term.match("Tag1"), nil
 	case TaggedTermNotMatch:
 		var whereLikeAnyVal string
 		if dontMatchMissingTags {
 			whereLikeAnyVal = where.HasPrefix("Tag1", term.Key+"=") + " AND "
 		}
 
-		whereMatch := where.Match("x", term.Key, term.Value)
+		whereMatch := term.match("x")
 
 		return fmt.Sprintf("%sNOT arrayExists((x) -> %s, Tags)", whereLikeAnyVal, whereMatch), nil
 	default:
@@ -255,14 +272,14 @@ func TaggedTermWhereN(term *TaggedTerm, useCarbonBehaviour, dontMatchMissingTags
 			return fmt.Sprintf("%sNOT arrayExists((x) -> %s, Tags)", whereLikeAnyVal, whereEq), nil
 		}
 	case TaggedTermMatch:
-		return fmt.Sprintf("arrayExists((x) -> %s, Tags)", where.Match("x", term.Key, term.Value)), nil
+		return fmt.Sprintf("arrayExists((x) -> %s, Tags)", term.match("x")), nil
 	case TaggedTermNotMatch:
 		var whereLikeAnyVal string
 		if dontMatchMissingTags {
 			whereLikeAnyVal = fmt.Sprintf("arrayExists((x) -> %s, Tags) AND ", where.HasPrefix("x", term.Key+"="))
 		}
 
-		whereMatch := where.Match("x", term.Key, term.Value)
+		whereMatch := term.match("x")
 
 		return fmt.Sprintf("%sNOT arrayExists((x) -> %s, Tags)", whereLikeAnyVal, whereMatch), nil
 	default:
@@ -272,7 +289,8 @@ func TaggedTermWhereN(term *TaggedTerm, useCarbonBehaviour, dontMatchMissingTags
 
 func setCost(term *TaggedTerm, costs *config.Costs) {
 	if term.Op == TaggedTermEq || term.Op == TaggedTermMatch {
-		if len(costs.ValuesCost) > 0 {
+		// values costs are set for exact values, so not used for case-insensitive regex
+		if len(costs.ValuesCost) > 0 && !term.CaseInsensitive {
 			if cost, ok := costs.ValuesCost[term.Value]; ok {
 				term.Cost = cost
 				term.NonDefaultCost = true
@@ -310,9 +328,24 @@ func ParseTaggedConditions(conditions []string, config *config.Config, autocompl
 			a[0] = strings.TrimSpace(a[0][:len(a[0])-1])
 		}
 
+		if len(a[1]) > 1 && a[1][0] == '=' && a[1][1] == '~' {
+			// ==~ is a fully anchored regex
+			terms[i].Anchored = true
+			a[1] = a[1][1:]
+		}
+
 		if len(a[1]) > 0 && a[1][0] == '~' {
 			op = op + "~"
 			a[1] = strings.TrimSpace(a[1][1:])
+
+			// =~* or =~(?i) is a case-insensitive regex, but =~* (without value) matches any value
+			if len(a[1]) > 1 && a[1][0] == '*' {
+				terms[i].CaseInsensitive = true
+				a[1] = strings.TrimSpace(a[1][1:])
+			} else if strings.HasPrefix(a[1], "(?i)") {
+				terms[i].CaseInsensitive = true
+				a[1] = a[1][4:]
+			}
 		}
 
 		terms[i].Key = a[0]
@@ -607,7 +640,17 @@ func (t *TaggedFinder) PrepareTaggedTerms(ctx context.Context, cfg *config.Confi
 	}
 
 	if t.tag1CountTable != "" {
-		err = t.SetCostsFromCountTable(ctx, terms, from, until)
+		var counts map[string]int
+		if cfg.ClickHouse.TagsCountSnapshot.Enabled {
+			counts = tagsCountSnapshot.Counts()
+		}
+
+		if counts != nil {
+			err = t.SetCostsFromSnapshot(ctx, counts, terms, from, until)
+		} else {
+			err = t.SetCostsFromCountTable(ctx, terms, from, until)
+		}
+
 		if err != nil {
 			return nil, err
 		}
@@ -647,6 +690,11 @@ func SortTaggedTermsByCost(terms []TaggedTerm) {
 				return true
 			}
 
+			if terms[i].Op == TaggedTermMatch && terms[i].CaseInsensitive != terms[j].CaseInsensitive {
+				// case-insensitive regex can't use the value prefix for index search
+				return !terms[i].CaseInsensitive
+			}
+
 			if terms[i].Cost != terms[j].Cost && terms[i].HasWildcard == terms[j].HasWildcard {
 				// compare taggs costs
 				return terms[i].Cost < terms[j].Cost
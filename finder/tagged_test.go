@@ -82,6 +82,16 @@ func TestTaggedWhere(t *testing.T) {
 		{"seriesByTag('dc!=de', 'cpu=cpu-total')", 0, "(Tag1='cpu=cpu-total') AND (NOT arrayExists((x) -> x='dc=de', Tags))", "", false},
 		{"seriesByTag('dc!=de', 'cpu!=cpu-total')", 0, "(NOT arrayExists((x) -> x='dc=de', Tags)) AND (NOT arrayExists((x) -> x='cpu=cpu-total', Tags))", "", false},
 		{"seriesByTag('dc!=~de|us', 'cpu=cpu-total')", 0, "(Tag1='cpu=cpu-total') AND (NOT arrayExists((x) -> x LIKE 'dc=%' AND match(x, '^dc=.*(de|us)'), Tags))", "", false},
+		// case-insensitive regex
+		{"seriesByTag('name=~*web')", 0, "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=(?i).*web')", "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=(?i).*web')", false},
+		{"seriesByTag('name=~(?i)web')", 0, "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=(?i).*web')", "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=(?i).*web')", false},
+		{"seriesByTag('name=rps', 'host=~*Web')", 0, "(Tag1='__name__=rps') AND (arrayExists((x) -> x LIKE 'host=%' AND match(x, '^host=(?i).*Web'), Tags))", "", false},
+		{"seriesByTag('name=rps', 'host!=~*web')", 0, "(Tag1='__name__=rps') AND (NOT arrayExists((x) -> x LIKE 'host=%' AND match(x, '^host=(?i).*web'), Tags))", "", false},
+		// anchored regex
+		{"seriesByTag('name==~web|db')", 0, "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=((web|db)$)')", "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=((web|db)$)')", false},
+		{"seriesByTag('name=rps', 'host==~web-01')", 0, "(Tag1='__name__=rps') AND (arrayExists((x) -> x='host=web-01', Tags))", "", false},
+		{"seriesByTag('name=rps', 'host!==~web.*')", 0, "(Tag1='__name__=rps') AND (NOT arrayExists((x) -> x LIKE 'host=web%' AND match(x, '^host=web.*$'), Tags))", "", false},
+		{"seriesByTag('name==~*^web.*$')", 0, "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=(?i)web.*$')", "Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%' AND match(Tag1, '^__name__=(?i)web.*$')", false},
 	}
 
 	for i, test := range table {
@@ -475,6 +485,26 @@ func TestParseSeriesByTag(t *testing.T) {
 		{Op: TaggedTermEq, Key: "cpu", Value: "cpu-total"},
 		{Op: TaggedTermMatch, Key: "host", Value: `Vladimirs-MacBook-Pro\.local`},
 	})
+
+	ok(`seriesByTag('host=~*web')`, []TaggedTerm{
+		{Op: TaggedTermMatch, Key: "host", Value: "web", CaseInsensitive: true},
+	})
+
+	ok(`seriesByTag('host=~(?i)web')`, []TaggedTerm{
+		{Op: TaggedTermMatch, Key: "host", Value: "web", CaseInsensitive: true},
+	})
+
+	ok(`seriesByTag('host=~*')`, []TaggedTerm{
+		{Op: TaggedTermMatch, Key: "host", Value: "*"},
+	})
+
+	ok(`seriesByTag('host==~web')`, []TaggedTerm{
+		{Op: TaggedTermMatch, Key: "host", Value: "web", Anchored: true},
+	})
+
+	ok(`seriesByTag('host!==~*web')`, []TaggedTerm{
+		{Op: TaggedTermNotMatch, Key: "host", Value: "web", CaseInsensitive: true, Anchored: true},
+	})
 }
 
 func newInt(i int) *int {
@@ -589,6 +619,13 @@ func TestParseSeriesByTagWithCosts(t *testing.T) {
 		{Op: TaggedTermMatch, Key: "dc", Value: "west.*"},
 		{Op: TaggedTermMatch, Key: "key2", Value: "^val.*4$"},
 	})
+
+	// case-insensitive match is after case-sensitive, values cost is not used for it
+	ok(`seriesByTag('key=~*^val.*4$', 'environment=production', 'dc=~west.*')`, []TaggedTerm{
+		{Op: TaggedTermEq, Key: "environment", Value: "production", Cost: 100, NonDefaultCost: true},
+		{Op: TaggedTermMatch, Key: "dc", Value: "west.*"},
+		{Op: TaggedTermMatch, Key: "key", Value: "^val.*4$", CaseInsensitive: true},
+	})
 }
 
 func BenchmarkParseSeriesByTag(b *testing.B) {
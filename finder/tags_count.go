@@ -0,0 +1,210 @@
+package finder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/msaf1980/go-stringutils"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+// TagsCountSnapshot is a periodically reloaded in-memory copy of the tag-value counts from tags-count-table
+type TagsCountSnapshot struct {
+	mu      sync.RWMutex
+	counts  map[string]int // Tag1 (tag=value) -> count
+	updated time.Time
+	maxAge  time.Duration
+
+	loader indexLoader
+}
+
+// tagsCountSnapshot is set up once by StartTagsCountSnapshot
+var tagsCountSnapshot *TagsCountSnapshot
+
+// NewTagsCountSnapshot returns not loaded *TagsCountSnapshot for tags count table from config
+func NewTagsCountSnapshot(cfg *config.Config) *TagsCountSnapshot {
+	s := &TagsCountSnapshot{
+		maxAge: cfg.ClickHouse.TagsCountSnapshot.MaxAge,
+		loader: indexLoader{
+			name:  "tags-count-snapshot",
+			url:   cfg.ClickHouse.URL,
+			table: cfg.ClickHouse.TagsCountTable,
+			buildQuery: func() string {
+				return tagsCountSnapshotQuery(cfg.ClickHouse.TagsCountTable, time.Now().AddDate(0, 0, -cfg.ClickHouse.TagsCountSnapshot.Days))
+			},
+			opts: clickhouse.Options{
+				TLSConfig:               cfg.ClickHouse.TLSConfig,
+				Timeout:                 cfg.ClickHouse.TagsCountSnapshot.LoadTimeout,
+				ConnectTimeout:          cfg.ClickHouse.ConnectTimeout,
+				CheckRequestProgress:    cfg.FeatureFlags.LogQueryProgress,
+				ProgressSendingInterval: cfg.ClickHouse.ProgressSendingInterval,
+			},
+			interval: cfg.ClickHouse.TagsCountSnapshot.Interval,
+		},
+	}
+
+	s.loader.load = func(reader io.Reader) ([]zap.Field, error) {
+		if err := s.Load(reader); err != nil {
+			return nil, err
+		}
+
+		s.mu.RLock()
+		n := len(s.counts)
+		s.mu.RUnlock()
+
+		return []zap.Field{zap.Int("items", n)}, nil
+	}
+
+	return s
+}
+
+// StartTagsCountSnapshot starts the snapshot loader until ctx is done. Does nothing if tags-count-snapshot is disabled
+func StartTagsCountSnapshot(ctx context.Context, cfg *config.Config) {
+	if tagsCountSnapshot != nil || !cfg.ClickHouse.TagsCountSnapshot.Enabled {
+		return
+	}
+
+	tagsCountSnapshot = NewTagsCountSnapshot(cfg)
+
+	go tagsCountSnapshot.loader.worker(ctx)
+}
+
+func tagsCountSnapshotQuery(table string, from time.Time) string {
+	return fmt.Sprintf(
+		"SELECT Tag1, sum(Count) as cnt FROM %s WHERE Date >= '%s' GROUP BY Tag1 FORMAT TabSeparatedRaw",
+		table, date.FromTimeToDaysFormat(from),
+	)
+}
+
+// Load reads 'Tag1\tcount' rows from reader and replaces the snapshot
+func (s *TagsCountSnapshot) Load(reader io.Reader) error {
+	counts := make(map[string]int)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		row := scanner.Text()
+
+		tag1, count, n := stringutils.Split2(row, "\t")
+		if n != 2 {
+			return fmt.Errorf("failed to parse tags count row: %q", row)
+		}
+
+		cnt, err := strconv.Atoi(count)
+		if err != nil {
+			return fmt.Errorf("failed to parse tags count row: %q: %w", row, err)
+		}
+
+		counts[tag1] = cnt
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.counts = counts
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	if metrics.TagsCountSnapshotMetrics != nil {
+		metrics.TagsCountSnapshotMetrics.Items.Update(int64(len(counts)))
+	}
+
+	return nil
+}
+
+// Counts returns the loaded counts (tag=value -> count). Returns nil if the snapshot is not loaded yet or stale
+func (s *TagsCountSnapshot) Counts() map[string]int {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.counts == nil || time.Since(s.updated) > s.maxAge {
+		return nil
+	}
+
+	return s.counts
+}
+
+// SetCostsFromSnapshot sets costs of eq terms from the snapshot counts,
+// tags count table is queried only for the values not found in the snapshot
+func (t *TaggedFinder) SetCostsFromSnapshot(ctx context.Context, counts map[string]int, terms []TaggedTerm, from int64, until int64) error {
+	var (
+		costs   map[string]*config.Costs
+		missing []TaggedTerm
+	)
+
+	for i := 0; i < len(terms); i++ {
+		if terms[i].Op != TaggedTermEq || terms[i].HasWildcard || terms[i].Value == "" {
+			continue
+		}
+
+		cnt, ok := counts[terms[i].concat()]
+		if !ok {
+			missing = append(missing, terms[i])
+			continue
+		}
+
+		if costs == nil {
+			costs = make(map[string]*config.Costs)
+		}
+
+		if costs[terms[i].Key] == nil {
+			costs[terms[i].Key] = &config.Costs{Cost: nil, ValuesCost: make(map[string]int, 0)}
+		}
+
+		costs[terms[i].Key].ValuesCost[terms[i].Value] = cnt
+	}
+
+	if metrics.TagsCountSnapshotMetrics != nil {
+		metrics.TagsCountSnapshotMetrics.Misses.Add(uint64(len(missing)))
+
+		for _, c := range costs {
+			metrics.TagsCountSnapshotMetrics.Hits.Add(uint64(len(c.ValuesCost)))
+		}
+	}
+
+	if len(missing) > 0 {
+		if err := t.SetCostsFromCountTable(ctx, missing, from, until); err != nil {
+			return err
+		}
+
+		if !t.metricMightExists {
+			return nil
+		}
+
+		for tag, c := range t.taggedCosts {
+			if costs == nil {
+				costs = make(map[string]*config.Costs)
+			}
+
+			if costs[tag] == nil {
+				costs[tag] = c
+				continue
+			}
+
+			for v, cnt := range c.ValuesCost {
+				costs[tag].ValuesCost[v] = cnt
+			}
+		}
+	}
+
+	if costs != nil {
+		t.taggedCosts = costs
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package finder
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+)
+
+func TestTagsCountSnapshot(t *testing.T) {
+	// 2022-11-11 00:01:00 +05:00 && 2022-11-11 00:01:10 +05:00
+	from, until := int64(1668106860), int64(1668106870)
+
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	dateWhere := `(Date >= '` + date.FromTimestampToDaysFormat(from) + `' AND Date <= '` + date.FromTimestampToDaysFormat(until) + `')`
+	srv.AddResponce(
+		`SELECT Tag1, sum(Count) as cnt FROM tag1_count_table WHERE (Tag1='dc=west') AND `+dateWhere+` GROUP BY Tag1 FORMAT TabSeparatedRaw`,
+		&chtest.TestResponse{Body: []byte("dc=west\t10\n")},
+	)
+	srv.AddResponce(
+		`SELECT Tag1, sum(Count) as cnt FROM tag1_count_table WHERE (Tag1='dc=east') AND `+dateWhere+` GROUP BY Tag1 FORMAT TabSeparatedRaw`,
+		&chtest.TestResponse{Body: []byte("")},
+	)
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.TagsCountTable = "tag1_count_table"
+	cfg.ClickHouse.TagsCountSnapshot.Enabled = true
+	cfg.ClickHouse.TagsCountSnapshot.MaxAge = time.Minute
+
+	s := NewTagsCountSnapshot(cfg)
+	assert.Nil(t, s.Counts())
+
+	require.NoError(t, s.Load(strings.NewReader("environment=production\t100\nkey=value\t1\n__name__=cpu\t50\n")))
+	assert.Equal(t, map[string]int{"environment=production": 100, "key=value": 1, "__name__=cpu": 50}, s.Counts())
+
+	tagsCountSnapshot = s
+	defer func() { tagsCountSnapshot = nil }()
+
+	tests := []struct {
+		query            string
+		want             []TaggedTerm
+		metricMightExist bool
+		wantQueries      uint64
+	}{
+		{
+			query: `seriesByTag('environment=production', 'name=cpu', 'key=value')`,
+			want: []TaggedTerm{
+				{Op: TaggedTermEq, Key: "key", Value: "value", Cost: 1, NonDefaultCost: true},
+				{Op: TaggedTermEq, Key: "__name__", Value: "cpu", Cost: 50, NonDefaultCost: true},
+				{Op: TaggedTermEq, Key: "environment", Value: "production", Cost: 100, NonDefaultCost: true},
+			},
+			metricMightExist: true,
+		},
+		{
+			query: `seriesByTag('environment=production', 'dc=west', 'key=value')`,
+			want: []TaggedTerm{
+				{Op: TaggedTermEq, Key: "key", Value: "value", Cost: 1, NonDefaultCost: true},
+				{Op: TaggedTermEq, Key: "dc", Value: "west", Cost: 10, NonDefaultCost: true},
+				{Op: TaggedTermEq, Key: "environment", Value: "production", Cost: 100, NonDefaultCost: true},
+			},
+			metricMightExist: true,
+			wantQueries:      1,
+		},
+		{
+			query: `seriesByTag('environment=production', 'dc=east')`,
+			want: []TaggedTerm{
+				{Op: TaggedTermEq, Key: "environment", Value: "production"},
+				{Op: TaggedTermEq, Key: "dc", Value: "east"},
+			},
+			metricMightExist: false,
+			wantQueries:      1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			queries := srv.Queries()
+
+			f := NewTagged(srv.URL, "graphite_tagged", "tag1_count_table", true, false, false, false, clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second}, nil)
+
+			terms, err := f.PrepareTaggedTerms(context.Background(), cfg, tt.query, from, until)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.want, terms)
+			assert.Equal(t, tt.metricMightExist, f.metricMightExists)
+			assert.Equal(t, tt.wantQueries, srv.Queries()-queries)
+		})
+	}
+
+	// stale snapshot is not used
+	s.updated = time.Now().Add(-2 * time.Minute)
+	assert.Nil(t, s.Counts())
+}
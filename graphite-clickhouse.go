@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	_ "net/http/pprof"
@@ -14,25 +16,38 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/lomik/zapwriter"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
+	"github.com/lomik/graphite-clickhouse/acl"
+	"github.com/lomik/graphite-clickhouse/auth"
 	"github.com/lomik/graphite-clickhouse/autocomplete"
 	"github.com/lomik/graphite-clickhouse/capabilities"
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/expand"
+	"github.com/lomik/graphite-clickhouse/explain"
 	"github.com/lomik/graphite-clickhouse/find"
+	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/healthcheck"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
 	"github.com/lomik/graphite-clickhouse/helper/rollup"
 	"github.com/lomik/graphite-clickhouse/index"
+	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/tlsserver"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 	"github.com/lomik/graphite-clickhouse/prometheus"
+	"github.com/lomik/graphite-clickhouse/querylog"
 	"github.com/lomik/graphite-clickhouse/render"
 	"github.com/lomik/graphite-clickhouse/sd"
 	"github.com/lomik/graphite-clickhouse/tagger"
@@ -82,12 +97,101 @@ func (app *App) Handler(handler http.Handler) http.Handler {
 
 		r = scope.HttpRequest(r)
 
+		r, span := tracing.StartServer(r)
+		defer func() { tracing.EndStatus(span, writer.Status()) }()
+
+		span.SetAttributes(attribute.String("request_id", scope.RequestID(r.Context())))
+
 		w.Header().Add("X-Gch-Request-ID", scope.RequestID(r.Context()))
 
+		tenant, err := app.config.ResolveTenant(r.Header.Get("X-Forwarded-User"), r.Header.Get(app.config.Tenants.Header))
+		if err != nil {
+			status := http.StatusBadRequest
+
+			var cerr errs.ErrorWithCode
+			if errors.As(err, &cerr) {
+				status = cerr.Code
+			}
+
+			http.Error(writer, err.Error(), status)
+
+			return
+		}
+
+		if tenant != "" {
+			r = r.WithContext(scope.WithTenant(r.Context(), tenant))
+			span.SetAttributes(attribute.String("tenant", tenant))
+		}
+
+		if len(app.config.Priority.Classes) > 0 {
+			class := app.config.GetPriority(r)
+			r = r.WithContext(limiter.WithPriority(r.Context(), class))
+			span.SetAttributes(attribute.String("priority", app.config.Priority.Classes[class].Name))
+		}
+
+		if app.config.ClickHouse.AdaptiveLimiter.Mode == limiter.AdaptiveLatency {
+			// clickhouse queries adapt the latency adaptive limiters
+			r = r.WithContext(limiter.WithQueries(r.Context()))
+		}
+
+		if app.config.Cluster.Enabled() {
+			// cluster leases are held by the request till the leave of the limiters
+			r = r.WithContext(limiter.WithLeases(r.Context()))
+		}
+
+		quota := app.config.GetUserQuota(r.Header.Get("X-Forwarded-User"))
+		if quota != nil {
+			if err := quota.Allow(time.Now()); err != nil {
+				var qerr *limiter.QuotaError
+				if errors.As(err, &qerr) {
+					writer.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(qerr.RetryAfter.Seconds())), 10))
+				}
+
+				http.Error(writer, err.Error(), http.StatusTooManyRequests)
+
+				return
+			}
+		}
+
+		r = logs.WithSlowQueryLog(app.config, r)
+
+		if quota != nil {
+			// the read quota is charged by the clickhouse queries stats
+			ql := clickhouse.GetQueryLog(r.Context())
+			if ql == nil {
+				ql = &clickhouse.QueryLog{}
+				r = r.WithContext(clickhouse.WithQueryLog(r.Context(), ql))
+			}
+
+			defer func() {
+				rows, bytes := ql.ReadStats()
+				quota.AddRead(time.Now(), rows, bytes)
+			}()
+		}
+
 		handler.ServeHTTP(writer, r)
 	})
 }
 
+// forTenants builds the handler for each tenant config and serves the request by the handler of the request tenant
+func forTenants[H http.Handler](cfg *config.Config, newHandler func(*config.Config) H) http.Handler {
+	names := cfg.TenantNames()
+	if len(names) == 0 {
+		return newHandler(cfg)
+	}
+
+	handlers := make(map[string]http.Handler, len(names)+1)
+	handlers[""] = newHandler(cfg)
+
+	for _, name := range names {
+		handlers[name] = newHandler(cfg.Tenant(name))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers[scope.Tenant(r.Context())].ServeHTTP(w, r)
+	})
+}
+
 var (
 	BuildVersion = "(development build)"
 	srv          *http.Server
@@ -534,6 +638,10 @@ func main() {
 		}()
 	}
 
+	// max-queries, shared by the instances
+	cluster := limiter.NewCluster(&cfg.Cluster)
+	cfg.SetupCluster(cluster)
+
 	/* CONFIG end */
 
 	if pprof != nil && *pprof != "" || cfg.Common.PprofListen != "" {
@@ -542,7 +650,24 @@ func main() {
 			listen = *pprof
 		}
 
-		go func() { log.Fatal(http.ListenAndServe(listen, nil)) }()
+		pprofSrv := &http.Server{Addr: listen}
+
+		if tlsserver.Enabled(&cfg.Common.PprofTLS) {
+			tlsServer, warns, err := tlsserver.New("pprof", &cfg.Common.PprofTLS, cfg.Common.TLSReloadInterval)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if len(warns) > 0 {
+				logger.Warn("pprof tls", zap.Strings("warnings", warns))
+			}
+
+			pprofSrv.TLSConfig = tlsServer.Config()
+
+			go func() { log.Fatal(pprofSrv.ListenAndServeTLS("", "")) }()
+		} else {
+			go func() { log.Fatal(pprofSrv.ListenAndServe()) }()
+		}
 	}
 
 	/* CONSOLE COMMANDS start */
@@ -560,16 +685,19 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.Handle("/_internal/capabilities/", app.Handler(capabilities.NewHandler(cfg)))
-	mux.Handle("/metrics/find/", app.Handler(find.NewHandler(cfg)))
-	mux.Handle("/metrics/index.json", app.Handler(index.NewHandler(cfg)))
-	mux.Handle("/render/", app.Handler(render.NewHandler(cfg)))
-	mux.Handle("/tags/autoComplete/tags", app.Handler(autocomplete.NewTags(cfg)))
-	mux.Handle("/tags/autoComplete/values", app.Handler(autocomplete.NewValues(cfg)))
+	mux.Handle("/metrics/find/", app.Handler(forTenants(cfg, find.NewHandler)))
+	mux.Handle("/metrics/expand/", app.Handler(forTenants(cfg, expand.NewHandler)))
+	mux.Handle("/metrics/autocomplete/", app.Handler(forTenants(cfg, autocomplete.NewPlain)))
+	mux.Handle("/metrics/index.json", app.Handler(forTenants(cfg, index.NewHandler)))
+	mux.Handle("/render/", app.Handler(forTenants(cfg, render.NewHandler)))
+	mux.Handle("/tags/autoComplete/tags", app.Handler(forTenants(cfg, autocomplete.NewTags)))
+	mux.Handle("/tags/autoComplete/values", app.Handler(forTenants(cfg, autocomplete.NewValues)))
 	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, "Graphite-clickhouse is alive.\n")
 	})
 	mux.Handle("/health", app.Handler(healthcheck.NewHandler(cfg)))
+	mux.Handle("/debug/explain", app.Handler(forTenants(cfg, explain.NewHandler)))
 	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
 		status := http.StatusOK
 		start := time.Now()
@@ -592,6 +720,14 @@ func main() {
 		w.Write(b)
 	})
 
+	if cfg.Metrics.Prometheus {
+		mux.Handle("/metrics", metrics.PrometheusHandler())
+	}
+
+	if err := acl.Start(cfg); err != nil {
+		log.Fatal(err)
+	}
+
 	if cfg.Prometheus.Listen != "" {
 		if err := prometheus.Run(cfg); err != nil {
 			log.Fatal(err)
@@ -602,11 +738,43 @@ func main() {
 		metrics.Graphite.Start(nil)
 	}
 
+	shutdownTracing, err := tracing.Setup(&cfg.Tracing, Version)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	querylog.Start(cfg)
+
+	// background loaders of the index replica, bloom filter and tags count snapshot
+	loadersCtx, stopLoaders := context.WithCancel(context.Background())
+
+	finder.StartIndexReplica(loadersCtx, cfg)
+	finder.StartIndexBloom(loadersCtx, cfg)
+	finder.StartTagsCountSnapshot(loadersCtx, cfg)
+
 	var exitWait sync.WaitGroup
 
+	authenticator, err := auth.New(&cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv = &http.Server{
 		Addr:    cfg.Common.Listen,
-		Handler: mux,
+		Handler: authenticator.Wrap(mux),
+	}
+
+	if tlsserver.Enabled(&cfg.Common.TLS) {
+		tlsServer, warns, err := tlsserver.New("listen", &cfg.Common.TLS, cfg.Common.TLSReloadInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(warns) > 0 {
+			logger.Warn("listen tls", zap.Strings("warnings", warns))
+		}
+
+		srv.TLSConfig = tlsServer.Config()
 	}
 
 	exitWait.Add(1)
@@ -614,13 +782,21 @@ func main() {
 	go func() {
 		defer exitWait.Done()
 
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+
+		if err != http.ErrServerClosed {
 			// unexpected error. port in use?
 			log.Fatalf("ListenAndServe(): %v", err)
 		}
 	}()
 
-	if cfg.Common.SD != "" && cfg.NeedLoadAvgColect() {
+	// the load is collected for the service discovery weight and the adaptive limiters
+	if cfg.NeedLoadAvgColect() {
 		go func() {
 			time.Sleep(time.Millisecond * 100)
 
@@ -648,5 +824,16 @@ func main() {
 
 	exitWait.Wait()
 
+	stopLoaders()
+	cluster.Close()
+	querylog.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("tracing shutdown", zap.Error(err))
+	}
+
+	cancel()
+
 	logger.Info("stop graphite-clickhouse")
 }
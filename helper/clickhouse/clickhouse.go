@@ -1,6 +1,7 @@
 package clickhouse
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -22,7 +23,10 @@ import (
 	httpHelper "github.com/lomik/graphite-clickhouse/helper/http"
 	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -91,6 +95,22 @@ func extractClickhouseError(e string) (int, string) {
 	return http.StatusServiceUnavailable, "Storage unavailable"
 }
 
+// queryFailed checks that the query error is caused by clickhouse (unavailable, overloaded or too slow),
+// not by the query itself or the canceled request
+func queryFailed(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var e *ErrWithDescr
+	if errors.As(err, &e) {
+		status, _ := extractClickhouseError(e.Error())
+		return status >= http.StatusInternalServerError
+	}
+
+	return true
+}
+
 func HandleError(w http.ResponseWriter, err error) (status int, queueFail bool) {
 	status = http.StatusOK
 	errStr := err.Error()
@@ -173,10 +193,13 @@ type Options struct {
 }
 
 type LoggedReader struct {
+	ctx        context.Context
 	reader     io.ReadCloser
 	logger     *zap.Logger
+	span       trace.Span
 	start      time.Time
 	finished   bool
+	logged     *loggedQuery
 	queryID    string
 	read_rows  int64
 	read_bytes int64
@@ -186,7 +209,22 @@ func (r *LoggedReader) Read(p []byte) (int, error) {
 	n, err := r.reader.Read(p)
 	if err != nil && !r.finished {
 		r.finished = true
-		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", time.Since(r.start)))
+		d := time.Since(r.start)
+		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", d))
+
+		if err == io.EOF {
+			r.logged.finish(d, nil)
+			limiter.QueryDone(r.ctx, d, false)
+			r.span.End()
+		} else {
+			r.logged.finish(d, err)
+
+			if queryFailed(err) {
+				limiter.QueryDone(r.ctx, d, true)
+			}
+
+			tracing.End(r.span, err)
+		}
 	}
 
 	return n, err
@@ -197,7 +235,11 @@ func (r *LoggedReader) Close() error {
 
 	if !r.finished {
 		r.finished = true
-		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", time.Since(r.start)))
+		d := time.Since(r.start)
+		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", d))
+		r.logged.finish(d, nil)
+		limiter.QueryDone(r.ctx, d, false)
+		r.span.End()
 	}
 
 	return err
@@ -256,6 +298,10 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 
 	var chQueryID string
 
+	recordQuery(ctx, query)
+
+	logged := logQuery(ctx, query)
+
 	start := time.Now()
 
 	requestID := scope.RequestID(ctx)
@@ -267,10 +313,22 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 
 	logger := scope.Logger(ctx).With(zap.String("query", formatSQL(queryForLogger)))
 
+	var span trace.Span
+
 	defer func() {
 		// fmt.Println(time.Since(start), formatSQL(queryForLogger))
 		if err != nil {
-			logger.Error("query", zap.Error(err), zap.Duration("time", time.Since(start)))
+			d := time.Since(start)
+			logger.Error("query", zap.Error(err), zap.Duration("time", d))
+			logged.finish(d, err)
+
+			if queryFailed(err) {
+				limiter.QueryDone(ctx, d, true)
+			}
+
+			if span != nil {
+				tracing.End(span, err)
+			}
 		}
 	}()
 
@@ -303,10 +361,16 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 		q.Set("query", query)
 		p.RawQuery = q.Encode()
 
-		postBody, contentHeader, err = extData.buildBody(ctx, p)
+		var body *bytes.Buffer
+
+		body, contentHeader, err = extData.buildBody(ctx, p)
 		if err != nil {
 			return
 		}
+
+		postBody = body
+
+		logged.setExtData(body.Len())
 	} else {
 		postBody = strings.NewReader(query)
 	}
@@ -320,6 +384,14 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 
 	req.Header.Add("User-Agent", scope.ClickhouseUserAgent(ctx))
 
+	// ClickHouse continues the trace from traceparent and tracestate headers
+	_, span = tracing.StartClient(ctx, "clickhouse.Query", req.Header,
+		attribute.String("db.system", "clickhouse"),
+		attribute.String("db.statement", formatSQL(queryForLogger)),
+		attribute.String("table", scope.Table(ctx)),
+		attribute.String("query_id", queryID),
+	)
+
 	if contentHeader != "" {
 		req.Header.Add("Content-Type", contentHeader)
 	}
@@ -370,6 +442,15 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 
 	read_rows, read_bytes, fields := stats.readRows, stats.readBytes, stats.loggerFields
 
+	logged.setStats(chQueryID, read_rows, read_bytes)
+
+	span.SetAttributes(
+		attribute.String("clickhouse.query_id", chQueryID),
+		attribute.Int64("read_rows", read_rows),
+		attribute.Int64("read_bytes", read_bytes),
+		attribute.Int("http.response.status_code", resp.StatusCode),
+	)
+
 	if len(fields) > 0 {
 		sort.Slice(fields, func(i, j int) bool {
 			return fields[i].Key < fields[j].Key
@@ -394,12 +475,15 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 	}
 
 	bodyReader = &LoggedReader{
+		ctx:        ctx,
 		reader:     resp.Body,
 		logger:     logger,
+		span:       span,
 		start:      start,
 		queryID:    chQueryID,
 		read_rows:  read_rows,
 		read_bytes: read_bytes,
+		logged:     logged,
 	}
 
 	return
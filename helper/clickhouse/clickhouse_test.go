@@ -1,10 +1,14 @@
 package clickhouse
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
 )
 
 func Test_extractClickhouseError(t *testing.T) {
@@ -63,3 +67,22 @@ func Test_extractClickhouseError(t *testing.T) {
 		})
 	}
 }
+
+func Test_queryFailed(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "canceled", err: fmt.Errorf("read: %w", context.Canceled), want: false},
+		{name: "timeout", err: context.DeadlineExceeded, want: true},
+		{name: "rows limit", err: NewErrWithDescr("clickhouse response status 500", "Code: 158. DB::Exception: Limit for rows (controlled by 'max_rows_to_read' setting) exceeded"), want: false},
+		{name: "unavailable", err: NewErrWithDescr("clickhouse response status 500", "Code: 999"), want: true},
+		{name: "bad gateway", err: errs.NewErrorWithCode("bad gateway", http.StatusBadGateway), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, queryFailed(tt.err))
+		})
+	}
+}
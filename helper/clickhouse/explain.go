@@ -0,0 +1,108 @@
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+type queryRecorderKey struct{}
+
+// RecordedQuery is a query sent to clickhouse with the context from WithQueryRecorder
+type RecordedQuery struct {
+	Table string `json:"table"`
+	SQL   string `json:"sql"`
+}
+
+// QueryRecorder collects the queries sent to clickhouse, used for explain requests
+type QueryRecorder struct {
+	mu      sync.Mutex
+	queries []RecordedQuery
+}
+
+// WithQueryRecorder returns a copy of ctx, all queries with this context will be added to r
+func WithQueryRecorder(ctx context.Context, r *QueryRecorder) context.Context {
+	return context.WithValue(ctx, queryRecorderKey{}, r)
+}
+
+func recordQuery(ctx context.Context, query string) {
+	if r, ok := ctx.Value(queryRecorderKey{}).(*QueryRecorder); ok {
+		r.mu.Lock()
+		r.queries = append(r.queries, RecordedQuery{Table: scope.Table(ctx), SQL: query})
+		r.mu.Unlock()
+	}
+}
+
+// Queries returns the recorded queries and resets the recorder
+func (r *QueryRecorder) Queries() []RecordedQuery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queries := r.queries
+	r.queries = nil
+
+	return queries
+}
+
+// EstimateRow is a row of EXPLAIN ESTIMATE answer
+type EstimateRow struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Parts    uint64 `json:"parts"`
+	Rows     uint64 `json:"rows"`
+	Marks    uint64 `json:"marks"`
+}
+
+// trimFormat removes the trailing FORMAT clause from query
+func trimFormat(query string) string {
+	query = strings.TrimSpace(query)
+
+	n := strings.LastIndex(query, "FORMAT")
+	if n <= 0 {
+		return query
+	}
+
+	if f := strings.TrimSpace(query[n+len("FORMAT"):]); f == "" || strings.ContainsAny(f, " \t\n)'") {
+		return query
+	}
+
+	return strings.TrimSpace(query[:n])
+}
+
+// Estimate runs query with EXPLAIN ESTIMATE and returns the parts, rows and marks would be read from the tables
+func Estimate(ctx context.Context, dsn string, query string, opts Options, extData *ExternalData) ([]EstimateRow, error) {
+	body, _, _, err := Query(ctx, dsn, "EXPLAIN ESTIMATE "+trimFormat(query)+" FORMAT TabSeparatedRaw", opts, extData)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]EstimateRow, 0)
+
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		fields := strings.Split(string(line), "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("failed to parse estimate row: %q", line)
+		}
+
+		row := EstimateRow{Database: fields[0], Table: fields[1]}
+
+		for i, v := range []*uint64{&row.Parts, &row.Rows, &row.Marks} {
+			if *v, err = strconv.ParseUint(fields[i+2], 10, 64); err != nil {
+				return nil, fmt.Errorf("failed to parse estimate row: %q: %w", line, err)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
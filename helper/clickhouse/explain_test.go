@@ -0,0 +1,25 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_trimFormat(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT Path FROM graphite_index GROUP BY Path FORMAT TabSeparatedRaw", "SELECT Path FROM graphite_index GROUP BY Path"},
+		{"SELECT Path\nFROM graphite_data\nGROUP BY Path\nFORMAT RowBinary", "SELECT Path\nFROM graphite_data\nGROUP BY Path"},
+		{"SELECT Path FROM graphite_index", "SELECT Path FROM graphite_index"},
+		{"SELECT Path FROM graphite_index WHERE Path = 'FORMAT a.b'", "SELECT Path FROM graphite_index WHERE Path = 'FORMAT a.b'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.want, trimFormat(tt.query))
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package clickhouse
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+type queryLogKey struct{}
+
+// LoggedQuery is a query sent to clickhouse with the context from WithQueryLog, and its read stats
+type LoggedQuery struct {
+	Table        string
+	SQL          string
+	QueryID      string
+	ExtDataBytes int
+	ReadRows     int64
+	ReadBytes    int64
+	Duration     time.Duration
+	Error        string
+}
+
+// QueryLog collects the queries sent to clickhouse with the read stats, used for the slow query log
+type QueryLog struct {
+	mu      sync.Mutex
+	queries []*LoggedQuery
+}
+
+// WithQueryLog returns a copy of ctx, all queries with this context will be added to l
+func WithQueryLog(ctx context.Context, l *QueryLog) context.Context {
+	return context.WithValue(ctx, queryLogKey{}, l)
+}
+
+// GetQueryLog returns the query log from ctx or nil
+func GetQueryLog(ctx context.Context) *QueryLog {
+	l, _ := ctx.Value(queryLogKey{}).(*QueryLog)
+	return l
+}
+
+// Queries returns a copy of the collected queries
+func (l *QueryLog) Queries() []LoggedQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	queries := make([]LoggedQuery, 0, len(l.queries))
+	for _, q := range l.queries {
+		queries = append(queries, *q)
+	}
+
+	return queries
+}
+
+// ReadStats returns the sum of the read rows and bytes of the collected queries, unknown stats are skipped
+func (l *QueryLog) ReadStats() (rows, bytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, q := range l.queries {
+		if q.ReadRows > 0 {
+			rows += q.ReadRows
+		}
+
+		if q.ReadBytes > 0 {
+			bytes += q.ReadBytes
+		}
+	}
+
+	return
+}
+
+// loggedQuery updates the query in the log, all methods are nil-safe for the context without the query log
+type loggedQuery struct {
+	log *QueryLog
+	q   *LoggedQuery
+}
+
+func logQuery(ctx context.Context, query string) *loggedQuery {
+	l := GetQueryLog(ctx)
+	if l == nil {
+		return nil
+	}
+
+	q := &LoggedQuery{Table: scope.Table(ctx), SQL: query, ReadRows: -1, ReadBytes: -1}
+
+	l.mu.Lock()
+	l.queries = append(l.queries, q)
+	l.mu.Unlock()
+
+	return &loggedQuery{log: l, q: q}
+}
+
+func (lq *loggedQuery) setExtData(size int) {
+	if lq == nil {
+		return
+	}
+
+	lq.log.mu.Lock()
+	lq.q.ExtDataBytes = size
+	lq.log.mu.Unlock()
+}
+
+func (lq *loggedQuery) setStats(queryID string, readRows, readBytes int64) {
+	if lq == nil {
+		return
+	}
+
+	lq.log.mu.Lock()
+	lq.q.QueryID = queryID
+	lq.q.ReadRows = readRows
+	lq.q.ReadBytes = readBytes
+	lq.log.mu.Unlock()
+}
+
+func (lq *loggedQuery) finish(d time.Duration, err error) {
+	if lq == nil {
+		return
+	}
+
+	lq.log.mu.Lock()
+	lq.q.Duration = d
+
+	if err != nil {
+		lq.q.Error = err.Error()
+	}
+
+	lq.log.mu.Unlock()
+}
@@ -0,0 +1,66 @@
+package clickhouse
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		if r.URL.Query().Get("query") == "SELECT fail" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Code: 62. DB::Exception: Syntax error")
+
+			return
+		}
+
+		w.Header().Set("X-ClickHouse-Query-Id", "ch-query-id")
+		w.Header().Set(ClickHouseSummaryHeader, `{"read_rows":"12","read_bytes":"345"}`)
+		io.WriteString(w, "1\n")
+	}))
+	defer srv.Close()
+
+	opts := Options{Timeout: time.Second, ConnectTimeout: time.Second}
+
+	// queries without the query log in the context are not collected
+	_, _, _, err := Query(context.Background(), srv.URL, "SELECT 1", opts, nil)
+	require.NoError(t, err)
+
+	l := &QueryLog{}
+	ctx := WithQueryLog(scope.WithTable(context.Background(), "graphite"), l)
+
+	body, _, _, err := Query(ctx, srv.URL, "SELECT 1", opts, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1\n", string(body))
+
+	extData := NewExternalData(ExternalTable{Name: "ids", Format: "TSV", Columns: []Column{{Name: "id", Type: "UInt64"}}, Data: []byte("1\n2\n")})
+	_, _, _, err = Query(ctx, srv.URL, "SELECT fail", opts, extData)
+	require.Error(t, err)
+
+	queries := l.Queries()
+	require.Len(t, queries, 2)
+
+	assert.Equal(t, "graphite", queries[0].Table)
+	assert.Equal(t, "SELECT 1", queries[0].SQL)
+	assert.Equal(t, "ch-query-id", queries[0].QueryID)
+	assert.Equal(t, int64(12), queries[0].ReadRows)
+	assert.Equal(t, int64(345), queries[0].ReadBytes)
+	assert.Equal(t, 0, queries[0].ExtDataBytes)
+	assert.Empty(t, queries[0].Error)
+	assert.Positive(t, queries[0].Duration)
+
+	assert.Equal(t, "SELECT fail", queries[1].SQL)
+	assert.Positive(t, queries[1].ExtDataBytes)
+	assert.Equal(t, int64(-1), queries[1].ReadRows)
+	assert.Contains(t, queries[1].Error, "Syntax error")
+}
@@ -0,0 +1,245 @@
+// Package redis is a minimal client of redis-compatible servers (RESP2 protocol)
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is the error reply of the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+var ErrProtocol = errors.New("redis: protocol error")
+
+// Client sends the commands to the server. The connections are reused, the broken connections are closed
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *conn
+}
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// New returns the client, the connections are established on the first commands.
+// Timeout is used for the dial and each command, poolSize is the max idle connections
+func New(addr, password string, db int, timeout time.Duration, poolSize int) *Client {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	return &Client{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		pool:     make(chan *conn, poolSize),
+	}
+}
+
+// Do sends the command and returns the reply: string for the simple string, int64, []byte for the bulk string
+// (nil for the null reply), []interface{} for the array. Error reply is returned as Error
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := cn.do(c.deadline(ctx), args)
+	if err != nil {
+		var rerr Error
+		if !errors.As(err, &rerr) {
+			// the connection state is unknown
+			cn.c.Close()
+			return nil, err
+		}
+	}
+
+	c.put(cn)
+
+	return reply, err
+}
+
+// Close closes the idle connections
+func (c *Client) Close() {
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.c.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+
+	return deadline
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: c.timeout}
+
+	nc, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	if c.password != "" {
+		if _, err = cn.do(c.deadline(ctx), []string{"AUTH", c.password}); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	if c.db != 0 {
+		if _, err = cn.do(c.deadline(ctx), []string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.c.Close()
+	}
+}
+
+func (cn *conn) do(deadline time.Time, args []string) (interface{}, error) {
+	if err := cn.c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if err := writeCommand(cn.w, args); err != nil {
+		return nil, err
+	}
+
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readReply(cn.r)
+}
+
+func writeCommand(w *bufio.Writer, args []string) error {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", ErrProtocol
+	}
+
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrProtocol, err)
+		}
+
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrProtocol, err)
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrProtocol, err)
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		array := make([]interface{}, n)
+		for i := range array {
+			// the error replies in the array are returned as Error values
+			if array[i], err = readReply(r); err != nil {
+				var rerr Error
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+
+				array[i] = rerr
+			}
+		}
+
+		return array, nil
+	default:
+		return nil, ErrProtocol
+	}
+}
@@ -0,0 +1,138 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    interface{}
+		wantErr error
+	}{
+		{name: "simple string", in: "+OK\r\n", want: "OK"},
+		{name: "error", in: "-ERR unknown command\r\n", wantErr: Error("ERR unknown command")},
+		{name: "integer", in: ":42\r\n", want: int64(42)},
+		{name: "bulk string", in: "$5\r\nhello\r\n", want: []byte("hello")},
+		{name: "null bulk string", in: "$-1\r\n", want: nil},
+		{
+			name: "array",
+			in:   "*3\r\n:1\r\n$1\r\na\r\n-ERR b\r\n",
+			want: []interface{}{int64(1), []byte("a"), Error("ERR b")},
+		},
+		{name: "bad line", in: "OK\n", wantErr: ErrProtocol},
+		{name: "unknown type", in: "!OK\r\n", wantErr: ErrProtocol},
+		{name: "bad integer", in: ":a\r\n", wantErr: ErrProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+// serve answers the commands with the replies, the received commands are sent to the channel
+func serve(t *testing.T, replies map[string]string) (string, chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() })
+
+	commands := make(chan []string, 16)
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				r := bufio.NewReader(c)
+
+				for {
+					reply, err := readReply(r)
+					if err != nil {
+						return
+					}
+
+					var args []string
+					for _, arg := range reply.([]interface{}) {
+						args = append(args, string(arg.([]byte)))
+					}
+
+					commands <- args
+
+					if _, err = c.Write([]byte(replies[args[0]])); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), commands
+}
+
+func TestClient(t *testing.T) {
+	addr, commands := serve(t, map[string]string{
+		"AUTH":   "+OK\r\n",
+		"SELECT": "+OK\r\n",
+		"ZCARD":  ":3\r\n",
+		"ZADD":   "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+	})
+
+	c := New(addr, "secret", 2, time.Second, 1)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	reply, err := c.Do(ctx, "ZCARD", "key")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), reply)
+
+	assert.Equal(t, []string{"AUTH", "secret"}, <-commands)
+	assert.Equal(t, []string{"SELECT", "2"}, <-commands)
+	assert.Equal(t, []string{"ZCARD", "key"}, <-commands)
+
+	// the connection is reused after the error reply
+	_, err = c.Do(ctx, "ZADD", "key", "1", "a")
+	assert.EqualError(t, err, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.Equal(t, []string{"ZADD", "key", "1", "a"}, <-commands)
+
+	_, err = c.Do(ctx, "ZCARD", "key")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ZCARD", "key"}, <-commands)
+	assert.Empty(t, commands)
+}
+
+func TestClientUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := New(addr, "", 0, 100*time.Millisecond, 1)
+
+	_, err = c.Do(context.Background(), "PING")
+	assert.Error(t, err)
+}
@@ -30,6 +30,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		d := time.Since(start)
 		logs.AccessLog(accessLogger, h.config, r, status, d, time.Duration(0), false, false)
+		logs.SlowQueryLog(h.config, r, "index", status, logs.Timings{Total: d})
 	}()
 
 	i, err := New(h.config, r.Context())
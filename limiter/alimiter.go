@@ -4,8 +4,11 @@ import (
 	"context"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/lomik/graphite-clickhouse/load_avg"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 )
 
 var (
@@ -39,7 +42,7 @@ func getWeighted(n, max int) int {
 // ALimiter provide limiter amount of requests/concurrently executing requests (adaptive with load avg)
 type ALimiter struct {
 	limiter           limiter
-	concurrentLimiter limiter
+	concurrentLimiter pool
 	concurrent        int
 	n                 int
 
@@ -47,7 +50,7 @@ type ALimiter struct {
 }
 
 // NewServerLimiter creates a limiter for specific servers list.
-func NewALimiter(capacity, concurrent, n int, enableMetrics bool, scope, sub string) ServerLimiter {
+func NewALimiter(p *PriorityConfig, capacity, concurrent, n int, enableMetrics bool, scope, sub string) ServerLimiter {
 	if capacity <= 0 && concurrent <= 0 {
 		return NoopLimiter{}
 	}
@@ -57,14 +60,13 @@ func NewALimiter(capacity, concurrent, n int, enableMetrics bool, scope, sub str
 	}
 
 	if n <= 0 {
-		return NewWLimiter(capacity, concurrent, enableMetrics, scope, sub)
+		return NewWLimiter(p, capacity, concurrent, enableMetrics, scope, sub)
 	}
 
 	a := &ALimiter{
 		m: metrics.NewWaitMetric(enableMetrics, scope, sub), concurrent: concurrent, n: n,
 	}
-	a.concurrentLimiter.ch = make(chan struct{}, concurrent)
-	a.concurrentLimiter.cap = concurrent
+	a.concurrentLimiter = newPool(p, concurrent, enableMetrics, scope, sub)
 
 	go a.balance()
 
@@ -106,6 +108,9 @@ func (sl *ALimiter) Capacity() int {
 }
 
 func (sl *ALimiter) Enter(ctx context.Context, s string) (err error) {
+	_, span := tracing.Start(ctx, "limiter.Enter", attribute.String("limiter", s))
+	defer func() { tracing.End(span, err) }()
+
 	if sl.limiter.cap > 0 {
 		if err = sl.limiter.tryEnter(ctx, s); err != nil {
 			sl.m.WaitErrors.Add(1)
@@ -113,7 +118,7 @@ func (sl *ALimiter) Enter(ctx context.Context, s string) (err error) {
 		}
 	}
 
-	if sl.concurrentLimiter.cap > 0 {
+	if sl.concurrentLimiter != nil {
 		if sl.concurrentLimiter.enter(ctx, s) != nil {
 			if sl.limiter.cap > 0 {
 				sl.limiter.leave(ctx, s)
@@ -139,7 +144,7 @@ func (sl *ALimiter) TryEnter(ctx context.Context, s string) (err error) {
 		}
 	}
 
-	if sl.concurrentLimiter.cap > 0 {
+	if sl.concurrentLimiter != nil {
 		if sl.concurrentLimiter.tryEnter(ctx, s) != nil {
 			if sl.limiter.cap > 0 {
 				sl.limiter.leave(ctx, s)
@@ -175,6 +180,7 @@ func (sl *ALimiter) SendDuration(queueMs int64) {
 // Unregiter unregister graphite metric
 func (sl *ALimiter) Unregiter() {
 	sl.m.Unregister()
+	sl.concurrentLimiter.unregister()
 }
 
 // Enabled return enabled flag, if false - it's a noop limiter and can be safely skiped
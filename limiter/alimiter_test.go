@@ -52,7 +52,7 @@ func TestNewALimiter(t *testing.T) {
 	concurrent := 12
 	n := 10
 	checkDelay = time.Millisecond * 10
-	limiter := NewALimiter(capacity, concurrent, n, false, "", "")
+	limiter := NewALimiter(nil, capacity, concurrent, n, false, "", "")
 
 	// inital - load not collected
 	load_avg.Store(0)
@@ -155,7 +155,7 @@ func Benchmark_Limiter_Parallel(b *testing.B) {
 				err error
 			)
 
-			limiter := NewALimiter(tt.l, tt.c, tt.n, false, "", "")
+			limiter := NewALimiter(nil, tt.l, tt.c, tt.n, false, "", "")
 
 			wgStart := sync.WaitGroup{}
 			wg := sync.WaitGroup{}
@@ -0,0 +1,433 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/helper/redis"
+)
+
+// ClusterConfig is the config of the max-queries limits, shared by the instances
+type ClusterConfig struct {
+	Redis         string        `toml:"redis"          json:"redis"          comment:"address of the redis-compatible server with the leases of the request slots (empty - disabled)"`
+	Password      string        `toml:"password"       json:"-"              comment:"redis password"`
+	DB            int           `toml:"db"             json:"db"             comment:"redis database"`
+	Prefix        string        `toml:"prefix"         json:"prefix"         comment:"prefix of the redis keys, the instances with the same prefix share the limits"`
+	Lease         time.Duration `toml:"lease"          json:"lease"          comment:"lease of the request slot, renewed while the request is executed, the slots of the failed instance are freed after the lease"`
+	Timeout       time.Duration `toml:"timeout"        json:"timeout"        comment:"timeout of the redis commands"`
+	RetryInterval time.Duration `toml:"retry-interval" json:"retry-interval" comment:"only the local limits are used for retry-interval after the redis error"`
+}
+
+// Enabled returns true if the redis address is set
+func (c *ClusterConfig) Enabled() bool {
+	return c.Redis != ""
+}
+
+// Validate checks the config
+func (c *ClusterConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Lease <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("lease and timeout must be positive")
+	}
+
+	if c.RetryInterval < 0 {
+		return fmt.Errorf("retry-interval can't be negative")
+	}
+
+	return nil
+}
+
+// coordinator is the shared store of the slot leases
+type coordinator interface {
+	// acquire adds the lease, if there are less than limit unexpired leases of the key
+	acquire(ctx context.Context, key, id string, limit int, now, expire time.Time) (bool, error)
+	release(ctx context.Context, key, id string) error
+	renew(ctx context.Context, key string, ids []string, expire time.Time, ttl time.Duration) error
+}
+
+// leases are the sorted set members with the expire time as the score, the expired leases are removed on acquire
+const (
+	acquireScript = `redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1`
+	renewScript = `redis.call('ZADD', KEYS[1], 'XX', unpack(ARGV, 2))
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 1`
+)
+
+type redisCoordinator struct {
+	client *redis.Client
+}
+
+func ms(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func (r redisCoordinator) acquire(ctx context.Context, key, id string, limit int, now, expire time.Time) (bool, error) {
+	reply, err := r.client.Do(ctx, "EVAL", acquireScript, "1", key,
+		ms(now), ms(expire), strconv.Itoa(limit), id, strconv.FormatInt(expire.Sub(now).Milliseconds(), 10),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply: %v", reply)
+	}
+
+	return n == 1, nil
+}
+
+func (r redisCoordinator) release(ctx context.Context, key, id string) error {
+	_, err := r.client.Do(ctx, "ZREM", key, id)
+	return err
+}
+
+func (r redisCoordinator) renew(ctx context.Context, key string, ids []string, expire time.Time, ttl time.Duration) error {
+	args := make([]string, 0, 5+2*len(ids))
+	args = append(args, "EVAL", renewScript, "1", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+
+	score := ms(expire)
+	for _, id := range ids {
+		args = append(args, score, id)
+	}
+
+	_, err := r.client.Do(ctx, args...)
+
+	return err
+}
+
+// Cluster shares the max-queries limits between the instances by the slot leases in redis.
+// The local limiters are used alone while redis is unavailable
+type Cluster struct {
+	coord         coordinator
+	prefix        string
+	lease         time.Duration
+	timeout       time.Duration
+	retryInterval time.Duration
+	instance      string // prefix of the lease ids
+	seq           atomic.Uint64
+	logger        *zap.Logger
+
+	mu        sync.Mutex
+	leases    map[string]map[string]struct{} // held leases by the key
+	downUntil time.Time
+
+	client *redis.Client
+	stop   context.CancelFunc
+}
+
+// NewCluster returns the cluster limits, nil if disabled
+func NewCluster(c *ClusterConfig) *Cluster {
+	if !c.Enabled() {
+		return nil
+	}
+
+	client := redis.New(c.Redis, c.Password, c.DB, c.Timeout, 16)
+	cl := newCluster(redisCoordinator{client}, c)
+	cl.client = client
+
+	ctx, stop := context.WithCancel(ctxMain)
+	cl.stop = stop
+
+	go cl.renewer(ctx)
+
+	return cl
+}
+
+// Close stops the lease renewal and closes the redis connections, the held leases are expired after the lease
+func (c *Cluster) Close() {
+	if c == nil {
+		return
+	}
+
+	if c.stop != nil {
+		c.stop()
+	}
+
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+func newCluster(coord coordinator, c *ClusterConfig) *Cluster {
+	hostname, _ := os.Hostname()
+
+	return &Cluster{
+		coord:         coord,
+		prefix:        c.Prefix,
+		lease:         c.Lease,
+		timeout:       c.Timeout,
+		retryInterval: c.RetryInterval,
+		instance:      fmt.Sprintf("%s:%d:%x", hostname, os.Getpid(), rand.Uint32()),
+		logger:        zapwriter.Logger("cluster_limiter"),
+		leases:        make(map[string]map[string]struct{}),
+	}
+}
+
+// Wrap returns the limiter with the cluster-wide capacity, the local limiter is returned if the cluster is nil
+// or capacity is not set
+func (c *Cluster) Wrap(l ServerLimiter, capacity int, scope, sub string) ServerLimiter {
+	if c == nil || capacity <= 0 || !l.Enabled() {
+		return l
+	}
+
+	return &CLimiter{
+		ServerLimiter: l,
+		cluster:       c,
+		key:           c.prefix + scope + ":" + sub,
+		capacity:      capacity,
+	}
+}
+
+func (c *Cluster) available(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !now.Before(c.downUntil)
+}
+
+func (c *Cluster) failed(err error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !now.Before(c.downUntil) {
+		c.logger.Warn("redis is unavailable, only the local limits are used", zap.Error(err), zap.Duration("retry_interval", c.retryInterval))
+	}
+
+	c.downUntil = now.Add(c.retryInterval)
+}
+
+// acquire returns the lease id, empty id - redis is unavailable and the request is limited only by the local limiter
+func (c *Cluster) acquire(ctx context.Context, key string, limit int) (string, error) {
+	now := time.Now()
+	if !c.available(now) {
+		return "", nil
+	}
+
+	id := c.instance + ":" + strconv.FormatUint(c.seq.Add(1), 10)
+
+	ok, err := c.coord.acquire(ctx, key, id, limit, now, now.Add(c.lease))
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ErrTimeout
+		}
+
+		c.failed(err)
+
+		return "", nil
+	}
+
+	if !ok {
+		return "", ErrOverflow
+	}
+
+	c.mu.Lock()
+	if c.leases[key] == nil {
+		c.leases[key] = make(map[string]struct{})
+	}
+
+	c.leases[key][id] = struct{}{}
+	c.mu.Unlock()
+
+	return id, nil
+}
+
+func (c *Cluster) release(key, id string) {
+	if id == "" {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.leases[key], id)
+
+	if len(c.leases[key]) == 0 {
+		delete(c.leases, key)
+	}
+	c.mu.Unlock()
+
+	// the lease expires, if it's not released
+	if !c.available(time.Now()) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctxMain, c.timeout)
+	defer cancel()
+
+	if err := c.coord.release(ctx, key, id); err != nil {
+		c.failed(err)
+	}
+}
+
+// renew extends the held leases
+func (c *Cluster) renew() {
+	c.mu.Lock()
+	leases := make(map[string][]string, len(c.leases))
+
+	for key, ids := range c.leases {
+		for id := range ids {
+			leases[key] = append(leases[key], id)
+		}
+	}
+	c.mu.Unlock()
+
+	expire := time.Now().Add(c.lease)
+
+	for key, ids := range leases {
+		ctx, cancel := context.WithTimeout(ctxMain, c.timeout)
+		err := c.coord.renew(ctx, key, ids, expire, c.lease)
+		cancel()
+
+		if err != nil {
+			c.failed(err)
+			return
+		}
+	}
+}
+
+func (c *Cluster) renewer(ctx context.Context) {
+	t := time.NewTicker(c.lease / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.renew()
+		}
+	}
+}
+
+type leasesKey struct{}
+
+// leases are the cluster leases, held by the request
+type leases struct {
+	mu  sync.Mutex
+	ids map[*CLimiter][]string
+}
+
+// WithLeases returns a copy of ctx, which holds the cluster leases of the request till the leave of the limiters.
+// The requests without it are limited only by the local limiters
+func WithLeases(ctx context.Context) context.Context {
+	return context.WithValue(ctx, leasesKey{}, &leases{})
+}
+
+func requestLeases(ctx context.Context) *leases {
+	l, _ := ctx.Value(leasesKey{}).(*leases)
+	return l
+}
+
+func (l *leases) push(sl *CLimiter, id string) {
+	l.mu.Lock()
+	if l.ids == nil {
+		l.ids = make(map[*CLimiter][]string)
+	}
+
+	l.ids[sl] = append(l.ids[sl], id)
+	l.mu.Unlock()
+}
+
+func (l *leases) pop(sl *CLimiter) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := l.ids[sl]
+	if len(ids) == 0 {
+		return ""
+	}
+
+	id := ids[len(ids)-1]
+	if len(ids) == 1 {
+		delete(l.ids, sl)
+	} else {
+		l.ids[sl] = ids[:len(ids)-1]
+	}
+
+	return id
+}
+
+// CLimiter limits the requests by the cluster-wide max-queries and by the local limiter
+type CLimiter struct {
+	ServerLimiter
+	cluster  *Cluster
+	key      string
+	capacity int
+}
+
+// acquire returns the lease id, empty id - the request is limited only by the local limiter
+func (sl *CLimiter) acquire(ctx context.Context) (string, error) {
+	if requestLeases(ctx) == nil {
+		return "", nil
+	}
+
+	return sl.cluster.acquire(ctx, sl.key, sl.capacity)
+}
+
+func (sl *CLimiter) push(ctx context.Context, id string) {
+	if l := requestLeases(ctx); l != nil {
+		l.push(sl, id)
+	}
+}
+
+// Enter claims the cluster slot (without blocking) and one of the local slots
+func (sl *CLimiter) Enter(ctx context.Context, s string) error {
+	id, err := sl.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = sl.ServerLimiter.Enter(ctx, s); err != nil {
+		sl.cluster.release(sl.key, id)
+		return err
+	}
+
+	sl.push(ctx, id)
+
+	return nil
+}
+
+// TryEnter claims the cluster slot and one of the local slots without blocking
+func (sl *CLimiter) TryEnter(ctx context.Context, s string) error {
+	id, err := sl.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = sl.ServerLimiter.TryEnter(ctx, s); err != nil {
+		sl.cluster.release(sl.key, id)
+		return err
+	}
+
+	sl.push(ctx, id)
+
+	return nil
+}
+
+// Frees the local and the cluster slots
+func (sl *CLimiter) Leave(ctx context.Context, s string) {
+	sl.ServerLimiter.Leave(ctx, s)
+
+	if l := requestLeases(ctx); l != nil {
+		sl.cluster.release(sl.key, l.pop(sl))
+	}
+}
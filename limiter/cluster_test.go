@@ -0,0 +1,243 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memCoordinator is the in-memory coordinator, shared by the test instances
+type memCoordinator struct {
+	mu     sync.Mutex
+	leases map[string]map[string]time.Time
+	err    error
+}
+
+func newMemCoordinator() *memCoordinator {
+	return &memCoordinator{leases: make(map[string]map[string]time.Time)}
+}
+
+func (m *memCoordinator) acquire(ctx context.Context, key, id string, limit int, now, expire time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return false, m.err
+	}
+
+	for id, e := range m.leases[key] {
+		if !e.After(now) {
+			delete(m.leases[key], id)
+		}
+	}
+
+	if len(m.leases[key]) >= limit {
+		return false, nil
+	}
+
+	if m.leases[key] == nil {
+		m.leases[key] = make(map[string]time.Time)
+	}
+
+	m.leases[key][id] = expire
+
+	return true, nil
+}
+
+func (m *memCoordinator) release(ctx context.Context, key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	delete(m.leases[key], id)
+
+	return nil
+}
+
+func (m *memCoordinator) renew(ctx context.Context, key string, ids []string, expire time.Time, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	for _, id := range ids {
+		if _, ok := m.leases[key][id]; ok {
+			m.leases[key][id] = expire
+		}
+	}
+
+	return nil
+}
+
+func (m *memCoordinator) held(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.leases[key])
+}
+
+func (m *memCoordinator) setErr(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+func TestClusterConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       ClusterConfig
+		wantErr string
+	}{
+		{name: "disabled"},
+		{name: "enabled", c: ClusterConfig{Redis: "127.0.0.1:6379", Lease: time.Minute, Timeout: time.Second}},
+		{name: "lease", c: ClusterConfig{Redis: "127.0.0.1:6379", Timeout: time.Second}, wantErr: "lease and timeout must be positive"},
+		{
+			name:    "retry-interval",
+			c:       ClusterConfig{Redis: "127.0.0.1:6379", Lease: time.Minute, Timeout: time.Second, RetryInterval: -time.Second},
+			wantErr: "retry-interval can't be negative",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClusterWrap(t *testing.T) {
+	var c *Cluster
+
+	l := NewALimiter(nil, 2, 2, 0, false, "test", "all")
+	assert.Same(t, l, c.Wrap(l, 2, "test", "all"))
+
+	c = newCluster(newMemCoordinator(), &ClusterConfig{Prefix: "test:", Lease: time.Minute, Timeout: time.Second})
+	assert.Same(t, l, c.Wrap(l, 0, "test", "all"))
+	assert.Equal(t, NoopLimiter{}, c.Wrap(NoopLimiter{}, 2, "test", "all"))
+
+	cl, ok := c.Wrap(l, 2, "test", "all").(*CLimiter)
+	require.True(t, ok)
+	assert.Equal(t, "test:test:all", cl.key)
+}
+
+func TestCLimiter(t *testing.T) {
+	coord := newMemCoordinator()
+	config := &ClusterConfig{Prefix: "test:", Lease: time.Minute, Timeout: time.Second, RetryInterval: time.Hour}
+
+	// two instances with the local limits 2, the cluster limit is 3
+	c1 := newCluster(coord, config)
+	c2 := newCluster(coord, config)
+	l1 := c1.Wrap(NewWLimiter(nil, 2, 2, false, "test", "all"), 3, "render", "all")
+	l2 := c2.Wrap(NewWLimiter(nil, 2, 2, false, "test", "all"), 3, "render", "all")
+
+	ctxs := make([]context.Context, 4)
+	for i := range ctxs {
+		ctxs[i] = WithLeases(context.Background())
+	}
+
+	require.NoError(t, l1.TryEnter(ctxs[0], "test"))
+	require.NoError(t, l1.TryEnter(ctxs[1], "test"))
+	require.NoError(t, l2.Enter(ctxs[2], "test"))
+	assert.Equal(t, 3, coord.held("test:render:all"))
+
+	// the cluster limit is reached, the local slot is free
+	assert.ErrorIs(t, l2.TryEnter(ctxs[3], "test"), ErrOverflow)
+	assert.ErrorIs(t, l2.Enter(ctxs[3], "test"), ErrOverflow)
+	assert.Equal(t, 3, coord.held("test:render:all"))
+
+	l1.Leave(ctxs[0], "test")
+	assert.Equal(t, 2, coord.held("test:render:all"))
+	require.NoError(t, l2.TryEnter(ctxs[3], "test"))
+
+	// the local limit is reached, the cluster lease is released
+	l1.Leave(ctxs[1], "test")
+	assert.ErrorIs(t, l2.TryEnter(ctxs[0], "test"), ErrOverflow)
+	assert.Equal(t, 2, coord.held("test:render:all"))
+
+	// the held leases are renewed
+	c2.renew()
+
+	for _, e := range coord.leases["test:render:all"] {
+		assert.True(t, e.After(time.Now().Add(30*time.Second)))
+	}
+
+	// the lease is released by the other context of the request
+	ctx, cancel := context.WithTimeout(ctxs[2], time.Minute)
+	defer cancel()
+
+	l2.Leave(ctx, "test")
+	l2.Leave(ctxs[3], "test")
+	assert.Equal(t, 0, coord.held("test:render:all"))
+	assert.Empty(t, c1.leases)
+	assert.Empty(t, c2.leases)
+
+	for i := range ctxs {
+		assert.Empty(t, requestLeases(ctxs[i]).ids, i)
+	}
+
+	// the request without the leases is limited only by the local limiter
+	require.NoError(t, l1.TryEnter(context.Background(), "test"))
+	assert.Equal(t, 0, coord.held("test:render:all"))
+	l1.Leave(context.Background(), "test")
+}
+
+func TestCLimiterExpire(t *testing.T) {
+	coord := newMemCoordinator()
+	config := &ClusterConfig{Prefix: "test:", Lease: 50 * time.Millisecond, Timeout: time.Second}
+
+	// the leases of the failed instance are expired
+	l1 := newCluster(coord, config).Wrap(NewWLimiter(nil, 2, 2, false, "test", "all"), 1, "render", "all")
+	l2 := newCluster(coord, config).Wrap(NewWLimiter(nil, 2, 2, false, "test", "all"), 1, "render", "all")
+
+	require.NoError(t, l1.TryEnter(WithLeases(context.Background()), "test"))
+	assert.ErrorIs(t, l2.TryEnter(WithLeases(context.Background()), "test"), ErrOverflow)
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, l2.TryEnter(WithLeases(context.Background()), "test"))
+}
+
+func TestCLimiterFallback(t *testing.T) {
+	coord := newMemCoordinator()
+	c := newCluster(coord, &ClusterConfig{Prefix: "test:", Lease: time.Minute, Timeout: time.Second, RetryInterval: 50 * time.Millisecond})
+	l := c.Wrap(NewWLimiter(nil, 2, 2, false, "test", "all"), 1, "render", "all")
+
+	ctx1 := WithLeases(context.Background())
+	ctx2 := WithLeases(context.Background())
+
+	require.NoError(t, l.TryEnter(ctx1, "test"))
+	assert.ErrorIs(t, l.TryEnter(ctx2, "test"), ErrOverflow)
+
+	// redis is unavailable, only the local limiter is used
+	coord.setErr(errors.New("connection refused"))
+	require.NoError(t, l.TryEnter(ctx2, "test"))
+	assert.ErrorIs(t, l.TryEnter(WithLeases(context.Background()), "test"), ErrOverflow)
+	assert.False(t, c.available(time.Now()))
+
+	l.Leave(ctx2, "test")
+	l.Leave(ctx1, "test")
+
+	// the unreleased lease is held in redis until it's expired
+	assert.Equal(t, 1, coord.held("test:render:all"))
+	assert.Empty(t, c.leases)
+
+	// redis is used again after retry-interval
+	coord.setErr(nil)
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, c.available(time.Now()))
+	assert.ErrorIs(t, l.TryEnter(ctx1, "test"), ErrOverflow)
+}
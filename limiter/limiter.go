@@ -3,7 +3,10 @@ package limiter
 import (
 	"context"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 )
 
 type limiter struct {
@@ -13,21 +16,18 @@ type limiter struct {
 
 // Limiter provides interface to limit amount of requests
 type Limiter struct {
-	limiter limiter
+	limiter pool
 	metrics metrics.WaitMetric
 }
 
 // NewServerLimiter creates a limiter for specific servers list.
-func NewLimiter(capacity int, enableMetrics bool, scope, sub string) ServerLimiter {
+func NewLimiter(p *PriorityConfig, capacity int, enableMetrics bool, scope, sub string) ServerLimiter {
 	if capacity <= 0 {
 		return NoopLimiter{}
 	}
 
 	return &Limiter{
-		limiter: limiter{
-			ch:  make(chan struct{}, capacity),
-			cap: capacity,
-		},
+		limiter: newPool(p, capacity, enableMetrics, scope, sub),
 		metrics: metrics.NewWaitMetric(enableMetrics, scope, sub),
 	}
 }
@@ -38,6 +38,9 @@ func (sl *Limiter) Capacity() int {
 
 // Enter claims one of free slots or blocks until there is one.
 func (sl *Limiter) Enter(ctx context.Context, s string) (err error) {
+	_, span := tracing.Start(ctx, "limiter.Enter", attribute.String("limiter", s))
+	defer func() { tracing.End(span, err) }()
+
 	if err = sl.limiter.enter(ctx, s); err != nil {
 		sl.metrics.WaitErrors.Add(1)
 	}
@@ -73,6 +76,7 @@ func (sl *Limiter) SendDuration(queueMs int64) {
 // Unregiter unregister graphite metric
 func (sl *Limiter) Unregiter() {
 	sl.metrics.Unregister()
+	sl.limiter.unregister()
 }
 
 // Enabled return enabled flag, if false - it's a noop limiter and can be safely skiped
@@ -0,0 +1,351 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
+)
+
+const (
+	AdaptiveLoadAvg = "load-avg"
+	AdaptiveLatency = "latency"
+)
+
+// AdaptiveConfig is the config of the adaptive limiters (with adaptive-queries > 0)
+type AdaptiveConfig struct {
+	Mode      string  `toml:"mode"      json:"mode"      comment:"load-avg (reserve slots on high load average) or latency (adapt to the clickhouse query latency and errors)"`
+	Tolerance float64 `toml:"tolerance" json:"tolerance" comment:"latency mode: ratio of the recent to the long-term latency, tolerated without decrease of concurrent queries"`
+	Backoff   float64 `toml:"backoff"   json:"backoff"   comment:"latency mode: multiplier of concurrent queries on the query timeout or error"`
+}
+
+// Validate checks the config
+func (c *AdaptiveConfig) Validate() error {
+	switch c.Mode {
+	case AdaptiveLoadAvg:
+		return nil
+	case AdaptiveLatency:
+	default:
+		return fmt.Errorf("unknown mode %q, known modes: %q, %q", c.Mode, AdaptiveLoadAvg, AdaptiveLatency)
+	}
+
+	if c.Tolerance < 1 {
+		return fmt.Errorf("tolerance must be at least 1")
+	}
+
+	if c.Backoff <= 0 || c.Backoff >= 1 {
+		return fmt.Errorf("backoff must be in (0, 1)")
+	}
+
+	return nil
+}
+
+// NewAdaptiveLimiter creates the adaptive limiter for the config mode
+func NewAdaptiveLimiter(c *AdaptiveConfig, p *PriorityConfig, capacity, concurrent, n int, enableMetrics bool, scope, sub string) ServerLimiter {
+	if c.Mode == AdaptiveLatency {
+		return NewLLimiter(p, capacity, concurrent, n, c.Tolerance, c.Backoff, enableMetrics, scope, sub)
+	}
+
+	return NewALimiter(p, capacity, concurrent, n, enableMetrics, scope, sub)
+}
+
+type queriesKey struct{}
+
+// queries are the latency adaptive limiters, entered by the request
+type queries struct {
+	mu      sync.Mutex
+	entered []*LLimiter
+}
+
+// WithQueries returns a copy of ctx, which passes the latency and the failures of the request clickhouse queries to
+// the latency adaptive limiters, entered with it
+func WithQueries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queriesKey{}, &queries{})
+}
+
+func requestQueries(ctx context.Context) *queries {
+	q, _ := ctx.Value(queriesKey{}).(*queries)
+	return q
+}
+
+func (q *queries) enter(sl *LLimiter) {
+	q.mu.Lock()
+	q.entered = append(q.entered, sl)
+	q.mu.Unlock()
+}
+
+func (q *queries) leave(sl *LLimiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := len(q.entered) - 1; i >= 0; i-- {
+		if q.entered[i] == sl {
+			q.entered = append(q.entered[:i], q.entered[i+1:]...)
+			return
+		}
+	}
+}
+
+// QueryDone passes the clickhouse query latency (or the failure) to the latency adaptive limiters, entered with ctx.
+// Does nothing for the context without WithQueries or canceled by the client.
+func QueryDone(ctx context.Context, d time.Duration, failed bool) {
+	q := requestQueries(ctx)
+	if q == nil || ctx.Err() == context.Canceled {
+		return
+	}
+
+	q.mu.Lock()
+	entered := make([]*LLimiter, 0, len(q.entered))
+	for _, sl := range q.entered {
+		if !slices.Contains(entered, sl) {
+			entered = append(entered, sl)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, sl := range entered {
+		sl.sample(d, failed)
+	}
+}
+
+const (
+	gradientShortAlpha = 2.0 / 11  // recent latency, ~10 samples
+	gradientLongAlpha  = 2.0 / 601 // long-term latency, ~600 samples
+	gradientSmoothing  = 0.2
+)
+
+// gradient is the concurrency window, adapted by the gradient of the recent and the long-term latency
+// (like Gradient2 from Netflix concurrency-limits)
+type gradient struct {
+	limit     float64
+	min       float64
+	max       float64
+	tolerance float64
+	backoff   float64
+	shortRTT  float64
+	longRTT   float64
+}
+
+// update adapts the window by the latency of the finished request
+func (g *gradient) update(rtt time.Duration, inFlight int, failed bool) {
+	if failed {
+		g.limit = math.Max(g.min, g.limit*g.backoff)
+		return
+	}
+
+	r := float64(rtt)
+	if g.longRTT == 0 {
+		g.shortRTT, g.longRTT = r, r
+	} else {
+		g.shortRTT += (r - g.shortRTT) * gradientShortAlpha
+		g.longRTT += (r - g.longRTT) * gradientLongAlpha
+	}
+
+	if g.shortRTT <= 0 {
+		return
+	}
+
+	// long-term latency recovers faster after the long period of the high latency
+	if g.longRTT/g.shortRTT > 2 {
+		g.longRTT *= 0.95
+	}
+
+	// the window is not used, the latency says nothing about it
+	if float64(inFlight) < g.limit/2 {
+		return
+	}
+
+	grad := math.Max(0.5, math.Min(1, g.tolerance*g.longRTT/g.shortRTT))
+	limit := g.limit*grad + math.Sqrt(g.limit)
+
+	g.limit = math.Max(g.min, math.Min(g.max, g.limit*(1-gradientSmoothing)+limit*gradientSmoothing))
+}
+
+func (g *gradient) window() int {
+	return int(g.limit)
+}
+
+// LLimiter provide limiter amount of requests/concurrently executing requests (adaptive with clickhouse latency).
+// The window of concurrent requests is changed from concurrent - n to concurrent by the latency of the clickhouse queries,
+// it's decreased on the timeouts and the failed queries
+type LLimiter struct {
+	limiter           limiter
+	concurrentLimiter pool
+	concurrent        int
+
+	mu       sync.Mutex
+	window   gradient
+	inFlight int
+	held     []context.Context // slots, held for the window decrease
+
+	m metrics.AdaptiveWaitMetric
+}
+
+// NewLLimiter creates a limiter for specific servers list.
+func NewLLimiter(p *PriorityConfig, capacity, concurrent, n int, tolerance, backoff float64, enableMetrics bool, scope, sub string) ServerLimiter {
+	if capacity <= 0 && concurrent <= 0 {
+		return NoopLimiter{}
+	}
+
+	if n >= concurrent {
+		n = concurrent - 1
+	}
+
+	if n <= 0 {
+		return NewWLimiter(p, capacity, concurrent, enableMetrics, scope, sub)
+	}
+
+	l := &LLimiter{
+		concurrent: concurrent,
+		window: gradient{
+			limit:     float64(concurrent),
+			min:       float64(concurrent - n),
+			max:       float64(concurrent),
+			tolerance: tolerance,
+			backoff:   backoff,
+		},
+		m: metrics.NewAdaptiveWaitMetric(enableMetrics, scope, sub),
+	}
+	if capacity > 0 {
+		l.limiter.ch = make(chan struct{}, capacity)
+		l.limiter.cap = capacity
+	}
+
+	l.concurrentLimiter = newPool(p, concurrent, enableMetrics, scope, sub)
+	l.m.Limit.Update(int64(concurrent))
+
+	return l
+}
+
+func (sl *LLimiter) Capacity() int {
+	return sl.limiter.capacity()
+}
+
+func (sl *LLimiter) Enter(ctx context.Context, s string) (err error) {
+	_, span := tracing.Start(ctx, "limiter.Enter", attribute.String("limiter", s))
+	defer func() { tracing.End(span, err) }()
+
+	if sl.limiter.cap > 0 {
+		if err = sl.limiter.tryEnter(ctx, s); err != nil {
+			sl.m.WaitErrors.Add(1)
+			return
+		}
+	}
+
+	if sl.concurrentLimiter.enter(ctx, s) != nil {
+		if sl.limiter.cap > 0 {
+			sl.limiter.leave(ctx, s)
+		}
+
+		sl.m.WaitErrors.Add(1)
+
+		err = ErrTimeout
+	} else {
+		sl.start(ctx)
+	}
+
+	sl.m.Requests.Add(1)
+
+	return
+}
+
+// TryEnter claims one of free slots without blocking.
+func (sl *LLimiter) TryEnter(ctx context.Context, s string) (err error) {
+	if sl.limiter.cap > 0 {
+		if err = sl.limiter.tryEnter(ctx, s); err != nil {
+			sl.m.WaitErrors.Add(1)
+			return
+		}
+	}
+
+	if sl.concurrentLimiter.tryEnter(ctx, s) != nil {
+		if sl.limiter.cap > 0 {
+			sl.limiter.leave(ctx, s)
+		}
+
+		sl.m.WaitErrors.Add(1)
+
+		err = ErrTimeout
+	} else {
+		sl.start(ctx)
+	}
+
+	sl.m.Requests.Add(1)
+
+	return
+}
+
+func (sl *LLimiter) start(ctx context.Context) {
+	sl.mu.Lock()
+	sl.inFlight++
+	sl.mu.Unlock()
+
+	if q := requestQueries(ctx); q != nil {
+		q.enter(sl)
+	}
+}
+
+// sample adapts the window by the latency of the finished clickhouse query
+func (sl *LLimiter) sample(d time.Duration, failed bool) {
+	sl.mu.Lock()
+	sl.window.update(d, sl.inFlight, failed)
+	sl.m.Limit.Update(int64(sl.window.window()))
+	sl.mu.Unlock()
+}
+
+// Frees a slot in limiter
+func (sl *LLimiter) Leave(ctx context.Context, s string) {
+	if sl.limiter.cap > 0 {
+		sl.limiter.leave(ctx, s)
+	}
+
+	if q := requestQueries(ctx); q != nil {
+		q.leave(sl)
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	sl.inFlight--
+
+	hold := sl.concurrent - sl.window.window()
+	if len(sl.held) < hold {
+		// the slot is held with the request priority for the decreased window
+		sl.held = append(sl.held, WithPriority(ctxMain, Priority(ctx)))
+		return
+	}
+
+	sl.concurrentLimiter.leave(ctx, s)
+
+	for len(sl.held) > hold {
+		n := len(sl.held) - 1
+		sl.concurrentLimiter.leave(sl.held[n], "window")
+		sl.held[n] = nil
+		sl.held = sl.held[:n]
+	}
+}
+
+// SendDuration send StatsD duration iming
+func (sl *LLimiter) SendDuration(queueMs int64) {
+	if sl.m.WaitTimeName != "" {
+		metrics.Gstatsd.Timing(sl.m.WaitTimeName, queueMs, 1.0)
+	}
+}
+
+// Unregiter unregister graphite metric
+func (sl *LLimiter) Unregiter() {
+	sl.m.Unregister()
+	sl.concurrentLimiter.unregister()
+}
+
+// Enabled return enabled flag, if false - it's a noop limiter and can be safely skiped
+func (sl *LLimiter) Enabled() bool {
+	return true
+}
@@ -0,0 +1,146 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       AdaptiveConfig
+		wantErr string
+	}{
+		{name: "load-avg", c: AdaptiveConfig{Mode: AdaptiveLoadAvg}},
+		{name: "latency", c: AdaptiveConfig{Mode: AdaptiveLatency, Tolerance: 1.5, Backoff: 0.9}},
+		{name: "unknown mode", c: AdaptiveConfig{Mode: "aimd"}, wantErr: `unknown mode "aimd", known modes: "load-avg", "latency"`},
+		{name: "tolerance", c: AdaptiveConfig{Mode: AdaptiveLatency, Tolerance: 0.5, Backoff: 0.9}, wantErr: "tolerance must be at least 1"},
+		{name: "backoff", c: AdaptiveConfig{Mode: AdaptiveLatency, Tolerance: 1.5, Backoff: 1}, wantErr: "backoff must be in (0, 1)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewAdaptiveLimiter(t *testing.T) {
+	assert.IsType(t, &LLimiter{}, NewAdaptiveLimiter(&AdaptiveConfig{Mode: AdaptiveLatency, Tolerance: 1.5, Backoff: 0.9}, nil, 0, 10, 5, false, "test", "all"))
+	assert.IsType(t, &WLimiter{}, NewAdaptiveLimiter(&AdaptiveConfig{Mode: AdaptiveLatency, Tolerance: 1.5, Backoff: 0.9}, nil, 0, 10, 0, false, "test", "all"))
+	assert.IsType(t, NoopLimiter{}, NewAdaptiveLimiter(&AdaptiveConfig{Mode: AdaptiveLatency, Tolerance: 1.5, Backoff: 0.9}, nil, 0, 0, 5, false, "test", "all"))
+}
+
+func TestGradient(t *testing.T) {
+	g := gradient{limit: 20, min: 5, max: 20, tolerance: 1.5, backoff: 0.9}
+
+	// stable latency
+	for i := 0; i < 100; i++ {
+		g.update(100*time.Millisecond, 20, false)
+	}
+
+	assert.Equal(t, 20, g.window())
+
+	// the latency is increased, the window is decreased to the minimum
+	for i := 0; i < 100; i++ {
+		g.update(time.Second, g.window(), false)
+	}
+
+	assert.Equal(t, 5, g.window())
+
+	// the latency is recovered, the window is increased
+	for i := 0; i < 100; i++ {
+		g.update(100*time.Millisecond, g.window(), false)
+	}
+
+	assert.Equal(t, 20, g.window())
+
+	// unused window is not changed
+	for i := 0; i < 100; i++ {
+		g.update(time.Second, 1, false)
+	}
+
+	assert.Equal(t, 20, g.window())
+
+	g.update(100*time.Millisecond, 1, true)
+	assert.Equal(t, 18, g.window())
+
+	for i := 0; i < 100; i++ {
+		g.update(100*time.Millisecond, 1, true)
+	}
+
+	assert.Equal(t, 5, g.window())
+}
+
+func TestLLimiterWindow(t *testing.T) {
+	l := NewLLimiter(nil, 0, 4, 2, 1.5, 0.5, false, "test", "all").(*LLimiter)
+
+	ctxs := make([]context.Context, 4)
+	for i := range ctxs {
+		ctxs[i] = WithQueries(context.Background())
+		require.NoError(t, l.TryEnter(ctxs[i], "test"))
+	}
+
+	assert.ErrorIs(t, l.TryEnter(context.Background(), "test"), ErrTimeout)
+
+	// the failed query decreases the window, the released slot is held
+	QueryDone(ctxs[0], time.Millisecond, true)
+	l.Leave(ctxs[0], "test")
+	assert.Equal(t, 2, l.window.window())
+	assert.Len(t, l.held, 1)
+	assert.ErrorIs(t, l.TryEnter(context.Background(), "test"), ErrTimeout)
+
+	l.Leave(ctxs[1], "test")
+	assert.Len(t, l.held, 2)
+	assert.ErrorIs(t, l.TryEnter(context.Background(), "test"), ErrTimeout)
+
+	// the queries of the request, canceled by the client, are not accounted
+	ctx, cancel := context.WithCancel(ctxs[2])
+	cancel()
+	QueryDone(ctx, time.Millisecond, true)
+	assert.Equal(t, 2, l.window.window())
+
+	// the slot is left with the other context of the request
+	l.Leave(ctxs[3], "test")
+	assert.Len(t, l.held, 2)
+	require.NoError(t, l.TryEnter(ctx, "test"))
+	l.Leave(ctxs[2], "test")
+	l.Leave(ctx, "test")
+
+	for i := range ctxs {
+		assert.Empty(t, requestQueries(ctxs[i]).entered, i)
+	}
+
+	assert.Equal(t, 0, l.inFlight)
+
+	// the queries after leave are not accounted
+	QueryDone(ctxs[0], time.Millisecond, true)
+	assert.Equal(t, 2, l.window.window())
+
+	// the window is increased
+	l.window.limit = 3
+	require.NoError(t, l.TryEnter(ctxs[0], "test"))
+	l.Leave(ctxs[0], "test")
+	assert.Len(t, l.held, 1)
+
+	l.window.limit = 4
+	for i := 0; i < 2; i++ {
+		require.NoError(t, l.TryEnter(ctxs[i], "test"), i)
+	}
+
+	l.Leave(ctxs[1], "test")
+	assert.Empty(t, l.held)
+
+	for i := 1; i < 4; i++ {
+		require.NoError(t, l.TryEnter(ctxs[i], "test"), i)
+	}
+}
@@ -0,0 +1,369 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+const (
+	PriorityStrict   = "strict"
+	PriorityWeighted = "weighted"
+)
+
+// PriorityConfig is the priority classes config
+type PriorityConfig struct {
+	Mode    string          `toml:"mode"   json:"mode"   comment:"scheduling of the waiting requests between the classes: strict or weighted"`
+	Header  string          `toml:"header" json:"header" comment:"request header with the class name (empty - class is selected by user and grafana headers)"`
+	Classes []PriorityClass `toml:"class"  json:"class"  comment:"priority classes, from the highest to the lowest, unmatched requests get the lowest class"`
+}
+
+// PriorityClass is the priority class config
+type PriorityClass struct {
+	Name              string   `toml:"name"               json:"name"`
+	Weight            int      `toml:"weight"             json:"weight"             comment:"share of the freed slots in weighted mode"`
+	Reserved          float64  `toml:"reserved"           json:"reserved"           comment:"share of the concurrent slots of each limiter, reserved for the class"`
+	Users             []string `toml:"users"              json:"users"              comment:"X-Forwarded-User of the requests in the class"`
+	GrafanaOrgs       []string `toml:"grafana-orgs"       json:"grafana-orgs"       comment:"X-Grafana-Org-Id of the requests in the class"`
+	GrafanaDashboards []string `toml:"grafana-dashboards" json:"grafana-dashboards" comment:"X-Dashboard-Id of the requests in the class"`
+}
+
+// Validate checks the config and sets the default weights
+func (c *PriorityConfig) Validate() error {
+	if len(c.Classes) == 0 {
+		return nil
+	}
+
+	switch c.Mode {
+	case PriorityStrict, PriorityWeighted:
+	default:
+		return fmt.Errorf("unknown mode %q, known modes: %q, %q", c.Mode, PriorityStrict, PriorityWeighted)
+	}
+
+	names := make(map[string]bool, len(c.Classes))
+
+	var reserved float64
+
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		if class.Name == "" {
+			return fmt.Errorf("class name can't be empty")
+		}
+
+		if names[class.Name] {
+			return fmt.Errorf("duplicate class %q", class.Name)
+		}
+
+		names[class.Name] = true
+
+		if class.Weight < 0 {
+			return fmt.Errorf("class %q: weight can't be negative", class.Name)
+		} else if class.Weight == 0 {
+			class.Weight = 1
+		}
+
+		if class.Reserved < 0 || class.Reserved >= 1 {
+			return fmt.Errorf("class %q: reserved must be in [0, 1)", class.Name)
+		}
+
+		reserved += class.Reserved
+	}
+
+	if reserved >= 1 {
+		return fmt.Errorf("sum of the reserved shares must be less than 1")
+	}
+
+	return nil
+}
+
+// Classify returns the class of the request: by the header value, then by user, grafana org and dashboard.
+// Unmatched requests get the lowest class
+func (c *PriorityConfig) Classify(header, user, org, dashboard string) int {
+	if header != "" {
+		for i := range c.Classes {
+			if c.Classes[i].Name == header {
+				return i
+			}
+		}
+	}
+
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		if user != "" && contains(class.Users, user) ||
+			org != "" && contains(class.GrafanaOrgs, org) ||
+			dashboard != "" && contains(class.GrafanaDashboards, dashboard) {
+			return i
+		}
+	}
+
+	return len(c.Classes) - 1
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx with the priority class (index in the classes) of the request
+func WithPriority(ctx context.Context, class int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, class)
+}
+
+// Priority returns the priority class of the request, -1 if not set
+func Priority(ctx context.Context) int {
+	if class, ok := ctx.Value(priorityKey{}).(int); ok {
+		return class
+	}
+
+	return -1
+}
+
+// pool is the slots pool for the concurrent requests
+type pool interface {
+	capacity() int
+	enter(ctx context.Context, s string) error
+	tryEnter(ctx context.Context, s string) error
+	leave(ctx context.Context, s string)
+	unregister()
+}
+
+// newPool returns the priority pool if the classes are set or the FIFO pool
+func newPool(p *PriorityConfig, capacity int, enableMetrics bool, scope, sub string) pool {
+	if p != nil && len(p.Classes) > 0 {
+		return newPriorityPool(p, capacity, enableMetrics, scope, sub)
+	}
+
+	return &limiter{ch: make(chan struct{}, capacity), cap: capacity}
+}
+
+func (sl *limiter) unregister() {}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+type priorityClass struct {
+	weight   float64
+	reserved int
+	inUse    int
+	pass     float64 // stride scheduling pass in weighted mode
+	waiters  []*waiter
+	metrics  metrics.PriorityWaitMetric
+}
+
+// priorityPool serves the waiting requests by the priority classes. The reserved slots of the class can't be used
+// by the other classes
+type priorityPool struct {
+	mu       sync.Mutex
+	cap      int
+	used     int
+	weighted bool
+	vtime    float64 // pass of the last served class
+	waiting  int
+	classes  []priorityClass
+}
+
+func newPriorityPool(c *PriorityConfig, capacity int, enableMetrics bool, scope, sub string) *priorityPool {
+	p := &priorityPool{
+		cap:      capacity,
+		weighted: c.Mode == PriorityWeighted,
+		classes:  make([]priorityClass, len(c.Classes)),
+	}
+
+	for i := range c.Classes {
+		p.classes[i] = priorityClass{
+			weight:   float64(c.Classes[i].Weight),
+			reserved: int(math.Ceil(c.Classes[i].Reserved * float64(capacity))),
+			metrics:  metrics.NewPriorityWaitMetric(enableMetrics, scope, sub, c.Classes[i].Name),
+		}
+	}
+
+	return p
+}
+
+func (p *priorityPool) class(ctx context.Context) int {
+	class := Priority(ctx)
+	if class < 0 || class >= len(p.classes) {
+		return len(p.classes) - 1
+	}
+
+	return class
+}
+
+func (p *priorityPool) capacity() int {
+	return p.cap
+}
+
+// canGrant checks that the slot for the class doesn't break the reservations of the other classes
+func (p *priorityPool) canGrant(class int) bool {
+	free := p.cap - p.used
+	if free <= 0 {
+		return false
+	}
+
+	var reserved int
+
+	for i := range p.classes {
+		if i != class && p.classes[i].inUse < p.classes[i].reserved {
+			reserved += p.classes[i].reserved - p.classes[i].inUse
+		}
+	}
+
+	return free > reserved
+}
+
+func (p *priorityPool) grant(class int) {
+	p.used++
+	p.classes[class].inUse++
+
+	if p.weighted {
+		p.classes[class].pass += 1 / p.classes[class].weight
+		p.vtime = p.classes[class].pass
+	}
+}
+
+// next returns the waiting class to serve or -1
+func (p *priorityPool) next() int {
+	next := -1
+
+	for i := range p.classes {
+		if len(p.classes[i].waiters) == 0 || !p.canGrant(i) {
+			continue
+		}
+
+		if !p.weighted {
+			return i
+		}
+
+		if next == -1 || p.classes[i].pass < p.classes[next].pass {
+			next = i
+		}
+	}
+
+	return next
+}
+
+// dispatch grants the free slots to the waiters
+func (p *priorityPool) dispatch() {
+	for p.waiting > 0 {
+		class := p.next()
+		if class == -1 {
+			return
+		}
+
+		c := &p.classes[class]
+		w := c.waiters[0]
+		c.waiters[0] = nil
+		c.waiters = c.waiters[1:]
+		p.waiting--
+
+		p.grant(class)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+func (p *priorityPool) tryEnter(ctx context.Context, s string) error {
+	class := p.class(ctx)
+	m := &p.classes[class].metrics
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m.Requests.Add(1)
+
+	if p.waiting > 0 || !p.canGrant(class) {
+		m.WaitErrors.Add(1)
+		return ErrOverflow
+	}
+
+	p.grant(class)
+
+	return nil
+}
+
+func (p *priorityPool) enter(ctx context.Context, s string) error {
+	class := p.class(ctx)
+	c := &p.classes[class]
+	start := time.Now()
+
+	p.mu.Lock()
+	c.metrics.Requests.Add(1)
+
+	if p.waiting == 0 && p.canGrant(class) {
+		p.grant(class)
+		p.mu.Unlock()
+
+		return nil
+	}
+
+	if p.weighted && len(c.waiters) == 0 && c.pass < p.vtime {
+		// idle class doesn't accumulate the credit
+		c.pass = p.vtime
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	p.waiting++
+	p.dispatch()
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		c.metrics.WaitTime.Add(uint64(time.Since(start).Milliseconds()))
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.metrics.WaitTime.Add(uint64(time.Since(start).Milliseconds()))
+	c.metrics.WaitErrors.Add(1)
+
+	if w.granted {
+		// the slot is granted concurrently with the timeout
+		p.release(class)
+	} else {
+		for i := range c.waiters {
+			if c.waiters[i] == w {
+				c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+				p.waiting--
+
+				break
+			}
+		}
+	}
+
+	return ErrTimeout
+}
+
+func (p *priorityPool) release(class int) {
+	p.used--
+	p.classes[class].inUse--
+	p.dispatch()
+}
+
+func (p *priorityPool) leave(ctx context.Context, s string) {
+	p.mu.Lock()
+	p.release(p.class(ctx))
+	p.mu.Unlock()
+}
+
+func (p *priorityPool) unregister() {
+	for i := range p.classes {
+		p.classes[i].metrics.Unregister()
+	}
+}
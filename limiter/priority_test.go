@@ -0,0 +1,178 @@
+package limiter
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       PriorityConfig
+		wantErr string
+	}{
+		{name: "disabled", c: PriorityConfig{}},
+		{name: "strict", c: PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{Name: "alerting", Reserved: 0.2}, {Name: "default"}}}},
+		{name: "unknown mode", c: PriorityConfig{Mode: "fifo", Classes: []PriorityClass{{Name: "default"}}}, wantErr: `unknown mode "fifo", known modes: "strict", "weighted"`},
+		{name: "duplicate", c: PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{Name: "a"}, {Name: "a"}}}, wantErr: `duplicate class "a"`},
+		{name: "empty name", c: PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{}}}, wantErr: "class name can't be empty"},
+		{name: "reserved", c: PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{Name: "a", Reserved: 0.6}, {Name: "b", Reserved: 0.4}}}, wantErr: "sum of the reserved shares must be less than 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPriorityConfigClassify(t *testing.T) {
+	c := PriorityConfig{
+		Mode: PriorityStrict,
+		Classes: []PriorityClass{
+			{Name: "alerting", Users: []string{"grafana-alerting"}, GrafanaDashboards: []string{"42"}},
+			{Name: "dashboards", GrafanaOrgs: []string{"1"}},
+			{Name: "default"},
+		},
+	}
+
+	assert.Equal(t, 0, c.Classify("", "grafana-alerting", "", ""))
+	assert.Equal(t, 0, c.Classify("", "", "1", "42"))
+	assert.Equal(t, 1, c.Classify("", "alice", "1", "7"))
+	assert.Equal(t, 2, c.Classify("", "alice", "", ""))
+	assert.Equal(t, 2, c.Classify("default", "grafana-alerting", "", ""))
+	assert.Equal(t, 0, c.Classify("unknown", "grafana-alerting", "", ""))
+}
+
+// waitQueued waits until n requests are queued in the pool
+func waitQueued(t *testing.T, p *priorityPool, n int) {
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		return p.waiting == n
+	}, time.Second, time.Millisecond)
+}
+
+// enterOrder runs the requests of the classes, queued in the given order, and returns the order of the entered classes
+func enterOrder(t *testing.T, p *priorityPool, classes []int) []int {
+	ctx := context.Background()
+
+	// hold the slots
+	for i := 0; i < p.cap; i++ {
+		require.NoError(t, p.enter(WithPriority(ctx, len(p.classes)-1), "test"))
+	}
+
+	var (
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		order []int
+	)
+
+	for i, class := range classes {
+		wg.Add(1)
+
+		go func(class int) {
+			defer wg.Done()
+
+			ctx := WithPriority(ctx, class)
+			if assert.NoError(t, p.enter(ctx, "test")) {
+				lock.Lock()
+				order = append(order, class)
+				lock.Unlock()
+
+				p.leave(ctx, "test")
+			}
+		}(class)
+
+		waitQueued(t, p, i+1)
+	}
+
+	for i := 0; i < p.cap; i++ {
+		p.leave(WithPriority(ctx, len(p.classes)-1), "test")
+	}
+
+	wg.Wait()
+
+	return order
+}
+
+func TestPriorityPoolStrict(t *testing.T) {
+	p := newPriorityPool(&PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{Name: "high"}, {Name: "low"}}}, 1, false, "test", "all")
+
+	assert.Equal(t, []int{0, 0, 1, 1}, enterOrder(t, p, []int{1, 1, 0, 0}))
+}
+
+func TestPriorityPoolWeighted(t *testing.T) {
+	p := newPriorityPool(&PriorityConfig{Mode: PriorityWeighted, Classes: []PriorityClass{{Name: "high", Weight: 3}, {Name: "low", Weight: 1}}}, 1, false, "test", "all")
+
+	order := enterOrder(t, p, []int{1, 1, 1, 1, 0, 0, 0, 0, 0, 0})
+
+	require.Len(t, order, 10)
+	// 3 of 4 slots go to the high class while it's waiting
+	assert.Equal(t, []int{0, 0, 0, 1}, sorted(order[:4]))
+	assert.Equal(t, []int{0, 0, 0, 1}, sorted(order[4:8]))
+}
+
+func sorted(classes []int) []int {
+	s := append([]int(nil), classes...)
+	sort.Ints(s)
+
+	return s
+}
+
+func TestPriorityPoolReserved(t *testing.T) {
+	p := newPriorityPool(&PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{Name: "high", Reserved: 0.25}, {Name: "low"}}}, 4, false, "test", "all")
+
+	high := WithPriority(context.Background(), 0)
+	low := context.Background() // the lowest class by default
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, p.enter(low, "test"))
+	}
+
+	// the last slot is reserved
+	assert.ErrorIs(t, p.tryEnter(low, "test"), ErrOverflow)
+
+	ctx, cancel := context.WithTimeout(low, 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, p.enter(ctx, "test"), ErrTimeout)
+	assert.Equal(t, 0, p.waiting)
+
+	require.NoError(t, p.enter(high, "test"))
+	assert.Equal(t, 4, p.used)
+
+	p.leave(high, "test")
+	p.leave(low, "test")
+
+	// the high class can use the unreserved slots
+	require.NoError(t, p.enter(high, "test"))
+	require.NoError(t, p.enter(high, "test"))
+	assert.Equal(t, []int{2, 2}, []int{p.classes[0].inUse, p.classes[1].inUse})
+}
+
+func TestWLimiterPriority(t *testing.T) {
+	p := &PriorityConfig{Mode: PriorityStrict, Classes: []PriorityClass{{Name: "high"}, {Name: "low"}}}
+
+	l := NewWLimiter(p, 0, 2, false, "test", "all")
+	require.IsType(t, &WLimiter{}, l)
+	assert.IsType(t, &priorityPool{}, l.(*WLimiter).concurrentLimiter)
+
+	l = NewWLimiter(nil, 0, 2, false, "test", "all")
+	assert.IsType(t, &limiter{}, l.(*WLimiter).concurrentLimiter)
+
+	l = NewWLimiter(&PriorityConfig{}, 0, 2, false, "test", "all")
+	assert.IsType(t, &limiter{}, l.(*WLimiter).concurrentLimiter)
+}
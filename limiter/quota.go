@@ -0,0 +1,180 @@
+package limiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// quotaSlots is the number of the slots in the rolling window, the expired reads are released by the slot
+const quotaSlots = 60
+
+// QuotaError is returned when the request rate or the read quota is exceeded
+type QuotaError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s exceeded, retry after %s", e.Reason, e.RetryAfter)
+}
+
+// UserQuota limits the requests rate with the token bucket and the clickhouse read rows and bytes in the rolling window
+type UserQuota struct {
+	mu sync.Mutex
+
+	rate   float64 // tokens per second, 0 - unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	maxRows   int64 // 0 - unlimited
+	maxBytes  int64
+	slotWidth time.Duration
+	slots     [quotaSlots]quotaSlot
+	rows      int64 // sum of the slots
+	bytes     int64
+}
+
+type quotaSlot struct {
+	start time.Time
+	rows  int64
+	bytes int64
+}
+
+// NewUserQuota returns the quota or nil if there are no limits. Burst less than 1 is set to the rate (but at least 1)
+func NewUserQuota(rate float64, burst int, maxRows, maxBytes int64, window time.Duration) *UserQuota {
+	if rate <= 0 && (maxRows <= 0 && maxBytes <= 0 || window <= 0) {
+		return nil
+	}
+
+	q := &UserQuota{}
+
+	if rate > 0 {
+		q.rate = rate
+		q.burst = float64(burst)
+
+		if q.burst < 1 {
+			q.burst = rate
+			if q.burst < 1 {
+				q.burst = 1
+			}
+		}
+
+		q.tokens = q.burst
+	}
+
+	if window > 0 {
+		q.maxRows = maxRows
+		q.maxBytes = maxBytes
+		q.slotWidth = window / quotaSlots
+
+		if q.slotWidth <= 0 {
+			q.slotWidth = 1
+		}
+	}
+
+	return q
+}
+
+// Allow takes the token for the request. Returns *QuotaError if the read quota or the request rate is exceeded
+func (q *UserQuota) Allow(now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+
+	if q.maxRows > 0 && q.rows >= q.maxRows {
+		return &QuotaError{Reason: "read rows quota", RetryAfter: q.releaseAfter(now, func(s *quotaSlot) int64 { return s.rows }, q.rows-q.maxRows)}
+	}
+
+	if q.maxBytes > 0 && q.bytes >= q.maxBytes {
+		return &QuotaError{Reason: "read bytes quota", RetryAfter: q.releaseAfter(now, func(s *quotaSlot) int64 { return s.bytes }, q.bytes-q.maxBytes)}
+	}
+
+	if q.rate > 0 {
+		if !q.last.IsZero() && now.After(q.last) {
+			q.tokens += now.Sub(q.last).Seconds() * q.rate
+			if q.tokens > q.burst {
+				q.tokens = q.burst
+			}
+		}
+
+		q.last = now
+
+		if q.tokens < 1 {
+			return &QuotaError{Reason: "requests rate", RetryAfter: time.Duration((1 - q.tokens) / q.rate * float64(time.Second))}
+		}
+
+		q.tokens--
+	}
+
+	return nil
+}
+
+// AddRead accounts the rows and bytes read by the request
+func (q *UserQuota) AddRead(now time.Time, rows, bytes int64) {
+	if q.slotWidth == 0 || rows <= 0 && bytes <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+
+	start := now.Truncate(q.slotWidth)
+	s := &q.slots[(start.UnixNano()/int64(q.slotWidth))%quotaSlots]
+
+	if !s.start.Equal(start) {
+		*s = quotaSlot{start: start}
+	}
+
+	s.rows += rows
+	s.bytes += bytes
+	q.rows += rows
+	q.bytes += bytes
+}
+
+// expire releases the slots out of the window
+func (q *UserQuota) expire(now time.Time) {
+	if q.slotWidth == 0 {
+		return
+	}
+
+	windowStart := now.Add(-q.slotWidth * (quotaSlots - 1)).Truncate(q.slotWidth)
+
+	for i := range q.slots {
+		s := &q.slots[i]
+		if !s.start.IsZero() && s.start.Before(windowStart) {
+			q.rows -= s.rows
+			q.bytes -= s.bytes
+			*s = quotaSlot{}
+		}
+	}
+}
+
+// releaseAfter returns the duration until the oldest slots with more than excess values are expired
+func (q *UserQuota) releaseAfter(now time.Time, value func(*quotaSlot) int64, excess int64) time.Duration {
+	slots := make([]*quotaSlot, 0, quotaSlots)
+
+	for i := range q.slots {
+		if s := &q.slots[i]; !s.start.IsZero() && value(s) > 0 {
+			slots = append(slots, s)
+		}
+	}
+
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start.Before(slots[j].start) })
+
+	var released int64
+
+	for _, s := range slots {
+		released += value(s)
+		if released > excess {
+			return s.start.Add(q.slotWidth * quotaSlots).Sub(now)
+		}
+	}
+
+	return q.slotWidth
+}
@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUserQuota(t *testing.T) {
+	assert.Nil(t, NewUserQuota(0, 0, 0, 0, time.Hour))
+	assert.Nil(t, NewUserQuota(0, 0, 1000, 0, 0))
+	assert.NotNil(t, NewUserQuota(0.5, 0, 0, 0, 0))
+	assert.NotNil(t, NewUserQuota(0, 0, 0, 1000, time.Hour))
+}
+
+func TestUserQuotaRate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	q := NewUserQuota(2, 3, 0, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Allow(now), i)
+	}
+
+	err := q.Allow(now)
+	require.Error(t, err)
+
+	var qerr *QuotaError
+
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, "requests rate", qerr.Reason)
+	assert.Equal(t, 500*time.Millisecond, qerr.RetryAfter)
+
+	// refilled with 2 tokens per second
+	now = now.Add(time.Second)
+	require.NoError(t, q.Allow(now))
+	require.NoError(t, q.Allow(now))
+	require.Error(t, q.Allow(now))
+
+	// not more than burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Allow(now), i)
+	}
+
+	require.Error(t, q.Allow(now))
+}
+
+func TestUserQuotaRead(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	q := NewUserQuota(0, 0, 1000, 1<<20, time.Minute)
+
+	require.NoError(t, q.Allow(now))
+	q.AddRead(now, 600, 100)
+
+	now = now.Add(10 * time.Second)
+	require.NoError(t, q.Allow(now))
+	q.AddRead(now, 600, 100)
+
+	// 1200 rows are read in the window
+	now = now.Add(10 * time.Second)
+	err := q.Allow(now)
+
+	var qerr *QuotaError
+
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, "read rows quota", qerr.Reason)
+	// the first read is released after the window
+	assert.Equal(t, 40*time.Second, qerr.RetryAfter)
+
+	now = now.Add(qerr.RetryAfter)
+	require.NoError(t, q.Allow(now))
+
+	// the second read is released too
+	now = now.Add(10 * time.Second)
+	q.AddRead(now, 0, 2<<20)
+
+	err = q.Allow(now)
+	require.ErrorAs(t, err, &qerr)
+	assert.Equal(t, "read bytes quota", qerr.Reason)
+	assert.Equal(t, time.Minute, qerr.RetryAfter)
+}
@@ -3,24 +3,27 @@ package limiter
 import (
 	"context"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 )
 
 // WLimiter provide limiter amount of requests/concurrently executing requests
 type WLimiter struct {
 	limiter           limiter
-	concurrentLimiter limiter
+	concurrentLimiter pool
 	metrics           metrics.WaitMetric
 }
 
 // NewServerLimiter creates a limiter for specific servers list.
-func NewWLimiter(capacity, concurrent int, enableMetrics bool, scope, sub string) ServerLimiter {
+func NewWLimiter(p *PriorityConfig, capacity, concurrent int, enableMetrics bool, scope, sub string) ServerLimiter {
 	if capacity <= 0 && concurrent <= 0 {
 		return NoopLimiter{}
 	}
 
 	if concurrent <= 0 {
-		return NewLimiter(capacity, enableMetrics, scope, sub)
+		return NewLimiter(p, capacity, enableMetrics, scope, sub)
 	}
 
 	w := &WLimiter{
@@ -32,8 +35,7 @@ func NewWLimiter(capacity, concurrent int, enableMetrics bool, scope, sub string
 	}
 
 	if concurrent > 0 {
-		w.concurrentLimiter.ch = make(chan struct{}, concurrent)
-		w.concurrentLimiter.cap = concurrent
+		w.concurrentLimiter = newPool(p, concurrent, enableMetrics, scope, sub)
 	}
 
 	return w
@@ -44,6 +46,9 @@ func (sl *WLimiter) Capacity() int {
 }
 
 func (sl *WLimiter) Enter(ctx context.Context, s string) (err error) {
+	_, span := tracing.Start(ctx, "limiter.Enter", attribute.String("limiter", s))
+	defer func() { tracing.End(span, err) }()
+
 	if sl.limiter.cap > 0 {
 		if err = sl.limiter.tryEnter(ctx, s); err != nil {
 			sl.metrics.WaitErrors.Add(1)
@@ -51,7 +56,7 @@ func (sl *WLimiter) Enter(ctx context.Context, s string) (err error) {
 		}
 	}
 
-	if sl.concurrentLimiter.cap > 0 {
+	if sl.concurrentLimiter != nil {
 		if sl.concurrentLimiter.enter(ctx, s) != nil {
 			if sl.limiter.cap > 0 {
 				sl.limiter.leave(ctx, s)
@@ -77,7 +82,7 @@ func (sl *WLimiter) TryEnter(ctx context.Context, s string) (err error) {
 		}
 	}
 
-	if sl.concurrentLimiter.cap > 0 {
+	if sl.concurrentLimiter != nil {
 		if sl.concurrentLimiter.tryEnter(ctx, s) != nil {
 			if sl.limiter.cap > 0 {
 				sl.limiter.leave(ctx, s)
@@ -113,6 +118,7 @@ func (sl *WLimiter) SendDuration(queueMs int64) {
 // Unregiter unregister graphite metric
 func (sl *WLimiter) Unregiter() {
 	sl.metrics.Unregister()
+	sl.concurrentLimiter.unregister()
 }
 
 // Enabled return enabled flag, if false - it's a noop limiter and can be safely skiped
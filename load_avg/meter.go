@@ -0,0 +1,231 @@
+package load_avg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signals of the normalized load
+const (
+	SignalLoadAvg        = "load-avg"        // host load average, divided by the host cpus
+	SignalCgroupCPU      = "cgroup-cpu"      // cpu usage of the cgroup, divided by the cgroup cpu quota
+	SignalCPUPressure    = "cpu-pressure"    // cpu stall time (PSI) of the cgroup
+	SignalMemoryPressure = "memory-pressure" // memory stall time (PSI) of the cgroup
+	SignalPressure       = "pressure"        // max of cpu-pressure and memory-pressure
+)
+
+// Signals is the list of the known signals
+var Signals = []string{SignalLoadAvg, SignalCgroupCPU, SignalCPUPressure, SignalMemoryPressure, SignalPressure}
+
+// ValidSignal returns true if the signal is known
+func ValidSignal(signal string) bool {
+	for _, s := range Signals {
+		if s == signal {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Meter measures the normalized load (1.0 - fully loaded) by the selected signal
+type Meter struct {
+	signal        string
+	pressureScale float64 // stall percent for the normalized load 1.0
+	proc          string
+	cgroup        string // cgroup v2 directory of the process
+
+	usage time.Duration // cpu usage of the cgroup on the previous measure
+	at    time.Time
+	load  float64
+}
+
+// NewMeter returns the meter of the signal, pressureScale is the stall percent (avg10) treated as the normalized load 1.0
+func NewMeter(signal string, pressureScale float64) *Meter {
+	return newMeter(signal, pressureScale, "/proc", "/sys/fs/cgroup")
+}
+
+func newMeter(signal string, pressureScale float64, proc, cgroupRoot string) *Meter {
+	return &Meter{
+		signal:        signal,
+		pressureScale: pressureScale,
+		proc:          proc,
+		cgroup:        cgroupDir(proc, cgroupRoot),
+	}
+}
+
+// cgroupDir returns the cgroup v2 directory of the process (the root, if the cgroup namespace is used)
+func cgroupDir(proc, cgroupRoot string) string {
+	b, err := os.ReadFile(filepath.Join(proc, "self", "cgroup"))
+	if err != nil {
+		return cgroupRoot
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if path, ok := strings.CutPrefix(s.Text(), "0::"); ok {
+			dir := filepath.Join(cgroupRoot, path)
+			if _, err = os.Stat(dir); err == nil {
+				return dir
+			}
+
+			break
+		}
+	}
+
+	return cgroupRoot
+}
+
+// Normalized returns the normalized load
+func (m *Meter) Normalized() (float64, error) {
+	switch m.signal {
+	case SignalLoadAvg, "":
+		return Normalized()
+	case SignalCgroupCPU:
+		return m.cpuUsage(time.Now())
+	case SignalCPUPressure:
+		return m.pressure("cpu")
+	case SignalMemoryPressure:
+		return m.pressure("memory")
+	case SignalPressure:
+		cpu, err := m.pressure("cpu")
+		if err != nil {
+			return 0, err
+		}
+
+		memory, err := m.pressure("memory")
+		if err != nil {
+			return 0, err
+		}
+
+		if memory > cpu {
+			return memory, nil
+		}
+
+		return cpu, nil
+	default:
+		return 0, fmt.Errorf("unknown load signal %q", m.signal)
+	}
+}
+
+// pressure reads the cgroup PSI, the host PSI is used for the root cgroup
+func (m *Meter) pressure(resource string) (float64, error) {
+	b, err := os.ReadFile(filepath.Join(m.cgroup, resource+".pressure"))
+	if errors.Is(err, os.ErrNotExist) {
+		b, err = os.ReadFile(filepath.Join(m.proc, "pressure", resource))
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	stall, err := parsePressure(b)
+	if err != nil {
+		return 0, fmt.Errorf("%s pressure: %w", resource, err)
+	}
+
+	return stall / m.pressureScale, nil
+}
+
+// cpuUsage returns the cpu usage since the previous measure, divided by the cgroup cpu quota.
+// The first measure returns 0
+func (m *Meter) cpuUsage(now time.Time) (float64, error) {
+	b, err := os.ReadFile(filepath.Join(m.cgroup, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	usage, err := parseCPUUsage(b)
+	if err != nil {
+		return 0, err
+	}
+
+	cpus := float64(runtime.NumCPU())
+
+	if b, err = os.ReadFile(filepath.Join(m.cgroup, "cpu.max")); err == nil {
+		if quota, ok := parseCPUMax(b); ok && quota < cpus {
+			cpus = quota
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	if !m.at.IsZero() {
+		elapsed := now.Sub(m.at)
+		if elapsed < time.Second {
+			// too short interval for the rate
+			return m.load, nil
+		}
+
+		m.load = float64(usage-m.usage) / float64(elapsed) / cpus
+	}
+
+	m.usage = usage
+	m.at = now
+
+	return m.load, nil
+}
+
+// parsePressure returns the some avg10 of the PSI file
+func parsePressure(b []byte) (float64, error) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+
+		for _, f := range fields[1:] {
+			if v, ok := strings.CutPrefix(f, "avg10="); ok {
+				return strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+
+	return 0, errors.New("some avg10 not found")
+}
+
+// parseCPUUsage returns usage_usec of the cgroup cpu.stat
+func parseCPUUsage(b []byte) (time.Duration, error) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "usage_usec "); ok {
+			usec, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("cpu.stat: %w", err)
+			}
+
+			return time.Duration(usec) * time.Microsecond, nil
+		}
+	}
+
+	return 0, errors.New("cpu.stat: usage_usec not found")
+}
+
+// parseCPUMax returns the cpu quota of the cgroup cpu.max, false if the quota is not set
+func parseCPUMax(b []byte) (float64, bool) {
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+
+	quota, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	period, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || period <= 0 || quota <= 0 {
+		return 0, false
+	}
+
+	return quota / period, true
+}
@@ -0,0 +1,153 @@
+package load_avg
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{
+			name: "cpu",
+			in:   "some avg10=12.50 avg60=3.00 avg300=1.00 total=123456\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n",
+			want: 12.5,
+		},
+		{
+			name: "full first",
+			in:   "full avg10=40.00 avg60=0.00 avg300=0.00 total=0\nsome avg10=50.00 avg60=0.00 avg300=0.00 total=0\n",
+			want: 50,
+		},
+		{name: "empty", in: "", wantErr: true},
+		{name: "invalid", in: "some avg10=a avg60=0.00\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePressure([]byte(tt.in))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseCPUMax(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   float64
+		wantOk bool
+	}{
+		{in: "max 100000\n"},
+		{in: "200000 100000\n", want: 2, wantOk: true},
+		{in: "50000 100000\n", want: 0.5, wantOk: true},
+		{in: "50000 0\n"},
+		{in: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := parseCPUMax([]byte(tt.in))
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMeterPressure(t *testing.T) {
+	dir := t.TempDir()
+	proc := filepath.Join(dir, "proc")
+	cgroup := filepath.Join(dir, "cgroup")
+
+	writeFiles(t, dir, map[string]string{
+		"proc/self/cgroup":     "0::/system.slice/graphite-clickhouse.service\n",
+		"proc/pressure/cpu":    "some avg10=80.00 avg60=0.00 avg300=0.00 total=0\n",
+		"proc/pressure/memory": "some avg10=1.00 avg60=0.00 avg300=0.00 total=0\n",
+		"cgroup/system.slice/graphite-clickhouse.service/cpu.pressure": "some avg10=10.00 avg60=0.00 avg300=0.00 total=0\n",
+	})
+
+	// the cgroup pressure is used, the host pressure is used if the cgroup file doesn't exist
+	m := newMeter(SignalCPUPressure, 20, proc, cgroup)
+	assert.Equal(t, filepath.Join(cgroup, "system.slice/graphite-clickhouse.service"), m.cgroup)
+
+	load, err := m.Normalized()
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, load)
+
+	m = newMeter(SignalMemoryPressure, 20, proc, cgroup)
+	load, err = m.Normalized()
+	require.NoError(t, err)
+	assert.Equal(t, 0.05, load)
+
+	m = newMeter(SignalPressure, 20, proc, cgroup)
+	load, err = m.Normalized()
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, load)
+
+	// cgroup namespace, the process cgroup is the root
+	m = newMeter(SignalCPUPressure, 20, filepath.Join(dir, "none"), cgroup)
+	assert.Equal(t, cgroup, m.cgroup)
+
+	load, err = m.Normalized()
+	assert.Error(t, err)
+	assert.Equal(t, 0.0, load)
+}
+
+func TestMeterCgroupCPU(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFiles(t, dir, map[string]string{
+		"cpu.stat": "usage_usec 1000000\nuser_usec 800000\nsystem_usec 200000\n",
+		"cpu.max":  "50000 100000\n",
+	})
+
+	m := newMeter(SignalCgroupCPU, 20, filepath.Join(dir, "none"), dir)
+	now := time.Now()
+
+	// the first measure
+	load, err := m.cpuUsage(now)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, load)
+
+	// 0.25 cpu of the 0.5 cpu quota
+	writeFiles(t, dir, map[string]string{"cpu.stat": "usage_usec 3500000\n"})
+
+	load, err = m.cpuUsage(now.Add(10 * time.Second))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, load, 1e-9)
+
+	// too short interval, the previous load is returned
+	writeFiles(t, dir, map[string]string{"cpu.stat": "usage_usec 9500000\n"})
+
+	load, err = m.cpuUsage(now.Add(10*time.Second + time.Millisecond))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, load, 1e-9)
+
+	// without quota the host cpus are used
+	writeFiles(t, dir, map[string]string{"cpu.max": "max 100000\n", "cpu.stat": "usage_usec 13500000\n"})
+
+	load, err = m.cpuUsage(now.Add(20 * time.Second))
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0/float64(runtime.NumCPU()), load, 1e-9)
+}
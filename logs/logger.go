@@ -17,6 +17,15 @@ func AccessLog(logger *zap.Logger, config *config.Config, r *http.Request, statu
 		logger = logger.With(zap.String("grafana", grafana))
 	}
 
+	// user is needed to find requests denied by ACL
+	if user := r.Header.Get("X-Forwarded-User"); user != "" {
+		logger = logger.With(zap.String("user", user))
+	}
+
+	if tenant := scope.Tenant(r.Context()); tenant != "" {
+		logger = logger.With(zap.String("tenant", tenant))
+	}
+
 	var peer string
 	if peer = r.Header.Get("X-Real-Ip"); peer == "" {
 		peer = r.RemoteAddr
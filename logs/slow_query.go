@@ -0,0 +1,120 @@
+package logs
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Timings is the request duration, split by the phases
+type Timings struct {
+	Total  time.Duration
+	Queue  time.Duration // waiting for the limiter slots
+	Encode time.Duration // encoding of the response
+}
+
+// WithSlowQueryLog adds the query log to the request context, if the slow query log or the query log is enabled
+func WithSlowQueryLog(config *config.Config, r *http.Request) *http.Request {
+	if !config.SlowQueryLog.Enabled() && !config.QueryLog.Enabled() {
+		return r
+	}
+
+	return r.WithContext(clickhouse.WithQueryLog(r.Context(), &clickhouse.QueryLog{}))
+}
+
+// SlowQueryLog writes the request to the slow_query logger, if the request is longer than the endpoint threshold
+// or one of the queries is longer than its table threshold
+func SlowQueryLog(config *config.Config, r *http.Request, endpoint string, status int, timings Timings) {
+	ql := clickhouse.GetQueryLog(r.Context())
+	if ql == nil {
+		return
+	}
+
+	queries := ql.Queries()
+	slow := exceeds(timings.Total, config.SlowQueryLog.EndpointThreshold(endpoint))
+
+	var chDuration time.Duration
+
+	for i := range queries {
+		chDuration += queries[i].Duration
+
+		if exceeds(queries[i].Duration, config.SlowQueryLog.TableThreshold(queries[i].Table)) {
+			slow = true
+		}
+	}
+
+	if !slow {
+		return
+	}
+
+	logger := zapwriter.Logger("slow_query").With(
+		zap.String("request_id", scope.RequestID(r.Context())),
+		zap.String("endpoint", endpoint),
+	)
+
+	if user := r.Header.Get("X-Forwarded-User"); user != "" {
+		logger = logger.With(zap.String("user", user))
+	}
+
+	if tenant := scope.Tenant(r.Context()); tenant != "" {
+		logger = logger.With(zap.String("tenant", tenant))
+	}
+
+	if grafana := scope.Grafana(r.Context()); grafana != "" {
+		logger = logger.With(zap.String("grafana", grafana))
+	}
+
+	logger.Warn("slow_query",
+		zap.String("url", r.URL.String()),
+		zap.Int("status", status),
+		zap.Duration("time", timings.Total),
+		zap.Duration("queue_time", timings.Queue),
+		zap.Duration("clickhouse_time", chDuration),
+		zap.Duration("encode_time", timings.Encode),
+		zap.Array("queries", loggedQueries(queries)),
+	)
+}
+
+func exceeds(d, threshold time.Duration) bool {
+	return threshold > 0 && d >= threshold
+}
+
+type loggedQueries []clickhouse.LoggedQuery
+
+func (qs loggedQueries) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for i := range qs {
+		if err := enc.AppendObject(loggedQuery(qs[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type loggedQuery clickhouse.LoggedQuery
+
+func (q loggedQuery) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("table", q.Table)
+	enc.AddString("query_id", q.QueryID)
+	enc.AddString("sql", q.SQL)
+
+	if q.ExtDataBytes > 0 {
+		enc.AddInt("external_data_bytes", q.ExtDataBytes)
+	}
+
+	enc.AddInt64("read_rows", q.ReadRows)
+	enc.AddInt64("read_bytes", q.ReadBytes)
+	enc.AddDuration("time", q.Duration)
+
+	if q.Error != "" {
+		enc.AddString("error", q.Error)
+	}
+
+	return nil
+}
@@ -12,6 +12,14 @@ import (
 
 var Graphite *graphite.Graphite
 
+// Prometheus is set if metrics are exposed in the prometheus text format (see PrometheusHandler)
+var Prometheus bool
+
+// Enabled returns true if metrics are sent to graphite or exposed for prometheus
+func Enabled() bool {
+	return Graphite != nil || Prometheus
+}
+
 type Config struct {
 	MetricEndpoint string                   `toml:"metric-endpoint" json:"metric-endpoint" comment:"graphite relay address"`
 	Statsd         string                   `toml:"statsd-endpoint" json:"statsd-endpoint" comment:"statsd server address"`
@@ -19,6 +27,7 @@ type Config struct {
 	MetricInterval time.Duration            `toml:"metric-interval" json:"metric-interval" comment:"graphite metrics send interval"`
 	MetricTimeout  time.Duration            `toml:"metric-timeout" json:"metric-timeout" comment:"graphite metrics send timeout"`
 	MetricPrefix   string                   `toml:"metric-prefix" json:"metric-prefix" comment:"graphite metrics prefix"`
+	Prometheus     bool                     `toml:"prometheus" json:"prometheus" comment:"expose metrics in prometheus format on /metrics of the main listener"`
 	BucketsWidth   []int64                  `toml:"request-buckets" json:"request-buckets" comment:"Request historgram buckets widths"`
 	BucketsLabels  []string                 `toml:"request-labels" json:"request-labels" comment:"Request historgram buckets labels"`
 	Ranges         map[string]time.Duration `toml:"ranges" json:"ranges" comment:"Additional separate stats for until-from ranges"`
@@ -41,6 +50,31 @@ var DefaultCacheMetrics *CacheMetric
 
 // var WaitMetrics []WaitMetric
 
+type IndexBloomMetric struct {
+	Items   metrics.Gauge
+	Size    metrics.Gauge  // filter size in bytes
+	FPRate  metrics.FGauge // estimated false positive rate
+	Checks  metrics.Counter
+	Skipped metrics.Counter // definite misses, index query is skipped
+}
+
+var IndexBloomMetrics *IndexBloomMetric
+
+type TagsCountSnapshotMetric struct {
+	Items  metrics.Gauge
+	Hits   metrics.Counter // tag-value costs found in snapshot
+	Misses metrics.Counter // tag-value costs queried from tags-count-table
+}
+
+var TagsCountSnapshotMetrics *TagsCountSnapshotMetric
+
+type ACLMetric struct {
+	Denied   metrics.Counter // requests denied by ACL
+	Filtered metrics.Counter // metrics removed from finder results by ACL
+}
+
+var ACLMetrics *ACLMetric
+
 type ReqMetric struct {
 	RequestsH        metrics.Histogram
 	Errors           metrics.Counter
@@ -95,6 +129,80 @@ func (w *WaitMetric) Unregister() {
 	}
 }
 
+// PriorityWaitMetric is the wait metric of the limiter priority class
+type PriorityWaitMetric struct {
+	WaitMetric
+	WaitTime     metrics.Counter // total wait time in milliseconds
+	nameRequests string
+	nameWaitTime string
+}
+
+func NewPriorityWaitMetric(enable bool, scope, sub, class string) PriorityWaitMetric {
+	sub += ".class_" + class
+	if enable {
+		w := PriorityWaitMetric{
+			WaitMetric:   NewWaitMetric(enable, scope, sub),
+			WaitTime:     metrics.NewCounter(),
+			nameRequests: scope + "_wait." + sub + ".requests",
+			nameWaitTime: scope + "_wait." + sub + ".wait_time",
+		}
+		// wait time is sent by the limiter
+		w.WaitTimeName = ""
+		metrics.Register(w.nameWaitTime, w.WaitTime)
+
+		return w
+	}
+
+	return PriorityWaitMetric{
+		WaitMetric: NewWaitMetric(enable, scope, sub),
+		WaitTime:   metrics.NilCounter{},
+	}
+}
+
+func (w *PriorityWaitMetric) Unregister() {
+	w.WaitMetric.Unregister()
+
+	if w.nameRequests != "" {
+		metrics.Unregister(w.nameRequests)
+		metrics.Unregister(w.nameWaitTime)
+		w.nameRequests = ""
+	}
+}
+
+// AdaptiveWaitMetric is the wait metric of the latency adaptive limiter
+type AdaptiveWaitMetric struct {
+	WaitMetric
+	Limit     metrics.Gauge // current window of the concurrent queries
+	nameLimit string
+}
+
+func NewAdaptiveWaitMetric(enable bool, scope, sub string) AdaptiveWaitMetric {
+	if enable {
+		w := AdaptiveWaitMetric{
+			WaitMetric: NewWaitMetric(enable, scope, sub),
+			Limit:      metrics.NewGauge(),
+			nameLimit:  scope + "_wait." + sub + ".limit",
+		}
+		metrics.Register(w.nameLimit, w.Limit)
+
+		return w
+	}
+
+	return AdaptiveWaitMetric{
+		WaitMetric: NewWaitMetric(enable, scope, sub),
+		Limit:      metrics.NilGauge{},
+	}
+}
+
+func (w *AdaptiveWaitMetric) Unregister() {
+	w.WaitMetric.Unregister()
+
+	if w.nameLimit != "" {
+		metrics.Unregister(w.nameLimit)
+		w.nameLimit = ""
+	}
+}
+
 func NewDisabledWaitMetric() *WaitMetric {
 	return &WaitMetric{
 		WaitErrors: metrics.NilCounter{},
@@ -123,6 +231,7 @@ type RenderMetrics struct {
 var RenderRequestMetric *RenderMetrics
 var FindRequestMetric *FindMetrics
 var TagsRequestMetric *FindMetrics
+var AutocompleteRequestMetric *FindMetrics
 
 func initFindCacheMetrics(c *Config) {
 	FinderCacheMetrics = &CacheMetric{
@@ -139,7 +248,7 @@ func initFindCacheMetrics(c *Config) {
 		CacheMisses: metrics.NewCounter(),
 	}
 
-	if c != nil && Graphite != nil {
+	if c != nil && Enabled() {
 		metrics.Register("find_cache_hits", FinderCacheMetrics.CacheHits)
 		metrics.Register("find_cache_misses", FinderCacheMetrics.CacheMisses)
 		metrics.Register("short_cache_hits", ShortCacheMetrics.CacheHits)
@@ -149,6 +258,50 @@ func initFindCacheMetrics(c *Config) {
 	}
 }
 
+func initIndexBloomMetrics(c *Config) {
+	IndexBloomMetrics = &IndexBloomMetric{
+		Items:   metrics.NewGauge(),
+		Size:    metrics.NewGauge(),
+		FPRate:  metrics.NewFGauge(),
+		Checks:  metrics.NewCounter(),
+		Skipped: metrics.NewCounter(),
+	}
+
+	if c != nil && Enabled() {
+		metrics.Register("index_bloom.items", IndexBloomMetrics.Items)
+		metrics.Register("index_bloom.size_bytes", IndexBloomMetrics.Size)
+		metrics.Register("index_bloom.fp_rate", IndexBloomMetrics.FPRate)
+		metrics.Register("index_bloom.checks", IndexBloomMetrics.Checks)
+		metrics.Register("index_bloom.skipped", IndexBloomMetrics.Skipped)
+	}
+}
+
+func initTagsCountSnapshotMetrics(c *Config) {
+	TagsCountSnapshotMetrics = &TagsCountSnapshotMetric{
+		Items:  metrics.NewGauge(),
+		Hits:   metrics.NewCounter(),
+		Misses: metrics.NewCounter(),
+	}
+
+	if c != nil && Enabled() {
+		metrics.Register("tags_count_snapshot.items", TagsCountSnapshotMetrics.Items)
+		metrics.Register("tags_count_snapshot.hits", TagsCountSnapshotMetrics.Hits)
+		metrics.Register("tags_count_snapshot.misses", TagsCountSnapshotMetrics.Misses)
+	}
+}
+
+func initACLMetrics(c *Config) {
+	ACLMetrics = &ACLMetric{
+		Denied:   metrics.NewCounter(),
+		Filtered: metrics.NewCounter(),
+	}
+
+	if c != nil && Enabled() {
+		metrics.Register("acl.denied", ACLMetrics.Denied)
+		metrics.Register("acl.filtered", ACLMetrics.Filtered)
+	}
+}
+
 func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 	requestMetric := &FindMetrics{
 		ReqMetric: ReqMetric{
@@ -158,7 +311,7 @@ func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 		},
 	}
 
-	if c == nil || Graphite == nil || !c.ExtendedStat {
+	if c == nil || !Enabled() || !c.ExtendedStat {
 		requestMetric.Requests200 = metrics.NilCounter{}
 		requestMetric.Requests400 = metrics.NilCounter{}
 		requestMetric.Requests403 = metrics.NilCounter{}
@@ -180,8 +333,8 @@ func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 		requestMetric.Requests4xx = metrics.NewCounter()
 	}
 
-	if c != nil && Graphite != nil {
-		requestMetric.RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
+	if c != nil && Enabled() {
+		requestMetric.RequestsH = newDurationHistogram(c)
 		metrics.Register(scope+".all.requests", requestMetric.RequestsH)
 		metrics.Register(scope+".all.errors", requestMetric.Errors)
 
@@ -203,7 +356,7 @@ func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 			requestMetric.RangeMetrics = make([]ReqMetric, len(c.FindRangeS))
 
 			for i := range c.FindRangeS {
-				requestMetric.RangeMetrics[i].RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
+				requestMetric.RangeMetrics[i].RequestsH = newDurationHistogram(c)
 				requestMetric.RangeMetrics[i].Errors = metrics.NewCounter()
 				requestMetric.RangeMetrics[i].MetricsCountName = scope + "." + requestMetric.RangeNames[i] + ".metrics"
 				requestMetric.RangeMetrics[i].PointsCountName = scope + "." + requestMetric.RangeNames[i] + ".points"
@@ -250,7 +403,7 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 		},
 	}
 
-	if c == nil || Graphite == nil || !c.ExtendedStat {
+	if c == nil || !Enabled() || !c.ExtendedStat {
 		requestMetric.Requests200 = metrics.NilCounter{}
 		requestMetric.Requests400 = metrics.NilCounter{}
 		requestMetric.Requests403 = metrics.NilCounter{}
@@ -272,9 +425,9 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 		requestMetric.Requests4xx = metrics.NewCounter()
 	}
 
-	if c != nil && Graphite != nil {
-		requestMetric.RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
-		requestMetric.FinderH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
+	if c != nil && Enabled() {
+		requestMetric.RequestsH = newDurationHistogram(c)
+		requestMetric.FinderH = newDurationHistogram(c)
 		metrics.Register(scope+".all.requests", requestMetric.RequestsH)
 		metrics.Register(scope+".all.requests_finder", requestMetric.FinderH)
 		metrics.Register(scope+".all.errors", requestMetric.Errors)
@@ -297,8 +450,8 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 			requestMetric.RangeMetrics = make([]RenderMetric, len(c.RangeS))
 
 			for i := range c.RangeS {
-				requestMetric.RangeMetrics[i].RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
-				requestMetric.RangeMetrics[i].FinderH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
+				requestMetric.RangeMetrics[i].RequestsH = newDurationHistogram(c)
+				requestMetric.RangeMetrics[i].FinderH = newDurationHistogram(c)
 				requestMetric.RangeMetrics[i].Errors = metrics.NewCounter()
 				requestMetric.RangeMetrics[i].MetricsCountName = scope + "." + requestMetric.RangeNames[i] + ".metrics"
 				requestMetric.RangeMetrics[i].PointsCountName = scope + "." + requestMetric.RangeNames[i] + ".points"
@@ -597,7 +750,7 @@ type rangeName struct {
 }
 
 func InitMetrics(c *Config, findWaitQueue, tagsWaitQueue bool) {
-	if c != nil && Graphite != nil {
+	if c != nil && Enabled() {
 		metrics.RegisterRuntimeMemStats(nil)
 		go metrics.CaptureRuntimeMemStats(c.MetricInterval)
 
@@ -681,8 +834,12 @@ func InitMetrics(c *Config, findWaitQueue, tagsWaitQueue bool) {
 	}
 
 	initFindCacheMetrics(c)
+	initIndexBloomMetrics(c)
+	initTagsCountSnapshotMetrics(c)
+	initACLMetrics(c)
 	FindRequestMetric = initFindMetrics("find", c, findWaitQueue)
 	TagsRequestMetric = initFindMetrics("tags", c, tagsWaitQueue)
+	AutocompleteRequestMetric = initFindMetrics("autocomplete", c, findWaitQueue)
 	RenderRequestMetric = initRenderMetrics("render", c)
 }
 
@@ -694,4 +851,5 @@ func DisableMetrics() {
 
 func UnregisterAll() {
 	metrics.DefaultRegistry.UnregisterAll()
+	promRegistry.UnregisterAll()
 }
@@ -0,0 +1,347 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/msaf1980/go-metrics"
+)
+
+const promNamespace = "graphite_clickhouse_"
+
+// promRegistry holds the metrics, exposed only for prometheus
+var promRegistry = metrics.NewRegistry()
+
+// durationHistogram is a VSumHistogram (in milliseconds), which also tracks the sum of the values for prometheus
+type durationHistogram struct {
+	*metrics.VSumHistogram
+	sum int64
+}
+
+func newDurationHistogram(c *Config) metrics.Histogram {
+	h := metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels)
+	h.SetNameTotal("")
+
+	return &durationHistogram{VSumHistogram: h}
+}
+
+func (h *durationHistogram) Add(v int64) {
+	atomic.AddInt64(&h.sum, v)
+	h.VSumHistogram.Add(v)
+}
+
+func (h *durationHistogram) Sum() int64 {
+	return atomic.LoadInt64(&h.sum)
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+// promDesc is a prometheus metric, parsed from the dot-joined graphite name
+type promDesc struct {
+	name   string
+	help   string
+	labels []promLabel
+}
+
+type promSample struct {
+	suffix string
+	labels []promLabel
+	value  float64
+}
+
+type promFamily struct {
+	typ     string
+	help    string
+	samples []promSample
+}
+
+var promHandlers = map[string]bool{"find": true, "tags": true, "render": true, "autocomplete": true}
+
+// parsePromName converts the graphite metric name to the prometheus name with labels. Returns false for the skipped metrics
+func parsePromName(name string) (promDesc, bool) {
+	if strings.HasPrefix(name, "runtime.") {
+		return promDesc{}, false
+	}
+
+	if strings.HasPrefix(name, "query.") {
+		// query.{table}.{range}.{kind}, table can contain dots
+		rest, kind := splitLast(name[len("query."):])
+		table, rng := splitLast(rest)
+
+		if table != "" && rng != "" {
+			labels := []promLabel{{"table", table}, {"range", rng}}
+
+			switch kind {
+			case "requests":
+				return promDesc{"query_duration_seconds", "ClickHouse query duration.", labels}, true
+			case "errors":
+				return promDesc{"query_errors_total", "ClickHouse query errors.", labels}, true
+			case "read_rows", "read_bytes", "ch_read_rows", "ch_read_bytes":
+				return promDesc{"query_" + kind + "_total", "ClickHouse query " + strings.ReplaceAll(kind, "_", " ") + ".", labels}, true
+			}
+		}
+	}
+
+	if i := strings.LastIndex(name, "_wait."); i > 0 {
+		// {scope}_wait.{sub}.{kind}
+		sub, kind := splitLast(name[i+len("_wait."):])
+		labels := []promLabel{{"limiter", name[:i]}}
+
+		// {sub}.class_{class} for the priority class metrics
+		sub, class, _ := strings.Cut(sub, ".class_")
+
+		if tenant := strings.TrimPrefix(sub, "tenant_"); tenant != sub {
+			labels = append(labels, promLabel{"range", "all"}, promLabel{"tenant", tenant})
+		} else {
+			labels = append(labels, promLabel{"range", sub})
+		}
+
+		if class != "" {
+			labels = append(labels, promLabel{"priority", class})
+		}
+
+		switch kind {
+		case "requests":
+			return promDesc{"limiter_wait_requests_total", "Requests, passed through the limiter.", labels}, true
+		case "errors":
+			return promDesc{"limiter_wait_errors_total", "Requests, failed to get a limiter slot.", labels}, true
+		case "wait_time":
+			return promDesc{"limiter_wait_time_milliseconds_total", "Time, spent waiting for a limiter slot.", labels}, true
+		case "limit":
+			return promDesc{"limiter_concurrency_limit", "Current window of the concurrent queries of the adaptive limiter.", labels}, true
+		}
+	}
+
+	if parts := strings.SplitN(name, ".", 3); len(parts) == 3 && promHandlers[parts[0]] {
+		// {handler}.{range}.{kind}
+		labels := []promLabel{{"handler", parts[0]}, {"range", parts[1]}}
+
+		switch kind := parts[2]; {
+		case kind == "requests":
+			return promDesc{"request_duration_seconds", "Request duration.", labels}, true
+		case kind == "requests_finder":
+			return promDesc{"request_finder_duration_seconds", "Duration of the finder stage of the request.", labels}, true
+		case kind == "errors":
+			return promDesc{"request_errors_total", "Failed requests.", labels}, true
+		case strings.HasPrefix(kind, "requests_status_code."):
+			labels = append(labels, promLabel{"status", kind[len("requests_status_code."):]})
+			return promDesc{"requests_total", "Requests by the response status code.", labels}, true
+		}
+	}
+
+	for _, kind := range []string{"hits", "misses"} {
+		if cache := strings.TrimSuffix(name, "_cache_"+kind); cache != name {
+			return promDesc{"cache_" + kind + "_total", "Cache " + kind + ".", []promLabel{{"cache", cache}}}, true
+		}
+	}
+
+	return promDesc{name: sanitizePromName(name)}, true
+}
+
+func splitLast(s string) (string, string) {
+	i := strings.LastIndexByte(s, '.')
+	if i == -1 {
+		return "", s
+	}
+
+	return s[:i], s[i+1:]
+}
+
+func sanitizePromName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+// promFamilies collects the registered metrics, grouped by the prometheus name
+func promFamilies() map[string]*promFamily {
+	families := make(map[string]*promFamily)
+
+	add := func(name, typ string, desc promDesc, samples ...promSample) {
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{typ: typ, help: desc.help}
+			families[name] = f
+		} else if f.typ != typ {
+			// prometheus name collision with different types, skip
+			return
+		}
+
+		f.samples = append(f.samples, samples...)
+	}
+
+	collect := func(name, _ string, tagsMap map[string]string, i interface{}) error {
+		desc, ok := parsePromName(name)
+		if !ok {
+			return nil
+		}
+
+		for k, v := range tagsMap {
+			desc.labels = append(desc.labels, promLabel{sanitizePromName(k), v})
+		}
+
+		switch m := i.(type) {
+		case metrics.Counter:
+			if !strings.HasSuffix(desc.name, "_total") {
+				desc.name += "_total"
+			}
+
+			add(desc.name, "counter", desc, promSample{labels: desc.labels, value: float64(m.Count())})
+		case metrics.Gauge:
+			add(desc.name, "gauge", desc, promSample{labels: desc.labels, value: float64(m.Value())})
+		case metrics.UGauge:
+			add(desc.name, "gauge", desc, promSample{labels: desc.labels, value: float64(m.Value())})
+		case metrics.FGauge:
+			add(desc.name, "gauge", desc, promSample{labels: desc.labels, value: m.Value()})
+		case metrics.Histogram:
+			if m.IsSummed() {
+				add(desc.name, "histogram", desc, histogramSamples(m, desc.labels)...)
+			}
+		}
+
+		return nil
+	}
+
+	metrics.DefaultRegistry.Each(collect, false)
+	promRegistry.Each(collect, false)
+
+	return families
+}
+
+// histogramSamples converts the summed histogram (bucket[i] counts the values greater than weights[i-1]) in milliseconds
+// to the cumulative prometheus histogram in seconds
+func histogramSamples(h metrics.Histogram, labels []promLabel) []promSample {
+	values := h.Values()
+	weights := h.Weights()
+
+	if len(values) == 0 || len(values) != len(weights) {
+		return nil
+	}
+
+	total := values[0]
+	samples := make([]promSample, 0, len(values)+2)
+
+	for i, w := range weights {
+		le := "+Inf"
+		count := total
+
+		if w != math.MaxInt64 {
+			le = strconv.FormatFloat(float64(w)/1000, 'g', -1, 64)
+
+			if i+1 < len(values) {
+				count = total - values[i+1]
+			}
+		}
+
+		bucketLabels := append(append(make([]promLabel, 0, len(labels)+1), labels...), promLabel{"le", le})
+		samples = append(samples, promSample{suffix: "_bucket", labels: bucketLabels, value: float64(count)})
+	}
+
+	if s, ok := h.(interface{ Sum() int64 }); ok {
+		samples = append(samples, promSample{suffix: "_sum", labels: labels, value: float64(s.Sum()) / 1000})
+	}
+
+	samples = append(samples, promSample{suffix: "_count", labels: labels, value: float64(total)})
+
+	return samples
+}
+
+// WritePrometheus writes the registered metrics in the prometheus text exposition format
+func WritePrometheus(w io.Writer) error {
+	families := promFamilies()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+
+	for _, name := range names {
+		f := families[name]
+		fullName := promNamespace + name
+
+		sort.SliceStable(f.samples, func(i, j int) bool {
+			return labelsLess(f.samples[i].labels, f.samples[j].labels)
+		})
+
+		if f.help != "" {
+			bw.WriteString("# HELP " + fullName + " " + f.help + "\n")
+		}
+
+		bw.WriteString("# TYPE " + fullName + " " + f.typ + "\n")
+
+		for _, s := range f.samples {
+			bw.WriteString(fullName + s.suffix)
+			writeLabels(bw, s.labels)
+			bw.WriteByte(' ')
+			bw.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+			bw.WriteByte('\n')
+		}
+	}
+
+	return bw.Flush()
+}
+
+// labelsLess orders the series by the label values. The le label is ignored, so the histogram samples stay in order
+func labelsLess(a, b []promLabel) bool {
+	return seriesKey(a) < seriesKey(b)
+}
+
+func seriesKey(labels []promLabel) string {
+	var sb strings.Builder
+
+	for _, l := range labels {
+		if l.name != "le" {
+			sb.WriteString(l.value)
+			sb.WriteByte(0xff)
+		}
+	}
+
+	return sb.String()
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeLabels(bw *bufio.Writer, labels []promLabel) {
+	if len(labels) == 0 {
+		return
+	}
+
+	bw.WriteByte('{')
+
+	for i, l := range labels {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+
+		bw.WriteString(l.name + `="`)
+		promLabelEscaper.WriteString(bw, l.value)
+		bw.WriteByte('"')
+	}
+
+	bw.WriteByte('}')
+}
+
+// PrometheusHandler exposes the registered metrics for the prometheus scraper
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w)
+	})
+}
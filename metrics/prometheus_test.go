@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePromName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   promDesc
+		wantOk bool
+	}{
+		{
+			name:   "render.all.requests",
+			want:   promDesc{"request_duration_seconds", "Request duration.", []promLabel{{"handler", "render"}, {"range", "all"}}},
+			wantOk: true,
+		},
+		{
+			name:   "find.7d.requests_status_code.5xx",
+			want:   promDesc{"requests_total", "Requests by the response status code.", []promLabel{{"handler", "find"}, {"range", "7d"}, {"status", "5xx"}}},
+			wantOk: true,
+		},
+		{
+			name:   "query.default.graphite_index.all.errors",
+			want:   promDesc{"query_errors_total", "ClickHouse query errors.", []promLabel{{"table", "default.graphite_index"}, {"range", "all"}}},
+			wantOk: true,
+		},
+		{
+			name:   "query.graphite.1h.ch_read_bytes",
+			want:   promDesc{"query_ch_read_bytes_total", "ClickHouse query ch read bytes.", []promLabel{{"table", "graphite"}, {"range", "1h"}}},
+			wantOk: true,
+		},
+		{
+			name:   "render_wait.7d.requests",
+			want:   promDesc{"limiter_wait_requests_total", "Requests, passed through the limiter.", []promLabel{{"limiter", "render"}, {"range", "7d"}}},
+			wantOk: true,
+		},
+		{
+			name:   "find_wait.tenant_team-a.errors",
+			want:   promDesc{"limiter_wait_errors_total", "Requests, failed to get a limiter slot.", []promLabel{{"limiter", "find"}, {"range", "all"}, {"tenant", "team-a"}}},
+			wantOk: true,
+		},
+		{
+			name:   "render_wait.7d.class_alerting.wait_time",
+			want:   promDesc{"limiter_wait_time_milliseconds_total", "Time, spent waiting for a limiter slot.", []promLabel{{"limiter", "render"}, {"range", "7d"}, {"priority", "alerting"}}},
+			wantOk: true,
+		},
+		{
+			name:   "render_wait.1h.limit",
+			want:   promDesc{"limiter_concurrency_limit", "Current window of the concurrent queries of the adaptive limiter.", []promLabel{{"limiter", "render"}, {"range", "1h"}}},
+			wantOk: true,
+		},
+		{
+			name:   "short_cache_misses",
+			want:   promDesc{"cache_misses_total", "Cache misses.", []promLabel{{"cache", "short"}}},
+			wantOk: true,
+		},
+		{
+			name:   "index_bloom.fp_rate",
+			want:   promDesc{name: "index_bloom_fp_rate"},
+			wantOk: true,
+		},
+		{
+			name: "runtime.MemStats.Alloc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePromName(tt.name)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	UnregisterAll()
+
+	QMetrics = make(map[string]*QueryMetrics)
+	Prometheus = true
+
+	defer func() {
+		Prometheus = false
+		QMetrics = make(map[string]*QueryMetrics)
+
+		UnregisterAll()
+	}()
+
+	c := &Config{BucketsWidth: []int64{200, 1000}}
+	InitMetrics(c, false, false)
+
+	q := InitQueryMetrics("graphite", c)
+
+	SendFindMetrics(FindRequestMetric, 200, 100, 0, false, 0)
+	SendFindMetrics(FindRequestMetric, 500, 700, 0, false, 0)
+	SendFindMetrics(FindRequestMetric, 200, 1500, 0, false, 0)
+	SendQueryRead(q, 0, 0, 300, 10, 1000, 0, 0, false)
+	FinderCacheMetrics.CacheHits.Add(3)
+
+	var buf bytes.Buffer
+
+	require.NoError(t, WritePrometheus(&buf))
+
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE graphite_clickhouse_request_duration_seconds histogram\n")
+	assert.Contains(t, out, "graphite_clickhouse_request_duration_seconds_count{handler=\"autocomplete\",range=\"all\"} 0\n")
+	assert.Contains(t, out, `graphite_clickhouse_request_duration_seconds_bucket{handler="find",range="all",le="0.2"} 1
+graphite_clickhouse_request_duration_seconds_bucket{handler="find",range="all",le="1"} 2
+graphite_clickhouse_request_duration_seconds_bucket{handler="find",range="all",le="+Inf"} 3
+graphite_clickhouse_request_duration_seconds_sum{handler="find",range="all"} 2.3
+graphite_clickhouse_request_duration_seconds_count{handler="find",range="all"} 3
+`)
+	assert.Contains(t, out, "graphite_clickhouse_request_errors_total{handler=\"find\",range=\"all\"} 1\n")
+	assert.Contains(t, out, "graphite_clickhouse_query_duration_seconds_count{table=\"graphite\",range=\"all\"} 1\n")
+	assert.Contains(t, out, "graphite_clickhouse_query_read_rows_total{table=\"graphite\",range=\"all\"} 10\n")
+	assert.Contains(t, out, "graphite_clickhouse_query_read_bytes_total{table=\"graphite\",range=\"all\"} 1000\n")
+	assert.Contains(t, out, "graphite_clickhouse_cache_hits_total{cache=\"find\"} 3\n")
+	assert.Contains(t, out, "# TYPE graphite_clickhouse_index_bloom_items gauge\n")
+	assert.NotContains(t, out, "runtime")
+}
@@ -9,6 +9,11 @@ type QueryMetric struct {
 	ReadBytesName   string
 	ChReadRowsName  string
 	ChReadBytesName string
+	// read stats counters, exposed only for prometheus (graphite receives them as statsd timings)
+	ReadRows    metrics.Counter
+	ReadBytes   metrics.Counter
+	ChReadRows  metrics.Counter
+	ChReadBytes metrics.Counter
 }
 
 type QueryMetrics struct {
@@ -29,6 +34,8 @@ var (
 	QMetrics            map[string]*QueryMetrics = make(map[string]*QueryMetrics)
 	AutocompleteQMetric *QueryMetrics
 	FindQMetric         *QueryMetrics
+	// PlainAutocompleteQMetric is for the plain (/metrics/autocomplete/) queries, AutocompleteQMetric is for the tags ones
+	PlainAutocompleteQMetric *QueryMetrics
 )
 
 func InitQueryMetrics(table string, c *Config) *QueryMetrics {
@@ -50,8 +57,10 @@ func InitQueryMetrics(table string, c *Config) *QueryMetrics {
 		},
 	}
 
-	if c != nil && Graphite != nil {
-		queryMetric.RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
+	queryMetric.initReadCounters("query." + table + ".all")
+
+	if c != nil && Enabled() {
+		queryMetric.RequestsH = newDurationHistogram(c)
 		metrics.Register("query."+table+".all.requests", queryMetric.RequestsH)
 		metrics.Register("query."+table+".all.errors", queryMetric.Errors)
 
@@ -61,7 +70,7 @@ func InitQueryMetrics(table string, c *Config) *QueryMetrics {
 			queryMetric.RangeMetrics = make([]QueryMetric, len(c.RangeS))
 
 			for i := range c.RangeS {
-				queryMetric.RangeMetrics[i].RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
+				queryMetric.RangeMetrics[i].RequestsH = newDurationHistogram(c)
 				metrics.Register("query."+table+"."+queryMetric.RangeNames[i]+".requests", queryMetric.RangeMetrics[i].RequestsH)
 				queryMetric.RangeMetrics[i].Errors = metrics.NewCounter()
 				metrics.Register("query."+table+"."+queryMetric.RangeNames[i]+".errors", queryMetric.RangeMetrics[i].Errors)
@@ -69,6 +78,7 @@ func InitQueryMetrics(table string, c *Config) *QueryMetrics {
 				queryMetric.RangeMetrics[i].ReadBytesName = "query." + table + "." + queryMetric.RangeNames[i] + ".read_bytes"
 				queryMetric.RangeMetrics[i].ChReadRowsName = "query." + table + "." + queryMetric.RangeNames[i] + ".ch_read_rows"
 				queryMetric.RangeMetrics[i].ChReadBytesName = "query." + table + "." + queryMetric.RangeNames[i] + ".ch_read_bytes"
+				queryMetric.RangeMetrics[i].initReadCounters("query." + table + "." + queryMetric.RangeNames[i])
 			}
 		}
 	} else {
@@ -80,8 +90,42 @@ func InitQueryMetrics(table string, c *Config) *QueryMetrics {
 	return queryMetric
 }
 
+func (q *QueryMetric) initReadCounters(prefix string) {
+	if !Prometheus {
+		q.ReadRows = metrics.NilCounter{}
+		q.ReadBytes = metrics.NilCounter{}
+		q.ChReadRows = metrics.NilCounter{}
+		q.ChReadBytes = metrics.NilCounter{}
+
+		return
+	}
+
+	q.ReadRows = metrics.NewCounter()
+	q.ReadBytes = metrics.NewCounter()
+	q.ChReadRows = metrics.NewCounter()
+	q.ChReadBytes = metrics.NewCounter()
+
+	promRegistry.Register(prefix+".read_rows", q.ReadRows)
+	promRegistry.Register(prefix+".read_bytes", q.ReadBytes)
+	promRegistry.Register(prefix+".ch_read_rows", q.ChReadRows)
+	promRegistry.Register(prefix+".ch_read_bytes", q.ChReadBytes)
+}
+
+func (q *QueryMetric) addRead(read_rows, read_bytes, ch_read_rows, ch_read_bytes int64, err bool) {
+	if ch_read_rows > 0 {
+		q.ChReadRows.Add(uint64(ch_read_rows))
+		q.ChReadBytes.Add(uint64(ch_read_bytes))
+	}
+
+	if !err {
+		q.ReadRows.Add(uint64(read_rows))
+		q.ReadBytes.Add(uint64(read_bytes))
+	}
+}
+
 func SendQueryRead(r *QueryMetrics, from, until, durationMs, read_rows, read_bytes, ch_read_rows, ch_read_bytes int64, err bool) {
 	r.RequestsH.Add(durationMs)
+	r.addRead(read_rows, read_bytes, ch_read_rows, ch_read_bytes, err)
 
 	if ch_read_rows > 0 {
 		Gstatsd.Timing(r.ChReadBytesName, ch_read_bytes, 1.0)
@@ -98,6 +142,7 @@ func SendQueryRead(r *QueryMetrics, from, until, durationMs, read_rows, read_byt
 	if len(r.RangeS) > 0 {
 		fromPos := metrics.SearchInt64Le(r.RangeS, until-from)
 		r.RangeMetrics[fromPos].RequestsH.Add(durationMs)
+		r.RangeMetrics[fromPos].addRead(read_rows, read_bytes, ch_read_rows, ch_read_bytes, err)
 
 		if ch_read_rows > 0 {
 			Gstatsd.Timing(r.RangeMetrics[fromPos].ChReadBytesName, ch_read_bytes, 1.0)
@@ -0,0 +1,108 @@
+package bloom
+
+import (
+	"math"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const maxHashes = 30
+
+// Filter is a Bloom filter. Filter is safe for concurrent reads, but not for concurrent Add
+type Filter struct {
+	bits   []uint64
+	m      uint64 // size in bits
+	k      uint64 // hashes count
+	items  int
+	target float64 // requested false positive rate
+}
+
+// Hash returns hash for use with AddHash
+func Hash(s string) uint64 {
+	return xxhash.Sum64String(s)
+}
+
+// New returns *Filter sized for n items with false positive rate fpRate.
+// If maxBytes > 0, the filter size is limited by it (and false positive rate grows)
+func New(n int, fpRate float64, maxBytes int) *Filter {
+	if n < 1 {
+		n = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if maxBytes > 0 && m > uint64(maxBytes)*8 {
+		m = uint64(maxBytes) * 8
+	}
+
+	// align to 64 bits
+	m = (m + 63) / 64 * 64
+	if m == 0 {
+		m = 64
+	}
+
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > maxHashes {
+		k = maxHashes
+	}
+
+	return &Filter{
+		bits:   make([]uint64, m/64),
+		m:      m,
+		k:      k,
+		target: fpRate,
+	}
+}
+
+// AddHash adds item by it's hash (see Hash)
+func (f *Filter) AddHash(h uint64) {
+	// double hashing, see Kirsch, Mitzenmacher "Less Hashing, Same Performance"
+	h1, h2 := h, h>>32|h<<32|1
+
+	for i := uint64(0); i < f.k; i++ {
+		pos := (h1 + i*h2) % f.m
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+
+	f.items++
+}
+
+// Add adds the item
+func (f *Filter) Add(s string) {
+	f.AddHash(Hash(s))
+}
+
+// TestHash checks item by it's hash. False is returned only if the item is definitely not in filter
+func (f *Filter) TestHash(h uint64) bool {
+	h1, h2 := h, h>>32|h<<32|1
+
+	for i := uint64(0); i < f.k; i++ {
+		pos := (h1 + i*h2) % f.m
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Test checks the item. False is returned only if the item is definitely not in filter
+func (f *Filter) Test(s string) bool {
+	return f.TestHash(Hash(s))
+}
+
+// Items returns count of added items
+func (f *Filter) Items() int {
+	return f.items
+}
+
+// Size returns the filter size in bytes
+func (f *Filter) Size() int {
+	return len(f.bits) * 8
+}
+
+// FPRate returns estimated false positive rate for added items
+func (f *Filter) FPRate() float64 {
+	return math.Pow(1-math.Exp(-float64(f.k)*float64(f.items)/float64(f.m)), float64(f.k))
+}
@@ -0,0 +1,47 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		n        int
+		fpRate   float64
+		maxBytes int
+		wantSize int
+	}{
+		{n: 10000, fpRate: 0.01, wantSize: 11984},
+		{n: 10000, fpRate: 0.001, wantSize: 17976},
+		{n: 10000, fpRate: 0.001, maxBytes: 4096, wantSize: 4096},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.n)+"_"+strconv.FormatFloat(tt.fpRate, 'g', -1, 64)+"_"+strconv.Itoa(tt.maxBytes), func(t *testing.T) {
+			f := New(tt.n, tt.fpRate, tt.maxBytes)
+			for i := 0; i < tt.n; i++ {
+				f.Add("test.metric." + strconv.Itoa(i))
+			}
+
+			assert.Equal(t, tt.n, f.Items())
+			assert.Equal(t, tt.wantSize, f.Size())
+
+			for i := 0; i < tt.n; i++ {
+				assert.True(t, f.Test("test.metric."+strconv.Itoa(i)))
+			}
+
+			fp := 0
+			for i := 0; i < tt.n; i++ {
+				if f.Test("test.missed." + strconv.Itoa(i)) {
+					fp++
+				}
+			}
+
+			// measured rate is close to the estimated
+			assert.InDelta(t, f.FPRate(), float64(fp)/float64(tt.n), f.FPRate()/2+0.001)
+		})
+	}
+}
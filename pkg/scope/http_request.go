@@ -18,6 +18,7 @@ var (
 		"X-Grafana-Org-Id",
 		"X-Panel-Id",
 		"X-Forwarded-For",
+		"X-Forwarded-User",
 	}
 )
 
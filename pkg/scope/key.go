@@ -51,6 +51,16 @@ func Table(ctx context.Context) string {
 	return String(ctx, "table")
 }
 
+// WithTenant returns the context with the tenant name
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return With(ctx, "tenant", tenant)
+}
+
+// Tenant returns the tenant name, empty for the default tenant
+func Tenant(ctx context.Context) string {
+	return String(ctx, "tenant")
+}
+
 // WithDebug returns the context with debug-name
 func WithDebug(ctx context.Context, name string) context.Context {
 	return With(ctx, "debug-"+name, true)
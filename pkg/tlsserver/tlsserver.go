@@ -0,0 +1,214 @@
+// Package tlsserver builds TLS configs for the server listeners with certificates reload on change
+package tlsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	tlsconfig "github.com/lomik/carbon-clickhouse/helper/config"
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+)
+
+// Enabled returns true if TLS params are set
+func Enabled(params *tlsconfig.TLS) bool {
+	return !reflect.DeepEqual(*params, tlsconfig.TLS{})
+}
+
+// Server holds the current server TLS config, it's replaced when certificates, keys or CA files are changed
+type Server struct {
+	name    string // listener name for logs
+	params  tlsconfig.TLS
+	current atomic.Pointer[tls.Config]
+	modTime map[string]time.Time
+}
+
+// New loads the certificates. If reloadInterval > 0, files are checked for changes in background.
+// Returns warnings about ignored settings
+func New(name string, params *tlsconfig.TLS, reloadInterval time.Duration) (*Server, []string, error) {
+	s := &Server{
+		name:   name,
+		params: *params,
+	}
+
+	warns, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reloadInterval > 0 {
+		go s.worker(reloadInterval)
+	}
+
+	return s, warns, nil
+}
+
+// nextProtos are ALPN protocols of the listener, the same as http.Server sets for TLS
+var nextProtos = []string{"h2", "http/1.1"}
+
+// Config returns *tls.Config for the listener, the current certificates are used for the new connections
+func (s *Server) Config() *tls.Config {
+	return &tls.Config{
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current.Load(), nil
+		},
+	}
+}
+
+func (s *Server) files() []string {
+	files := make([]string, 0, 2*len(s.params.Certificates)+len(s.params.CACertFiles))
+	for _, c := range s.params.Certificates {
+		files = append(files, c.CertFile, c.KeyFile)
+	}
+
+	return append(files, s.params.CACertFiles...)
+}
+
+// changed returns true if any file modification time is changed since the last load
+func (s *Server) changed() (bool, error) {
+	for _, f := range s.files() {
+		st, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+
+		if !st.ModTime().Equal(s.modTime[f]) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Server) load() ([]string, error) {
+	modTime := make(map[string]time.Time)
+
+	for _, f := range s.files() {
+		st, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+
+		modTime[f] = st.ModTime()
+	}
+
+	cfg, warns, err := ParseServerTLSConfig(&s.params)
+	if err != nil {
+		return nil, err
+	}
+
+	// the config from GetConfigForClient is used for the handshake, so ALPN protocols of the listener config
+	// (set by http.Server) must be copied, otherwise HTTP/2 is not negotiated
+	cfg.NextProtos = nextProtos
+
+	s.current.Store(cfg)
+	s.modTime = modTime
+
+	return warns, nil
+}
+
+func (s *Server) worker(interval time.Duration) {
+	logger := zapwriter.Logger("tls").With(zap.String("listener", s.name))
+
+	for {
+		time.Sleep(interval)
+
+		changed, err := s.changed()
+		if err == nil && changed {
+			if _, err = s.load(); err == nil {
+				logger.Info("certificates reloaded")
+			}
+		}
+
+		if err != nil {
+			logger.Error("certificates reload failed, previous certificates are used", zap.Error(err))
+		}
+	}
+}
+
+// ParseServerTLSConfig parses TLS params for the server listener: certificates, client CA and client auth type,
+// versions, curves and ciphers. Returns warnings about ignored settings
+func ParseServerTLSConfig(params *tlsconfig.TLS) (*tls.Config, []string, error) {
+	if len(params.Certificates) == 0 {
+		return nil, nil, errors.New("no tls certificates provided")
+	}
+
+	certificates := make([]tls.Certificate, 0, len(params.Certificates))
+
+	for _, it := range params.Certificates {
+		cert, err := tls.LoadX509KeyPair(it.CertFile, it.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		certificates = append(certificates, cert)
+	}
+
+	clientAuth, err := tlsconfig.ParseClientAuthType(params.ClientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var clientCAs *x509.CertPool
+
+	if len(params.CACertFiles) > 0 {
+		clientCAs = x509.NewCertPool()
+
+		for _, caCert := range params.CACertFiles {
+			cert, err := os.ReadFile(caCert)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !clientCAs.AppendCertsFromPEM(cert) {
+				return nil, nil, fmt.Errorf("no certificates found in %s", caCert)
+			}
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, nil, fmt.Errorf("client-auth %s requires ca-cert", params.ClientAuth)
+	}
+
+	minVersion, err := tlsconfig.ParseTLSVersion(params.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxVersion, err := tlsconfig.ParseTLSVersion(params.MaxVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	curves, err := tlsconfig.ParseCurves(params.Curves)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only secure ciphers are accepted
+	ciphers, _, err := tlsconfig.CipherSuitesToUint16(params.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warns []string
+
+	if params.InsecureSkipVerify {
+		warns = append(warns, "insecure-skip-verify is ignored for the server")
+	}
+
+	return &tls.Config{
+		Certificates:     certificates,
+		ClientAuth:       clientAuth,
+		ClientCAs:        clientCAs,
+		MinVersion:       minVersion,
+		MaxVersion:       maxVersion,
+		CipherSuites:     ciphers,
+		CurvePreferences: curves,
+	}, warns, nil
+}
@@ -0,0 +1,220 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tlsconfig "github.com/lomik/carbon-clickhouse/helper/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) tlsconfig.CertificatePair {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+
+	pair := tlsconfig.CertificatePair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+
+	require.NoError(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	require.NoError(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return pair
+}
+
+func TestParseServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, true)
+	pair := newCert(t, "localhost", ca, false).write(t, dir, "server")
+	caPair := ca.write(t, dir, "ca")
+
+	tests := []struct {
+		name    string
+		params  tlsconfig.TLS
+		wantErr bool
+		warns   int
+	}{
+		{"no certificates", tlsconfig.TLS{}, true, 0},
+		{"server", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, MinVersion: "TLS12"}, false, 0},
+		{"verify without ca", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, ClientAuth: "RequireAndVerifyClientCert"}, true, 0},
+		{"mtls", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, ClientAuth: "RequireAndVerifyClientCert", CACertFiles: []string{caPair.CertFile}}, false, 0},
+		{"bad client auth", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, ClientAuth: "Always"}, true, 0},
+		{"bad version", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, MinVersion: "SSL3"}, true, 0},
+		{"ciphers", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, false, 0},
+		{"insecure cipher", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA"}}, true, 0},
+		{"insecure-skip-verify", tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}, InsecureSkipVerify: true}, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, warns, err := ParseServerTLSConfig(&tt.params)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Len(t, warns, tt.warns)
+			assert.Len(t, cfg.Certificates, 1)
+		})
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, true)
+	caPair := ca.write(t, dir, "ca")
+	pair := newCert(t, "localhost", ca, false).write(t, dir, "server")
+
+	s, _, err := New("test", &tlsconfig.TLS{
+		Certificates: []tlsconfig.CertificatePair{pair},
+		ClientAuth:   "RequireAndVerifyClientCert",
+		CACertFiles:  []string{caPair.CertFile},
+		MinVersion:   "TLS12",
+	}, 0)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}))
+	srv.TLS = s.Config()
+	srv.StartTLS()
+
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := newCert(t, "alice", ca, false)
+	get := func(certs []tls.Certificate) (*x509.Certificate, string, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs, ServerName: "localhost"}}}
+
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+
+		return resp.TLS.PeerCertificates[0], string(body), err
+	}
+
+	clientCert := []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}
+
+	serverCert, user, err := get(clientCert)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	_, _, err = get(nil)
+	assert.Error(t, err, "client certificate is required")
+
+	changed, err := s.changed()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// replace server certificate
+	newCert(t, "localhost", ca, false).write(t, dir, "server")
+	require.NoError(t, os.Chtimes(pair.CertFile, time.Now(), time.Now().Add(time.Second)))
+
+	changed, err = s.changed()
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	_, err = s.load()
+	require.NoError(t, err)
+
+	reloaded, _, err := get(clientCert)
+	require.NoError(t, err)
+	assert.NotEqual(t, serverCert.SerialNumber, reloaded.SerialNumber)
+}
+
+func TestServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, true)
+	pair := newCert(t, "localhost", ca, false).write(t, dir, "server")
+
+	s, _, err := New("test", &tlsconfig.TLS{Certificates: []tlsconfig.CertificatePair{pair}}, 0)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = s.Config()
+	srv.StartTLS()
+
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	c := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := c.Get(srv.URL)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", string(body))
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+}
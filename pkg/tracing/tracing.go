@@ -0,0 +1,192 @@
+// Package tracing provides OpenTelemetry spans for the request pipeline
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone     = ""
+	ExporterOTLPHTTP = "otlphttp"
+	ExporterFile     = "file"
+)
+
+const tracerName = "github.com/lomik/graphite-clickhouse"
+
+// Config is the tracing config
+type Config struct {
+	Exporter    string            `toml:"exporter"     json:"exporter"     comment:"spans exporter: otlphttp or file (empty - tracing is disabled)"`
+	Endpoint    string            `toml:"endpoint"     json:"endpoint"     comment:"OTLP/HTTP traces endpoint URL"`
+	File        string            `toml:"file"         json:"file"         comment:"file for the file exporter, spans are appended as JSON"`
+	SampleRatio float64           `toml:"sample-ratio" json:"sample-ratio" comment:"ratio of the sampled traces, started by graphite-clickhouse (the sampling decision of the incoming traceparent is respected)"`
+	ServiceName string            `toml:"service-name" json:"service-name" comment:"service.name resource attribute"`
+	Timeout     time.Duration     `toml:"timeout"      json:"timeout"      comment:"export timeout"`
+	Headers     map[string]string `toml:"headers"      json:"headers"      comment:"additional headers for OTLP/HTTP requests"`
+}
+
+// Validate checks the config
+func (c *Config) Validate() error {
+	switch c.Exporter {
+	case ExporterNone:
+		return nil
+	case ExporterOTLPHTTP:
+		if c.Endpoint == "" {
+			return fmt.Errorf("endpoint is required for %s exporter", c.Exporter)
+		}
+	case ExporterFile:
+		if c.File == "" {
+			return fmt.Errorf("file is required for %s exporter", c.Exporter)
+		}
+	default:
+		return fmt.Errorf("unknown exporter %q, known exporters: %q, %q", c.Exporter, ExporterOTLPHTTP, ExporterFile)
+	}
+
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("sample-ratio must be in [0, 1]")
+	}
+
+	return nil
+}
+
+// Setup registers the global tracer provider and W3C trace context propagator. The returned shutdown func flushes
+// the spans. If the exporter isn't set, tracing stays disabled (spans are not recorded)
+func Setup(c *Config, version string) (shutdown func(context.Context) error, err error) {
+	if c.Exporter == ExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		closer   func() error
+	)
+
+	switch c.Exporter {
+	case ExporterOTLPHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(c.Endpoint)}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+		}
+
+		if c.Timeout > 0 {
+			opts = append(opts, otlptracehttp.WithTimeout(c.Timeout))
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterFile:
+		var f *os.File
+
+		f, err = os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		closer = f.Close
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		err = fmt.Errorf("unknown exporter %q", c.Exporter)
+	}
+
+	if err != nil {
+		if closer != nil {
+			closer()
+		}
+
+		return nil, err
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", c.ServiceName),
+		attribute.String("service.version", version),
+	)
+
+	var batcherOpts []sdktrace.BatchSpanProcessorOption
+	if c.Timeout > 0 {
+		batcherOpts = append(batcherOpts, sdktrace.WithExportTimeout(c.Timeout))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, batcherOpts...),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer(); err == nil {
+				err = cerr
+			}
+		}
+
+		return err
+	}, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Start starts the internal span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartClient starts the span for the outgoing request and injects the trace context (traceparent and tracestate) into header
+func StartClient(ctx context.Context, name string, header http.Header, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+
+	return ctx, span
+}
+
+// StartServer starts the span for the incoming request, the trace context is extracted from the request headers
+func StartServer(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, r.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+
+	return r.WithContext(ctx), span
+}
+
+// End sets the error status (if err isn't nil) and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// EndStatus sets the response status and ends the server span, 5xx statuses are errors
+func EndStatus(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+
+	span.End()
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{name: "disabled", c: Config{}},
+		{name: "otlphttp", c: Config{Exporter: "otlphttp", Endpoint: "http://localhost:4318/v1/traces", SampleRatio: 1}},
+		{name: "otlphttp without endpoint", c: Config{Exporter: "otlphttp"}, wantErr: true},
+		{name: "file without file", c: Config{Exporter: "file"}, wantErr: true},
+		{name: "invalid ratio", c: Config{Exporter: "file", File: "spans.json", SampleRatio: 2}, wantErr: true},
+		{name: "unknown", c: Config{Exporter: "jaeger"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spans.json")
+
+	shutdown, err := Setup(&Config{Exporter: ExporterFile, File: file, SampleRatio: 1, ServiceName: "test"}, "0.0.1")
+	require.NoError(t, err)
+
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	r := httptest.NewRequest(http.MethodGet, "/render/", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	r, span := StartServer(r)
+
+	_, internal := Start(r.Context(), "finder.Find")
+	End(internal, errors.New("failed"))
+
+	header := make(http.Header)
+	_, client := StartClient(r.Context(), "clickhouse.Query", header)
+	client.End()
+
+	EndStatus(span, http.StatusOK)
+
+	// trace context is propagated to the outgoing request
+	assert.Contains(t, header.Get("traceparent"), traceID)
+
+	require.NoError(t, shutdown(context.Background()))
+
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	out := string(b)
+	assert.Contains(t, out, traceID)
+	assert.Contains(t, out, `"Name":"/render/"`)
+	assert.Contains(t, out, `"Name":"finder.Find"`)
+	assert.Contains(t, out, `"Name":"clickhouse.Query"`)
+	assert.Contains(t, out, `"Description":"failed"`)
+}
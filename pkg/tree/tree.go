@@ -0,0 +1,243 @@
+package tree
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+type node struct {
+	name     string
+	leaf     bool // metric with this path exists
+	dir      bool // path has childs
+	children []*node
+}
+
+// Tree is a compact in-memory representation of the graphite metrics tree
+type Tree struct {
+	root  node
+	nodes int
+	leafs int
+}
+
+// New returns empty *Tree
+func New() *Tree {
+	return &Tree{}
+}
+
+// Nodes returns count of the tree nodes
+func (t *Tree) Nodes() int {
+	return t.nodes
+}
+
+// Leafs returns count of the metrics in tree
+func (t *Tree) Leafs() int {
+	return t.leafs
+}
+
+func (n *node) search(name string) int {
+	return sort.Search(len(n.children), func(i int) bool { return n.children[i].name >= name })
+}
+
+func (n *node) child(name string) *node {
+	i := n.search(name)
+	if i < len(n.children) && n.children[i].name == name {
+		return n.children[i]
+	}
+
+	return nil
+}
+
+func (t *Tree) addChild(n *node, name string) *node {
+	// fast path for sorted input
+	if l := len(n.children); l > 0 && n.children[l-1].name < name {
+		c := &node{name: strings.Clone(name)}
+		n.children = append(n.children, c)
+		t.nodes++
+
+		return c
+	}
+
+	i := n.search(name)
+	if i < len(n.children) && n.children[i].name == name {
+		return n.children[i]
+	}
+
+	c := &node{name: strings.Clone(name)}
+
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = c
+	t.nodes++
+
+	return c
+}
+
+// Add inserts the path into the tree. Path with a trailing dot is a directory (like in index table)
+func (t *Tree) Add(path string) {
+	dir := false
+	if strings.HasSuffix(path, ".") {
+		dir = true
+		path = path[:len(path)-1]
+	}
+
+	if path == "" {
+		return
+	}
+
+	n := &t.root
+
+	for {
+		name, tail, found := strings.Cut(path, ".")
+
+		n = t.addChild(n, name)
+		if !found {
+			break
+		}
+
+		n.dir = true
+		path = tail
+	}
+
+	if dir {
+		n.dir = true
+	} else if !n.leaf {
+		n.leaf = true
+		t.leafs++
+	}
+}
+
+// HasLeaf checks if the metric with exact path exists in tree
+func (t *Tree) HasLeaf(path string) bool {
+	n := &t.root
+
+	for {
+		name, tail, found := strings.Cut(path, ".")
+		if n = n.child(name); n == nil {
+			return false
+		}
+
+		if !found {
+			return n.leaf
+		}
+
+		path = tail
+	}
+}
+
+type matcher struct {
+	exact  []string // sorted list of node names without wildcards
+	prefix string   // non-wildcard prefix of glob
+	re     *regexp.Regexp
+}
+
+func newMatcher(glob string) (*matcher, error) {
+	if where.IsRegexpNode(glob) {
+		re, err := regexp.Compile("^" + where.RegexpNodeToRegexp(glob) + "$")
+		if err != nil {
+			return nil, err
+		}
+
+		return &matcher{re: re}, nil
+	}
+
+	glob = where.ClearGlob(glob)
+
+	if !where.HasWildcard(glob) {
+		return &matcher{exact: []string{glob}}, nil
+	}
+
+	if strings.IndexAny(glob, "[]*?") == -1 {
+		// only lists, like {a,b}, expand it
+		var values []string
+		if err := where.GlobExpandSimple(glob, "", &values); err == nil {
+			sort.Strings(values)
+			return &matcher{exact: values}, nil
+		}
+	}
+
+	m := &matcher{prefix: glob[:where.IndexWildcard(glob)]}
+
+	if glob != "*" {
+		var err error
+		if m.re, err = regexp.Compile("^" + where.GlobToRegexp(glob) + "$"); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *matcher) each(n *node, f func(c *node)) {
+	if m.exact != nil {
+		for _, name := range m.exact {
+			if c := n.child(name); c != nil {
+				f(c)
+			}
+		}
+
+		return
+	}
+
+	for i := n.search(m.prefix); i < len(n.children); i++ {
+		c := n.children[i]
+		if !strings.HasPrefix(c.name, m.prefix) {
+			break
+		}
+
+		if m.re == nil || m.re.MatchString(c.name) {
+			f(c)
+		}
+	}
+}
+
+// Match returns paths matched by the graphite glob query.
+// Directories are returned with a trailing dot, as the index table does
+func (t *Tree) Match(query string) ([][]byte, error) {
+	globs := strings.Split(query, ".")
+	matchers := make([]*matcher, len(globs))
+
+	for i, glob := range globs {
+		m, err := newMatcher(glob)
+		if err != nil {
+			return nil, err
+		}
+
+		matchers[i] = m
+	}
+
+	var (
+		walk func(n *node, level int, path []byte)
+		rows = make([][]byte, 0)
+	)
+
+	walk = func(n *node, level int, path []byte) {
+		matchers[level].each(n, func(c *node) {
+			p := make([]byte, 0, len(path)+len(c.name)+1)
+			p = append(p, path...)
+			p = append(p, c.name...)
+
+			if level < len(matchers)-1 {
+				if c.dir {
+					walk(c, level+1, append(p, '.'))
+				}
+
+				return
+			}
+
+			if c.dir {
+				rows = append(rows, append(p[:len(p):len(p)], '.'))
+			}
+
+			if c.leaf {
+				rows = append(rows, p)
+			}
+		})
+	}
+
+	walk(&t.root, 0, nil)
+
+	return rows, nil
+}
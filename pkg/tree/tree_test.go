@@ -0,0 +1,82 @@
+package tree
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTree() *Tree {
+	t := New()
+	for _, path := range []string{
+		"host.",
+		"host.web-eu-1.",
+		"host.web-eu-1.cpu.",
+		"host.web-eu-1.cpu.user",
+		"host.web-eu-1.cpu.system",
+		"host.web-us-1.cpu.user",
+		"host.db-1.cpu.user",
+		"host.db-1.cpu",
+		"host.db-1.cpu.user", // duplicate
+		"host.db-10.load",
+		"other",
+	} {
+		t.Add(path)
+	}
+
+	return t
+}
+
+func TestTreeAdd(t *testing.T) {
+	tr := newTestTree()
+
+	assert.Equal(t, 7, tr.Leafs())
+	assert.Equal(t, 14, tr.Nodes())
+
+	assert.True(t, tr.HasLeaf("host.db-1.cpu"))
+	assert.True(t, tr.HasLeaf("host.db-1.cpu.user"))
+	assert.True(t, tr.HasLeaf("other"))
+	assert.False(t, tr.HasLeaf("host.web-eu-1.cpu"))
+	assert.False(t, tr.HasLeaf("host"))
+	assert.False(t, tr.HasLeaf("host.db-2.cpu"))
+}
+
+func TestTreeMatch(t *testing.T) {
+	tr := newTestTree()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"*", []string{"host.", "other"}},
+		{"host.*", []string{"host.db-1.", "host.db-10.", "host.web-eu-1.", "host.web-us-1."}},
+		{"host.db-1.*", []string{"host.db-1.cpu", "host.db-1.cpu."}},
+		{"host.db-1*.*", []string{"host.db-1.cpu", "host.db-1.cpu.", "host.db-10.load"}},
+		{"host.web-{eu,us}-1.cpu.user", []string{"host.web-eu-1.cpu.user", "host.web-us-1.cpu.user"}},
+		{"host.web-[a-z][a-z]-1.cpu.{user}", []string{"host.web-eu-1.cpu.user", "host.web-us-1.cpu.user"}},
+		{"host.*.cpu.s?stem", []string{"host.web-eu-1.cpu.system"}},
+		{"host.*.*.*", []string{"host.db-1.cpu.user", "host.web-eu-1.cpu.system", "host.web-eu-1.cpu.user", "host.web-us-1.cpu.user"}},
+		{"host.~^web-(eu|us)-[0-9]+$.cpu.user", []string{"host.web-eu-1.cpu.user", "host.web-us-1.cpu.user"}},
+		{"host.~^db-[0-9]$", []string{"host.db-1."}},
+		{"host.db-2.*", []string{}},
+		{"other.*", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rows, err := tr.Match(tt.query)
+			require.NoError(t, err)
+
+			got := make([]string, 0, len(rows))
+			for _, row := range rows {
+				got = append(got, string(row))
+			}
+
+			sort.Strings(got)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
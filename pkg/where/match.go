@@ -125,6 +125,10 @@ func HasUnmatchedBrackets(query string) bool {
 	}
 
 	for _, node := range strings.Split(query, ".") {
+		if IsRegexpNode(node) {
+			continue
+		}
+
 		if nodeHasUnmatched(node) {
 			return true
 		}
@@ -138,6 +142,10 @@ func glob(field string, query string, optionalDotAtEnd bool) string {
 		return ""
 	}
 
+	if HasRegexpNode(query) {
+		return regexpNodesGlob(field, query, optionalDotAtEnd)
+	}
+
 	query = ClearGlob(query)
 
 	if !HasWildcard(query) {
@@ -225,3 +233,38 @@ func Match(field string, key, value string) string {
 		field, quoteRegex(key, value),
 	)
 }
+
+// MatchCaseInsensitive is like Match, but the tag value (not the key) is matched case-insensitive
+func MatchCaseInsensitive(field string, key, value string) string {
+	if len(value) == 0 || value == "*" {
+		return Like(field, key+"=%")
+	}
+
+	var expr string
+	if value[0] == '^' {
+		expr = fmt.Sprintf("'^%s%s(?i)%s'", key, opEq, escapeRegex(value[1:]))
+	} else {
+		expr = fmt.Sprintf("'^%s%s(?i).*%s'", key, opEq, escapeRegex(value))
+	}
+
+	return fmt.Sprintf("%s AND match(%s, %s)", HasPrefix(field, key+opEq), field, expr)
+}
+
+// AnchorRegex returns the value regex, anchored to match the whole tag value (like ^(value)$).
+// Empty value and * (match any) are returned as is.
+func AnchorRegex(value string) string {
+	if len(value) == 0 || value == "*" {
+		return value
+	}
+
+	value = strings.TrimPrefix(value, "^")
+	if strings.HasSuffix(value, "$") && !strings.HasSuffix(value, `\$`) {
+		value = value[:len(value)-1]
+	}
+
+	if strings.Contains(value, "|") {
+		return "^(" + value + ")$"
+	}
+
+	return "^" + value + "$"
+}
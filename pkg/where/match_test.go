@@ -44,7 +44,8 @@ func Test_HasUnmatchedBrackets(t *testing.T) {
 		{"a.{a,b.}.te{s,t}*.b", true}, // dots are not escaped inside curly brackets
 		{"О.[б].те{s}t.b", false},     // utf-8 string
 		{"О.[б.теs}t.b", true},
-		{"О.[].те{}t.b", false}, // utf-8 string with empthy blocks
+		{"О.[].те{}t.b", false},          // utf-8 string with empthy blocks
+		{`a.~^web-\[[0-9]{2}$.b`, false}, // regexp nodes are not checked
 	}
 	for _, tt := range tests {
 		t.Run(tt.query, func(t *testing.T) {
@@ -67,6 +68,9 @@ func TestGlob(t *testing.T) {
 		{"a.{a,b}.test*.b", "test LIKE 'a.%' AND match(test, '^a[.](a|b)[.]test([^.]*?)[.]b$')"},
 		{"a.[b].te{s}t.b", "test='a.b.test.b'"},
 		{"a.[ab].te{s,t}*.b", "test LIKE 'a.%' AND match(test, '^a[.][ab][.]te(s|t)([^.]*?)[.]b$')"},
+		{"a.~^web-(eu|us)-[0-9]{1,2}$.b", "test LIKE 'a.%' AND match(test, '^a[.](?:web-(eu|us)-[0-9]{1,2})[.]b$')"},
+		{"a.b*.~^web$.{c}", "test LIKE 'a.b%' AND match(test, '^a[.]b([^.]*?)[.](?:web)[.]c$')"},
+		{`~^\w+$.b`, `match(test, '^(?:\\w+)[.]b$')`},
 	}
 	for _, tt := range tests {
 		t.Run(tt.query, func(t *testing.T) {
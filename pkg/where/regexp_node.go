@@ -0,0 +1,159 @@
+package where
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+)
+
+// RegexpNodePrefix starts the regular expression node in plain query, like servers.~^web-(eu|us)-[0-9]+$.cpu
+// Node ends with $ and can't contain dot (it's a nodes separator), use character classes like \w instead
+const RegexpNodePrefix = "~^"
+
+// IsRegexpNode checks if node is the regular expression node (~^...$)
+func IsRegexpNode(node string) bool {
+	return len(node) > len(RegexpNodePrefix) && strings.HasPrefix(node, RegexpNodePrefix) && node[len(node)-1] == '$'
+}
+
+// HasRegexpNode checks if query contains the regular expression node
+func HasRegexpNode(query string) bool {
+	return strings.HasPrefix(query, RegexpNodePrefix) || strings.Contains(query, "."+RegexpNodePrefix)
+}
+
+// indexRegexpNode returns positions of the first regular expression node start and the last regular expression node end
+func indexRegexpNode(query string) (first, last int) {
+	first, last = -1, -1
+
+	for start := 0; start < len(query); {
+		end := strings.IndexByte(query[start:], '.')
+		if end == -1 {
+			end = len(query)
+		} else {
+			end += start
+		}
+
+		if strings.HasPrefix(query[start:end], RegexpNodePrefix) {
+			if first == -1 {
+				first = start
+			}
+
+			last = end - 1
+		}
+
+		start = end + 1
+	}
+
+	return
+}
+
+// RegexpNodeToRegexp returns regular expression (without anchors) for the regular expression node
+func RegexpNodeToRegexp(node string) string {
+	return "(?:" + node[len(RegexpNodePrefix):len(node)-1] + ")"
+}
+
+// ValidateRegexpNodes checks the regular expression nodes syntax (RE2)
+func ValidateRegexpNodes(query string) error {
+	if !HasRegexpNode(query) {
+		return nil
+	}
+
+	for _, node := range strings.Split(query, ".") {
+		if !strings.HasPrefix(node, RegexpNodePrefix) {
+			continue
+		}
+
+		if !IsRegexpNode(node) {
+			return errs.NewErrorWithCode("regexp node must end with $ and can't contain dot: "+node, http.StatusBadRequest)
+		}
+
+		if _, err := regexp.Compile(RegexpNodeToRegexp(node)); err != nil {
+			return errs.NewErrorWithCode("invalid regexp node: "+err.Error(), http.StatusBadRequest)
+		}
+	}
+
+	return nil
+}
+
+// MaskRegexpNodes replaces the regular expression nodes with placeholders (~^N$),
+// so glob lists expanding don't touch it. Restore it with UnmaskRegexpNodes
+func MaskRegexpNodes(query string) (string, []string) {
+	if !HasRegexpNode(query) {
+		return query, nil
+	}
+
+	var masked []string
+
+	nodes := strings.Split(query, ".")
+	for i, node := range nodes {
+		if IsRegexpNode(node) {
+			nodes[i] = RegexpNodePrefix + strconv.Itoa(len(masked)) + "$"
+			masked = append(masked, node)
+		}
+	}
+
+	return strings.Join(nodes, "."), masked
+}
+
+// UnmaskRegexpNodes restores the regular expression nodes, replaced by MaskRegexpNodes
+func UnmaskRegexpNodes(query string, masked []string) string {
+	if len(masked) == 0 {
+		return query
+	}
+
+	nodes := strings.Split(query, ".")
+	for i, node := range nodes {
+		if IsRegexpNode(node) {
+			if n, err := strconv.Atoi(node[len(RegexpNodePrefix) : len(node)-1]); err == nil && n < len(masked) {
+				nodes[i] = masked[n]
+			}
+		}
+	}
+
+	return strings.Join(nodes, ".")
+}
+
+func regexpNodesGlob(field string, query string, optionalDotAtEnd bool) string {
+	nodes := strings.Split(query, ".")
+	re := make([]string, len(nodes))
+
+	var simplePrefix string
+
+	prefixDone := false
+
+	for i, node := range nodes {
+		if IsRegexpNode(node) {
+			re[i] = RegexpNodeToRegexp(node)
+			prefixDone = true
+
+			continue
+		}
+
+		node = ClearGlob(node)
+		re[i] = GlobToRegexp(node)
+
+		if !prefixDone {
+			if w := IndexWildcard(node); w >= 0 {
+				simplePrefix += node[:w]
+				prefixDone = true
+			} else {
+				simplePrefix += node + "."
+			}
+		}
+	}
+
+	postfix := `$`
+	if optionalDotAtEnd {
+		postfix = `[.]?$`
+	}
+
+	expr := quote(`^` + strings.Join(re, `[.]`) + postfix)
+
+	if simplePrefix == "" {
+		return "match(" + field + ", " + expr + ")"
+	}
+
+	return HasPrefix(field, simplePrefix) + " AND match(" + field + ", " + expr + ")"
+}
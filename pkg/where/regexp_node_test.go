@@ -0,0 +1,51 @@
+package where
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRegexpNodes(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"a.b.c", false},
+		{"a.~^web-(eu|us)-[0-9]+$.cpu", false},
+		{"~^a|b$", false},
+		{"a.~^web.*$.cpu", true}, // dot in regexp node
+		{"a.~^web-(eu$.cpu", true},
+		{"a.~^web", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			err := ValidateRegexpNodes(tt.query)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMaskRegexpNodes(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantMasked string
+	}{
+		{"a.{b,c}.d", "a.{b,c}.d"},
+		{"a.{b,c}.~^d{1,2}$.~^e|f$", "a.{b,c}.~^0$.~^1$"},
+		{"~^[ab]{2}$.c", "~^0$.c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			masked, nodes := MaskRegexpNodes(tt.query)
+			assert.Equal(t, tt.wantMasked, masked)
+			assert.Equal(t, tt.query, UnmaskRegexpNodes(masked, nodes))
+		})
+	}
+}
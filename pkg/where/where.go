@@ -75,16 +75,32 @@ func HasWildcard(target string) bool {
 	return strings.IndexAny(target, "[]{}*?") > -1
 }
 
+// IndexLastWildcard returns position of the last wildcard symbol or the last regexp node end
 func IndexLastWildcard(target string) int {
-	return strings.LastIndexAny(target, "[]{}*?")
+	i := strings.LastIndexAny(target, "[]{}*?")
+	if HasRegexpNode(target) {
+		if _, last := indexRegexpNode(target); last > i {
+			i = last
+		}
+	}
+
+	return i
 }
 
+// IndexWildcard returns position of the first wildcard symbol or the first regexp node start
 func IndexWildcard(target string) int {
-	return strings.IndexAny(target, "[]{}*?")
+	i := strings.IndexAny(target, "[]{}*?")
+	if HasRegexpNode(target) {
+		if first, _ := indexRegexpNode(target); first != -1 && (i == -1 || first < i) {
+			i = first
+		}
+	}
+
+	return i
 }
 
 func MaxWildcardDistance(query string) int {
-	if !HasWildcard(query) {
+	if IndexWildcard(query) == -1 {
 		return -1
 	}
 
@@ -171,6 +187,10 @@ func Eq(field, value interface{}) string {
 	return fmt.Sprintf("%s=%s", field, quote(value))
 }
 
+func Gt(field, value interface{}) string {
+	return fmt.Sprintf("%s>%s", field, quote(value))
+}
+
 func HasPrefix(field, prefix string) string {
 	return fmt.Sprintf("%s LIKE '%s%%'", field, likeEscape(prefix))
 }
@@ -183,10 +203,25 @@ func HasPrefixBytes(field, prefix []byte) string {
 	return fmt.Sprintf("%s LIKE '%s%%'", field, likeEscape(unsafeString(prefix)))
 }
 
+// ContainsCaseInsensitive returns condition for case-insensitive substring match
+func ContainsCaseInsensitive(field, s string) string {
+	return fmt.Sprintf("positionCaseInsensitive(%s, %s) > 0", field, quote(s))
+}
+
+// NgramSearchCaseInsensitive returns case-insensitive fuzzy match score (from 0 to 1)
+func NgramSearchCaseInsensitive(field, s string) string {
+	return fmt.Sprintf("ngramSearchCaseInsensitive(%s, %s)", field, quote(s))
+}
+
 func ArrayHas(field, element string) string {
 	return fmt.Sprintf("has(%s, %s)", field, quote(element))
 }
 
+// ArrayMatch checks if any element of the array field matches the regexp
+func ArrayMatch(field, regexp string) string {
+	return fmt.Sprintf("arrayExists((x) -> match(x, %s), %s)", quote(regexp), field)
+}
+
 func In(field string, list []string) string {
 	if len(list) == 1 {
 		return Eq(field, list[0])
@@ -86,6 +86,8 @@ func TestMaxWildcardDistance(t *testing.T) {
 		{`test.foo.bar.*.bar.foo.test`, 3},
 		{`test.foo.bar.foobar.*.middle.*.foobar.bar.foo.test`, 4},
 		{`*.test.foo.bar.*`, 0},
+		{`test.~^foo$.bar.count`, 2},
+		{`test.~^f{1,2}$.bar.~^c[a-z]+$`, 1},
 	}
 
 	for _, test := range table {
@@ -12,6 +12,7 @@ import (
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/util/annotations"
 
+	"github.com/lomik/graphite-clickhouse/acl"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
@@ -26,6 +27,15 @@ type Querier struct {
 	maxt   int64
 }
 
+// forContext returns the querier with the config of the tenant from the request context
+func (q *Querier) forContext(ctx context.Context) *Querier {
+	if cfg := q.config.ForContext(ctx); cfg != q.config {
+		return &Querier{config: cfg, mint: q.mint, maxt: q.maxt}
+	}
+
+	return q
+}
+
 // Close releases the resources of the Querier.
 func (q *Querier) Close() error {
 	return nil
@@ -33,6 +43,8 @@ func (q *Querier) Close() error {
 
 // LabelValues returns all potential values for a label name.
 func (q *Querier) LabelValues(ctx context.Context, label string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	q = q.forContext(ctx)
+
 	// @TODO: support matchers
 	w := where.New()
 	w.And(where.HasPrefix("Tag1", label+"="))
@@ -67,11 +79,26 @@ func (q *Querier) LabelValues(ctx context.Context, label string, hints *storage.
 		rows = rows[:len(rows)-1]
 	}
 
+	// prometheus requests have no user, so ACL for the anonymous user is applied
+	if access := acl.FromContext(ctx); access.Restricted() {
+		allowed := rows[:0]
+
+		for _, value := range rows {
+			if access.AllowedTagValue(label, value) {
+				allowed = append(allowed, value)
+			}
+		}
+
+		rows = allowed
+	}
+
 	return rows, nil, nil
 }
 
 // LabelNames returns all the unique label names present in the block in sorted order.
 func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	q = q.forContext(ctx)
+
 	// @TODO support matchers
 	w := where.New()
 	fromDate := time.Now().AddDate(0, 0, -q.config.ClickHouse.TaggedAutocompleDays).UTC()
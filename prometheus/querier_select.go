@@ -31,7 +31,7 @@ func (q *Querier) lookup(ctx context.Context, from, until int64, qlimiter limite
 	)
 
 	if qlimiter.Enabled() {
-		limitCtx, cancel = context.WithTimeout(ctx, q.config.ClickHouse.IndexTimeout)
+		limitCtx, cancel = context.WithTimeout(limiter.WithLeases(ctx), q.config.ClickHouse.IndexTimeout)
 		defer cancel()
 
 		start := time.Now()
@@ -93,6 +93,8 @@ func (q *Querier) timeRange(hints *storage.SelectHints) (int64, int64) {
 
 // Select returns a set of series that matches the given label matchers.
 func (q *Querier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, labelsMatcher ...*labels.Matcher) storage.SeriesSet {
+	q = q.forContext(ctx)
+
 	var (
 		queueDuration time.Duration
 	)
@@ -5,12 +5,14 @@ package prometheus
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/grafana/regexp"
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/tlsserver"
 	"github.com/lomik/zapwriter"
 	"github.com/prometheus/client_golang/prometheus"
 	promConfig "github.com/prometheus/prometheus/config"
@@ -20,6 +22,7 @@ import (
 	"github.com/prometheus/prometheus/scrape"
 	"github.com/prometheus/prometheus/web"
 	"github.com/prometheus/prometheus/web/ui"
+	"go.uber.org/zap"
 
 	uiStatic "github.com/lomik/prometheus-ui-static"
 	"github.com/prometheus/common/assets"
@@ -33,7 +36,7 @@ func Run(config *config.Config) error {
 		z: zapwriter.Logger("prometheus"),
 	}
 
-	storage := newStorage(config)
+	storage := newStorage(config.Tenant(config.Prometheus.Tenant))
 
 	corsOrigin, err := regexp.Compile("^$")
 	if err != nil {
@@ -83,8 +86,32 @@ func Run(config *config.Config) error {
 	promHandler.ApplyConfig(&promConfig.Config{})
 	promHandler.SetReady(true)
 
+	var tlsConfig *tls.Config
+
+	if tlsserver.Enabled(&config.Prometheus.TLS) {
+		tlsServer, warns, err := tlsserver.New("prometheus", &config.Prometheus.TLS, config.Common.TLSReloadInterval)
+		if err != nil {
+			return err
+		}
+
+		if len(warns) > 0 {
+			zapLogger.z.Warn("tls", zap.Strings("warnings", warns))
+		}
+
+		tlsConfig = tlsServer.Config()
+	}
+
+	listener, err := promHandler.Listener()
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
 	go func() {
-		log.Fatal(promHandler.Run(context.Background(), nil, ""))
+		log.Fatal(promHandler.Run(context.Background(), listener, ""))
 	}()
 
 	return nil
@@ -0,0 +1,309 @@
+// Package querylog writes the requests log into the clickhouse table for the usage analytics
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+const columns = "EventTime,RequestID,Endpoint,User,Tenant,GrafanaOrg,Dashboard,Panel,Targets,From,Until,Tables,Metrics,Points,ReadRows,ReadBytes,Duration,Status"
+
+// Entry is the request for the query log. User, tenant, grafana headers, tables and read stats are taken
+// from the request context
+type Entry struct {
+	Endpoint string
+	Targets  []string
+	From     int64 // unix time, 0 for the requests without time range
+	Until    int64
+	Metrics  int64
+	Points   int64
+	Status   int
+	Duration time.Duration
+}
+
+type row struct {
+	Entry
+	time       time.Time
+	requestID  string
+	user       string
+	tenant     string
+	grafanaOrg string
+	dashboard  string
+	panel      string
+	tables     []string
+	readRows   int64
+	readBytes  int64
+}
+
+type writer struct {
+	table         string
+	url           string
+	batchSize     int
+	flushInterval time.Duration
+	compression   clickhouse.ContentEncoding
+	opts          clickhouse.Options
+	logger        *zap.Logger
+
+	queue   chan *row
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+// current is the started writer, nil if the query log is disabled
+var current atomic.Pointer[writer]
+
+// Start starts the background writer. Does nothing if the query log table is not set
+func Start(cfg *config.Config) {
+	if !cfg.QueryLog.Enabled() {
+		return
+	}
+
+	w := &writer{
+		table:         cfg.QueryLog.Table,
+		url:           cfg.QueryLog.URL,
+		batchSize:     cfg.QueryLog.BatchSize,
+		flushInterval: cfg.QueryLog.FlushInterval,
+		compression:   cfg.QueryLog.Compression,
+		opts: clickhouse.Options{
+			TLSConfig:               cfg.ClickHouse.TLSConfig,
+			Timeout:                 cfg.QueryLog.Timeout,
+			ConnectTimeout:          cfg.ClickHouse.ConnectTimeout,
+			ProgressSendingInterval: cfg.ClickHouse.ProgressSendingInterval,
+		},
+		logger: zapwriter.Logger("query_log"),
+		queue:  make(chan *row, cfg.QueryLog.QueueSize),
+		stop:   make(chan struct{}),
+	}
+
+	w.done.Add(1)
+
+	go w.worker()
+
+	current.Store(w)
+}
+
+// Stop flushes the queued rows and stops the writer
+func Stop() {
+	w := current.Swap(nil)
+	if w == nil {
+		return
+	}
+
+	close(w.stop)
+	w.done.Wait()
+}
+
+// Enabled returns true if the writer is started
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// Log enqueues the request row. The row is dropped if the queue is full
+func Log(r *http.Request, e Entry) {
+	w := current.Load()
+	if w == nil {
+		return
+	}
+
+	ctx := r.Context()
+	row := &row{
+		Entry:      e,
+		time:       time.Now(),
+		requestID:  scope.RequestID(ctx),
+		user:       r.Header.Get("X-Forwarded-User"),
+		tenant:     scope.Tenant(ctx),
+		grafanaOrg: scope.String(ctx, "X-Grafana-Org-Id"),
+		dashboard:  scope.String(ctx, "X-Dashboard-Id"),
+		panel:      scope.String(ctx, "X-Panel-Id"),
+	}
+
+	if ql := clickhouse.GetQueryLog(ctx); ql != nil {
+		for _, q := range ql.Queries() {
+			row.tables = appendUnique(row.tables, q.Table)
+		}
+
+		row.readRows, row.readBytes = ql.ReadStats()
+	}
+
+	select {
+	case w.queue <- row:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+
+	return append(list, s)
+}
+
+func (w *writer) worker() {
+	defer w.done.Done()
+
+	t := time.NewTicker(w.flushInterval)
+	defer t.Stop()
+
+	batch := make([]*row, 0, w.batchSize)
+
+	for {
+		select {
+		case row := <-w.queue:
+			batch = append(batch, row)
+			if len(batch) >= w.batchSize {
+				batch = w.flush(batch)
+			}
+		case <-t.C:
+			batch = w.flush(batch)
+		case <-w.stop:
+			for {
+				select {
+				case row := <-w.queue:
+					batch = append(batch, row)
+					if len(batch) >= w.batchSize {
+						batch = w.flush(batch)
+					}
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush inserts the batch and returns it truncated for the reuse. Failed batches are dropped
+func (w *writer) flush(batch []*row) []*row {
+	if dropped := w.dropped.Swap(0); dropped > 0 {
+		w.logger.Warn("queue is full, rows are dropped", zap.Int64("dropped", dropped))
+	}
+
+	if len(batch) == 0 {
+		return batch
+	}
+
+	if err := w.insert(batch); err != nil {
+		w.logger.Error("insert", zap.Error(err), zap.Int("rows", len(batch)))
+	}
+
+	for i := range batch {
+		batch[i] = nil
+	}
+
+	return batch[:0]
+}
+
+func (w *writer) insert(batch []*row) error {
+	body := new(bytes.Buffer)
+
+	wc, err := compressor(w.compression, body)
+	if err != nil {
+		return err
+	}
+
+	if err = encode(batch, wc); err != nil {
+		return err
+	}
+
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	ctx := scope.New(context.Background()).WithLogger(w.logger).WithTable(w.table)
+
+	_, _, _, err = clickhouse.PostWithEncoding(
+		ctx,
+		w.url,
+		fmt.Sprintf("INSERT INTO %s (%s) FORMAT RowBinary", w.table, columns),
+		body,
+		w.compression,
+		w.opts,
+		nil,
+	)
+
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func compressor(encoding clickhouse.ContentEncoding, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case clickhouse.ContentEncodingNone:
+		return nopCloser{w}, nil
+	case clickhouse.ContentEncodingGzip:
+		return gzip.NewWriter(w), nil
+	case clickhouse.ContentEncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", encoding)
+	}
+}
+
+func encode(batch []*row, w io.Writer) error {
+	enc := RowBinary.NewEncoder(w)
+
+	for _, r := range batch {
+		var status uint16
+		if r.Status > 0 {
+			status = uint16(r.Status)
+		}
+
+		for _, err := range []error{
+			enc.Uint32(uint32(r.time.Unix())),
+			enc.String(r.requestID),
+			enc.String(r.Endpoint),
+			enc.String(r.user),
+			enc.String(r.tenant),
+			enc.String(r.grafanaOrg),
+			enc.String(r.dashboard),
+			enc.String(r.panel),
+			enc.StringList(r.Targets),
+			enc.Uint32(uint32(r.From)),
+			enc.Uint32(uint32(r.Until)),
+			enc.StringList(r.tables),
+			enc.Uint64(uint64(r.Metrics)),
+			enc.Uint64(uint64(r.Points)),
+			enc.Uint64(uint64(r.readRows)),
+			enc.Uint64(uint64(r.readBytes)),
+			enc.Uint32(uint32(r.Duration.Milliseconds())),
+			enc.Uint16(status),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
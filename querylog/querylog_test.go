@@ -0,0 +1,125 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func TestLog(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		queries []string
+		bodies  [][]byte
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			body = gz
+		}
+
+		b, _ := io.ReadAll(body)
+
+		lock.Lock()
+		queries = append(queries, r.URL.Query().Get("query"))
+		bodies = append(bodies, b)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.QueryLog.Table = "graphite_query_log"
+	cfg.QueryLog.URL = srv.URL
+	cfg.QueryLog.BatchSize = 2
+	cfg.QueryLog.FlushInterval = time.Hour
+
+	Start(cfg)
+	require.True(t, Enabled())
+
+	ql := &clickhouse.QueryLog{}
+
+	r := httptest.NewRequest(http.MethodGet, "/render/?target=a.b.*", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.Header.Set("X-Dashboard-Id", "42")
+	r = scope.HttpRequest(r)
+	r = r.WithContext(clickhouse.WithQueryLog(r.Context(), ql))
+
+	for i := 0; i < 3; i++ {
+		Log(r, Entry{Endpoint: "render", Targets: []string{"a.b.*"}, From: 1000, Until: 2000, Metrics: 2, Points: 120, Status: http.StatusOK, Duration: time.Second})
+	}
+
+	// the last row is flushed on stop
+	Stop()
+	assert.False(t, Enabled())
+
+	// disabled writer ignores the rows
+	Log(r, Entry{Endpoint: "find"})
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	require.Len(t, queries, 2)
+	assert.Equal(t, "INSERT INTO graphite_query_log ("+columns+") FORMAT RowBinary", queries[0])
+
+	for _, b := range bodies {
+		assert.Contains(t, string(b), "alice")
+		assert.Contains(t, string(b), "a.b.*")
+		assert.Contains(t, string(b), "42")
+	}
+
+	// both rows in the first batch have the same size
+	assert.Equal(t, 2*len(bodies[1]), len(bodies[0]))
+}
+
+func TestLogDropped(t *testing.T) {
+	w := &writer{queue: make(chan *row, 1)}
+	current.Store(w)
+
+	defer current.Store(nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics/find/?query=a.*", nil)
+
+	Log(r, Entry{Endpoint: "find"})
+	Log(r, Entry{Endpoint: "find"})
+
+	assert.Len(t, w.queue, 1)
+	assert.Equal(t, int64(1), w.dropped.Load())
+}
+
+func TestEncode(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := encode([]*row{{
+		Entry:  Entry{Endpoint: "find", Targets: []string{"a.*"}, Status: http.StatusNotFound},
+		time:   time.Unix(1700000000, 0),
+		tables: []string{"graphite_index"},
+	}}, &buf)
+	require.NoError(t, err)
+
+	b := buf.Bytes()
+	// EventTime is UInt32 little-endian
+	assert.Equal(t, []byte{0x00, 0xf1, 0x53, 0x65}, b[:4])
+	// Status is UInt16 little-endian at the end
+	assert.Equal(t, []byte{0x94, 0x01}, b[len(b)-2:])
+	assert.Contains(t, string(b), "graphite_index")
+}
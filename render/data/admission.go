@@ -0,0 +1,172 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// framesCost returns the cost of the explained time frames: the points to read or the estimated rows to read
+func framesCost(frames []ExplainTimeFrame, estimate bool) (int64, error) {
+	var cost int64
+
+	for i := range frames {
+		f := &frames[i]
+
+		if estimate {
+			for _, q := range f.Queries {
+				if q.EstimateError != "" {
+					return 0, errors.New(q.EstimateError)
+				}
+
+				for _, row := range q.Estimate {
+					cost += int64(row.Rows)
+				}
+			}
+
+			continue
+		}
+
+		for _, m := range f.Metrics {
+			step := int64(m.Step)
+			if step < 1 {
+				step = 1
+			}
+
+			cost += (f.Until-f.From)/step + 1
+		}
+	}
+
+	return cost, nil
+}
+
+// costSlots returns the limiter slots for the request cost, up to half of the concurrent slots
+func costSlots(cost, slotCost int64, concurrent int) int {
+	if slotCost <= 0 || concurrent < 4 {
+		return 1
+	}
+
+	slots := 1 + cost/slotCost
+	if max := int64(concurrent / 2); slots > max {
+		return int(max)
+	}
+
+	return int(slots)
+}
+
+// admissionLimits returns the max cost and the concurrent queries of the render limiter for the request
+func admissionLimits(ctx context.Context, cfg *config.Config, qp *config.QueryParam) (maxCost int64, concurrent int) {
+	maxCost = cfg.Admission.MaxCost
+	concurrent = qp.ConcurrentQueries
+
+	// the same limiter as in GetQueryLimiter
+	if username := scope.String(ctx, "X-Forwarded-User"); username != "" {
+		if u, ok := cfg.ClickHouse.UserLimits[username]; ok {
+			if u.MaxCost > 0 {
+				maxCost = u.MaxCost
+			}
+
+			if u.ConcurrentQueries > 0 {
+				concurrent = u.ConcurrentQueries
+			}
+		}
+	}
+
+	return maxCost, concurrent
+}
+
+// admit calculates the cost of the request before the data queries, rejects the request with the cost greater
+// than max-cost and returns the limiter slots for the request. EXPLAIN ESTIMATE queries are executed under one slot
+// of the limiter, the wait time is added to queueDuration
+func (m *MultiTarget) admit(
+	ctx context.Context, cfg *config.Config, chContext string, qlimiter limiter.ServerLimiter, queueDuration *time.Duration,
+) (int, error) {
+	if !cfg.Admission.Enabled() {
+		return 1, nil
+	}
+
+	qp, _ := GetQueryParam("", cfg, m)
+	maxCost, concurrent := admissionLimits(ctx, cfg, qp)
+
+	if maxCost <= 0 && cfg.Admission.SlotCost <= 0 {
+		return 1, nil
+	}
+
+	estimate := cfg.Admission.Mode == config.AdmissionEstimate
+	unit := "points"
+
+	if estimate {
+		unit = "rows"
+
+		if qlimiter.Enabled() {
+			start := time.Now()
+			err := qlimiter.Enter(ctx, "render")
+			*queueDuration += time.Since(start)
+
+			if err != nil {
+				return 0, err
+			}
+
+			defer qlimiter.Leave(ctx, "render")
+		}
+	}
+
+	frames, err := m.Explain(ctx, cfg, chContext, estimate)
+	if err != nil {
+		return 0, err
+	}
+
+	cost, err := framesCost(frames, estimate)
+	if err != nil {
+		// the request is not rejected if clickhouse can't estimate it
+		scope.Logger(ctx).Warn("admission", zap.Error(err))
+		return 1, nil
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("cost", cost))
+	scope.Logger(ctx).Info("admission", zap.Int64("cost", cost), zap.String("unit", unit), zap.Int64("max_cost", maxCost))
+
+	if maxCost > 0 && cost > maxCost {
+		return 0, errs.NewErrorWithCode(
+			fmt.Sprintf("request is too expensive: %d %s to read, the limit is %d, reduce the time range or the number of metrics", cost, unit, maxCost),
+			http.StatusForbidden,
+		)
+	}
+
+	return costSlots(cost, cfg.Admission.SlotCost, concurrent), nil
+}
+
+// slotsLocks serializes the entering of several slots of the limiter (limiter.ServerLimiter -> *sync.Mutex),
+// so the expensive requests don't wait for each other while holding a part of the slots
+var slotsLocks sync.Map
+
+// enterSlots claims n slots of the limiter, entered is increased for each claimed slot
+func enterSlots(ctx context.Context, l limiter.ServerLimiter, n int, entered *int) error {
+	if n > 1 {
+		lock, _ := slotsLocks.LoadOrStore(l, &sync.Mutex{})
+		lock.(*sync.Mutex).Lock()
+		defer lock.(*sync.Mutex).Unlock()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := l.Enter(ctx, "render"); err != nil {
+			return err
+		}
+
+		*entered++
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func TestFramesCost(t *testing.T) {
+	frames := []ExplainTimeFrame{
+		{
+			From:    0,
+			Until:   3600,
+			Metrics: []ExplainMetric{{Name: "a", Step: 60}, {Name: "b", Step: 10}},
+			Queries: []ExplainQuery{
+				{Aggregation: "avg", Estimate: []clickhouse.EstimateRow{{Rows: 1000}, {Rows: 24}}},
+				{Aggregation: "max", Estimate: []clickhouse.EstimateRow{{Rows: 100}}},
+			},
+		},
+		{
+			From:    3600,
+			Until:   7200,
+			Metrics: []ExplainMetric{{Name: "c", Step: 0}},
+		},
+	}
+
+	cost, err := framesCost(frames, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(61+361+3601), cost)
+
+	cost, err = framesCost(frames, true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1124), cost)
+
+	frames[1].Queries = []ExplainQuery{{EstimateError: "clickhouse response status 500"}}
+	_, err = framesCost(frames, true)
+	assert.EqualError(t, err, "clickhouse response status 500")
+}
+
+func TestCostSlots(t *testing.T) {
+	tests := []struct {
+		name       string
+		cost       int64
+		slotCost   int64
+		concurrent int
+		want       int
+	}{
+		{name: "disabled", cost: 1000, slotCost: 0, concurrent: 10, want: 1},
+		{name: "cheap", cost: 99, slotCost: 100, concurrent: 10, want: 1},
+		{name: "expensive", cost: 250, slotCost: 100, concurrent: 10, want: 3},
+		{name: "half of concurrent", cost: 10000, slotCost: 100, concurrent: 10, want: 5},
+		{name: "small limiter", cost: 10000, slotCost: 100, concurrent: 3, want: 1},
+		{name: "without concurrent limiter", cost: 10000, slotCost: 100, concurrent: 0, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, costSlots(tt.cost, tt.slotCost, tt.concurrent))
+		})
+	}
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	cfg := config.New()
+	cfg.Admission.MaxCost = 1000
+	cfg.ClickHouse.UserLimits = map[string]config.UserLimits{
+		"robot": {ConcurrentQueries: 4, MaxCost: 100},
+		"alice": {MaxQueries: 10},
+	}
+	qp := &config.QueryParam{ConcurrentQueries: 20}
+
+	tests := []struct {
+		user           string
+		wantMaxCost    int64
+		wantConcurrent int
+	}{
+		{"", 1000, 20},
+		{"robot", 100, 4},
+		// the user limits without concurrent-queries and max-cost
+		{"alice", 1000, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			ctx := scope.With(context.Background(), "X-Forwarded-User", tt.user)
+			maxCost, concurrent := admissionLimits(ctx, cfg, qp)
+			assert.Equal(t, tt.wantMaxCost, maxCost)
+			assert.Equal(t, tt.wantConcurrent, concurrent)
+		})
+	}
+}
+
+func TestAdmitEstimateLimiter(t *testing.T) {
+	cfg := config.New()
+	cfg.Admission = config.Admission{Mode: config.AdmissionEstimate, MaxCost: 1000}
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{ConcurrentQueries: 1}}
+
+	qlimiter := limiter.NewWLimiter(nil, 0, 1, false, "render", "test")
+	m := MultiTarget{}
+
+	var queueDuration time.Duration
+
+	slots, err := m.admit(context.Background(), cfg, "", qlimiter, &queueDuration)
+	require.NoError(t, err)
+	assert.Equal(t, 1, slots)
+
+	// the slot of the estimate is released
+	require.NoError(t, qlimiter.TryEnter(context.Background(), "render"))
+
+	// the estimate waits for the busy limiter
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = m.admit(ctx, cfg, "", qlimiter, &queueDuration)
+	assert.ErrorIs(t, err, limiter.ErrTimeout)
+	assert.GreaterOrEqual(t, queueDuration, 10*time.Millisecond)
+}
+
+func TestEnterSlotsLimiters(t *testing.T) {
+	busy := limiter.NewWLimiter(nil, 0, 2, false, "render", "busy")
+	require.NoError(t, busy.Enter(context.Background(), "render"))
+	require.NoError(t, busy.Enter(context.Background(), "render"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	done := make(chan error)
+
+	go func() {
+		var entered int
+
+		done <- enterSlots(ctx, busy, 2, &entered)
+	}()
+
+	// the request waits for the busy limiter with the lock of the slots
+	time.Sleep(10 * time.Millisecond)
+
+	// the waiting request of the busy limiter doesn't block the other limiter
+	free := limiter.NewWLimiter(nil, 0, 2, false, "render", "free")
+
+	var entered int
+
+	require.NoError(t, enterSlots(context.Background(), free, 2, &entered))
+	assert.Equal(t, 2, entered)
+	assert.NoError(t, ctx.Err())
+
+	cancel()
+	assert.ErrorIs(t, <-done, limiter.ErrTimeout)
+}
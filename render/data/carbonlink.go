@@ -7,6 +7,8 @@ import (
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/helper/point"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	graphitePickle "github.com/lomik/graphite-pickle"
@@ -64,10 +66,13 @@ func queryCarbonlink(parentCtx context.Context, carbonlink *carbonlinkClient, me
 	}
 
 	go func() {
-		ctx, cancel := context.WithTimeout(parentCtx, carbonlink.totalTimeout)
+		spanCtx, span := tracing.Start(parentCtx, "carbonlink.CacheQueryMulti", attribute.Int("metrics", len(metrics)))
+
+		ctx, cancel := context.WithTimeout(spanCtx, carbonlink.totalTimeout)
 		defer cancel()
 
 		res, err := carbonlink.CacheQueryMulti(ctx, metrics)
+		tracing.End(span, err)
 
 		if err != nil {
 			logger.Info("carbonlink failed", zap.Error(err))
@@ -0,0 +1,225 @@
+package data
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+)
+
+// ExplainMetric shows the rollup rule applied to the metric
+type ExplainMetric struct {
+	Name               string `json:"name"`
+	Step               uint32 `json:"step"`
+	Aggregation        string `json:"aggregation"`
+	AggregationPattern string `json:"aggregation-pattern,omitempty"`
+	RetentionPattern   string `json:"retention-pattern,omitempty"`
+}
+
+// ExplainQuery is a data query, which would be sent to clickhouse
+type ExplainQuery struct {
+	Aggregation   string                   `json:"aggregation,omitempty"`
+	Metrics       int                      `json:"metrics"`
+	SQL           string                   `json:"sql"`
+	Estimate      []clickhouse.EstimateRow `json:"estimate,omitempty"`
+	EstimateError string                   `json:"estimate-error,omitempty"`
+}
+
+// ExplainTimeFrame shows how the data for the time frame would be fetched
+type ExplainTimeFrame struct {
+	From               int64           `json:"from"`
+	Until              int64           `json:"until"`
+	MaxDataPoints      int64           `json:"max-data-points"`
+	DataTable          string          `json:"data-table"`
+	Reverse            bool            `json:"reverse"`
+	RollupUseReverted  bool            `json:"rollup-use-reverted"`
+	Aggregated         bool            `json:"aggregated"`
+	Step               int64           `json:"step"`
+	QueryParamIndex    int             `json:"query-param-index"`
+	QueryParamDuration time.Duration   `json:"query-param-duration"` // url of the query param is not shown, it can contain credentials
+	Metrics            []ExplainMetric `json:"metrics"`
+	Queries            []ExplainQuery  `json:"queries"`
+}
+
+// Explain prepares the data queries in the same way as Fetch, but doesn't execute them.
+// If estimate is set, queries are executed with EXPLAIN ESTIMATE.
+func (m *MultiTarget) Explain(ctx context.Context, cfg *config.Config, chContext string, estimate bool) ([]ExplainTimeFrame, error) {
+	cfg = cfg.ForContext(ctx)
+
+	conds := make([]*conditions, 0, len(*m))
+
+	for tf, targets := range *m {
+		tf := tf
+
+		cond := &conditions{TimeFrame: &tf,
+			Targets:           targets,
+			aggregated:        cfg.ClickHouse.InternalAggregation,
+			appendEmptySeries: cfg.Common.AppendEmptySeries,
+		}
+		if cond.MaxDataPoints <= 0 || int64(cfg.ClickHouse.MaxDataPoints) < cond.MaxDataPoints {
+			cond.MaxDataPoints = int64(cfg.ClickHouse.MaxDataPoints)
+		}
+
+		if err := cond.selectDataTable(cfg, cond.TimeFrame, chContext); err != nil {
+			return nil, err
+		}
+
+		cond.prepareMetricsLists()
+
+		if err := cond.prepareLookup(); err != nil {
+			return nil, errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
+		}
+
+		conds = append(conds, cond)
+	}
+
+	sort.Slice(conds, func(i, j int) bool {
+		if conds[i].From == conds[j].From {
+			return conds[i].Until < conds[j].Until
+		}
+
+		return conds[i].From < conds[j].From
+	})
+
+	// common step for aggregated requests is calculated over all time frames
+	q := newQuery(cfg, len(conds))
+
+	var wg sync.WaitGroup
+
+	for _, cond := range conds {
+		if len(cond.metricsRequested) == 0 {
+			if q.cStep != nil {
+				q.cStep.doneTarget()
+			}
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(cond *conditions) {
+			defer wg.Done()
+
+			cond.setStep(q.cStep)
+		}(cond)
+	}
+
+	wg.Wait()
+
+	result := make([]ExplainTimeFrame, 0, len(conds))
+
+	for _, cond := range conds {
+		n := config.GetQueryParam(cfg.ClickHouse.QueryParams, time.Second*time.Duration(cond.Until-cond.From))
+
+		e := ExplainTimeFrame{
+			From:               cond.From,
+			Until:              cond.Until,
+			MaxDataPoints:      cond.MaxDataPoints,
+			DataTable:          cond.pointsTable,
+			Reverse:            cond.isReverse,
+			RollupUseReverted:  cond.rollupUseReverted,
+			Aggregated:         cond.aggregated,
+			QueryParamIndex:    n,
+			QueryParamDuration: cfg.ClickHouse.QueryParams[n].Duration,
+			Metrics:            cond.explainMetrics(),
+			Queries:            make([]ExplainQuery, 0, len(cond.extDataBodies)),
+		}
+
+		if len(cond.metricsRequested) == 0 {
+			result = append(result, e)
+			continue
+		}
+
+		if cond.step < 1 {
+			return nil, ErrSetStepTimeout
+		}
+
+		cond.setFromUntil()
+		cond.setPrewhere()
+		cond.setWhere()
+
+		e.Step = cond.step
+
+		for agg, extTableBody := range cond.extDataBodies {
+			eq := ExplainQuery{
+				Aggregation: agg,
+				Metrics:     strings.Count(extTableBody.String(), "\n"),
+				SQL:         cond.generateQuery(agg),
+			}
+
+			if estimate {
+				chURL, chDataTimeout := q.getParam(cond.from, cond.until)
+
+				rows, err := clickhouse.Estimate(
+					ctx,
+					chURL,
+					eq.SQL,
+					clickhouse.Options{
+						Timeout:                 chDataTimeout,
+						ConnectTimeout:          q.chConnectTimeout,
+						TLSConfig:               q.chTLSConfig,
+						ProgressSendingInterval: q.chProgressSendingInterval,
+					},
+					q.metricsListExtData(extTableBody),
+				)
+				if err != nil {
+					eq.EstimateError = err.Error()
+				} else {
+					eq.Estimate = rows
+				}
+			}
+
+			e.Queries = append(e.Queries, eq)
+		}
+
+		sort.Slice(e.Queries, func(i, j int) bool { return e.Queries[i].Aggregation < e.Queries[j].Aggregation })
+
+		result = append(result, e)
+	}
+
+	return result, nil
+}
+
+// explainMetrics returns the rollup step and aggregation for requested metrics, must be called after prepareLookup
+func (c *conditions) explainMetrics() []ExplainMetric {
+	age := uint32(dry.Max(0, time.Now().Unix()-c.From))
+
+	// aggregation could be overridden by consolidateBy
+	aggregations := make(map[string]string, len(c.metricsUnreverse))
+	for agg, metrics := range c.aggregations {
+		for _, m := range metrics {
+			aggregations[m] = agg
+		}
+	}
+
+	result := make([]ExplainMetric, 0, len(c.metricsRequested))
+
+	for i := range c.metricsRequested {
+		step, _, aggrPattern, retentionPattern := c.rollupRules.Lookup(c.metricsLookup[i], age, true)
+
+		em := ExplainMetric{
+			Name:        c.metricsUnreverse[i],
+			Step:        step,
+			Aggregation: aggregations[c.metricsUnreverse[i]],
+		}
+
+		if aggrPattern != nil {
+			em.AggregationPattern = aggrPattern.Regexp
+		}
+
+		if retentionPattern != nil {
+			em.RetentionPattern = retentionPattern.Regexp
+		}
+
+		result = append(result, em)
+	}
+
+	return result
+}
@@ -158,6 +158,7 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 	)
 
 	logger := scope.Logger(ctx)
+	cfg = cfg.ForContext(ctx)
 
 	setCarbonlinkClient(&cfg.Carbonlink)
 
@@ -178,6 +179,12 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 		cancel()
 	}()
 
+	slots, err := m.admit(ctxTimeout, cfg, chContext, qlimiter, queueDuration)
+	if err != nil {
+		logger.Error("admission", zap.Error(err))
+		return nil, err
+	}
+
 	errors := make([]error, 0, len(*m))
 	query := newQuery(cfg, len(*m))
 
@@ -205,7 +212,9 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 
 		if qlimiter.Enabled() {
 			start := time.Now()
-			err = qlimiter.Enter(ctxTimeout, "render")
+			// the slots for the request cost are claimed with the first time frame
+			err = enterSlots(ctxTimeout, qlimiter, slots, &entered)
+			slots = 1
 			*queueDuration += time.Since(start)
 
 			if err != nil {
@@ -218,8 +227,6 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 
 				break
 			}
-
-			entered++
 		}
 
 		wg.Add(1)
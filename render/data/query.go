@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	"github.com/lomik/graphite-clickhouse/config"
@@ -22,6 +23,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/pkg/dry"
 	"github.com/lomik/graphite-clickhouse/pkg/reverse"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
 	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
 
@@ -138,12 +140,14 @@ func (q *query) getParam(from, until int64) (string, time.Duration) {
 	return q.chQueryParams[n].URL, q.chQueryParams[n].DataTimeout
 }
 
-func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
+func (q *query) getDataPoints(ctx context.Context, cond *conditions) (err error) {
 	logger := scope.Logger(ctx)
 
-	var err error
+	ctx, span := tracing.Start(ctx, "data.getDataPoints", attribute.String("table", cond.pointsTable))
+	defer func() { tracing.End(span, err) }()
 
 	cond.prepareMetricsLists()
+	span.SetAttributes(attribute.Int("metrics", len(cond.metricsRequested)))
 
 	if len(cond.metricsRequested) == 0 {
 		q.cStep.doneTarget()
@@ -204,7 +208,10 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 				atomic.AddInt64(&ch_read_bytes, body.ChReadBytes())
 				atomic.AddInt64(&ch_read_rows, body.ChReadRows())
 
+				_, parseSpan := tracing.Start(ctx, "data.parseResponse")
 				err = data.parseResponse(queryContext, body, cond)
+				tracing.End(parseSpan, err)
+
 				if err != nil {
 					logger.Error("reader", zap.Error(err))
 					data.e <- err
@@ -8,10 +8,12 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	"github.com/go-graphite/carbonapi/pkg/parser"
 
+	"github.com/lomik/graphite-clickhouse/acl"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
@@ -20,6 +22,8 @@ import (
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/tracing"
+	"github.com/lomik/graphite-clickhouse/querylog"
 	"github.com/lomik/graphite-clickhouse/render/data"
 	"github.com/lomik/graphite-clickhouse/render/reply"
 )
@@ -248,6 +252,23 @@ func (h *Handler) finder(fetchRequests data.MultiTarget, ctx context.Context, lo
 	return
 }
 
+// queryLogTargets returns the targets and the widest time range of the request for the query log
+func queryLogTargets(fetchRequests data.MultiTarget) (targets []string, from, until int64) {
+	for tf, t := range fetchRequests {
+		targets = append(targets, t.List...)
+
+		if from == 0 || tf.From < from {
+			from = tf.From
+		}
+
+		if tf.Until > until {
+			until = tf.Until
+		}
+	}
+
+	return
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var (
 		maxDuration   int64
@@ -258,6 +279,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		cachedFind    bool
 		queueFail     bool
 		queueDuration time.Duration
+		replyDuration time.Duration
 		err           error
 		fetchRequests data.MultiTarget
 		luser         string
@@ -290,6 +312,21 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		end := time.Now()
 		logs.AccessLog(accessLogger, h.config, r, status, end.Sub(start), queueDuration, cachedFind, queueFail)
+		logs.SlowQueryLog(h.config, r, "render", status, logs.Timings{Total: end.Sub(start), Queue: queueDuration, Encode: replyDuration})
+
+		if querylog.Enabled() {
+			targets, from, until := queryLogTargets(fetchRequests)
+			querylog.Log(r, querylog.Entry{
+				Endpoint: "render",
+				Targets:  targets,
+				From:     from,
+				Until:    until,
+				Metrics:  int64(metricsLen),
+				Points:   pointsCount,
+				Status:   status,
+				Duration: end.Sub(start),
+			})
+		}
 		qlimiter.SendDuration(queueDuration.Milliseconds())
 		metrics.SendRenderMetrics(metrics.RenderRequestMetric, status, start, fetchStart, end, maxDuration, h.config.Metrics.ExtendedStat, int64(metricsLen), pointsCount)
 	}()
@@ -331,7 +368,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var maxCacheTimeoutStr string
 
-	useCache := h.config.Common.FindCache != nil && !parser.TruthyBool(r.FormValue("noCache"))
+	// find cache is shared between users, so results filtered by ACL are not cached
+	useCache := h.config.Common.FindCache != nil && !parser.TruthyBool(r.FormValue("noCache")) && !acl.Restricted(username)
 
 	if useCache {
 		var cached int
@@ -398,8 +436,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	rStart := time.Now()
 
+	_, span := tracing.Start(r.Context(), "formatter.Reply", attribute.Int64("points", pointsCount))
 	formatter.Reply(w, r, reply)
+	span.End()
 
-	d := time.Since(rStart)
-	logger.Debug("reply", zap.String("runtime", d.String()), zap.Duration("runtime_ns", d))
+	replyDuration = time.Since(rStart)
+	logger.Debug("reply", zap.String("runtime", replyDuration.String()), zap.Duration("runtime_ns", replyDuration))
 }
@@ -57,6 +57,8 @@ func Register(cfg *config.Common, logger *zap.Logger) {
 		err           error
 		load          float64
 		w             int64
+		loadFailed    bool
+		meter         = load_avg.NewMeter(cfg.LoadSignal, cfg.LoadPressureScale)
 	)
 
 	if cfg.SD != "" {
@@ -74,7 +76,7 @@ func Register(cfg *config.Common, logger *zap.Logger) {
 			panic("serive discovery type not registered")
 		}
 
-		load, err = load_avg.Normalized()
+		load, err = meter.Normalized()
 		if err == nil {
 			load_avg.Store(load)
 		}
@@ -89,10 +91,16 @@ func Register(cfg *config.Common, logger *zap.Logger) {
 	}
 LOOP:
 	for {
-		load, err = load_avg.Normalized()
-		if err == nil {
+		if l, err := meter.Normalized(); err == nil {
+			load = l
 			load_avg.Store(load)
+			loadFailed = false
+		} else if !loadFailed {
+			// logged once, until the load is measured again
+			logger.Warn("load", zap.String("signal", cfg.LoadSignal), zap.Error(err))
+			loadFailed = true
 		}
+
 		if sd != nil {
 			w = load_avg.Weight(cfg.BaseWeight, cfg.DegragedMultiply, cfg.DegragedLoad, load)
 